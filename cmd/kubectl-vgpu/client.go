@@ -0,0 +1,210 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"volcano.sh/k8s-device-plugin/pkg/aggregator"
+)
+
+// The APIs of the monitor.
+const (
+	monitorSnapshotPath     = "/ui/api/node"
+	monitorEventsPath       = "/api/v1/events"
+	monitorEventsStreamPath = "/api/v1/events/stream"
+)
+
+// nodeSnapshot is the state of the GPUs of a node as served by its monitor.
+type nodeSnapshot struct {
+	Node    string           `json:"node"`
+	Time    time.Time        `json:"time"`
+	Devices []deviceSnapshot `json:"devices"`
+}
+
+type deviceSnapshot struct {
+	Index       int             `json:"index"`
+	UUID        string          `json:"uuid"`
+	Type        string          `json:"type"`
+	Healthy     bool            `json:"healthy"`
+	MemoryTotal uint64          `json:"memoryTotal"`
+	MemoryUsed  uint64          `json:"memoryUsed"`
+	Utilization uint32          `json:"utilization"`
+	Slices      int32           `json:"slices"`
+	Containers  []sliceSnapshot `json:"containers"`
+}
+
+type sliceSnapshot struct {
+	Namespace   string `json:"namespace"`
+	Pod         string `json:"pod"`
+	Container   string `json:"container"`
+	MemoryLimit uint64 `json:"memoryLimit"`
+	MemoryUsed  uint64 `json:"memoryUsed"`
+	SmLimit     uint64 `json:"smLimit"`
+	SmUtil      uint64 `json:"smUtil"`
+}
+
+// event is an event of the journal of a monitor.
+type event struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Node      string    `json:"node"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Device    string    `json:"device"`
+	Message   string    `json:"message"`
+}
+
+type client struct {
+	clientset kubernetes.Interface
+}
+
+// aggregatorGet returns the body of path on the aggregator.
+func (c *client) aggregatorGet(ctx context.Context, path string) ([]byte, error) {
+	if aggregatorURL != "" {
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(aggregatorURL, "/")+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("aggregator returned %s", resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+	return c.clientset.CoreV1().RESTClient().Get().
+		Namespace(aggregatorNamespace).Resource("services").Name(aggregatorService).
+		SubResource("proxy").Suffix(path).DoRaw(ctx)
+}
+
+// summary returns the summary of the cluster by the aggregator.
+func (c *client) summary(ctx context.Context) (aggregator.ClusterSummary, error) {
+	var summary aggregator.ClusterSummary
+	data, err := c.aggregatorGet(ctx, aggregator.SummaryPath)
+	if err != nil {
+		return summary, fmt.Errorf("failed to get the summary from the aggregator: %v", err)
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return summary, fmt.Errorf("failed to decode the summary: %v", err)
+	}
+	return summary, nil
+}
+
+// monitors returns the running monitor pods, of the node when not empty.
+func (c *client) monitors(ctx context.Context, node string) ([]corev1.Pod, error) {
+	opts := metav1.ListOptions{LabelSelector: monitorSelector}
+	if node != "" {
+		opts.FieldSelector = "spec.nodeName=" + node
+	}
+	list, err := c.clientset.CoreV1().Pods(monitorNamespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the monitors: %v", err)
+	}
+	var res []corev1.Pod
+	for _, pod := range list.Items {
+		if pod.Status.Phase == corev1.PodRunning {
+			res = append(res, pod)
+		}
+	}
+	if node != "" && len(res) == 0 {
+		return nil, fmt.Errorf("no monitor running on node %s", node)
+	}
+	return res, nil
+}
+
+func (c *client) monitorRequest(pod corev1.Pod, path string, query url.Values) *rest.Request {
+	name := fmt.Sprintf("%s:%d", pod.Name, monitorPort)
+	if monitorHTTPS {
+		name = "https:" + name
+	}
+	req := c.clientset.CoreV1().RESTClient().Get().
+		Namespace(pod.Namespace).Resource("pods").Name(name).
+		SubResource("proxy").Suffix(path)
+	for k, vs := range query {
+		for _, v := range vs {
+			req = req.Param(k, v)
+		}
+	}
+	return req
+}
+
+// snapshots returns the snapshots of the nodes of the monitors by node
+// name, those which could not be reached are left out.
+func (c *client) snapshots(ctx context.Context, monitors []corev1.Pod) map[string]nodeSnapshot {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	res := make(map[string]nodeSnapshot)
+	for _, pod := range monitors {
+		wg.Add(1)
+		go func(pod corev1.Pod) {
+			defer wg.Done()
+			data, err := c.monitorRequest(pod, monitorSnapshotPath, nil).DoRaw(ctx)
+			if err != nil {
+				warnf("failed to get the usage of node %s: %v", pod.Spec.NodeName, err)
+				return
+			}
+			var snap nodeSnapshot
+			if err := json.Unmarshal(data, &snap); err != nil {
+				warnf("failed to decode the usage of node %s: %v", pod.Spec.NodeName, err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			res[pod.Spec.NodeName] = snap
+		}(pod)
+	}
+	wg.Wait()
+	return res
+}
+
+// events returns the events in the journal of the monitor.
+func (c *client) events(ctx context.Context, pod corev1.Pod, query url.Values) ([]event, error) {
+	data, err := c.monitorRequest(pod, monitorEventsPath, query).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the events of node %s: %v", pod.Spec.NodeName, err)
+	}
+	var res []event
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode the events of node %s: %v", pod.Spec.NodeName, err)
+	}
+	return res, nil
+}
+
+// streamEvents returns the stream of server-sent events of the monitor.
+func (c *client) streamEvents(ctx context.Context, pod corev1.Pod, query url.Values) (io.ReadCloser, error) {
+	return c.monitorRequest(pod, monitorEventsStreamPath, query).Stream(ctx)
+}
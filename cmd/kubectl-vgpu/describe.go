@@ -0,0 +1,126 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newDescribeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "describe",
+		Short: "show the details of a vGPU resource",
+	}
+	cmd.AddCommand(newDescribeDeviceCommand())
+	return cmd
+}
+
+func newDescribeDeviceCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "device UUID",
+		Short: "show a GPU, the vGPUs granted on it and their usage",
+		Long:  "Show a GPU, the vGPUs granted on it and their usage. The UUID may be abbreviated to a prefix matching one GPU.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			summary, err := c.summary(ctx)
+			if err != nil {
+				return err
+			}
+			var matches []string
+			var ni, di int
+			for i, n := range summary.Nodes {
+				for j, d := range n.Devices {
+					if strings.HasPrefix(d.UUID, args[0]) {
+						matches = append(matches, d.UUID)
+						ni, di = i, j
+					}
+				}
+			}
+			switch len(matches) {
+			case 0:
+				return fmt.Errorf("no GPU %s registered in the cluster", args[0])
+			case 1:
+			default:
+				return fmt.Errorf("%s matches %d GPUs: %s", args[0], len(matches), strings.Join(matches, ", "))
+			}
+			n := summary.Nodes[ni]
+			node, d := n.Name, n.Devices[di]
+
+			var snap *deviceSnapshot
+			monitors, err := c.monitors(ctx, node)
+			if err != nil {
+				warnf("%v", err)
+			}
+			for _, s := range c.snapshots(ctx, monitors) {
+				for i := range s.Devices {
+					if s.Devices[i].UUID == d.UUID {
+						snap = &s.Devices[i]
+					}
+				}
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(w, "UUID:\t%s\n", d.UUID)
+			fmt.Fprintf(w, "Node:\t%s\n", node)
+			fmt.Fprintf(w, "Type:\t%s\n", d.Type)
+			fmt.Fprintf(w, "Healthy:\t%v\n", d.Health)
+			fmt.Fprintf(w, "vGPUs:\t%d/%d granted\n", d.Used, d.Count)
+			fmt.Fprintf(w, "Memory:\t%d/%d granted\n", d.AllocatedMemory, d.Memory)
+			fmt.Fprintf(w, "Cores:\t%d/100 granted\n", d.AllocatedCores)
+			if snap != nil {
+				fmt.Fprintf(w, "Index:\t%d\n", snap.Index)
+				fmt.Fprintf(w, "Memory used:\t%s/%s\n", mib(snap.MemoryUsed), mib(snap.MemoryTotal))
+				fmt.Fprintf(w, "Utilization:\t%d%%\n", snap.Utilization)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			slices := make(map[string]sliceSnapshot)
+			if snap != nil {
+				for _, s := range snap.Containers {
+					slices[s.Namespace+"/"+s.Pod+"/"+s.Container] = s
+				}
+			}
+			fmt.Println("Allocations:")
+			w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "  NAMESPACE\tPOD\tCONTAINER\tMEMORY(GRANTED)\tCORES(GRANTED)\tMEMORY(USED)\tSM(USED)")
+			for _, a := range n.Allocations {
+				if a.DeviceUUID != d.UUID {
+					continue
+				}
+				memUsed, smUtil := "-", "-"
+				if s, ok := slices[a.Namespace+"/"+a.Pod+"/"+a.Container]; ok {
+					memUsed, smUtil = mib(s.MemoryUsed), fmt.Sprintf("%d%%", s.SmUtil)
+				}
+				fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t%d\t%s\t%s\n", a.Namespace, a.Pod, a.Container, a.Memory, a.Cores, memUsed, smUtil)
+			}
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newEventsCommand() *cobra.Command {
+	var node, namespace, pod, typ string
+	var follow bool
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "show the vGPU events of the nodes: allocations, limits hit, throttling, OOM kills, GPU health changes and Xid errors",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			monitors, err := c.monitors(ctx, node)
+			if err != nil {
+				return err
+			}
+			query := url.Values{}
+			for k, v := range map[string]string{"namespace": namespace, "pod": pod, "type": typ} {
+				if v != "" {
+					query.Set(k, v)
+				}
+			}
+			if follow {
+				return followEvents(ctx, c, monitors, query)
+			}
+			var events []event
+			for _, m := range monitors {
+				e, err := c.events(ctx, m, query)
+				if err != nil {
+					warnf("%v", err)
+					continue
+				}
+				events = append(events, e...)
+			}
+			sort.SliceStable(events, func(i, j int) bool {
+				return events[i].Time.Before(events[j].Time)
+			})
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tNODE\tTYPE\tOBJECT\tMESSAGE")
+			for _, e := range events {
+				printEvent(w, e)
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&node, "node", "", "show the events of this node only")
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "show the events of the pods of this namespace only")
+	cmd.Flags().StringVar(&pod, "pod", "", "show the events of this pod only")
+	cmd.Flags().StringVar(&typ, "type", "", "show the events of this type only: allocation, limit-hit, throttle, oom, health or xid")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep streaming the new events")
+	return cmd
+}
+
+func printEvent(w io.Writer, e event) {
+	object := e.Device
+	if e.Pod != "" {
+		object = e.Namespace + "/" + e.Pod + "/" + e.Container
+		if e.Device != "" {
+			object += " on " + e.Device
+		}
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339), e.Node, e.Type, object, e.Message)
+}
+
+// followEvents prints the events streamed by the monitors as they come,
+// reconnecting after the last event received from a stream which broke.
+func followEvents(ctx context.Context, c *client, monitors []corev1.Pod, query url.Values) error {
+	if len(monitors) == 0 {
+		return fmt.Errorf("no monitor running")
+	}
+	events := make(chan event)
+	for _, m := range monitors {
+		go func(m corev1.Pod) {
+			var last uint64
+			for {
+				q := url.Values{}
+				for k, v := range query {
+					q[k] = v
+				}
+				if last > 0 {
+					q.Set("since", fmt.Sprint(last))
+				}
+				stream, err := c.streamEvents(ctx, m, q)
+				if err != nil {
+					warnf("failed to stream the events of node %s: %v", m.Spec.NodeName, err)
+				} else {
+					last = readEvents(stream, last, events)
+					stream.Close()
+				}
+				time.Sleep(5 * time.Second)
+			}
+		}(m)
+	}
+	for e := range events {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		printEvent(w, e)
+		w.Flush()
+	}
+	return nil
+}
+
+// readEvents sends the events of a stream of server-sent events until it
+// ends and returns the id of the last one.
+func readEvents(r io.Reader, last uint64, events chan<- event) uint64 {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var e event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			continue
+		}
+		last = e.ID
+		events <- e
+	}
+	return last
+}
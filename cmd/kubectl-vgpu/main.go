@@ -0,0 +1,93 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-vgpu is a kubectl plugin showing the vGPU placement and usage of
+// the cluster from the APIs of the aggregator and of the monitors, reached
+// through the proxy of the API server.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	kubeconfig  string
+	kubecontext string
+
+	aggregatorNamespace string
+	aggregatorService   string
+	aggregatorURL       string
+
+	monitorNamespace string
+	monitorSelector  string
+	monitorPort      int
+	monitorHTTPS     bool
+
+	rootCmd = &cobra.Command{
+		Use:          "kubectl-vgpu",
+		Short:        "inspect the vGPU placement and usage of the cluster",
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	rootCmd.PersistentFlags().SortFlags = false
+
+	rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "the kubeconfig file, $KUBECONFIG or ~/.kube/config when empty")
+	rootCmd.PersistentFlags().StringVar(&kubecontext, "context", "", "the kubeconfig context to use")
+
+	rootCmd.PersistentFlags().StringVar(&aggregatorNamespace, "aggregator-namespace", "kube-system", "the namespace of the aggregator service")
+	rootCmd.PersistentFlags().StringVar(&aggregatorService, "aggregator-service", "vgpu-aggregator:9395", "the aggregator service, as name:port, reached through the API server proxy")
+	rootCmd.PersistentFlags().StringVar(&aggregatorURL, "aggregator-url", "", "the URL of the aggregator, reached directly instead of through the API server proxy")
+
+	rootCmd.PersistentFlags().StringVar(&monitorNamespace, "monitor-namespace", "kube-system", "the namespace of the monitor pods")
+	rootCmd.PersistentFlags().StringVar(&monitorSelector, "monitor-selector", "name=volcano-device-plugin", "the label selector of the monitor pods")
+	rootCmd.PersistentFlags().IntVar(&monitorPort, "monitor-port", 9394, "the port the monitors serve their API on")
+	rootCmd.PersistentFlags().BoolVar(&monitorHTTPS, "monitor-https", false, "reach the monitors over HTTPS, when they serve their API with a certificate")
+
+	rootCmd.AddCommand(newTopCommand(), newDescribeCommand(), newEventsCommand())
+}
+
+// newClient builds the client of the cluster from the global flags.
+func newClient() (*client, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: kubecontext}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubeconfig: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build clientset: %v", err)
+	}
+	return &client{clientset: clientset}, nil
+}
+
+// warnf reports what couldn't be shown, the rest of the output still is.
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
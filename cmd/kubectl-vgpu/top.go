@@ -0,0 +1,197 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/aggregator"
+)
+
+func newTopCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "show the vGPU allocation and usage of nodes or pods",
+	}
+	cmd.AddCommand(newTopNodesCommand(), newTopPodsCommand())
+	return cmd
+}
+
+func mib(b uint64) string {
+	return fmt.Sprintf("%dMi", b/1048576)
+}
+
+// usage returns the memory used and the utilization of the devices of the
+// node in the snapshot, "-" when unknown.
+func usage(snap nodeSnapshot, ok bool) (string, string) {
+	if !ok {
+		return "-", "-"
+	}
+	var used, total uint64
+	var util uint32
+	for _, d := range snap.Devices {
+		used += d.MemoryUsed
+		total += d.MemoryTotal
+		util += d.Utilization
+	}
+	if len(snap.Devices) == 0 {
+		return "-", "-"
+	}
+	return mib(used) + "/" + mib(total), fmt.Sprintf("%d%%", util/uint32(len(snap.Devices)))
+}
+
+func newTopNodesCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "nodes [NAME]",
+		Aliases: []string{"node"},
+		Short:   "show the vGPUs granted on the nodes and the usage of their GPUs",
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			summary, err := c.summary(ctx)
+			if err != nil {
+				return err
+			}
+			node := ""
+			if len(args) > 0 {
+				node = args[0]
+			}
+			monitors, err := c.monitors(ctx, node)
+			if err != nil {
+				warnf("%v", err)
+			}
+			snapshots := c.snapshots(ctx, monitors)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tGPUS\tHEALTHY\tVGPUS\tMEMORY(GRANTED)\tCORES(GRANTED)\tMEMORY(USED)\tUTILIZATION")
+			for _, n := range summary.Nodes {
+				if node != "" && n.Name != node {
+					continue
+				}
+				var healthy, count, used, memory, allocatedMemory, allocatedCores int32
+				for _, d := range n.Devices {
+					if d.Health {
+						healthy++
+					}
+					count += d.Count
+					used += d.Used
+					memory += d.Memory
+					allocatedMemory += d.AllocatedMemory
+					allocatedCores += d.AllocatedCores
+				}
+				snap, ok := snapshots[n.Name]
+				memUsed, util := usage(snap, ok)
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d/%d\t%d/%d\t%d/%d\t%s\t%s\n", n.Name, len(n.Devices), healthy,
+					used, count, allocatedMemory, memory, allocatedCores, 100*len(n.Devices), memUsed, util)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newTopPodsCommand() *cobra.Command {
+	var namespace string
+	var allNamespaces bool
+	cmd := &cobra.Command{
+		Use:     "pods [NAME]",
+		Aliases: []string{"pod"},
+		Short:   "show the vGPUs granted to the containers of pods and their usage",
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			summary, err := c.summary(ctx)
+			if err != nil {
+				return err
+			}
+			if namespace == "" && !allNamespaces {
+				namespace = "default"
+			}
+			type allocation struct {
+				node string
+				aggregator.ContainerAllocation
+			}
+			var allocations []allocation
+			nodes := make(map[string]bool)
+			for _, n := range summary.Nodes {
+				for _, a := range n.Allocations {
+					if (allNamespaces || a.Namespace == namespace) && (len(args) == 0 || a.Pod == args[0]) {
+						allocations = append(allocations, allocation{node: n.Name, ContainerAllocation: a})
+						nodes[n.Name] = true
+					}
+				}
+			}
+			sort.Slice(allocations, func(i, j int) bool {
+				a, b := allocations[i], allocations[j]
+				if a.Namespace != b.Namespace {
+					return a.Namespace < b.Namespace
+				}
+				if a.Pod != b.Pod {
+					return a.Pod < b.Pod
+				}
+				return a.Container < b.Container
+			})
+			monitors, err := c.monitors(ctx, "")
+			if err != nil {
+				warnf("%v", err)
+			}
+			var needed []corev1.Pod
+			for _, m := range monitors {
+				if nodes[m.Spec.NodeName] {
+					needed = append(needed, m)
+				}
+			}
+			slices := make(map[string]sliceSnapshot)
+			for _, snap := range c.snapshots(ctx, needed) {
+				for _, d := range snap.Devices {
+					for _, s := range d.Containers {
+						slices[s.Namespace+"/"+s.Pod+"/"+s.Container+"/"+d.UUID] = s
+					}
+				}
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tNODE\tDEVICE\tMEMORY(GRANTED)\tCORES(GRANTED)\tMEMORY(USED)\tSM(USED)")
+			for _, a := range allocations {
+				memUsed, smUtil := "-", "-"
+				if s, ok := slices[a.Namespace+"/"+a.Pod+"/"+a.Container+"/"+a.DeviceUUID]; ok {
+					memUsed, smUtil = mib(s.MemoryUsed), fmt.Sprintf("%d%%", s.SmUtil)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", a.Namespace, a.Pod, a.Container, a.node, a.DeviceUUID,
+					a.Memory, a.Cores, memUsed, smUtil)
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "the namespace of the pods, default when empty")
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "show the pods of all namespaces")
+	return cmd
+}
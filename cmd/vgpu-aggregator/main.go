@@ -0,0 +1,280 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/aggregator"
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/quota"
+	"volcano.sh/k8s-device-plugin/pkg/tenant"
+)
+
+var (
+	bindAddress        string
+	clusterName        string
+	federatePeers      []string
+	federationInterval time.Duration
+	priceConfigFile    string
+	nodeGroupLabel     string
+
+	namespaceLabels      []string
+	namespaceAnnotations []string
+
+	defrag                  bool
+	defragDryRun            bool
+	defragInterval          time.Duration
+	defragBudget            int
+	defragBudgetWindow      time.Duration
+	defragMaxPodMemory      int32
+	defragExcludeNamespaces []string
+
+	lockJanitor         bool
+	lockJanitorInterval time.Duration
+	lockJanitorGrace    time.Duration
+
+	quotaStatusInterval time.Duration
+
+	rootCmd = &cobra.Command{
+		Use:   "vgpu-aggregator",
+		Short: "kubernetes vgpu cluster aggregator",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := start(); err != nil {
+				klog.Fatal(err)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.Flags().SortFlags = false
+	rootCmd.PersistentFlags().SortFlags = false
+
+	rootCmd.Flags().StringVar(&bindAddress, "bind-address", ":9395", "the address the API and metrics endpoints bind to")
+	rootCmd.Flags().StringVar(&clusterName, "cluster-name", "local", "the name of this cluster in the summaries")
+	rootCmd.Flags().StringArrayVar(&federatePeers, "federate", nil, "the aggregator of another cluster to federate, as name=url, can be repeated")
+	rootCmd.Flags().DurationVar(&federationInterval, "federation-interval", 30*time.Second, "the interval between two pulls of the federated summaries")
+
+	rootCmd.Flags().StringVar(&priceConfigFile, "gpu-price-config", "", "the file with the hourly price of the GPU models, enables the OpenCost metrics")
+	rootCmd.Flags().StringSliceVar(&namespaceLabels, "namespace-label", nil, "the namespace labels attached to the container allocations and cost metrics, e.g. team")
+	rootCmd.Flags().StringSliceVar(&namespaceAnnotations, "namespace-annotation", nil, "the namespace annotations attached to the container allocations and cost metrics, e.g. cost-center")
+	rootCmd.Flags().StringVar(&nodeGroupLabel, "node-group-label", aggregator.InstanceTypeLabel, "the node label the scale-up hints group the nodes by and pending pods select their pool with")
+
+	rootCmd.Flags().BoolVar(&defrag, "defrag", false, "evict small pods to free GPUs for the unschedulable vGPU requests")
+	rootCmd.Flags().BoolVar(&defragDryRun, "defrag-dry-run", true, "only log and serve the defragmentation plans, evict no pod, the devices freed by the evictions are not held for the pending pods")
+	rootCmd.Flags().DurationVar(&defragInterval, "defrag-interval", 5*time.Minute, "the interval between two defragmentation runs")
+	rootCmd.Flags().IntVar(&defragBudget, "defrag-budget", 5, "the most pods evicted to defragment GPUs per budget window")
+	rootCmd.Flags().DurationVar(&defragBudgetWindow, "defrag-budget-window", time.Hour, "the window the defragmentation budget applies to")
+	rootCmd.Flags().Int32Var(&defragMaxPodMemory, "defrag-max-pod-memory", 0, "the largest vGPU memory of a pod evicted to defragment GPUs, 0 for no limit")
+	rootCmd.Flags().StringSliceVar(&defragExcludeNamespaces, "defrag-exclude-namespace", []string{"kube-system"}, "the namespaces whose pods are never evicted to defragment GPUs")
+
+	rootCmd.Flags().BoolVar(&lockJanitor, "lock-janitor", false, "release the vGPU node locks which expired or no pod waits for")
+	rootCmd.Flags().DurationVar(&lockJanitorInterval, "lock-janitor-interval", 30*time.Second, "the interval between two checks of the node locks")
+	rootCmd.Flags().DurationVar(&lockJanitorGrace, "lock-janitor-grace", 30*time.Second, "how long a node lock is kept while no pod waits for its devices")
+	rootCmd.Flags().DurationVar(&quotaStatusInterval, "quota-status-interval", 0, "the interval between two writes of the usage of the VGPUQuotas in their status, disabled when 0")
+	rootCmd.Flags().DurationVar(&lock.LockTTL, "node-lock-ttl", lock.LockTTL, "how long a node lock is held before it expires")
+
+	// The resource names pending pods are matched with.
+	rootCmd.PersistentFlags().AddGoFlagSet(util.GlobalFlagSet())
+}
+
+// clusterAggregator summarizes the local cluster from the informer caches.
+type clusterAggregator struct {
+	nodeLister listerscorev1.NodeLister
+	podLister  listerscorev1.PodLister
+	federation *aggregator.Federation
+	// tenant is nil unless namespace labels or annotations are configured.
+	tenant *tenant.Resolver
+}
+
+func (a *clusterAggregator) list() ([]*corev1.Node, []*corev1.Pod) {
+	nodes, err := a.nodeLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list nodes: %v", err)
+	}
+	pods, err := a.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list pods: %v", err)
+	}
+	return nodes, pods
+}
+
+func (a *clusterAggregator) Local() aggregator.ClusterSummary {
+	nodes, pods := a.list()
+	summary := aggregator.Summarize(clusterName, nodes, pods, time.Now())
+	if a.tenant != nil {
+		for _, n := range summary.Nodes {
+			for i := range n.Allocations {
+				n.Allocations[i].Tenant = a.tenant.Map(n.Allocations[i].Namespace)
+			}
+		}
+	}
+	return summary
+}
+
+func (a *clusterAggregator) ScaleUpHints() aggregator.ScaleUpHints {
+	nodes, pods := a.list()
+	return aggregator.BuildScaleUpHints(clusterName, nodes, pods, nodeGroupLabel, time.Now())
+}
+
+func (a *clusterAggregator) PendingDemand() aggregator.PendingDemand {
+	_, pods := a.list()
+	return aggregator.BuildPendingDemand(clusterName, pods, nodeGroupLabel, time.Now())
+}
+
+// defragState returns what the defragmenter plans on, from one listing.
+func (a *clusterAggregator) defragState() (aggregator.ClusterSummary, []*corev1.Pod, aggregator.ScaleUpHints) {
+	nodes, pods := a.list()
+	now := time.Now()
+	return aggregator.Summarize(clusterName, nodes, pods, now), pods,
+		aggregator.BuildScaleUpHints(clusterName, nodes, pods, nodeGroupLabel, now)
+}
+
+// All returns the local summary followed by the federated ones.
+func (a *clusterAggregator) All() []aggregator.ClusterSummary {
+	return append([]aggregator.ClusterSummary{a.Local()}, a.federation.Summaries()...)
+}
+
+func start() error {
+	if err := util.SetupLogging(); err != nil {
+		return err
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return fmt.Errorf("failed to build kubeconfig: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to build clientset: %v", err)
+	}
+	var peers []aggregator.Peer
+	for _, s := range federatePeers {
+		p, err := aggregator.ParsePeer(s)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, p)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(clientset, time.Hour)
+	a := &clusterAggregator{
+		nodeLister: informerFactory.Core().V1().Nodes().Lister(),
+		podLister:  informerFactory.Core().V1().Pods().Lister(),
+		federation: aggregator.NewFederation(peers),
+	}
+	stopCh := make(chan struct{})
+	informerFactory.Start(stopCh)
+	for typ, ok := range informerFactory.WaitForCacheSync(stopCh) {
+		if !ok {
+			return fmt.Errorf("failed to sync %v informer", typ)
+		}
+	}
+	a.tenant = tenant.NewResolver(clientset, namespaceLabels, namespaceAnnotations, stopCh)
+	if len(peers) > 0 {
+		go a.federation.Run(federationInterval)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(aggregator.SummaryCollector{Summaries: a.All})
+	reg.MustRegister(aggregator.ScaleUpCollector{Hints: a.ScaleUpHints})
+	reg.MustRegister(aggregator.DemandCollector{Demand: a.PendingDemand})
+	if priceConfigFile != "" {
+		prices, err := aggregator.LoadPriceTable(priceConfigFile)
+		if err != nil {
+			return fmt.Errorf("failed to load GPU prices: %v", err)
+		}
+		reg.MustRegister(aggregator.NewCostCollector(a.All, prices, a.tenant.Names()))
+	}
+	if defrag {
+		d := &aggregator.Defragmenter{
+			Client: clientset,
+			Policy: aggregator.DefragPolicy{
+				MaxPodMemory:      defragMaxPodMemory,
+				ExcludeNamespaces: defragExcludeNamespaces,
+			},
+			DryRun:       defragDryRun,
+			Budget:       defragBudget,
+			BudgetWindow: defragBudgetWindow,
+		}
+		reg.MustRegister(d)
+		http.HandleFunc(aggregator.DefragPath, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, d.Plans())
+		})
+		go d.Run(defragInterval, a.defragState)
+	}
+	if lockJanitor {
+		lock.UseClient(clientset)
+		j := &aggregator.LockJanitor{LockName: util.VGPUDeviceName, TTL: lock.LockTTL, Grace: lockJanitorGrace}
+		reg.MustRegister(j)
+		go j.Run(lockJanitorInterval, a.list)
+	}
+	if quotaStatusInterval > 0 {
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("failed to build dynamic client: %v", err)
+		}
+		w := &quota.StatusWriter{Client: dynamicClient}
+		reg.MustRegister(w)
+		go w.Run(quotaStatusInterval, a.list)
+	}
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	http.HandleFunc(aggregator.SummaryPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.Local())
+	})
+	http.HandleFunc("/api/v1/federation", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.All())
+	})
+	http.HandleFunc(aggregator.ScaleUpHintsPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.ScaleUpHints())
+	})
+	http.HandleFunc(aggregator.PendingDemandPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.PendingDemand())
+	})
+	klog.Infof("Serving cluster %s summary on %s", clusterName, bindAddress)
+	return http.ListenAndServe(bindAddress, nil)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		klog.Fatal(err)
+	}
+}
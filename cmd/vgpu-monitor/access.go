@@ -0,0 +1,359 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+var (
+	ctrDeviceOpensDesc = prometheus.NewDesc(
+		"vgpu_container_device_opens_total",
+		"Number of openat calls on an NVIDIA device node traced in the cgroup of the container, empty pod labels for processes outside of pods",
+		[]string{"podnamespace", "podname", "ctrname", "device"}, nil,
+	)
+	ctrDeviceIoctlsDesc = prometheus.NewDesc(
+		"vgpu_container_device_ioctls_total",
+		"Number of ioctl calls on an NVIDIA device node traced in the cgroup of the container, empty pod labels for processes outside of pods",
+		[]string{"podnamespace", "podname", "ctrname", "device"}, nil,
+	)
+	ctrDeviceUnexpectedAccessDesc = prometheus.NewDesc(
+		"vgpu_container_device_unexpected_access",
+		"Whether the container was traced accessing a GPU it was not granted",
+		[]string{"podnamespace", "podname", "ctrname", "device", "deviceuuid"}, nil,
+	)
+	accessTraceUpDesc = prometheus.NewDesc(
+		"vgpu_access_trace_up",
+		"Whether the eBPF tracing of the accesses to the NVIDIA device nodes is running",
+		nil, nil,
+	)
+)
+
+// accessTraceScript counts in the kernel, per cgroup and device node, the
+// openat calls on the NVIDIA device nodes and the ioctl calls on the file
+// descriptors they return, and prints the counts every interval.
+const accessTraceScript = `
+tracepoint:syscalls:sys_enter_openat /strncmp(str(args->filename), "/dev/nvidia", 11) == 0/ {
+	@path[tid] = str(args->filename);
+}
+tracepoint:syscalls:sys_exit_openat /@path[tid] != ""/ {
+	if (args->ret >= 0) {
+		@fds[pid, args->ret] = @path[tid];
+		@opens[cgroup, @path[tid]] = count();
+	}
+	delete(@path[tid]);
+}
+tracepoint:syscalls:sys_enter_ioctl /@fds[pid, args->fd] != ""/ {
+	@ioctls[cgroup, @fds[pid, args->fd]] = count();
+}
+tracepoint:syscalls:sys_enter_close /@fds[pid, args->fd] != ""/ {
+	delete(@fds[pid, args->fd]);
+}
+interval:s:%d {
+	print(@opens);
+	print(@ioctls);
+	clear(@opens);
+	clear(@ioctls);
+}
+`
+
+// accessLine is a line of the counts printed by the script, like
+// "@ioctls[4242, /dev/nvidia0]: 57".
+var accessLine = regexp.MustCompile(`^@(opens|ioctls)\[(\d+), (/dev/nvidia[^\]]*)\]: (\d+)$`)
+
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+var nvidiaDeviceNode = regexp.MustCompile(`^/dev/nvidia(\d+)$`)
+
+type accessKey struct {
+	cgroup uint64
+	device string
+}
+
+// accessTracer runs bpftrace to trace the accesses to the NVIDIA device
+// nodes by cgroup, independently of the hook library enforcing the limits.
+type accessTracer struct {
+	bpftrace   string
+	interval   time.Duration
+	cgroupRoot string
+
+	mutex   sync.Mutex
+	running bool
+	opens   map[accessKey]uint64
+	ioctls  map[accessKey]uint64
+	// containers are the container IDs by cgroup ID, refreshed at most
+	// once per interval when a cgroup is unknown.
+	containers map[uint64]string
+	indexed    time.Time
+}
+
+func newAccessTracer(bpftrace string, interval time.Duration) *accessTracer {
+	return &accessTracer{
+		bpftrace:   bpftrace,
+		interval:   interval,
+		cgroupRoot: "/sys/fs/cgroup",
+		opens:      make(map[accessKey]uint64),
+		ioctls:     make(map[accessKey]uint64),
+		containers: make(map[uint64]string),
+	}
+}
+
+// Run runs bpftrace, restarting it when it exits.
+func (t *accessTracer) Run() {
+	seconds := int(t.interval.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	for {
+		if err := t.trace(fmt.Sprintf(accessTraceScript, seconds)); err != nil {
+			klog.Errorf("Access tracing stopped: %v", err)
+		}
+		time.Sleep(t.interval)
+	}
+}
+
+func (t *accessTracer) trace(script string) error {
+	cmd := exec.Command(t.bpftrace, "-e", script)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t.setRunning(true)
+	defer t.setRunning(false)
+	t.read(stdout)
+	return cmd.Wait()
+}
+
+func (t *accessTracer) setRunning(running bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.running = running
+}
+
+// read adds the counts printed by the script to the totals.
+func (t *accessTracer) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := accessLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		cgroup, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseUint(m[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		key := accessKey{cgroup: cgroup, device: m[3]}
+		t.mutex.Lock()
+		if m[1] == "opens" {
+			t.opens[key] += n
+		} else {
+			t.ioctls[key] += n
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// indexCgroups maps the cgroup IDs, the inodes of the cgroup v2 directories,
+// to the IDs of the containers they are named after. The mutex must be
+// held.
+func (t *accessTracer) indexCgroups() {
+	containers := make(map[uint64]string)
+	_ = filepath.Walk(t.cgroupRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		id := containerIDPattern.FindString(info.Name())
+		if id == "" {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			containers[st.Ino] = id
+		}
+		return filepath.SkipDir
+	})
+	// The counts of the containers gone go with them.
+	for cgroup := range t.containers {
+		if _, ok := containers[cgroup]; ok {
+			continue
+		}
+		for key := range t.opens {
+			if key.cgroup == cgroup {
+				delete(t.opens, key)
+			}
+		}
+		for key := range t.ioctls {
+			if key.cgroup == cgroup {
+				delete(t.ioctls, key)
+			}
+		}
+	}
+	t.containers = containers
+	t.indexed = time.Now()
+}
+
+// containerOf returns the ID of the container of the cgroup, empty for the
+// processes outside of containers. The mutex must be held.
+func (t *accessTracer) containerOf(cgroup uint64) string {
+	id, ok := t.containers[cgroup]
+	if !ok && time.Since(t.indexed) > t.interval {
+		t.indexCgroups()
+		id = t.containers[cgroup]
+	}
+	return id
+}
+
+// podContainer is a container of a pod and the uuids of the GPUs it is
+// granted.
+type podContainer struct {
+	pod     *corev1.Pod
+	name    string
+	granted map[string]bool
+}
+
+// podContainers indexes the containers of the pods by container ID.
+func podContainers(pods []*corev1.Pod) map[string]podContainer {
+	res := make(map[string]podContainer)
+	for _, pod := range pods {
+		assigned := util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+		all := make(map[string]bool)
+		byName := make(map[string]map[string]bool)
+		for i, ctr := range assigned {
+			if i >= len(pod.Spec.Containers) {
+				break
+			}
+			granted := make(map[string]bool)
+			for _, dev := range ctr {
+				granted[dev.UUID] = true
+				all[dev.UUID] = true
+			}
+			byName[pod.Spec.Containers[i].Name] = granted
+		}
+		add := func(statuses []corev1.ContainerStatus, init bool) {
+			for _, s := range statuses {
+				id := containerIDPattern.FindString(s.ContainerID)
+				if id == "" {
+					continue
+				}
+				// An init container reuses the devices of its pod.
+				granted := byName[s.Name]
+				if init {
+					granted = all
+				}
+				res[id] = podContainer{pod: pod, name: s.Name, granted: granted}
+			}
+		}
+		add(pod.Status.InitContainerStatuses, true)
+		add(pod.Status.ContainerStatuses, false)
+	}
+	return res
+}
+
+// deviceUUIDs returns the uuids of the GPUs by the minor number of their
+// device node.
+func deviceUUIDs(devices []nvidia.Device) map[string]string {
+	res := make(map[string]string)
+	for _, d := range devices {
+		if d.Minor >= 0 {
+			res[fmt.Sprint(d.Minor)] = d.UUID
+		}
+	}
+	return res
+}
+
+func describeAccess(ch chan<- *prometheus.Desc) {
+	ch <- ctrDeviceOpensDesc
+	ch <- ctrDeviceIoctlsDesc
+	ch <- ctrDeviceUnexpectedAccessDesc
+	ch <- accessTraceUpDesc
+}
+
+func (t *accessTracer) collect(ch chan<- prometheus.Metric, pods []*corev1.Pod, devices []nvidia.Device) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	up := 0.0
+	if t.running {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(accessTraceUpDesc, prometheus.GaugeValue, up)
+
+	containers := podContainers(pods)
+	uuids := deviceUUIDs(devices)
+	type series struct {
+		namespace, pod, ctr, device string
+	}
+	opens := make(map[series]uint64)
+	ioctls := make(map[series]uint64)
+	unexpected := make(map[series]string)
+	account := func(counts map[accessKey]uint64, into map[series]uint64) {
+		for key, n := range counts {
+			var s series
+			c, ok := containers[t.containerOf(key.cgroup)]
+			if ok {
+				s = series{namespace: c.pod.Namespace, pod: c.pod.Name, ctr: c.name}
+			}
+			s.device = key.device
+			into[s] += n
+			m := nvidiaDeviceNode.FindStringSubmatch(key.device)
+			if !ok || m == nil {
+				continue
+			}
+			if uuid, known := uuids[m[1]]; known && !c.granted[uuid] {
+				unexpected[s] = uuid
+			}
+		}
+	}
+	account(t.opens, opens)
+	account(t.ioctls, ioctls)
+	for s, n := range opens {
+		ch <- prometheus.MustNewConstMetric(ctrDeviceOpensDesc, prometheus.CounterValue, float64(n), s.namespace, s.pod, s.ctr, s.device)
+	}
+	for s, n := range ioctls {
+		ch <- prometheus.MustNewConstMetric(ctrDeviceIoctlsDesc, prometheus.CounterValue, float64(n), s.namespace, s.pod, s.ctr, s.device)
+	}
+	for s, uuid := range unexpected {
+		ch <- prometheus.MustNewConstMetric(ctrDeviceUnexpectedAccessDesc, prometheus.GaugeValue, 1, s.namespace, s.pod, s.ctr, s.device, uuid)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ctrCoreLimitRatioDesc = prometheus.NewDesc(
+		"vgpu_container_device_core_limit_ratio",
+		"Average SM utilization of the container over the compliance window divided by its vgpu-cores limit",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrCoreLimitPeakRatioDesc = prometheus.NewDesc(
+		"vgpu_container_device_core_limit_peak_ratio",
+		"Highest SM utilization of the container over the compliance window divided by its vgpu-cores limit",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+)
+
+type utilizationSample struct {
+	time  time.Time
+	value float64
+}
+
+// coreCompliance keeps the SM utilization samples of every container device
+// over a sliding window, to compare them with the granted core limit.
+type coreCompliance struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	samples map[string][]utilizationSample
+}
+
+func newCoreCompliance(window time.Duration) *coreCompliance {
+	return &coreCompliance{window: window, samples: make(map[string][]utilizationSample)}
+}
+
+// Observe records value for key and returns the average and the peak of the
+// samples still in the window.
+func (c *coreCompliance) Observe(key string, now time.Time, value float64) (avg float64, peak float64) {
+	samples := append(c.samples[key], utilizationSample{time: now, value: value})
+	start := 0
+	for start < len(samples) && now.Sub(samples[start].time) > c.window {
+		start++
+	}
+	samples = samples[start:]
+	c.samples[key] = samples
+	for _, s := range samples {
+		avg += s.value
+		if s.value > peak {
+			peak = s.value
+		}
+	}
+	return avg / float64(len(samples)), peak
+}
+
+func describeCoreCompliance(ch chan<- *prometheus.Desc) {
+	ch <- ctrCoreLimitRatioDesc
+	ch <- ctrCoreLimitPeakRatioDesc
+}
+
+// collect exports how the SM utilization of every container
+// device with a core limit compares with it, a ratio above 1 means the limit
+// is not holding, a ratio chronically low means the grant is too large. The
+// driver measurement is used when available, the shared region one otherwise.
+func (c *coreCompliance) collect(ch chan<- prometheus.Metric, matched []matchedContainer, samples map[string]map[uint32]processUtilization, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	seen := make(map[string]bool)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			limit := mc.Usage.Info.DeviceSmLimit(i)
+			if limit == 0 {
+				continue
+			}
+			uuid := mc.Usage.Info.DeviceUUID(i)
+			util := float64(mc.Usage.Info.DeviceSmUtil(i))
+			if procs := samples[uuid]; procs != nil {
+				util = sumUtilization(procs, mc.Usage.Info.HostPids()).sm
+			}
+			key := fmt.Sprintf("%s/%s/%d", mc.Usage.PodUID, mc.ContainerName, i)
+			seen[key] = true
+			avg, peak := c.Observe(key, now, util)
+			labels := []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), uuid}
+			ch <- prometheus.MustNewConstMetric(ctrCoreLimitRatioDesc, prometheus.GaugeValue, avg/float64(limit), labels...)
+			ch <- prometheus.MustNewConstMetric(ctrCoreLimitPeakRatioDesc, prometheus.GaugeValue, peak/float64(limit), labels...)
+		}
+	}
+	for key := range c.samples {
+		if !seen[key] {
+			delete(c.samples, key)
+		}
+	}
+}
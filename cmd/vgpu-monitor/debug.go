@@ -0,0 +1,150 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// DebugState is the full state the monitor has of the node, served on
+// /debug/vgpu for the diagnostics scripts.
+type DebugState struct {
+	NodeSnapshot
+	// Containers are the containers of the monitor path, those without a
+	// pod on the node have empty pod fields.
+	Containers []ContainerDebug `json:"containers"`
+}
+
+// ContainerDebug is a vGPU container with its shared region and the
+// devices it was granted.
+type ContainerDebug struct {
+	Namespace string                 `json:"namespace,omitempty"`
+	Pod       string                 `json:"pod,omitempty"`
+	PodUID    string                 `json:"podUID"`
+	Container string                 `json:"container"`
+	Region    RegionDebug            `json:"region"`
+	Devices   []ContainerDeviceDebug `json:"devices"`
+}
+
+// RegionDebug is the health of the shared region of a container.
+type RegionDebug struct {
+	Path       string     `json:"path,omitempty"`
+	Present    bool       `json:"present"`
+	Version    string     `json:"version,omitempty"`
+	Compatible bool       `json:"compatible"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+	Processes  int        `json:"processes"`
+	HostPids   []int      `json:"hostPids,omitempty"`
+	Priority   int        `json:"priority"`
+	// LastKernel is the unix time of the last kernel launched, 0 when none
+	// was.
+	LastKernel int64 `json:"lastKernel"`
+}
+
+// ContainerDeviceDebug is the limits and usage of a container on one of its
+// vGPUs.
+type ContainerDeviceDebug struct {
+	VDevice       int    `json:"vdevice"`
+	UUID          string `json:"uuid"`
+	MemoryLimit   uint64 `json:"memoryLimit"`
+	MemoryUsed    uint64 `json:"memoryUsed"`
+	MemoryContext uint64 `json:"memoryContext"`
+	MemoryModule  uint64 `json:"memoryModule"`
+	MemoryData    uint64 `json:"memoryData"`
+	SmLimit       uint64 `json:"smLimit"`
+	SmUtil        uint64 `json:"smUtil"`
+}
+
+// DebugState assembles the snapshot of the node with every container of the
+// monitor path, matched with its pod or not.
+func (c *ClusterManager) DebugState() DebugState {
+	state := DebugState{NodeSnapshot: c.Snapshot(), Containers: []ContainerDebug{}}
+	pods, err := c.PodLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list pods: %v", err)
+	}
+	owners := make(map[string]matchedContainer)
+	matched := c.MatchContainers(pods)
+	c.ReleaseContainers(matched)
+	for _, mc := range matched {
+		owners[string(mc.Pod.UID)+"_"+mc.ContainerName] = mc
+	}
+
+	c.containerLister.Lock()
+	defer c.containerLister.UnLock()
+	for name, usage := range c.containerLister.ListContainers() {
+		d := ContainerDebug{PodUID: usage.PodUID, Container: usage.ContainerName, Devices: []ContainerDeviceDebug{}}
+		if mc, ok := owners[name]; ok {
+			d.Namespace, d.Pod = mc.Pod.Namespace, mc.Pod.Name
+		}
+		d.Region = RegionDebug{Path: usage.CacheFile, Present: usage.CacheFile != "", Compatible: usage.Info != nil}
+		if d.Region.Present {
+			d.Region.Version = fmt.Sprintf("%d.%d", usage.MajorVersion, usage.MinorVersion)
+			if info, err := os.Stat(usage.CacheFile); err == nil {
+				t := info.ModTime()
+				d.Region.LastUpdate = &t
+			}
+		}
+		if info := usage.Info; info != nil {
+			d.Region.Processes = info.ProcNum()
+			d.Region.HostPids = info.HostPids()
+			d.Region.Priority = info.GetPriority()
+			d.Region.LastKernel = info.LastKernelTime()
+			for i := 0; i < info.DeviceNum(); i++ {
+				d.Devices = append(d.Devices, ContainerDeviceDebug{
+					VDevice:       i,
+					UUID:          info.DeviceUUID(i),
+					MemoryLimit:   info.DeviceMemoryLimit(i),
+					MemoryUsed:    info.DeviceMemoryTotal(i),
+					MemoryContext: info.DeviceMemoryContextSize(i),
+					MemoryModule:  info.DeviceMemoryModuleSize(i),
+					MemoryData:    info.DeviceMemoryBufferSize(i),
+					SmLimit:       info.DeviceSmLimit(i),
+					SmUtil:        info.DeviceSmUtil(i),
+				})
+			}
+		}
+		state.Containers = append(state.Containers, d)
+	}
+	sort.Slice(state.Containers, func(i, j int) bool {
+		a, b := state.Containers[i], state.Containers[j]
+		if a.PodUID != b.PodUID {
+			return a.PodUID < b.PodUID
+		}
+		return a.Container < b.Container
+	})
+	return state
+}
+
+func registerDebug(mux *http.ServeMux, cm *ClusterManager) {
+	mux.HandleFunc("/debug/vgpu", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cm.DebugState()); err != nil {
+			klog.Errorf("Failed to encode debug state: %v", err)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Descriptors of the host device metrics collected besides memory usage and
+// core utilization.
+var (
+	hostGPUProcessesDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_processes",
+		"Number of processes resident on the GPU device",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUTopProcessMemoryDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_top_process_memory_bytes",
+		"GPU device memory used by the largest process on the device",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUNvLinkErrorsDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_nvlink_errors_total",
+		"NVLink data link errors and recoveries counted by the GPU on its links attached to an NVSwitch, by link",
+		[]string{"deviceidx", "deviceuuid", "switch", "link", "type"}, nil,
+	)
+	hostRetiredPagesDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_retired_pages",
+		"Number of GPU memory pages retired, by cause",
+		[]string{"deviceidx", "deviceuuid", "cause"}, nil,
+	)
+	hostRetiredPagesPendingDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_retired_pages_pending",
+		"Whether page retirements are pending until the next reset of the GPU device",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostRemappedRowsDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_remapped_rows",
+		"Number of GPU memory rows remapped, by error kind",
+		[]string{"deviceidx", "deviceuuid", "type"}, nil,
+	)
+	hostRemapPendingDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_row_remap_pending",
+		"Whether row remappings are pending until the next reset of the GPU device",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostRemapFailureDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_row_remap_failure",
+		"Whether a row remapping has failed on the GPU device",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+)
+
+// nvlinkErrorCounters are the data link counters exported for the NVLinks
+// attached to an NVSwitch.
+var nvlinkErrorCounters = []struct {
+	counter nvml.NvLinkErrorCounter
+	name    string
+}{
+	{nvml.NVLINK_ERROR_DL_REPLAY, "replay"},
+	{nvml.NVLINK_ERROR_DL_RECOVERY, "recovery"},
+	{nvml.NVLINK_ERROR_DL_CRC_FLIT, "crc_flit"},
+	{nvml.NVLINK_ERROR_DL_CRC_DATA, "crc_data"},
+	{nvml.NVLINK_ERROR_DL_ECC_DATA, "ecc_data"},
+}
+
+func describeDevice(ch chan<- *prometheus.Desc) {
+	ch <- hostGPUProcessesDesc
+	ch <- hostGPUTopProcessMemoryDesc
+	ch <- hostGPUNvLinkErrorsDesc
+	ch <- hostRetiredPagesDesc
+	ch <- hostRetiredPagesPendingDesc
+	ch <- hostRemappedRowsDesc
+	ch <- hostRemapPendingDesc
+	ch <- hostRemapFailureDesc
+}
+
+// collectDeviceProcesses exports the number of compute and graphics processes
+// on the device and the memory of the largest one, a saturation signal which
+// does not need a series per process.
+func collectDeviceProcesses(ch chan<- prometheus.Metric, procs *deviceProcesses) {
+	if procs == nil {
+		return
+	}
+	top := uint64(0)
+	for _, mem := range procs.memory {
+		if mem > top {
+			top = mem
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(hostGPUProcessesDesc, prometheus.GaugeValue, float64(len(procs.memory)), procs.idx, procs.uuid)
+	ch <- prometheus.MustNewConstMetric(hostGPUTopProcessMemoryDesc, prometheus.GaugeValue, float64(top), procs.idx, procs.uuid)
+}
+
+// collectNvLinkErrors exports the error counters the device keeps for every
+// one of its active NVLinks whose remote end is an NVSwitch, labelled with
+// the PCI bus id of the switch and the link index of the device. The ports
+// of the switch itself are only known to the fabric manager.
+func collectNvLinkErrors(ch chan<- prometheus.Metric, hdev nvml.Device, idx string, uuid string) {
+	for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+		state, ret := hdev.GetNvLinkState(link)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			// No NVLink on this device, or no more links.
+			return
+		}
+		if ret != nvml.SUCCESS || state != nvml.FEATURE_ENABLED {
+			continue
+		}
+		remote, ret := hdev.GetNvLinkRemoteDeviceType(link)
+		if ret != nvml.SUCCESS || remote != nvml.NVLINK_DEVICE_TYPE_SWITCH {
+			continue
+		}
+		pci, ret := hdev.GetNvLinkRemotePciInfo(link)
+		if ret != nvml.SUCCESS {
+			nvidia.RecordNVMLError("GetNvLinkRemotePciInfo", ret)
+			klog.V(4).Infof("nvml get remote pci info of device %s link %d error ret=%v", uuid, link, ret)
+			continue
+		}
+		switchID := pciBusID(pci)
+		linkIdx := fmt.Sprint(link)
+		for _, c := range nvlinkErrorCounters {
+			v, ret := hdev.GetNvLinkErrorCounter(link, c.counter)
+			if ret != nvml.SUCCESS {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(hostGPUNvLinkErrorsDesc, prometheus.CounterValue, float64(v),
+				idx, uuid, switchID, linkIdx, c.name)
+		}
+	}
+}
+
+// collectMemoryRetirement exports the page retirement counters of pre-Ampere
+// devices and the row remapping counters of Ampere and later ones, each
+// device only supports one of the two mechanisms.
+func collectMemoryRetirement(ch chan<- prometheus.Metric, hdev nvml.Device, idx string, uuid string) {
+	for cause, name := range map[nvml.PageRetirementCause]string{
+		nvml.PAGE_RETIREMENT_CAUSE_MULTIPLE_SINGLE_BIT_ECC_ERRORS: "single_bit_ecc",
+		nvml.PAGE_RETIREMENT_CAUSE_DOUBLE_BIT_ECC_ERROR:           "double_bit_ecc",
+	} {
+		pages, ret := hdev.GetRetiredPages(cause)
+		if ret != nvml.SUCCESS {
+			nvidia.RecordNVMLError("GetRetiredPages", ret)
+			klog.V(4).Infof("nvml get retired pages of device %s error ret=%v", uuid, ret)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(hostRetiredPagesDesc, prometheus.GaugeValue, float64(len(pages)), idx, uuid, name)
+	}
+	if pending, ret := hdev.GetRetiredPagesPendingStatus(); ret == nvml.SUCCESS {
+		ch <- prometheus.MustNewConstMetric(hostRetiredPagesPendingDesc, prometheus.GaugeValue,
+			boolToFloat(pending == nvml.FEATURE_ENABLED), idx, uuid)
+	}
+	corrected, uncorrected, pending, failed, ret := hdev.GetRemappedRows()
+	if ret != nvml.SUCCESS {
+		nvidia.RecordNVMLError("GetRemappedRows", ret)
+		klog.V(4).Infof("nvml get remapped rows of device %s error ret=%v", uuid, ret)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(hostRemappedRowsDesc, prometheus.GaugeValue, float64(corrected), idx, uuid, "correctable")
+	ch <- prometheus.MustNewConstMetric(hostRemappedRowsDesc, prometheus.GaugeValue, float64(uncorrected), idx, uuid, "uncorrectable")
+	ch <- prometheus.MustNewConstMetric(hostRemapPendingDesc, prometheus.GaugeValue, boolToFloat(pending), idx, uuid)
+	ch <- prometheus.MustNewConstMetric(hostRemapFailureDesc, prometheus.GaugeValue, boolToFloat(failed), idx, uuid)
+}
+
+// pciBusID returns the nil terminated bus id of a PCI info.
+func pciBusID(pci nvml.PciInfo) string {
+	var b []byte
+	for _, c := range pci.BusId {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return strings.ToLower(string(b))
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// The paths the events are served on.
+const (
+	EventsPath       = "/api/v1/events"
+	EventsStreamPath = "/api/v1/events/stream"
+)
+
+// The types of the events.
+const (
+	// EventAllocation is a container seen using a vGPU for the first time.
+	EventAllocation = "allocation"
+	// EventLimitHit is a container reaching its memory limit on a vGPU.
+	EventLimitHit = "limit-hit"
+	// EventThrottle is a container reaching its core limit on a vGPU, the
+	// hook throttles its kernels.
+	EventThrottle = "throttle"
+	// EventOOM is a container of a vGPU pod killed out of host memory.
+	EventOOM = "oom"
+	// EventDeviceOOM is a container its vGPU hook denied allocations for
+	// going over its memory limit.
+	EventDeviceOOM = "device-oom"
+	// EventHealth is a GPU turning unhealthy or healthy again.
+	EventHealth = "health"
+	// EventXid is an Xid critical error reported by the driver for a GPU.
+	EventXid = "xid"
+	// EventMemoryPressure is a GPU going over or back under the memory
+	// pressure threshold of its physical memory.
+	EventMemoryPressure = "memory-pressure"
+)
+
+// Event is something which happened to a vGPU container or a GPU of the
+// node. IDs increase, a consumer resumes after the last one it has seen.
+type Event struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Node      string    `json:"node"`
+	Namespace string    `json:"namespace,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// eventJournal keeps the last events in memory and fans them out to the
+// streams tailing it.
+type eventJournal struct {
+	mutex       sync.Mutex
+	size        int
+	events      []Event
+	next        uint64
+	subscribers map[chan Event]struct{}
+}
+
+func newEventJournal(size int) *eventJournal {
+	return &eventJournal{size: size, next: 1, subscribers: make(map[chan Event]struct{})}
+}
+
+// Append records the event, dropping the oldest one when the journal is
+// full. A subscriber too slow to take it misses it.
+func (j *eventJournal) Append(e Event) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	e.ID = j.next
+	j.next++
+	j.events = append(j.events, e)
+	if len(j.events) > j.size {
+		j.events = j.events[len(j.events)-j.size:]
+	}
+	for ch := range j.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Since returns the events after the id still in the journal.
+func (j *eventJournal) Since(id uint64) []Event {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.since(id)
+}
+
+func (j *eventJournal) since(id uint64) []Event {
+	res := []Event{}
+	for _, e := range j.events {
+		if e.ID > id {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Subscribe returns the events after the id still in the journal and a
+// channel the next ones are sent to.
+func (j *eventJournal) Subscribe(id uint64) ([]Event, chan Event) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	ch := make(chan Event, 64)
+	j.subscribers[ch] = struct{}{}
+	return j.since(id), ch
+}
+
+func (j *eventJournal) Unsubscribe(ch chan Event) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	delete(j.subscribers, ch)
+}
+
+// eventDetector turns the changes between two snapshots of the node into
+// events.
+type eventDetector struct {
+	journal *eventJournal
+	// slices are the states of the slices of the last snapshot, by
+	// namespace/pod/container/uuid, health the one of the devices.
+	slices   map[string]sliceState
+	health   map[string]bool
+	restarts map[string]int32
+	started  bool
+}
+
+type sliceState struct {
+	limitHit  bool
+	throttled bool
+}
+
+func newEventDetector(journal *eventJournal) *eventDetector {
+	return &eventDetector{
+		journal:  journal,
+		slices:   make(map[string]sliceState),
+		health:   make(map[string]bool),
+		restarts: make(map[string]int32),
+	}
+}
+
+// Observe records the events between the last snapshot and this one. The
+// first snapshot records the allocations and the unhealthy devices found.
+func (d *eventDetector) Observe(snap NodeSnapshot, pods []*corev1.Pod) {
+	slices := make(map[string]sliceState)
+	health := make(map[string]bool)
+	for _, dev := range snap.Devices {
+		health[dev.UUID] = dev.Healthy
+		if was, ok := d.health[dev.UUID]; (ok && was != dev.Healthy) || (!ok && !dev.Healthy) {
+			msg := "device is healthy"
+			if !dev.Healthy {
+				msg = "device is unhealthy"
+			}
+			d.journal.Append(Event{Time: snap.Time, Type: EventHealth, Node: snap.Node, Device: dev.UUID, Message: msg})
+		}
+		for _, s := range dev.Containers {
+			key := s.Namespace + "/" + s.Pod + "/" + s.Container + "/" + dev.UUID
+			e := Event{Time: snap.Time, Node: snap.Node, Namespace: s.Namespace, Pod: s.Pod, Container: s.Container, Device: dev.UUID}
+			st := sliceState{
+				limitHit:  s.MemoryLimit > 0 && s.MemoryUsed >= s.MemoryLimit,
+				throttled: s.SmLimit > 0 && s.SmUtil >= s.SmLimit,
+			}
+			prev, known := d.slices[key]
+			if !known {
+				e.Type, e.Message = EventAllocation, fmt.Sprintf("using %d MiB of memory and %d%% of the cores", s.MemoryLimit/1048576, s.SmLimit)
+				d.journal.Append(e)
+			}
+			if st.limitHit && !prev.limitHit {
+				e.Type, e.Message = EventLimitHit, fmt.Sprintf("memory used %d MiB reached its limit", s.MemoryUsed/1048576)
+				d.journal.Append(e)
+			}
+			if st.throttled && !prev.throttled {
+				e.Type, e.Message = EventThrottle, fmt.Sprintf("SM utilization %d%% reached its limit", s.SmUtil)
+				d.journal.Append(e)
+			}
+			slices[key] = st
+		}
+	}
+	d.slices, d.health = slices, health
+
+	restarts := make(map[string]int32)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != snap.Node || pod.Annotations[util.AssignedIDsAnnotations] == "" {
+			continue
+		}
+		for _, s := range pod.Status.ContainerStatuses {
+			key := pod.Namespace + "/" + pod.Name + "/" + s.Name
+			restarts[key] = s.RestartCount
+			last, ok := d.restarts[key]
+			t := s.LastTerminationState.Terminated
+			if !d.started || t == nil || t.Reason != "OOMKilled" || (ok && last == s.RestartCount) {
+				continue
+			}
+			d.journal.Append(Event{Time: snap.Time, Type: EventOOM, Node: snap.Node, Namespace: pod.Namespace, Pod: pod.Name, Container: s.Name,
+				Message: fmt.Sprintf("container was OOM killed, restarted %d times", s.RestartCount)})
+		}
+	}
+	d.restarts = restarts
+	d.started = true
+}
+
+// Run observes the node every interval once its containers are synced, the
+// snapshots taken before miss containers.
+func (d *eventDetector) Run(cm *ClusterManager, interval time.Duration) {
+	for {
+		pods, err := cm.PodLister.List(labels.Everything())
+		if err != nil {
+			klog.Errorf("Failed to list pods: %v", err)
+		}
+		if snap := cm.Snapshot(); snap.ContainersReady {
+			d.Observe(snap, pods)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// eventFilter selects the events of the query parameters namespace, pod
+// and type.
+type eventFilter struct {
+	namespace, pod, typ string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	q := r.URL.Query()
+	return eventFilter{namespace: q.Get("namespace"), pod: q.Get("pod"), typ: q.Get("type")}
+}
+
+func (f eventFilter) match(e Event) bool {
+	return (f.namespace == "" || f.namespace == e.Namespace) &&
+		(f.pod == "" || f.pod == e.Pod) &&
+		(f.typ == "" || f.typ == e.Type)
+}
+
+// lastEventID is the id to resume after, from the Last-Event-ID header of a
+// reconnecting stream or the since query parameter.
+func lastEventID(r *http.Request) uint64 {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("since")
+	}
+	id, _ := strconv.ParseUint(s, 10, 64)
+	return id
+}
+
+// registerEvents serves the journal as JSON and as a stream of server-sent
+// events.
+func registerEvents(mux *http.ServeMux, journal *eventJournal) {
+	mux.HandleFunc(EventsPath, func(w http.ResponseWriter, r *http.Request) {
+		filter := newEventFilter(r)
+		res := []Event{}
+		for _, e := range journal.Since(lastEventID(r)) {
+			if filter.match(e) {
+				res = append(res, e)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			klog.Errorf("Failed to encode events: %v", err)
+		}
+	})
+	mux.HandleFunc(EventsStreamPath, func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		filter := newEventFilter(r)
+		events, ch := journal.Subscribe(lastEventID(r))
+		defer journal.Unsubscribe(ch)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		send := func(e Event) bool {
+			if !filter.match(e) {
+				return true
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return true
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return false
+			}
+			flusher.Flush()
+			return true
+		}
+		for _, e := range events {
+			if !send(e) {
+				return
+			}
+		}
+		flusher.Flush()
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e := <-ch:
+				if !send(e) {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
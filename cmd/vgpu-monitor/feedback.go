@@ -20,7 +20,7 @@ import (
 	"time"
 
 	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
-	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
 
 	"k8s.io/klog/v2"
 )
@@ -62,11 +62,18 @@ func CheckPriority(utSwitchOn map[string]UtilizationPerDevice, p int, c *nvidia.
 	return false
 }
 
-func Observe(lister *nvidia.ContainerLister) {
+// Observe blocks the containers of lower priority than the ones running
+// kernels on their GPU, and turns on the limiter of the containers sharing
+// it, except for those whose limiter the core QoS drives.
+func Observe(lister *nvidia.ContainerLister, qos *coreQoS, inversions *priorityInversions) {
 	utSwitchOn := map[string]UtilizationPerDevice{}
-	containers := lister.ListContainers()
+	containers := lister.AcquireContainers()
+	defer lister.ReleaseContainers(containers)
 
 	for _, c := range containers {
+		if c.Info == nil {
+			continue
+		}
 		recentKernel := c.Info.GetRecentKernel()
 		if recentKernel > 0 {
 			recentKernel--
@@ -78,16 +85,20 @@ func Observe(lister *nvidia.ContainerLister) {
 					}
 					uuid := c.Info.DeviceUUID(i)
 					if len(utSwitchOn[uuid]) == 0 {
-						utSwitchOn[uuid] = []int{0, 0}
+						utSwitchOn[uuid] = make(UtilizationPerDevice, len(util.TaskPriorityClasses))
 					}
-					utSwitchOn[uuid][c.Info.GetPriority()]++
+					utSwitchOn[uuid][containerPriority(c)]++
 				}
 			}
 			c.Info.SetRecentKernel(recentKernel)
 		}
 	}
+	inversions.observe(utSwitchOn)
 	for idx, c := range containers {
-		priority := c.Info.GetPriority()
+		if c.Info == nil {
+			continue
+		}
+		priority := containerPriority(c)
 		recentKernel := c.Info.GetRecentKernel()
 		utilizationSwitch := c.Info.GetUtilizationSwitch()
 		if CheckBlocking(utSwitchOn, priority, c) {
@@ -103,6 +114,9 @@ func Observe(lister *nvidia.ContainerLister) {
 				c.Info.SetRecentKernel(0)
 			}
 		}
+		if qos.Managed(c) {
+			continue
+		}
 		if CheckPriority(utSwitchOn, priority, c) {
 			if utilizationSwitch != 1 {
 				klog.Infof("utSwitchon=%v", utSwitchOn)
@@ -119,8 +133,9 @@ func Observe(lister *nvidia.ContainerLister) {
 	}
 }
 
-func watchAndFeedback(lister *nvidia.ContainerLister) {
-	config.Nvml().Init()
+func watchAndFeedback(lister *nvidia.ContainerLister, qos *coreQoS, inversions *priorityInversions) {
+	// The device cache initializes NVML on first use.
+	lister.Devices().Devices()
 	for {
 		time.Sleep(time.Second * 5)
 		err := lister.Update()
@@ -128,6 +143,6 @@ func watchAndFeedback(lister *nvidia.ContainerLister) {
 			klog.Errorf("Failed to update container list: %v", err)
 			continue
 		}
-		Observe(lister)
+		Observe(lister, qos, inversions)
 	}
 }
@@ -0,0 +1,245 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/api"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// usageServer implements the VGPUMonitor service on top of the node
+// snapshots of the ClusterManager.
+type usageServer struct {
+	api.UnimplementedVGPUMonitorServer
+	cm       *ClusterManager
+	interval time.Duration
+}
+
+// serveGRPC serves the VGPUMonitor service on address, it only returns on
+// error.
+func serveGRPC(ctx context.Context, address string, cm *ClusterManager, interval time.Duration) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	api.RegisterVGPUMonitorServer(s, &usageServer{cm: cm, interval: interval})
+	go func() {
+		<-ctx.Done()
+		// The usage streams only end with their subscribers, they are cut
+		// after the grace period.
+		timer := time.AfterFunc(shutdownGracePeriod, s.Stop)
+		s.GracefulStop()
+		timer.Stop()
+	}()
+	klog.Infof("Serving VGPUMonitor gRPC on %s", address)
+	return s.Serve(lis)
+}
+
+// StreamUsage sends a full update, then the changes of every interval until
+// the subscriber goes away.
+func (s *usageServer) StreamUsage(req *api.StreamUsageRequest, stream api.VGPUMonitor_StreamUsageServer) error {
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval < s.interval {
+		interval = s.interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prevDevices map[string]*api.DeviceUsage
+	var prevContainers map[string]*api.ContainerDeviceUsage
+	for {
+		snap := s.cm.Snapshot()
+		devices, containers := flattenSnapshot(snap)
+		update := usageDelta(prevDevices, devices, prevContainers, containers)
+		update.Node = snap.Node
+		update.TimestampUnixNano = snap.Time.UnixNano()
+		update.Full = prevDevices == nil
+		if update.Full || len(update.Devices)+len(update.Containers)+len(update.RemovedDevices)+len(update.RemovedContainers) > 0 {
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+		prevDevices, prevContainers = devices, containers
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// flattenSnapshot indexes the devices of a snapshot by uuid and the granted
+// vGPUs by namespace/pod/container/vdevice.
+func flattenSnapshot(snap NodeSnapshot) (map[string]*api.DeviceUsage, map[string]*api.ContainerDeviceUsage) {
+	devices := make(map[string]*api.DeviceUsage)
+	containers := make(map[string]*api.ContainerDeviceUsage)
+	for _, d := range snap.Devices {
+		devices[d.UUID] = &api.DeviceUsage{
+			Index:       int32(d.Index),
+			Uuid:        d.UUID,
+			Healthy:     d.Healthy,
+			MemoryUsed:  d.MemoryUsed,
+			MemoryTotal: d.MemoryTotal,
+			Utilization: d.Utilization,
+		}
+		for _, c := range d.Containers {
+			ctr := fmt.Sprintf("%s/%s/%s", c.Namespace, c.Pod, c.Container)
+			containers[fmt.Sprintf("%s/%d", ctr, c.VDevice)] = &api.ContainerDeviceUsage{
+				Namespace:   c.Namespace,
+				Pod:         c.Pod,
+				Container:   c.Container,
+				Vdevice:     int32(c.VDevice),
+				DeviceUuid:  d.UUID,
+				MemoryUsed:  c.MemoryUsed,
+				MemoryLimit: c.MemoryLimit,
+				SmUtil:      c.SmUtil,
+				SmLimit:     c.SmLimit,
+			}
+		}
+	}
+	return devices, containers
+}
+
+// usageDelta returns the entries which are new or changed and the keys of
+// those which are gone since the previous state.
+func usageDelta(prevDevices, devices map[string]*api.DeviceUsage, prevContainers, containers map[string]*api.ContainerDeviceUsage) *api.UsageUpdate {
+	update := &api.UsageUpdate{}
+	for uuid, d := range devices {
+		if p, ok := prevDevices[uuid]; !ok || !proto.Equal(p, d) {
+			update.Devices = append(update.Devices, d)
+		}
+	}
+	for uuid := range prevDevices {
+		if _, ok := devices[uuid]; !ok {
+			update.RemovedDevices = append(update.RemovedDevices, uuid)
+		}
+	}
+	for key, c := range containers {
+		if p, ok := prevContainers[key]; !ok || !proto.Equal(p, c) {
+			update.Containers = append(update.Containers, c)
+		}
+	}
+	for key := range prevContainers {
+		if _, ok := containers[key]; !ok {
+			update.RemovedContainers = append(update.RemovedContainers, key)
+		}
+	}
+	return update
+}
+
+// WatchContainerUsage sends an ADDED event for every container watched, then
+// the events of the containers which changed every interval until the
+// subscriber goes away.
+func (s *usageServer) WatchContainerUsage(req *api.WatchContainerUsageRequest, stream api.VGPUMonitor_WatchContainerUsageServer) error {
+	selector, err := labels.Parse(req.LabelSelector)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid label selector %q: %v", req.LabelSelector, err)
+	}
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval < s.interval {
+		interval = s.interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev map[string]*api.ContainerUsage
+	for {
+		snap := s.cm.Snapshot()
+		containers := s.watchedContainers(snap, req.Namespace, selector)
+		for _, e := range containerEvents(prev, containers) {
+			e.Node = snap.Node
+			e.TimestampUnixNano = snap.Time.UnixNano()
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+		prev = containers
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchedContainers groups the granted vGPUs of a snapshot by container,
+// keyed by namespace/pod/container, keeping those of namespace and of the
+// pods matching selector.
+func (s *usageServer) watchedContainers(snap NodeSnapshot, namespace string, selector labels.Selector) map[string]*api.ContainerUsage {
+	_, devices := flattenSnapshot(snap)
+	res := make(map[string]*api.ContainerUsage)
+	for _, d := range devices {
+		if namespace != "" && d.Namespace != namespace {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s/%s", d.Namespace, d.Pod, d.Container)
+		c, ok := res[key]
+		if !ok {
+			if !selector.Empty() {
+				pod, err := s.cm.PodLister.Pods(d.Namespace).Get(d.Pod)
+				if err != nil || !selector.Matches(labels.Set(pod.Labels)) {
+					continue
+				}
+			}
+			c = &api.ContainerUsage{Namespace: d.Namespace, Pod: d.Pod, Container: d.Container}
+			res[key] = c
+		}
+		c.Devices = append(c.Devices, d)
+	}
+	for _, c := range res {
+		sort.Slice(c.Devices, func(i, j int) bool { return c.Devices[i].Vdevice < c.Devices[j].Vdevice })
+	}
+	return res
+}
+
+// containerEvents returns the events from the previous containers to the
+// current ones, ADDED for all of them when there are no previous ones, in
+// the order of their keys.
+func containerEvents(prev, containers map[string]*api.ContainerUsage) []*api.ContainerUsageEvent {
+	var res []*api.ContainerUsageEvent
+	for key, c := range containers {
+		p, ok := prev[key]
+		switch {
+		case !ok:
+			res = append(res, &api.ContainerUsageEvent{Type: api.ContainerUsageEvent_ADDED, Container: c})
+		case !proto.Equal(p, c):
+			res = append(res, &api.ContainerUsageEvent{Type: api.ContainerUsageEvent_MODIFIED, Container: c})
+		}
+	}
+	for key, p := range prev {
+		if _, ok := containers[key]; !ok {
+			res = append(res, &api.ContainerUsageEvent{Type: api.ContainerUsageEvent_DELETED,
+				Container: &api.ContainerUsage{Namespace: p.Namespace, Pod: p.Pod, Container: p.Container}})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i].Container, res[j].Container
+		return fmt.Sprintf("%s/%s/%s", a.Namespace, a.Pod, a.Container) < fmt.Sprintf("%s/%s/%s", b.Namespace, b.Pod, b.Container)
+	})
+	return res
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/slo"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// handshakeTracker observes the end of the handshakes of the pods: the
+// region and total phases end when libvgpu created the shared region of a
+// container, as first seen by the monitor.
+type handshakeTracker struct {
+	recorder *slo.Recorder
+	// started is when the monitor started, the regions of the pods
+	// allocated before may be older than the monitor and are not observed.
+	started time.Time
+	// seen are the containers whose region was seen, by pod UID/container.
+	seen map[string]bool
+}
+
+func newHandshakeTracker() *handshakeTracker {
+	return &handshakeTracker{recorder: slo.NewRecorder(), started: time.Now(), seen: make(map[string]bool)}
+}
+
+// Observe records the phases of the containers whose shared region shows
+// up.
+func (t *handshakeTracker) Observe(matched []matchedContainer, now time.Time) {
+	seen := make(map[string]bool)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		key := string(mc.Pod.UID) + "/" + mc.ContainerName
+		seen[key] = true
+		if t.seen[key] {
+			continue
+		}
+		annotations := mc.Pod.Annotations
+		allocated, ok := slo.ParseTime(annotations[util.AllocatedTimeAnnotation])
+		if !ok || allocated.Before(t.started) {
+			continue
+		}
+		id := annotations[util.CorrelationIDAnnotation]
+		t.recorder.Observe(slo.PhaseRegion, id, now.Sub(allocated))
+		if assigned, ok := slo.ParseTime(annotations[util.HandshakeStartAnnotation]); ok {
+			t.recorder.Observe(slo.PhaseTotal, id, now.Sub(assigned))
+		}
+	}
+	t.seen = seen
+}
+
+// Run observes the containers every interval once they are synced.
+func (t *handshakeTracker) Run(cm *ClusterManager, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !cm.ContainersReady() {
+			continue
+		}
+		pods, err := cm.PodLister.List(labels.Everything())
+		if err != nil {
+			klog.Errorf("Failed to list pods: %v", err)
+			continue
+		}
+		matched := cm.MatchContainers(pods)
+		t.Observe(matched, time.Now())
+		cm.ReleaseContainers(matched)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Descriptors of the thermal, power and clock state of the devices, only
+// exported with --collect-hardware-metrics.
+var (
+	hostGPUTemperatureDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_temperature_celsius",
+		"Temperature of the GPU die",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUPowerUsageDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_power_usage_watts",
+		"Power drawn by the GPU board",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUPowerLimitDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_power_limit_watts",
+		"Power limit enforced on the GPU board",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUClockDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_clock_hertz",
+		"Current clock of the GPU by domain: sm or memory",
+		[]string{"deviceidx", "deviceuuid", "clock"}, nil,
+	)
+	hostGPUThrottleDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_throttled",
+		"Whether the clocks of the GPU are reduced for the reason",
+		[]string{"deviceidx", "deviceuuid", "reason"}, nil,
+	)
+)
+
+// throttleReasons are the reasons the clocks of a device are reduced for.
+var throttleReasons = []struct {
+	mask uint64
+	name string
+}{
+	{nvml.ClocksThrottleReasonGpuIdle, "gpu_idle"},
+	{nvml.ClocksThrottleReasonApplicationsClocksSetting, "applications_clocks_setting"},
+	{nvml.ClocksThrottleReasonSwPowerCap, "sw_power_cap"},
+	{nvml.ClocksThrottleReasonHwSlowdown, "hw_slowdown"},
+	{nvml.ClocksThrottleReasonSyncBoost, "sync_boost"},
+	{nvml.ClocksThrottleReasonSwThermalSlowdown, "sw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwThermalSlowdown, "hw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, "hw_power_brake_slowdown"},
+	{nvml.ClocksThrottleReasonDisplayClockSetting, "display_clock_setting"},
+}
+
+func describeHardware(ch chan<- *prometheus.Desc) {
+	if !collectHardwareMetrics {
+		return
+	}
+	ch <- hostGPUTemperatureDesc
+	ch <- hostGPUPowerUsageDesc
+	ch <- hostGPUPowerLimitDesc
+	ch <- hostGPUClockDesc
+	ch <- hostGPUThrottleDesc
+}
+
+// collectHardware exports the temperature, the power draw and limit, the
+// clocks and the throttle reasons of the device, for the capacity planning
+// of the shared nodes. Those the device doesn't support are left out.
+func collectHardware(ch chan<- prometheus.Metric, hdev nvml.Device, idx string, uuid string) {
+	if temp, ret := hdev.GetTemperature(nvml.TEMPERATURE_GPU); ret == nvml.SUCCESS {
+		ch <- prometheus.MustNewConstMetric(hostGPUTemperatureDesc, prometheus.GaugeValue, float64(temp), idx, uuid)
+	} else {
+		nvidia.RecordNVMLError("GetTemperature", ret)
+		klog.V(4).Infof("nvml get temperature of device %s error ret=%v", uuid, ret)
+	}
+	// The power is reported in milliwatts.
+	if power, ret := hdev.GetPowerUsage(); ret == nvml.SUCCESS {
+		ch <- prometheus.MustNewConstMetric(hostGPUPowerUsageDesc, prometheus.GaugeValue, float64(power)/1000, idx, uuid)
+	} else {
+		nvidia.RecordNVMLError("GetPowerUsage", ret)
+		klog.V(4).Infof("nvml get power usage of device %s error ret=%v", uuid, ret)
+	}
+	if limit, ret := hdev.GetEnforcedPowerLimit(); ret == nvml.SUCCESS {
+		ch <- prometheus.MustNewConstMetric(hostGPUPowerLimitDesc, prometheus.GaugeValue, float64(limit)/1000, idx, uuid)
+	} else {
+		nvidia.RecordNVMLError("GetEnforcedPowerLimit", ret)
+		klog.V(4).Infof("nvml get power limit of device %s error ret=%v", uuid, ret)
+	}
+	// The clocks are reported in MHz.
+	for clock, name := range map[nvml.ClockType]string{nvml.CLOCK_SM: "sm", nvml.CLOCK_MEM: "memory"} {
+		if mhz, ret := hdev.GetClockInfo(clock); ret == nvml.SUCCESS {
+			ch <- prometheus.MustNewConstMetric(hostGPUClockDesc, prometheus.GaugeValue, float64(mhz)*1e6, idx, uuid, name)
+		} else {
+			nvidia.RecordNVMLError("GetClockInfo", ret)
+			klog.V(4).Infof("nvml get %s clock of device %s error ret=%v", name, uuid, ret)
+		}
+	}
+	reasons, ret := hdev.GetCurrentClocksThrottleReasons()
+	if ret != nvml.SUCCESS {
+		nvidia.RecordNVMLError("GetCurrentClocksThrottleReasons", ret)
+		klog.V(4).Infof("nvml get throttle reasons of device %s error ret=%v", uuid, ret)
+		return
+	}
+	for _, r := range throttleReasons {
+		ch <- prometheus.MustNewConstMetric(hostGPUThrottleDesc, prometheus.GaugeValue, boolToFloat(reasons&r.mask != 0), idx, uuid, r.name)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// healthCheck is a condition of the probes of the monitor, nil when it
+// holds.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// livenessChecks fail when the monitor can't recover by itself: NVML is
+// not initialized, the hook path can't be read or the sampling hangs. A
+// node without NVIDIA driver is not a failure, the monitor runs degraded.
+func (c *ClusterManager) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"nvml", func() error {
+			c.containerLister.Devices().Devices()
+			if devices := c.containerLister.Devices(); !devices.Initialized() && !devices.NoGPU() {
+				return fmt.Errorf("NVML is not initialized")
+			}
+			return nil
+		}},
+		{"hook-path", func() error {
+			_, err := os.ReadDir(c.containerLister.Path())
+			return err
+		}},
+		{"sampler", func() error {
+			if c.sampler == nil {
+				return nil
+			}
+			if age, ok := c.sampler.age(); ok && age > 3*sampleInterval+time.Minute {
+				return fmt.Errorf("last sample is %s old", age.Round(time.Second))
+			}
+			return nil
+		}},
+	}
+}
+
+// readinessChecks add to the liveness the sync of the containers and the
+// pods, before which the container series are left out.
+func (c *ClusterManager) readinessChecks() []healthCheck {
+	return append(c.livenessChecks(),
+		healthCheck{"containers", func() error {
+			if !c.containerLister.Synced() {
+				return fmt.Errorf("containers of the hook path not listed yet")
+			}
+			return nil
+		}},
+		healthCheck{"pods", func() error {
+			if c.podsSynced != nil && !c.podsSynced() {
+				return fmt.Errorf("pod cache not synced yet")
+			}
+			return nil
+		}},
+	)
+}
+
+// healthHandler serves the checks the way the probes of the Kubernetes
+// components do: a line per check, 503 when any fails.
+func healthHandler(probe string, checks func() []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var out bytes.Buffer
+		failed := false
+		for _, c := range checks() {
+			if err := c.check(); err != nil {
+				failed = true
+				fmt.Fprintf(&out, "[-]%s failed: %v\n", c.name, err)
+				continue
+			}
+			fmt.Fprintf(&out, "[+]%s ok\n", c.name)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			klog.Warningf("%s check failed:\n%s", probe, out.String())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(&out, "%s check failed\n", probe)
+		} else {
+			fmt.Fprintf(&out, "%s check passed\n", probe)
+		}
+		w.Write(out.Bytes())
+	}
+}
+
+func registerHealth(mux *http.ServeMux, cm *ClusterManager) {
+	mux.HandleFunc("/healthz", healthHandler("healthz", cm.livenessChecks))
+	mux.HandleFunc("/readyz", healthHandler("readyz", cm.readinessChecks))
+}
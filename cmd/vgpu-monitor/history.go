@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ctrSmUtilizationQuantileDesc = prometheus.NewDesc(
+	"vgpu_container_sm_utilization_quantile_ratio",
+	"Quantile of the SM utilization of the container on the vGPU over the window: 0.5, 0.95 or 1 for the max",
+	[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid", "window", "quantile"}, nil,
+)
+
+// utilizationWindows are the windows of the utilization quantiles, the
+// ring buffers keep the samples of the longest.
+var utilizationWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+var utilizationQuantiles = []float64{0.5, 0.95, 1}
+
+// utilizationRingSize bounds the samples of a container device, enough for
+// the longest window sampled every second.
+const utilizationRingSize = 1024
+
+// utilizationRing is a fixed-size ring buffer of utilization samples, the
+// oldest are overwritten.
+type utilizationRing struct {
+	samples []utilizationSample
+	next    int
+}
+
+func (r *utilizationRing) add(s utilizationSample) {
+	if len(r.samples) < utilizationRingSize {
+		r.samples = append(r.samples, s)
+		return
+	}
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % utilizationRingSize
+}
+
+// since returns the values of the samples taken after start.
+func (r *utilizationRing) since(start time.Time) []float64 {
+	var res []float64
+	for _, s := range r.samples {
+		if s.time.After(start) {
+			res = append(res, s.value)
+		}
+	}
+	return res
+}
+
+// quantile returns the nearest-rank quantile q of the sorted values.
+func quantile(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// utilizationHistory keeps the recent SM utilization of every container
+// device, for the schedulers and autoscalers which pack on smoothed usage
+// rather than on the last sample.
+type utilizationHistory struct {
+	mutex sync.Mutex
+	rings map[string]*utilizationRing
+}
+
+func newUtilizationHistory() *utilizationHistory {
+	return &utilizationHistory{rings: make(map[string]*utilizationRing)}
+}
+
+func describeUtilizationHistory(ch chan<- *prometheus.Desc) {
+	ch <- ctrSmUtilizationQuantileDesc
+}
+
+// collect records the SM utilization of every container device and exports
+// its quantiles over the windows, of the driver measurement when available,
+// the shared region one otherwise.
+func (h *utilizationHistory) collect(ch chan<- prometheus.Metric, matched []matchedContainer, samples map[string]map[uint32]processUtilization, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	seen := make(map[string]bool)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			uuid := mc.Usage.Info.DeviceUUID(i)
+			util := float64(mc.Usage.Info.DeviceSmUtil(i))
+			if procs := samples[uuid]; procs != nil {
+				util = sumUtilization(procs, mc.Usage.Info.HostPids()).sm
+			}
+			key := fmt.Sprintf("%s/%s/%d", mc.Usage.PodUID, mc.ContainerName, i)
+			seen[key] = true
+			ring, ok := h.rings[key]
+			if !ok {
+				ring = &utilizationRing{}
+				h.rings[key] = ring
+			}
+			ring.add(utilizationSample{time: now, value: util / 100})
+			labels := []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), uuid}
+			for _, w := range utilizationWindows {
+				values := ring.since(now.Add(-w.duration))
+				sort.Float64s(values)
+				for _, q := range utilizationQuantiles {
+					ch <- prometheus.MustNewConstMetric(ctrSmUtilizationQuantileDesc, prometheus.GaugeValue, quantile(values, q),
+						append(labels, w.name, fmt.Sprint(q))...)
+				}
+			}
+		}
+	}
+	for key := range h.rings {
+		if !seen[key] {
+			delete(h.rings, key)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptors of the libvgpu hook health of every vGPU container. A granted
+// container whose hook never created its shared region, runs an unknown
+// region layout or has no process attached would otherwise look idle.
+var (
+	ctrHookHealthyDesc = prometheus.NewDesc(
+		"vgpu_container_hook_healthy",
+		"Whether the vGPU hook of the container has a compatible shared region with at least one process attached",
+		[]string{"podnamespace", "podname", "ctrname"}, nil,
+	)
+	ctrHookRegionDesc = prometheus.NewDesc(
+		"vgpu_container_hook_region_present",
+		"Whether the vGPU hook of the container created its shared region",
+		[]string{"podnamespace", "podname", "ctrname"}, nil,
+	)
+	ctrHookCompatibleDesc = prometheus.NewDesc(
+		"vgpu_container_hook_version_compatible",
+		"Whether the shared region version of the container is supported by the monitor",
+		[]string{"podnamespace", "podname", "ctrname", "version"}, nil,
+	)
+	ctrHookProcessesDesc = prometheus.NewDesc(
+		"vgpu_container_hook_processes",
+		"Number of processes registered in the shared region of the container",
+		[]string{"podnamespace", "podname", "ctrname"}, nil,
+	)
+	ctrHookLastUpdateDesc = prometheus.NewDesc(
+		"vgpu_container_hook_last_update_seconds",
+		"Seconds since the shared region of the container was last written",
+		[]string{"podnamespace", "podname", "ctrname"}, nil,
+	)
+)
+
+func describeHookHealth(ch chan<- *prometheus.Desc) {
+	ch <- ctrHookHealthyDesc
+	ch <- ctrHookRegionDesc
+	ch <- ctrHookCompatibleDesc
+	ch <- ctrHookProcessesDesc
+	ch <- ctrHookLastUpdateDesc
+}
+
+func collectHookHealth(ch chan<- prometheus.Metric, matched []matchedContainer, now time.Time) {
+	for _, mc := range matched {
+		c := mc.Usage
+		labels := []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName}
+		present := c.CacheFile != ""
+		compatible := c.Info != nil
+		procs := 0
+		if compatible {
+			procs = c.Info.ProcNum()
+		}
+		ch <- prometheus.MustNewConstMetric(ctrHookHealthyDesc, prometheus.GaugeValue,
+			boolToFloat(present && compatible && procs > 0), labels...)
+		ch <- prometheus.MustNewConstMetric(ctrHookRegionDesc, prometheus.GaugeValue,
+			boolToFloat(present), labels...)
+		if !present {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(ctrHookCompatibleDesc, prometheus.GaugeValue,
+			boolToFloat(compatible), append(labels, fmt.Sprintf("%d.%d", c.MajorVersion, c.MinorVersion))...)
+		ch <- prometheus.MustNewConstMetric(ctrHookProcessesDesc, prometheus.GaugeValue,
+			float64(procs), labels...)
+		if info, err := os.Stat(c.CacheFile); err == nil {
+			age := now.Sub(info.ModTime()).Seconds()
+			if age < 0 {
+				age = 0
+			}
+			ch <- prometheus.MustNewConstMetric(ctrHookLastUpdateDesc, prometheus.GaugeValue, age, labels...)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
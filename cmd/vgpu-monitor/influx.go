@@ -0,0 +1,190 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/klog/v2"
+)
+
+// InfluxSink periodically gathers the samples registered for the /metrics
+// endpoint and writes them in Influx line protocol, for agents (Telegraf,
+// vmagent, ...) which do not scrape Prometheus endpoints.
+type InfluxSink struct {
+	endpoint *url.URL
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+// NewInfluxSink returns an InfluxSink writing to endpoint. The scheme selects
+// the transport: udp, tcp, unix or unixgram for sockets, http or https for
+// the Influx write API.
+func NewInfluxSink(endpoint string, gatherer prometheus.Gatherer) (*InfluxSink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx endpoint %q: %v", endpoint, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("influx endpoint %q has no host", endpoint)
+		}
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return nil, fmt.Errorf("influx endpoint %q has no socket path", endpoint)
+		}
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported influx endpoint scheme %q", u.Scheme)
+	}
+	return &InfluxSink{
+		endpoint: u,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Run writes the gathered samples every interval, it never returns.
+func (s *InfluxSink) Run(interval time.Duration) {
+	klog.Infof("Writing influx line protocol to %s every %v", s.endpoint.Redacted(), interval)
+	for {
+		time.Sleep(interval)
+		if err := s.Flush(); err != nil {
+			klog.Errorf("Failed to write samples to influx endpoint: %v", err)
+		}
+	}
+}
+
+// Flush gathers the current samples and writes them to the endpoint.
+func (s *InfluxSink) Flush() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect along with the error.
+		klog.Warningf("Gathering metrics for influx returned error: %v", err)
+	}
+	var buf bytes.Buffer
+	writeLineProtocol(&buf, families, time.Now())
+	if buf.Len() == 0 {
+		return nil
+	}
+	return s.write(buf.Bytes())
+}
+
+func (s *InfluxSink) write(data []byte) error {
+	switch s.endpoint.Scheme {
+	case "http", "https":
+		resp, err := s.client.Post(s.endpoint.String(), "text/plain; charset=utf-8", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("influx write returned status %s", resp.Status)
+		}
+		return nil
+	case "unix", "unixgram":
+		return s.writeSocket(s.endpoint.Scheme, s.endpoint.Path, data)
+	default:
+		return s.writeSocket(s.endpoint.Scheme, s.endpoint.Host, data)
+	}
+}
+
+// writeSocket sends data over a fresh connection, datagram transports get
+// one line per packet so that no packet exceeds the receiver's buffer.
+func (s *InfluxSink) writeSocket(network, address string, data []byte) error {
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if network == "udp" || network == "unixgram" {
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			if _, err := conn.Write(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// writeLineProtocol renders every gauge, counter and untyped sample as one
+// line: the metric family name is the measurement, labels become tags and
+// the sample is written in the "value" field.
+func writeLineProtocol(w *bytes.Buffer, families []*dto.MetricFamily, now time.Time) {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			w.WriteString(escapeInflux(mf.GetName(), measurementEscaper))
+			pairs := m.GetLabel()
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+			for _, lp := range pairs {
+				// Influx rejects empty tag values.
+				if lp.GetValue() == "" {
+					continue
+				}
+				w.WriteByte(',')
+				w.WriteString(escapeInflux(lp.GetName(), tagEscaper))
+				w.WriteByte('=')
+				w.WriteString(escapeInflux(lp.GetValue(), tagEscaper))
+			}
+			w.WriteString(" value=")
+			w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+			w.WriteByte(' ')
+			w.WriteString(ts)
+			w.WriteByte('\n')
+		}
+	}
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+func escapeInflux(s string, r *strings.Replacer) string {
+	return r.Replace(s)
+}
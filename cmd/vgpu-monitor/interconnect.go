@@ -0,0 +1,119 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Descriptors of the interconnect traffic of the devices, only exported with
+// --collect-interconnect-metrics.
+var (
+	hostGPUPcieThroughputDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_pcie_throughput_bytes_per_second",
+		"PCIe throughput of the GPU sampled by the driver over 20ms, by direction: tx or rx",
+		[]string{"deviceidx", "deviceuuid", "direction"}, nil,
+	)
+	hostGPUPcieReplaysDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_pcie_replays_total",
+		"PCIe replays of the GPU, a growing count is a sign of a degraded link",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUNvLinkDataDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_nvlink_data_bytes_total",
+		"Data transferred over an NVLink of the GPU, by link and direction: tx or rx",
+		[]string{"deviceidx", "deviceuuid", "link", "direction"}, nil,
+	)
+)
+
+func describeInterconnect(ch chan<- *prometheus.Desc) {
+	if !collectInterconnectMetrics {
+		return
+	}
+	ch <- hostGPUPcieThroughputDesc
+	ch <- hostGPUPcieReplaysDesc
+	ch <- hostGPUNvLinkDataDesc
+}
+
+// collectInterconnect exports the PCIe throughput and replays of the device
+// and the data counters of its active NVLinks, those the device doesn't
+// support are left out.
+func collectInterconnect(ch chan<- prometheus.Metric, hdev nvml.Device, idx string, uuid string) {
+	// The throughput is reported in KB/s.
+	for counter, direction := range map[nvml.PcieUtilCounter]string{nvml.PCIE_UTIL_TX_BYTES: "tx", nvml.PCIE_UTIL_RX_BYTES: "rx"} {
+		kbps, ret := hdev.GetPcieThroughput(counter)
+		if ret != nvml.SUCCESS {
+			nvidia.RecordNVMLError("GetPcieThroughput", ret)
+			klog.V(4).Infof("nvml get PCIe %s throughput of device %s error ret=%v", direction, uuid, ret)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(hostGPUPcieThroughputDesc, prometheus.GaugeValue, float64(kbps)*1024, idx, uuid, direction)
+	}
+	if replays, ret := hdev.GetPcieReplayCounter(); ret == nvml.SUCCESS {
+		ch <- prometheus.MustNewConstMetric(hostGPUPcieReplaysDesc, prometheus.CounterValue, float64(replays), idx, uuid)
+	}
+
+	for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+		state, ret := hdev.GetNvLinkState(link)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			// No NVLink on this device, or no more links.
+			return
+		}
+		if ret != nvml.SUCCESS || state != nvml.FEATURE_ENABLED {
+			continue
+		}
+		values := []nvml.FieldValue{
+			{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX, ScopeId: uint32(link)},
+			{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX, ScopeId: uint32(link)},
+		}
+		if ret := hdev.GetFieldValues(values); ret != nvml.SUCCESS {
+			nvidia.RecordNVMLError("GetFieldValues", ret)
+			klog.V(4).Infof("nvml get NVLink throughput of device %s link %d error ret=%v", uuid, link, ret)
+			continue
+		}
+		for i, direction := range []string{"tx", "rx"} {
+			kib, ok := fieldUint64(values[i])
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(hostGPUNvLinkDataDesc, prometheus.CounterValue, float64(kib)*1024,
+				idx, uuid, fmt.Sprint(link), direction)
+		}
+	}
+}
+
+// fieldUint64 returns the value of an unsigned field, false when it failed
+// or is of another type.
+func fieldUint64(v nvml.FieldValue) (uint64, bool) {
+	if nvml.Return(v.NvmlReturn) != nvml.SUCCESS {
+		return 0, false
+	}
+	switch nvml.ValueType(v.ValueType) {
+	case nvml.VALUE_TYPE_UNSIGNED_INT:
+		return uint64(binary.LittleEndian.Uint32(v.Value[:4])), true
+	case nvml.VALUE_TYPE_UNSIGNED_LONG, nvml.VALUE_TYPE_UNSIGNED_LONG_LONG:
+		return binary.LittleEndian.Uint64(v.Value[:]), true
+	}
+	return 0, false
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// nodeName is the node the monitor runs on, resolved by resolveNodeName.
+var nodeName string
+
+// resolveNodeName returns the node of the NODE_NAME env, set from the
+// downward API, or the hostname the kubelet registers the node as by
+// default.
+func resolveNodeName() (string, error) {
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("NODE_NAME not set and no hostname: %v", err)
+	}
+	return strings.ToLower(hostname), nil
+}
+
+// constLabels returns the labels added to all the metrics: the zone, the
+// node and the static labels, which must not override the first two.
+func constLabels(zone, node string, static map[string]string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{"zone": zone, "node": node}
+	for name, value := range static {
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid static label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("static label %q overrides a label of the monitor", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
@@ -17,24 +17,337 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/dcgm"
 	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/profiling"
+	"volcano.sh/k8s-device-plugin/pkg/tenant"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
 	"k8s.io/klog/v2"
 )
 
-func main() {
+// shutdownGracePeriod is how long the requests in flight are given to
+// complete on shutdown.
+const shutdownGracePeriod = 5 * time.Second
+
+var (
+	metricsBindAddress     string
+	metricsTLSCertFile     string
+	metricsTLSKeyFile      string
+	metricsTLSClientCAFile string
+	legacyMetrics          bool
+	hostMetrics            bool
+	containerMetrics       bool
+	sampleInterval         time.Duration
+	pprofEnabled           bool
+	containerWatch         bool
+	terminatedRetention    time.Duration
+	containerResync        time.Duration
+
+	influxEndpoint    string
+	influxInterval    time.Duration
+	otlpEndpoint      string
+	otlpInterval      time.Duration
+	otlpHeaders       []string
+	webhookConfigFile string
+	webhookInterval   time.Duration
+
+	coreComplianceWindow time.Duration
+	processMetrics       bool
+
+	metricsSource   string
+	dcgmExporterURL string
+
+	collectHardwareMetrics     bool
+	collectInterconnectMetrics bool
+
+	grpcBindAddress    string
+	grpcStreamInterval time.Duration
+
+	predictionInterval    time.Duration
+	predictionHalfLife    time.Duration
+	predictionHorizon     time.Duration
+	predictionAnnotations bool
+
+	reclaimInterval time.Duration
+	reclaimCooldown time.Duration
+	reclaimDryRun   bool
+
+	memoryPressureInterval  time.Duration
+	memoryPressureThreshold float64
+	memoryPressureDryRun    bool
+
+	memoryResizeInterval time.Duration
+
+	coreQoSInterval      time.Duration
+	coreQoSBurst         uint
+	coreQoSBurstDuration time.Duration
+
+	eventInterval    time.Duration
+	eventJournalSize int
+
+	oomLogDir   string
+	oomInterval time.Duration
+
+	accessTrace         bool
+	bpftracePath        string
+	accessTraceInterval time.Duration
+
+	namespaceLabels      []string
+	namespaceAnnotations []string
+	podLabelAllowlist    []string
+	exemplars            bool
+	namespaceAllowlist   []string
+	namespaceDenylist    []string
+	staticLabels         map[string]string
+
+	rootCmd = &cobra.Command{
+		Use:   "vgpu-monitor",
+		Short: "kubernetes vgpu monitor",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := start(); err != nil {
+				klog.Fatal(err)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.Flags().SortFlags = false
+	rootCmd.PersistentFlags().SortFlags = false
+
+	rootCmd.Flags().StringVar(&metricsBindAddress, "metrics-bind-address", ":9394", "the address the metrics endpoint binds to")
+	rootCmd.Flags().BoolVar(&legacyMetrics, "legacy-metrics", time.Now().Before(legacyMetricsUntil), "also export the metrics under their deprecated names, by default until "+legacyMetricsUntil.Format("2006-01-02"))
+	rootCmd.Flags().BoolVar(&hostMetrics, "host-metrics", true, "export the metrics of the GPUs of the node")
+	rootCmd.Flags().BoolVar(&containerMetrics, "container-metrics", true, "export the metrics of the vGPU containers, off for the nodes without vGPU")
+	rootCmd.Flags().DurationVar(&sampleInterval, "sample-interval", 10*time.Second, "the interval between two samplings of the metrics in the background, the scrapes serving the last one; collected on every scrape when 0")
+	rootCmd.Flags().StringVar(&metricsTLSCertFile, "metrics-tls-cert-file", "", "the certificate the metrics endpoint serves HTTPS with, plain HTTP when empty")
+	rootCmd.Flags().StringVar(&metricsTLSKeyFile, "metrics-tls-key-file", "", "the private key of the metrics certificate")
+	rootCmd.Flags().StringVar(&metricsTLSClientCAFile, "metrics-tls-client-ca-file", "", "the CA the client certificates must be signed by, not verified when empty")
+	rootCmd.Flags().BoolVar(&containerWatch, "container-watch", false, "keep the containers of the hook path current with inotify, rather than scanning the path on every scrape")
+	rootCmd.Flags().DurationVar(&containerResync, "container-resync-interval", time.Minute, "the interval between two scans of the hook path with --container-watch, for the containers of the pods deleted")
+	rootCmd.Flags().DurationVar(&terminatedRetention, "terminated-retention", 5*time.Minute, "how long the last usage of the containers which exited is exported with terminated=\"true\", disabled when 0")
+	rootCmd.Flags().BoolVar(&pprofEnabled, "pprof", false, "serve the profiles of the runtime on /debug/pprof/ and export the Go runtime and process metrics on the metrics endpoint")
+	rootCmd.Flags().StringVar(&influxEndpoint, "influx-endpoint", "", "write samples in Influx line protocol to this endpoint, one of:\n\t\t[udp://host:port | tcp://host:port | unix:///path | http(s)://host:port/write?db=...]")
+	rootCmd.Flags().DurationVar(&influxInterval, "influx-interval", 15*time.Second, "the interval between two writes to the Influx endpoint")
+	rootCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "push the samples with OTLP/HTTP to this metrics receiver of an OpenTelemetry collector, e.g. http://otel-collector:4318/v1/metrics")
+	rootCmd.Flags().DurationVar(&otlpInterval, "otlp-interval", 15*time.Second, "the interval between two pushes to the OTLP endpoint")
+	rootCmd.Flags().StringSliceVar(&otlpHeaders, "otlp-header", nil, "the key=value headers added to the OTLP requests, e.g. for authentication")
+
+	rootCmd.Flags().StringVar(&webhookConfigFile, "webhook-config", "", "the file defining the webhooks fired on usage threshold breaches and unhealthy devices")
+	rootCmd.Flags().DurationVar(&webhookInterval, "webhook-interval", 30*time.Second, "the interval between two evaluations of the webhook conditions")
+
+	rootCmd.Flags().DurationVar(&coreComplianceWindow, "core-compliance-window", 5*time.Minute, "the sliding window over which container SM utilization is compared with its core limit")
+	rootCmd.Flags().StringVar(&metricsSource, "metrics-source", "nvml", "where the memory and utilization of the GPUs are read from: nvml, or dcgm for the profiling metrics too")
+	rootCmd.Flags().StringVar(&dcgmExporterURL, "dcgm-exporter-url", dcgm.DefaultURL, "the metrics endpoint of the dcgm-exporter the dcgm source reads")
+	rootCmd.Flags().BoolVar(&collectHardwareMetrics, "collect-hardware-metrics", false, "export the temperature, power draw and limit, clocks and throttle reasons of the GPUs")
+	rootCmd.Flags().BoolVar(&collectInterconnectMetrics, "collect-interconnect-metrics", false, "export the PCIe throughput and replays and the NVLink traffic of the GPUs, sampling the PCIe throughput takes 40ms per GPU")
+	rootCmd.Flags().BoolVar(&processMetrics, "process-metrics", false, "export the memory and SM utilization of every process on the GPUs, a series per process")
+
+	rootCmd.Flags().StringVar(&grpcBindAddress, "grpc-bind-address", "", "the address the VGPUMonitor gRPC service binds to, disabled when empty")
+	rootCmd.Flags().DurationVar(&grpcStreamInterval, "grpc-stream-interval", 5*time.Second, "the default and shortest interval between two usage updates of a gRPC stream")
+
+	rootCmd.Flags().DurationVar(&predictionInterval, "prediction-interval", 0, "the interval between two samples of the usage predictions, disabled when 0")
+	rootCmd.Flags().DurationVar(&predictionHalfLife, "prediction-half-life", 5*time.Minute, "the half-life of the exponentially weighted usage predictions")
+	rootCmd.Flags().DurationVar(&predictionHorizon, "prediction-horizon", 5*time.Minute, "how far ahead the usage is predicted")
+	rootCmd.Flags().BoolVar(&predictionAnnotations, "prediction-annotations", false, "annotate the usage predictions on the node and its pods")
+
+	rootCmd.Flags().DurationVar(&reclaimInterval, "reclaim-interval", 0, "the interval between two reclamations of the memory of guaranteed vGPUs from over-limit best-effort co-tenants, disabled when 0")
+	rootCmd.Flags().DurationVar(&reclaimCooldown, "reclaim-cooldown", 2*time.Minute, "how long an evicted pod is left to terminate before it may be evicted again")
+	rootCmd.Flags().BoolVar(&reclaimDryRun, "reclaim-dry-run", true, "only log and count the evictions the reclamation would do")
+	rootCmd.Flags().DurationVar(&memoryPressureInterval, "memory-pressure-interval", 0, "the interval between two checks of the physical memory used on the GPUs against --memory-pressure-threshold, disabled when 0")
+	rootCmd.Flags().Float64Var(&memoryPressureThreshold, "memory-pressure-threshold", 0.95, "the share of the physical memory of a GPU used above which pods of the GPU are evicted, the best-effort ones first")
+	rootCmd.Flags().BoolVar(&memoryPressureDryRun, "memory-pressure-dry-run", true, "only alert on and count the evictions the memory pressure would do")
+
+	rootCmd.Flags().DurationVar(&memoryResizeInterval, "memory-resize-interval", 0, "the interval between two resizes of the vGPU memory of the running containers from the "+MemoryResizeAnnotation+" annotation of their pod, disabled when 0")
+	rootCmd.Flags().DurationVar(&coreQoSInterval, "core-qos-interval", 0, "the interval between two updates of the token buckets enforcing the vgpu-cores of the containers as a guaranteed share of the SM time, best-effort throttling by libvgpu when 0")
+	rootCmd.Flags().UintVar(&coreQoSBurst, "core-qos-burst", 0, "the SM percents a vGPU may run over its vgpu-cores while its bucket has tokens, overridden by the "+CoreBurstAnnotation+" annotation of the pod")
+	rootCmd.Flags().DurationVar(&coreQoSBurstDuration, "core-qos-burst-duration", 30*time.Second, "how long a vGPU idle enough to fill its bucket may burst")
+	rootCmd.Flags().UintVar(&config.GPUMemoryFactor, "gpu-memory-factor", 1, "the unit of the vGPU memory in MB, the same as the device plugin")
+
+	rootCmd.Flags().DurationVar(&eventInterval, "event-interval", 10*time.Second, "the interval between two detections of the container and device events, disabled when 0")
+	rootCmd.Flags().IntVar(&eventJournalSize, "event-journal-size", 1000, "the number of events kept in memory for the event stream")
+	rootCmd.Flags().StringVar(&oomLogDir, "oom-log-dir", "/hostvar/log/pods", "the pod log directory of the kubelet the allocations denied by the vGPU hook are read from, disabled when empty")
+	rootCmd.Flags().DurationVar(&oomInterval, "oom-interval", 10*time.Second, "the interval between two reads of the allocations denied by the vGPU hook, disabled when 0")
+
+	rootCmd.Flags().BoolVar(&accessTrace, "access-trace", false, "trace with eBPF the openat and ioctl calls on the NVIDIA device nodes by container")
+	rootCmd.Flags().StringVar(&bpftracePath, "bpftrace-path", "bpftrace", "the bpftrace binary running the access tracing")
+	rootCmd.Flags().DurationVar(&accessTraceInterval, "access-trace-interval", 10*time.Second, "the interval between two reads of the access counts from the kernel")
+
+	rootCmd.Flags().StringVar(&config.NvmlLibraryPath, "nvml-library", "", "the libnvidia-ml library to load, searched for in the dynamic linker path and the driver directories when empty")
+
+	rootCmd.Flags().StringSliceVar(&namespaceLabels, "namespace-label", nil, "the namespace labels attached to the container metrics, e.g. team")
+	rootCmd.Flags().StringSliceVar(&namespaceAnnotations, "namespace-annotation", nil, "the namespace annotations attached to the container metrics, e.g. cost-center")
+	rootCmd.Flags().StringToStringVar(&staticLabels, "static-labels", nil, "the labels added to all the metrics besides zone and node, e.g. cluster=prod,region=eu")
+	rootCmd.Flags().StringArrayVar(&namespaceAllowlist, "namespace-allowlist", nil, "only export the container metrics of these namespaces, comma-separated names or a label selector such as team=ml, repeatable")
+	rootCmd.Flags().StringArrayVar(&namespaceDenylist, "namespace-denylist", nil, "do not export the container metrics of these namespaces, comma-separated names or a label selector such as tier!=gpu, repeatable")
+	rootCmd.Flags().StringSliceVar(&podLabelAllowlist, "pod-label-allowlist", nil, "the pod labels attached to the container metrics as label_<name>, e.g. team,volcano.sh/job-name")
+	rootCmd.Flags().BoolVar(&exemplars, "exemplars", false, "attach the pod UID and the container ID to the container counters as exemplars, served to the OpenMetrics scrapers")
+
+	rootCmd.Flags().StringVar(&util.LogFormat, "log-format", util.LogFormatText, "the format of the logs: text or json")
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	klog.InitFlags(fs)
+	rootCmd.PersistentFlags().AddGoFlagSet(fs)
+}
+
+func start() error {
+	if err := util.SetupLogging(); err != nil {
+		return err
+	}
 	if err := ValidateEnvVars(); err != nil {
 		klog.Fatalf("Failed to validate environment variables: %v", err)
 	}
+	if legacyMetrics {
+		klog.Warningf("Exporting the deprecated metric names too, they are off by default from %s and will be removed, move to the volcano_vgpu_ ones", legacyMetricsUntil.Format("2006-01-02"))
+	}
+	if path, err := config.LoadNvmlLibrary(); err != nil {
+		klog.Errorf("Failed to find NVML: %v", err)
+	} else {
+		klog.Infof("Using NVML library %s", path)
+	}
+	var err error
+	if nodeName, err = resolveNodeName(); err != nil {
+		return err
+	}
 	containerLister, err := nvidia.NewContainerLister()
 	if err != nil {
 		klog.Fatalf("Failed to create container lister: %v", err)
 	}
-	errchannel := make(chan error)
-	go initMetrics(containerLister)
-	go watchAndFeedback(containerLister)
-	for {
-		err := <-errchannel
-		klog.Errorf("failed to serve: %v", err)
+	// Since we are dealing with custom Collector implementations, it might
+	// be a good idea to try it out with a pedantic registry.
+	reg := prometheus.NewRegistry()
+	//reg := prometheus.NewPedanticRegistry()
+	if pprofEnabled {
+		reg.MustRegister(profiling.RuntimeCollectors()...)
+	}
+
+	// Construct cluster managers. In real code, we would assign them to
+	// variables to then do something with them.
+	// The informers and the servers stop on SIGTERM, as the DaemonSet pod
+	// is deleted, or SIGINT.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	cm, err := NewClusterManager("vGPU", reg, containerLister, ctx.Done())
+	if err != nil {
+		return err
+	}
+	// The container metrics of the namespaces not selected are dropped.
+	filter, err := tenant.NewNamespaceFilter(containerLister.Clientset(), namespaceAllowlist, namespaceDenylist, ctx.Done())
+	if err != nil {
+		return err
+	}
+	// The others get the tenant labels of their namespace.
+	gatherer := tenant.NewResolver(containerLister.Clientset(), namespaceLabels, namespaceAnnotations, ctx.Done()).Gatherer(filter.Gatherer(reg, "podnamespace"), "podnamespace")
+	// And the allowed labels of their pod.
+	gatherer = tenant.NewPodLabels(cm.PodLister, podLabelAllowlist).Gatherer(gatherer, "podnamespace", "podname")
+	// And the exemplars of their pod and container.
+	gatherer = tenant.NewPodExemplars(cm.PodLister, exemplars).Gatherer(gatherer, "podnamespace", "podname", "ctrname")
+
+	if influxEndpoint != "" {
+		sink, err := NewInfluxSink(influxEndpoint, gatherer)
+		if err != nil {
+			klog.Fatalf("Failed to create influx sink: %v", err)
+		}
+		go sink.Run(influxInterval)
+	}
+	if otlpEndpoint != "" {
+		sink, err := NewOTLPSink(otlpEndpoint, otlpHeaders, gatherer)
+		if err != nil {
+			klog.Fatalf("Failed to create otlp sink: %v", err)
+		}
+		go sink.Run(otlpInterval)
+	}
+	if webhookConfigFile != "" {
+		notifier, err := NewWebhookNotifier(webhookConfigFile, cm)
+		if err != nil {
+			klog.Fatalf("Failed to load webhook config: %v", err)
+		}
+		go notifier.Run(webhookInterval)
+	}
+	var servers sync.WaitGroup
+	errchannel := make(chan error, 1)
+	if grpcBindAddress != "" {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			if err := serveGRPC(ctx, grpcBindAddress, cm, grpcStreamInterval); err != nil {
+				klog.Errorf("failed to serve gRPC: %v", err)
+			}
+		}()
+	}
+	if cm.usagePredictor != nil {
+		go cm.usagePredictor.Run(cm, predictionInterval, predictionAnnotations)
+	}
+	if cm.reclaimer != nil {
+		go cm.reclaimer.Run(cm, reclaimInterval)
+	}
+	if cm.pressure != nil {
+		go cm.pressure.Run(cm, memoryPressureInterval)
+	}
+	if cm.resizer != nil {
+		go cm.resizer.Run(cm, memoryResizeInterval)
+	}
+	if cm.coreQoS != nil {
+		go cm.coreQoS.Run(cm, coreQoSInterval)
+	}
+	if cm.events != nil {
+		go newEventDetector(cm.events).Run(cm, eventInterval)
+	}
+	if cm.ooms != nil {
+		go cm.ooms.Run(cm, oomInterval)
+	}
+	if cm.accessTracer != nil {
+		go cm.accessTracer.Run()
+	}
+	if cm.sampler != nil {
+		go cm.sampler.Run(cm.collects(), sampleInterval)
+	}
+	go cm.handshakes.Run(cm, 5*time.Second)
+	go cm.xids.Run()
+	go containerLister.Devices().Watch(30 * time.Second)
+	servers.Add(1)
+	go func() {
+		defer servers.Done()
+		if err := initMetrics(ctx, gatherer, cm); err != nil {
+			errchannel <- err
+		}
+	}()
+	if containerWatch {
+		go func() {
+			if err := containerLister.Watch(containerResync, ctx.Done()); err != nil {
+				klog.Errorf("Failed to watch the containers, scanning them on every update: %v", err)
+			}
+		}()
+	}
+	go watchAndFeedback(containerLister, cm.coreQoS, cm.inversions)
+
+	select {
+	case <-ctx.Done():
+		klog.Info("Shutting down")
+	case err = <-errchannel:
+		err = fmt.Errorf("failed to serve metrics: %v", err)
+	}
+	stop()
+	servers.Wait()
+	cm.Close()
+	return err
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		klog.Fatal(err)
 	}
 }
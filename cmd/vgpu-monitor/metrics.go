@@ -17,41 +17,78 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
-	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/profiling"
 
-	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
 // ClusterManager is an example for a system that might have been built without
 // Prometheus in mind. It models a central manager of jobs running in a
-// cluster. Thus, we implement a custom Collector called
-// ClusterManagerCollector, which collects information from a ClusterManager
-// using its provided methods and turns them into Prometheus Metrics for
+// cluster. Thus, we implement the custom Collectors HostDeviceCollector and
+// ContainerVGPUCollector, which collect information from a ClusterManager
+// using its provided methods and turn them into Prometheus Metrics for
 // collection.
 //
 // An additional challenge is that multiple instances of the ClusterManager are
 // run within the same binary, each in charge of a different zone. We need to
-// make use of wrapping Registerers to be able to register each
-// ClusterManagerCollector instance with Prometheus.
+// make use of wrapping Registerers to be able to register the collectors of
+// each instance with Prometheus.
 type ClusterManager struct {
 	Zone string
 	// Contains many more fields not listed in this example.
 	PodLister       listerscorev1.PodLister
+	podsSynced      cache.InformerSynced
 	containerLister *nvidia.ContainerLister
+	// source reads the memory and utilization of the GPUs.
+	source    nvidia.Source
+	telemetry *collectorTelemetry
+	// host and containers are nil when their metrics are disabled.
+	host       *HostDeviceCollector
+	containers *ContainerVGPUCollector
+	// sampler is nil unless the metrics are sampled in the background.
+	sampler        *metricsSampler
+	processSampler *processSampler
+	coreCompliance *coreCompliance
+	memViolations  *memoryViolations
+	utilHistory    *utilizationHistory
+	handshakes     *handshakeTracker
+	xids           *xidWatcher
+	// usagePredictor is nil unless the predictions are enabled.
+	usagePredictor *usagePredictor
+	// reclaimer is nil unless the memory reclamation is enabled.
+	reclaimer *memoryReclaimer
+	// pressure is nil unless the memory pressure of the GPUs is checked.
+	pressure *memoryPressure
+	// resizer is nil unless the memory resizes are enabled.
+	resizer *memoryResizer
+	// coreQoS is nil unless the cores are enforced as token buckets.
+	coreQoS    *coreQoS
+	inversions *priorityInversions
+	// accessTracer is nil unless the access tracing is enabled.
+	accessTracer *accessTracer
+	// events is nil unless the event journal is enabled.
+	events *eventJournal
+	// ooms is nil unless the out of memory errors are watched.
+	ooms *oomWatcher
+	// terminated is nil unless the usage of the terminated containers is
+	// retained.
+	terminated *terminatedContainers
+	// unregister removes the collectors from the registry.
+	unregister func()
 }
 
 // ReallyExpensiveAssessmentOfTheSystemState is a mock for the data gathering a
@@ -73,12 +110,76 @@ func (c *ClusterManager) ReallyExpensiveAssessmentOfTheSystemState() (
 	return
 }
 
-// ClusterManagerCollector implements the Collector interface.
-type ClusterManagerCollector struct {
+// The names of the collectors, the sampler keeps a sample of each.
+const (
+	hostCollector      = "host"
+	containerCollector = "container"
+)
+
+// collectLog logs the errors of the collections at most once a minute, the
+// collections run on every scrape.
+var collectLog = util.NewRateLimitedLog(time.Minute)
+
+// HostDeviceCollector implements the Collector interface for the metrics of
+// the GPUs of the node, which don't need vGPU containers.
+type HostDeviceCollector struct {
+	ClusterManager *ClusterManager
+	scrapes        scrapeDeduper
+}
+
+// ContainerVGPUCollector implements the Collector interface for the metrics
+// of the vGPU containers and their processes.
+type ContainerVGPUCollector struct {
 	ClusterManager *ClusterManager
+	scrapes        scrapeDeduper
 }
 
-// Descriptors used by the ClusterManagerCollector below.
+// Descriptors used by the collectors below, following the Prometheus naming
+// conventions.
+var (
+	hostGPUMemoryUsedDesc = prometheus.NewDesc(
+		"volcano_vgpu_host_gpu_memory_used_bytes",
+		"Device memory used on the GPU",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostGPUUtilizationDesc = prometheus.NewDesc(
+		"volcano_vgpu_host_gpu_utilization_ratio",
+		"Share of the time the GPU was running kernels",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	ctrMemoryUsedDesc = prometheus.NewDesc(
+		"volcano_vgpu_container_memory_used_bytes",
+		"Device memory used by the container on the vGPU",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrMemoryLimitDesc = prometheus.NewDesc(
+		"volcano_vgpu_container_memory_limit_bytes",
+		"Device memory limit of the container on the vGPU",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrMemoryBreakdownDesc = prometheus.NewDesc(
+		"volcano_vgpu_container_memory_breakdown_bytes",
+		"Device memory used by the container on the vGPU by kind: context, module or data",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid", "kind"}, nil,
+	)
+	ctrSmUtilizationDesc = prometheus.NewDesc(
+		"volcano_vgpu_container_sm_utilization_ratio",
+		"SM utilization of the container on the vGPU",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrLastKernelAgeDesc = prometheus.NewDesc(
+		"volcano_vgpu_container_last_kernel_age_seconds",
+		"Seconds since the container last launched a kernel",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+)
+
+// legacyMetricsUntil ends the deprecation window of the legacy metric names
+// below, --legacy-metrics is off by default after it and the names will be
+// removed.
+var legacyMetricsUntil = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// Descriptors of the legacy metric names, exported with --legacy-metrics.
 var (
 	hostGPUdesc = prometheus.NewDesc(
 		"HostGPUMemoryUsage",
@@ -123,200 +224,463 @@ var (
 // Describe is implemented with DescribeByCollect. That's possible because the
 // Collect method will always return the same two metrics with the same two
 // descriptors.
-func (cc ClusterManagerCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- hostGPUdesc
-	ch <- ctrvGPUdesc
-	ch <- ctrvGPUlimitdesc
-	ch <- hostGPUUtilizationdesc
+func (hc *HostDeviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hostGPUMemoryUsedDesc
+	ch <- hostGPUUtilizationDesc
+	if legacyMetrics {
+		ch <- hostGPUdesc
+		ch <- hostGPUUtilizationdesc
+	}
+	describeDevice(ch)
+	describeMig(ch)
+	describeProfiling(ch)
+	describeHardware(ch)
+	describeInterconnect(ch)
+	describeXid(ch)
 	//prometheus.DescribeByCollect(cc, ch)
 }
 
+func (cc *ContainerVGPUCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ctrMemoryUsedDesc
+	ch <- ctrMemoryLimitDesc
+	ch <- ctrMemoryBreakdownDesc
+	ch <- ctrSmUtilizationDesc
+	ch <- ctrLastKernelAgeDesc
+	if legacyMetrics {
+		ch <- ctrvGPUdesc
+		ch <- ctrvGPUlimitdesc
+		ch <- ctrDeviceMemorydesc
+		ch <- ctrDeviceUtilizationdesc
+		ch <- ctrDeviceLastKernelDesc
+	}
+	describeHookHealth(ch)
+	describeRegion(ch)
+	describeContainerUtilization(ch)
+	describeCoreCompliance(ch)
+	describeMemoryViolations(ch)
+	describeUtilizationHistory(ch)
+	describePrediction(ch)
+	describeReclaim(ch)
+	describeMemoryPressure(ch)
+	describeSpill(ch)
+	describeResize(ch)
+	describeCoreQoS(ch)
+	describePriority(ch)
+	describeOOM(ch)
+	describeAccess(ch)
+	describeScrape(ch)
+	describeProcesses(ch)
+	describeTerminated(ch)
+}
+
 // Collect first triggers the ReallyExpensiveAssessmentOfTheSystemState. Then it
 // creates constant metrics for each host on the fly based on the returned data.
 //
-// Note that Collect could be called concurrently, so we depend on
-// ReallyExpensiveAssessmentOfTheSystemState to be concurrency-safe.
-func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
-	klog.Info("Starting to collect metrics for vGPUMonitor")
-	containerLister := cc.ClusterManager.containerLister
-	if err := containerLister.Update(); err != nil {
-		klog.Error("Update container error: %s", err.Error())
+// Note that Collect could be called concurrently, the concurrent calls share
+// the metrics of a single collection. With a --sample-interval, Collect only
+// serves the last metrics sampled in the background.
+func (hc *HostDeviceCollector) Collect(ch chan<- prometheus.Metric) {
+	hc.ClusterManager.serve(ch, hostCollector, &hc.scrapes, hc.collect)
+}
+
+func (cc *ContainerVGPUCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.ClusterManager.serve(ch, containerCollector, &cc.scrapes, cc.collect)
+}
+
+// serve sends the metrics of the named collector, from the last sample or
+// from the collection in flight.
+func (c *ClusterManager) serve(ch chan<- prometheus.Metric, name string, scrapes *scrapeDeduper, collect func(chan<- prometheus.Metric)) {
+	if s := c.sampler; s != nil {
+		s.collect(name, ch)
+		return
 	}
+	for _, m := range scrapes.do(collect) {
+		ch <- m
+	}
+}
 
-	nvret := config.Nvml().Init()
-	if nvret != nvml.SUCCESS {
-		klog.Errorf("nvml Init err= %v", nvret)
+// collects returns the collections of the enabled collectors, by name.
+func (c *ClusterManager) collects() map[string]func(chan<- prometheus.Metric) {
+	res := make(map[string]func(chan<- prometheus.Metric))
+	if c.host != nil {
+		res[hostCollector] = c.host.collect
 	}
-	devnum, nvret := config.Nvml().DeviceGetCount()
-	if nvret != nvml.SUCCESS {
-		klog.Errorf("nvml GetDeviceCount err= %v", nvret)
-	} else {
-		for ii := 0; ii < devnum; ii++ {
-			hdev, nvret := config.Nvml().DeviceGetHandleByIndex(ii)
-			if nvret != nvml.SUCCESS {
-				klog.Error(nvret)
-			}
-			memoryUsed := 0
-			memory, ret := hdev.GetMemoryInfo()
-			if ret == nvml.SUCCESS {
-				memoryUsed = int(memory.Used)
-			} else {
-				klog.Error("nvml get memory error ret=", ret)
-			}
+	if c.containers != nil {
+		res[containerCollector] = c.containers.collect
+	}
+	return res
+}
 
-			uuid, nvret := hdev.GetUUID()
-			if nvret != nvml.SUCCESS {
-				klog.Error(nvret)
-			} else {
-				ch <- prometheus.MustNewConstMetric(
-					hostGPUdesc,
-					prometheus.GaugeValue,
-					float64(memoryUsed),
-					fmt.Sprint(ii), uuid,
-				)
-			}
-			util, nvret := hdev.GetUtilizationRates()
-			if nvret != nvml.SUCCESS {
-				klog.Error(nvret)
-			} else {
+func (hc *HostDeviceCollector) collect(ch chan<- prometheus.Metric) {
+	klog.V(4).InfoS("Collecting the host metrics")
+	start := time.Now()
+	defer func() { hc.ClusterManager.telemetry.observe(hostCollector, time.Since(start)) }()
+
+	devices := hc.ClusterManager.containerLister.Devices().Devices()
+	deviceStats := hc.ClusterManager.source.Sample(devices)
+	for _, d := range devices {
+		ii, hdev, uuid := d.Index, d.Handle, d.UUID
+		stats := deviceStats[uuid]
+		memoryUsed := 0
+		if stats.HasMemory {
+			memoryUsed = int(stats.MemoryUsed)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			hostGPUMemoryUsedDesc,
+			prometheus.GaugeValue,
+			float64(memoryUsed),
+			fmt.Sprint(ii), uuid,
+		)
+		if legacyMetrics {
+			ch <- prometheus.MustNewConstMetric(
+				hostGPUdesc,
+				prometheus.GaugeValue,
+				float64(memoryUsed),
+				fmt.Sprint(ii), uuid,
+			)
+		}
+		if stats.HasUtilization {
+			ch <- prometheus.MustNewConstMetric(
+				hostGPUUtilizationDesc,
+				prometheus.GaugeValue,
+				stats.Utilization,
+				fmt.Sprint(ii), uuid,
+			)
+			if legacyMetrics {
 				ch <- prometheus.MustNewConstMetric(
 					hostGPUUtilizationdesc,
 					prometheus.GaugeValue,
-					float64(util.Gpu),
+					stats.Utilization*100,
 					fmt.Sprint(ii), uuid,
 				)
 			}
+		}
+		collectProfiling(ch, stats, fmt.Sprint(ii), uuid)
+		collectDeviceProcesses(ch, listDeviceProcesses(hdev, fmt.Sprint(ii), uuid))
+		collectNvLinkErrors(ch, hdev, fmt.Sprint(ii), uuid)
+		collectMemoryRetirement(ch, hdev, fmt.Sprint(ii), uuid)
+		collectEccErrors(ch, hdev, fmt.Sprint(ii), uuid)
+		if collectHardwareMetrics {
+			collectHardware(ch, hdev, fmt.Sprint(ii), uuid)
+		}
+		if collectInterconnectMetrics {
+			collectInterconnect(ch, hdev, fmt.Sprint(ii), uuid)
+		}
+	}
+	migDevices := hc.ClusterManager.containerLister.Devices().MigDevices()
+	collectMig(ch, migDevices, hc.ClusterManager.source.Sample(migDevices))
+	hc.ClusterManager.xids.collect(ch)
+}
 
+func (cc *ContainerVGPUCollector) collect(ch chan<- prometheus.Metric) {
+	klog.V(4).InfoS("Collecting the container metrics")
+	start := time.Now()
+	defer func() { cc.ClusterManager.telemetry.observe(containerCollector, time.Since(start)) }()
+	containerLister := cc.ClusterManager.containerLister
+	if err := containerLister.Update(); err != nil {
+		collectLog.ErrorS(err, "Failed to update the containers")
+	}
+
+	// The driver samples of the processes attribute the device usage to
+	// the containers.
+	processSamples := make(map[string]map[uint32]processUtilization)
+	var deviceProcs []*deviceProcesses
+	for _, d := range containerLister.Devices().Devices() {
+		if processMetrics {
+			if procs := listDeviceProcesses(d.Handle, fmt.Sprint(d.Index), d.UUID); procs != nil {
+				deviceProcs = append(deviceProcs, procs)
+			}
 		}
+		processSamples[d.UUID] = cc.ClusterManager.processSampler.Sample(d.Handle, d.UUID)
 	}
 
 	pods, err := cc.ClusterManager.PodLister.List(labels.Everything())
 	if err != nil {
-		klog.Error("failed to list pods with err=", err.Error())
+		collectLog.ErrorS(err, "Failed to list the pods")
 	}
 	nowSec := time.Now().Unix()
 
-	containers := containerLister.ListContainers()
-	for _, pod := range pods {
-		for _, c := range containers {
-			//for sridx := range srPodList {
-			//	if srPodList[sridx].sr == nil {
-			//		continue
-			//	}
-			if c.Info == nil {
-				continue
+	cc.ClusterManager.usagePredictor.collect(ch)
+	cc.ClusterManager.reclaimer.collect(ch)
+	cc.ClusterManager.pressure.collect(ch)
+	cc.ClusterManager.resizer.collect(ch)
+	cc.ClusterManager.coreQoS.collect(ch)
+	cc.ClusterManager.inversions.collect(ch)
+	cc.ClusterManager.ooms.collect(ch)
+	ready := err == nil && cc.ClusterManager.ContainersReady()
+	ch <- prometheus.MustNewConstMetric(containerMetricsReadyDesc, prometheus.GaugeValue, boolToFloat(ready))
+	if !ready {
+		collectLog.InfoS("Containers or pods not synced yet, leaving out the container metrics")
+		return
+	}
+	matched := cc.ClusterManager.MatchContainers(pods)
+	defer cc.ClusterManager.ReleaseContainers(matched)
+	collectHookHealth(ch, matched, time.Now())
+	collectRegion(ch, matched)
+	collectContainerUtilization(ch, matched, processSamples)
+	if processMetrics {
+		collectProcesses(ch, deviceProcs, processSamples, matched, pods)
+	}
+	collectSpill(ch, matched, containerLister.Devices().Devices(), deviceProcs)
+	cc.ClusterManager.coreCompliance.collect(ch, matched, processSamples, time.Now())
+	cc.ClusterManager.memViolations.collect(ch, matched)
+	cc.ClusterManager.utilHistory.collect(ch, matched, processSamples, time.Now())
+	cc.ClusterManager.accessTracer.collect(ch, pods, containerLister.Devices().Devices())
+	cc.ClusterManager.terminated.collect(ch, matched, time.Now())
+	for _, mc := range matched {
+		pod, ctrName, c := mc.Pod, mc.ContainerName, mc.Usage
+		if c.Info == nil {
+			continue
+		}
+		for i := 0; i < c.Info.DeviceNum(); i++ {
+			uuid := c.Info.DeviceUUID(i)
+			memoryTotal := c.Info.DeviceMemoryTotal(i)
+			memoryLimit := c.Info.DeviceMemoryLimit(i)
+			memoryContextSize := c.Info.DeviceMemoryContextSize(i)
+			memoryModuleSize := c.Info.DeviceMemoryModuleSize(i)
+			memoryBufferSize := c.Info.DeviceMemoryBufferSize(i)
+			memoryOffset := c.Info.DeviceMemoryOffset(i)
+			smUtil := c.Info.DeviceSmUtil(i)
+			lastKernelTime := c.Info.LastKernelTime()
+
+			ctrLabels := []string{pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid}
+			ch <- prometheus.MustNewConstMetric(ctrMemoryUsedDesc, prometheus.GaugeValue, float64(memoryTotal), ctrLabels...)
+			ch <- prometheus.MustNewConstMetric(ctrMemoryLimitDesc, prometheus.GaugeValue, float64(memoryLimit), ctrLabels...)
+			for kind, size := range map[string]uint64{"context": memoryContextSize, "module": memoryModuleSize, "data": memoryBufferSize} {
+				ch <- prometheus.MustNewConstMetric(ctrMemoryBreakdownDesc, prometheus.GaugeValue, float64(size), append(ctrLabels, kind)...)
+			}
+			ch <- prometheus.MustNewConstMetric(ctrSmUtilizationDesc, prometheus.GaugeValue, float64(smUtil)/100, ctrLabels...)
+			if lastKernelTime > 0 {
+				lastSec := nowSec - lastKernelTime
+				if lastSec < 0 {
+					lastSec = 0
+				}
+				ch <- prometheus.MustNewConstMetric(ctrLastKernelAgeDesc, prometheus.GaugeValue, float64(lastSec), ctrLabels...)
 			}
-			//podUID := strings.Split(srPodList[sridx].idstr, "_")[0]
-			//ctrName := strings.Split(srPodList[sridx].idstr, "_")[1]
-			podUID := c.PodUID
-			ctrName := c.ContainerName
-			if strings.Compare(string(pod.UID), podUID) != 0 {
+			if !legacyMetrics {
 				continue
 			}
-			fmt.Println("Pod matched!", pod.Name, pod.Namespace, pod.Labels)
-			for _, ctr := range pod.Spec.Containers {
-				if strings.Compare(ctr.Name, ctrName) != 0 {
-					continue
-				}
-				fmt.Println("container matched", ctr.Name)
-				//err := setHostPid(pod, pod.Status.ContainerStatuses[ctridx], &srPodList[sridx])
-				//if err != nil {
-				//	fmt.Println("setHostPid filed", err.Error())
-				//}
-				//fmt.Println("sr.list=", srPodList[sridx].sr)
-				podlabels := make(map[string]string)
-				for idx, val := range pod.Labels {
-					idxfix := strings.ReplaceAll(idx, "-", "_")
-					valfix := strings.ReplaceAll(val, "-", "_")
-					podlabels[idxfix] = valfix
-				}
-				for i := 0; i < c.Info.DeviceNum(); i++ {
-					uuid := c.Info.DeviceUUID(i)[0:40]
-					memoryTotal := c.Info.DeviceMemoryTotal(i)
-					memoryLimit := c.Info.DeviceMemoryLimit(i)
-					memoryContextSize := c.Info.DeviceMemoryContextSize(i)
-					memoryModuleSize := c.Info.DeviceMemoryModuleSize(i)
-					memoryBufferSize := c.Info.DeviceMemoryBufferSize(i)
-					memoryOffset := c.Info.DeviceMemoryOffset(i)
-					smUtil := c.Info.DeviceSmUtil(i)
-					lastKernelTime := c.Info.LastKernelTime()
-
-					//fmt.Println("uuid=", uuid, "length=", len(uuid))
-					ch <- prometheus.MustNewConstMetric(
-						ctrvGPUdesc,
-						prometheus.GaugeValue,
-						float64(memoryTotal),
-						pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid, /*,string(sr.sr.uuids[i].uuid[:])*/
-					)
-					ch <- prometheus.MustNewConstMetric(
-						ctrvGPUlimitdesc,
-						prometheus.GaugeValue,
-						float64(memoryLimit),
-						pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid, /*,string(sr.sr.uuids[i].uuid[:])*/
-					)
-					ch <- prometheus.MustNewConstMetric(
-						ctrDeviceMemorydesc,
-						prometheus.CounterValue,
-						float64(memoryTotal),
-						pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid,
-						fmt.Sprint(memoryContextSize), fmt.Sprint(memoryModuleSize), fmt.Sprint(memoryBufferSize), fmt.Sprint(memoryOffset),
-					)
-					ch <- prometheus.MustNewConstMetric(
-						ctrDeviceUtilizationdesc,
-						prometheus.GaugeValue,
-						float64(smUtil),
-						pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid,
-					)
-					if lastKernelTime > 0 {
-						lastSec := nowSec - lastKernelTime
-						if lastSec < 0 {
-							lastSec = 0
-						}
-						ch <- prometheus.MustNewConstMetric(
-							ctrDeviceLastKernelDesc,
-							prometheus.GaugeValue,
-							float64(lastSec),
-							pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid,
-						)
-					}
+
+			ch <- prometheus.MustNewConstMetric(
+				ctrvGPUdesc,
+				prometheus.GaugeValue,
+				float64(memoryTotal),
+				pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid, /*,string(sr.sr.uuids[i].uuid[:])*/
+			)
+			ch <- prometheus.MustNewConstMetric(
+				ctrvGPUlimitdesc,
+				prometheus.GaugeValue,
+				float64(memoryLimit),
+				pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid, /*,string(sr.sr.uuids[i].uuid[:])*/
+			)
+			ch <- prometheus.MustNewConstMetric(
+				ctrDeviceMemorydesc,
+				prometheus.CounterValue,
+				float64(memoryTotal),
+				pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid,
+				fmt.Sprint(memoryContextSize), fmt.Sprint(memoryModuleSize), fmt.Sprint(memoryBufferSize), fmt.Sprint(memoryOffset),
+			)
+			ch <- prometheus.MustNewConstMetric(
+				ctrDeviceUtilizationdesc,
+				prometheus.GaugeValue,
+				float64(smUtil),
+				pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid,
+			)
+			if lastKernelTime > 0 {
+				lastSec := nowSec - lastKernelTime
+				if lastSec < 0 {
+					lastSec = 0
 				}
+				ch <- prometheus.MustNewConstMetric(
+					ctrDeviceLastKernelDesc,
+					prometheus.GaugeValue,
+					float64(lastSec),
+					pod.Namespace, pod.Name, ctrName, fmt.Sprint(i), uuid,
+				)
 			}
 		}
 	}
 }
 
+// matchedContainer is a vGPU container of the monitor path paired with the
+// pod it belongs to.
+type matchedContainer struct {
+	Pod           *corev1.Pod
+	ContainerName string
+	Usage         *nvidia.ContainerUsage
+}
+
+// MatchContainers pairs every container of the monitor path with its pod and
+// container spec, containers whose pod is not in pods are skipped, as are
+// the init containers not running. The usage Info of a matched container is
+// nil while its shared region is not loaded. The containers are acquired,
+// their shared regions staying mapped until ReleaseContainers.
+func (c *ClusterManager) MatchContainers(pods []*corev1.Pod) []matchedContainer {
+	c.containerLister.Lock()
+	defer c.containerLister.UnLock()
+	var res []matchedContainer
+	for _, pod := range pods {
+		containers := c.containerLister.PodContainers(string(pod.UID))
+		if len(containers) == 0 {
+			continue
+		}
+		for _, ctr := range pod.Spec.Containers {
+			if usage, ok := containers[ctr.Name]; ok {
+				c.containerLister.Acquire(usage)
+				res = append(res, matchedContainer{Pod: pod, ContainerName: ctr.Name, Usage: usage})
+			}
+		}
+		// An init container reuses the slices of the containers of its
+		// pod, it counts while it runs, before them.
+		for _, status := range pod.Status.InitContainerStatuses {
+			if usage, ok := containers[status.Name]; ok && status.State.Running != nil {
+				c.containerLister.Acquire(usage)
+				res = append(res, matchedContainer{Pod: pod, ContainerName: status.Name, Usage: usage})
+			}
+		}
+	}
+	return res
+}
+
+// ReleaseContainers releases the containers of MatchContainers.
+func (c *ClusterManager) ReleaseContainers(matched []matchedContainer) {
+	usages := make([]*nvidia.ContainerUsage, 0, len(matched))
+	for _, mc := range matched {
+		usages = append(usages, mc.Usage)
+	}
+	c.containerLister.Release(usages...)
+}
+
 // NewClusterManager first creates a Prometheus-ignorant ClusterManager
-// instance. Then, it creates a ClusterManagerCollector for the just created
-// ClusterManager. Finally, it registers the ClusterManagerCollector with a
-// wrapping Registerer that adds the zone as a label. In this way, the metrics
-// collected by different ClusterManagerCollectors do not collide.
-func NewClusterManager(zone string, reg prometheus.Registerer, containerLister *nvidia.ContainerLister) *ClusterManager {
+// instance. Then, it creates the collectors enabled by --host-metrics and
+// --container-metrics for the just created ClusterManager. Finally, it
+// registers them with a wrapping Registerer that adds the zone as a label.
+// In this way, the metrics collected by different ClusterManagers do not
+// collide.
+func NewClusterManager(zone string, reg prometheus.Registerer, containerLister *nvidia.ContainerLister, stopCh <-chan struct{}) (*ClusterManager, error) {
 	c := &ClusterManager{
 		Zone:            zone,
 		containerLister: containerLister,
+		telemetry:       newCollectorTelemetry(containerLister),
+		processSampler:  newProcessSampler(),
+		coreCompliance:  newCoreCompliance(coreComplianceWindow),
+		memViolations:   newMemoryViolations(),
+		utilHistory:     newUtilizationHistory(),
+		handshakes:      newHandshakeTracker(),
+		terminated:      newTerminatedContainers(terminatedRetention),
+		inversions:      newPriorityInversions(),
+	}
+	source, err := newMetricsSource(metricsSource)
+	if err != nil {
+		return nil, err
+	}
+	c.source = source
+	if predictionInterval > 0 {
+		c.usagePredictor = newUsagePredictor(predictionHalfLife, predictionHorizon)
+	}
+	if reclaimInterval > 0 {
+		c.reclaimer = newMemoryReclaimer(reclaimDryRun, reclaimCooldown)
+	}
+	if memoryResizeInterval > 0 {
+		c.resizer = newMemoryResizer()
+	}
+	if coreQoSInterval > 0 {
+		c.coreQoS = newCoreQoS(uint64(coreQoSBurst), coreQoSBurstDuration)
+	}
+	if eventInterval > 0 && eventJournalSize > 0 {
+		c.events = newEventJournal(eventJournalSize)
+	}
+	c.xids = newXidWatcher(c.events, containerLister.Devices())
+	if memoryPressureInterval > 0 {
+		c.pressure = newMemoryPressure(memoryPressureThreshold, memoryPressureDryRun, reclaimCooldown, c.events)
+	}
+	if oomLogDir != "" && oomInterval > 0 {
+		c.ooms = newOOMWatcher(oomLogDir, containerLister.Clientset(), c.events)
+	}
+	if sampleInterval > 0 {
+		c.sampler = newMetricsSampler()
+	}
+	if accessTrace {
+		c.accessTracer = newAccessTracer(bpftracePath, accessTraceInterval)
 	}
 
 	informerFactory := informers.NewSharedInformerFactoryWithOptions(containerLister.Clientset(), time.Hour*1)
 	c.PodLister = informerFactory.Core().V1().Pods().Lister()
-	stopCh := make(chan struct{})
+	c.podsSynced = informerFactory.Core().V1().Pods().Informer().HasSynced
 	informerFactory.Start(stopCh)
 
-	cc := ClusterManagerCollector{ClusterManager: c}
-	prometheus.WrapRegistererWith(prometheus.Labels{"zone": zone}, reg).MustRegister(cc)
-	return c
+	labels, err := constLabels(zone, nodeName, staticLabels)
+	if err != nil {
+		return nil, err
+	}
+	collectors := []prometheus.Collector{c.telemetry}
+	if hostMetrics {
+		c.host = &HostDeviceCollector{ClusterManager: c}
+		collectors = append(collectors, c.host)
+	}
+	if containerMetrics {
+		c.containers = &ContainerVGPUCollector{ClusterManager: c}
+		collectors = append(collectors, c.containers, c.handshakes.recorder)
+	}
+	if c.sampler != nil {
+		collectors = append(collectors, c.sampler)
+	}
+	wrapped := prometheus.WrapRegistererWith(labels, reg)
+	wrapped.MustRegister(collectors...)
+	c.unregister = func() {
+		for _, collector := range collectors {
+			wrapped.Unregister(collector)
+		}
+	}
+	return c, nil
+}
+
+// Close unregisters the collectors of the manager and shuts NVML down, the
+// informers stop with the channel the manager was created with.
+func (c *ClusterManager) Close() {
+	c.unregister()
+	c.containerLister.Devices().Shutdown()
 }
 
-func initMetrics(containerLister *nvidia.ContainerLister) {
-	// Since we are dealing with custom Collector implementations, it might
-	// be a good idea to try it out with a pedantic registry.
+// initMetrics serves the metrics until ctx is done, the requests in flight
+// are given the grace period to complete.
+func initMetrics(ctx context.Context, reg prometheus.Gatherer, cm *ClusterManager) error {
 	klog.Info("Initializing metrics for vGPUmonitor")
-	reg := prometheus.NewRegistry()
-	//reg := prometheus.NewPedanticRegistry()
-
-	// Construct cluster managers. In real code, we would assign them to
-	// variables to then do something with them.
-	NewClusterManager("vGPU", reg, containerLister)
-
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	log.Fatal(http.ListenAndServe(":9394", nil))
+	// The profiles are only served with --pprof, not on the default mux
+	// net/http/pprof registers them on.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(reg))
+	registerUI(mux, cm)
+	registerDebug(mux, cm)
+	registerHealth(mux, cm)
+	if cm.events != nil {
+		registerEvents(mux, cm.events)
+	}
+	if pprofEnabled {
+		profiling.Register(mux)
+	}
+	server := &http.Server{Addr: metricsBindAddress, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			klog.Errorf("Failed to shut the metrics server down: %v", err)
+		}
+	}()
+	var err error
+	if metricsTLSCertFile == "" && metricsTLSKeyFile == "" {
+		err = server.ListenAndServe()
+	} else {
+		reloader, rerr := newCertReloader(metricsTLSCertFile, metricsTLSKeyFile, metricsTLSClientCAFile)
+		if rerr != nil {
+			return fmt.Errorf("failed to load the metrics certificates: %v", rerr)
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,63 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var migLabels = []string{"deviceidx", "deviceuuid", "miguuid", "gpu_instance_id", "compute_instance_id", "mig_profile"}
+
+// Descriptors of the MIG devices of the GPUs in MIG mode, labelled with the
+// index and the UUID of their GPU.
+var (
+	hostMigMemoryUsedDesc = prometheus.NewDesc(
+		"vgpu_host_mig_memory_used_bytes",
+		"GPU device memory used by the MIG device, in bytes",
+		migLabels, nil,
+	)
+	hostMigUtilizationDesc = prometheus.NewDesc(
+		"vgpu_host_mig_utilization_ratio",
+		"Activity of the graphics engine of the MIG device as a ratio, only reported by DCGM",
+		migLabels, nil,
+	)
+)
+
+func describeMig(ch chan<- *prometheus.Desc) {
+	ch <- hostMigMemoryUsedDesc
+	ch <- hostMigUtilizationDesc
+}
+
+// collectMig exports the memory and the utilization of the MIG devices, those
+// the source doesn't report are left out.
+func collectMig(ch chan<- prometheus.Metric, devices []nvidia.Device, stats map[string]nvidia.DeviceStats) {
+	for _, d := range devices {
+		s := stats[d.UUID]
+		labels := []string{fmt.Sprint(d.Index), d.Mig.ParentUUID, d.UUID,
+			fmt.Sprint(d.Mig.GPUInstanceID), fmt.Sprint(d.Mig.ComputeInstanceID), d.Mig.Profile}
+		if s.HasMemory {
+			ch <- prometheus.MustNewConstMetric(hostMigMemoryUsedDesc, prometheus.GaugeValue, float64(s.MemoryUsed), labels...)
+		}
+		if s.HasUtilization {
+			ch <- prometheus.MustNewConstMetric(hostMigUtilizationDesc, prometheus.GaugeValue, s.Utilization, labels...)
+		}
+	}
+}
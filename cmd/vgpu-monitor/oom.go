@@ -0,0 +1,281 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// hookOOMPattern matches the line libvgpu logs when it denies an allocation
+// of a container over the memory limit of a vGPU, with the index of the
+// vGPU, the memory the allocation would have brought it to and the limit.
+var hookOOMPattern = regexp.MustCompile(`Device (\d+) OOM (\d+) / (\d+)`)
+
+// oomLogReadLimit bounds the bytes of a container log read per scan, a
+// container logging faster loses the oldest lines of the scan.
+const oomLogReadLimit = 1 << 20
+
+// oomEventReason is the reason of the pod events of the denied allocations.
+const oomEventReason = "VGPUOutOfMemory"
+
+var ctrMemoryOOMDesc = prometheus.NewDesc(
+	"vgpu_container_memory_oom_total",
+	"Allocations of the container denied by the vGPU hook for going over its memory limit",
+	[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+)
+
+type oomKey struct {
+	namespace, pod, container string
+	vdevice                   int
+	uuid                      string
+}
+
+// containerLog is the position of the monitor in the current log file of a
+// container.
+type containerLog struct {
+	path   string
+	offset int64
+}
+
+// oomWatcher finds in the logs the kubelet keeps of the vGPU containers
+// the allocations their hook denied, counts them and reports them as
+// events of their pod, so that the CUDA out of memory errors of a workload
+// are attributed to its vGPU limit.
+type oomWatcher struct {
+	logDir    string
+	clientset kubernetes.Interface
+	journal   *eventJournal
+
+	mutex sync.Mutex
+	// counts are by pod UID/container name, as are the logs, only used by
+	// the scans.
+	counts map[string]map[oomKey]uint64
+	logs   map[string]*containerLog
+}
+
+func newOOMWatcher(logDir string, clientset kubernetes.Interface, journal *eventJournal) *oomWatcher {
+	return &oomWatcher{
+		logDir:    logDir,
+		clientset: clientset,
+		journal:   journal,
+		counts:    make(map[string]map[oomKey]uint64),
+		logs:      make(map[string]*containerLog),
+	}
+}
+
+// Run scans the logs of the vGPU containers every interval once they are
+// synced.
+func (w *oomWatcher) Run(cm *ClusterManager, interval time.Duration) {
+	klog.Infof("Watching the vGPU out of memory errors in %s every %v", w.logDir, interval)
+	for {
+		time.Sleep(interval)
+		pods, err := cm.PodLister.List(labels.Everything())
+		if err != nil {
+			klog.Errorf("Failed to list pods: %v", err)
+			continue
+		}
+		if !cm.ContainersReady() {
+			continue
+		}
+		matched := cm.MatchContainers(pods)
+		w.scan(matched, time.Now())
+		cm.ReleaseContainers(matched)
+	}
+}
+
+// hookOOM is a line of a container log of a denied allocation.
+type hookOOM struct {
+	vdevice          int
+	requested, limit uint64
+}
+
+func (w *oomWatcher) scan(matched []matchedContainer, now time.Time) {
+	seen := make(map[string]bool)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		id := string(mc.Pod.UID) + "/" + mc.ContainerName
+		seen[id] = true
+		dir := filepath.Join(w.logDir, mc.Pod.Namespace+"_"+mc.Pod.Name+"_"+string(mc.Pod.UID), mc.ContainerName)
+		ooms := w.readLog(id, dir)
+		if len(ooms) == 0 {
+			continue
+		}
+		w.mutex.Lock()
+		counts := w.counts[id]
+		if counts == nil {
+			counts = make(map[oomKey]uint64)
+			w.counts[id] = counts
+		}
+		for _, o := range ooms {
+			uuid := ""
+			if o.vdevice < mc.Usage.Info.DeviceNum() {
+				uuid = mc.Usage.Info.DeviceUUID(o.vdevice)
+			}
+			counts[oomKey{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, o.vdevice, uuid}]++
+		}
+		w.mutex.Unlock()
+		last := ooms[len(ooms)-1]
+		msg := fmt.Sprintf("the vGPU hook denied %d allocations of container %s, the last one on vGPU %d would have used %d MiB over its %d MiB limit",
+			len(ooms), mc.ContainerName, last.vdevice, last.requested/1048576, last.limit/1048576)
+		w.recordEvent(mc.Pod, msg, now)
+		if w.journal != nil {
+			w.journal.Append(Event{Time: now, Type: EventDeviceOOM, Node: nodeName, Namespace: mc.Pod.Namespace, Pod: mc.Pod.Name,
+				Container: mc.ContainerName, Message: msg})
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for id := range w.logs {
+		if !seen[id] {
+			delete(w.logs, id)
+			delete(w.counts, id)
+		}
+	}
+}
+
+// recordEvent reports the denied allocations as a warning event of the pod,
+// the allocations of a scan in a single event.
+func (w *oomWatcher) recordEvent(pod *corev1.Pod, msg string, now time.Time) {
+	t := metav1.NewTime(now)
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.Name + ".",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+		Reason:         oomEventReason,
+		Message:        msg,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "volcano-vgpu-monitor", Host: nodeName},
+		FirstTimestamp: t,
+		LastTimestamp:  t,
+		Count:          1,
+	}
+	if _, err := w.clientset.CoreV1().Events(pod.Namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		klog.Errorf("Failed to record the out of memory event of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// readLog returns the denied allocations logged by the container since the
+// last scan. The log of a container seen for the first time is read from
+// its end, those of its restarts from their start.
+func (w *oomWatcher) readLog(id, dir string) []hookOOM {
+	path := currentLog(dir)
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		klog.V(4).Infof("Failed to open the log %s: %v", path, err)
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	l, known := w.logs[id]
+	if !known {
+		w.logs[id] = &containerLog{path: path, offset: info.Size()}
+		return nil
+	}
+	if l.path != path || info.Size() < l.offset {
+		l.path, l.offset = path, 0
+	}
+	start := l.offset
+	if info.Size()-start > oomLogReadLimit {
+		start = info.Size() - oomLogReadLimit
+	}
+	l.offset = info.Size()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil
+	}
+	var res []hookOOM
+	scanner := bufio.NewScanner(io.LimitReader(f, info.Size()-start))
+	for scanner.Scan() {
+		m := hookOOMPattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		vdevice, _ := strconv.Atoi(m[1])
+		requested, _ := strconv.ParseUint(m[2], 10, 64)
+		limit, _ := strconv.ParseUint(m[3], 10, 64)
+		res = append(res, hookOOM{vdevice: vdevice, requested: requested, limit: limit})
+	}
+	return res
+}
+
+// currentLog returns the log file the kubelet writes for the container in
+// dir, the last modified one, empty when there is none.
+func currentLog(dir string) string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	res, latest := "", time.Time{}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			res, latest = p, info.ModTime()
+		}
+	}
+	return res
+}
+
+func describeOOM(ch chan<- *prometheus.Desc) {
+	ch <- ctrMemoryOOMDesc
+}
+
+// collect exports the denied allocations of the containers, nothing while
+// the watcher is disabled.
+func (w *oomWatcher) collect(ch chan<- prometheus.Metric) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, counts := range w.counts {
+		for key, n := range counts {
+			ch <- prometheus.MustNewConstMetric(ctrMemoryOOMDesc, prometheus.CounterValue, float64(n),
+				key.namespace, key.pod, key.container, strconv.Itoa(key.vdevice), key.uuid)
+		}
+	}
+}
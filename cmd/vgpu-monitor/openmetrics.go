@@ -0,0 +1,182 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/klog/v2"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// metricsHandler serves the metrics of g in the text format, or in
+// OpenMetrics with the exemplars of the counters for the scrapers which
+// accept it, which the Prometheus client doesn't encode in this version.
+func metricsHandler(g prometheus.Gatherer) http.Handler {
+	text := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	if !exemplars {
+		return text
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r.Header.Get("Accept")) {
+			text.ServeHTTP(w, r)
+			return
+		}
+		families, err := g.Gather()
+		if err != nil {
+			// As promhttp does by default, serve what was gathered.
+			klog.Errorf("Error gathering the metrics: %v", err)
+		}
+		var buf bytes.Buffer
+		writeOpenMetrics(&buf, families)
+		w.Header().Set("Content-Type", openMetricsContentType)
+		_, _ = w.Write(buf.Bytes())
+	})
+}
+
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if t, _, err := mime.ParseMediaType(part); err == nil && t == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOpenMetrics renders the families in the OpenMetrics text format. The
+// counters whose name doesn't end with _total, which OpenMetrics requires,
+// are written as unknown.
+func writeOpenMetrics(w *bytes.Buffer, families []*dto.MetricFamily) {
+	for _, mf := range families {
+		name, typ := mf.GetName(), "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			if strings.HasSuffix(name, "_total") {
+				name, typ = strings.TrimSuffix(name, "_total"), "counter"
+			}
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+		w.WriteString("# TYPE " + name + " " + typ + "\n")
+		if mf.GetHelp() != "" {
+			w.WriteString("# HELP " + name + " " + escaper.Replace(mf.GetHelp()) + "\n")
+		}
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.Counter != nil:
+				exemplar := m.GetCounter().GetExemplar()
+				if typ != "counter" {
+					exemplar = nil
+				}
+				writeOpenMetricsSample(w, mf.GetName(), m, "", "", m.GetCounter().GetValue(), exemplar)
+			case m.Gauge != nil:
+				writeOpenMetricsSample(w, name, m, "", "", m.GetGauge().GetValue(), nil)
+			case m.Untyped != nil:
+				writeOpenMetricsSample(w, name, m, "", "", m.GetUntyped().GetValue(), nil)
+			case m.Summary != nil:
+				for _, q := range m.GetSummary().GetQuantile() {
+					writeOpenMetricsSample(w, name, m, "quantile", formatOpenMetricsFloat(q.GetQuantile()), q.GetValue(), nil)
+				}
+				writeOpenMetricsSample(w, name+"_sum", m, "", "", m.GetSummary().GetSampleSum(), nil)
+				writeOpenMetricsSample(w, name+"_count", m, "", "", float64(m.GetSummary().GetSampleCount()), nil)
+			case m.Histogram != nil:
+				infSeen := false
+				for _, b := range m.GetHistogram().GetBucket() {
+					infSeen = infSeen || math.IsInf(b.GetUpperBound(), 1)
+					writeOpenMetricsSample(w, name+"_bucket", m, "le", formatOpenMetricsFloat(b.GetUpperBound()),
+						float64(b.GetCumulativeCount()), b.GetExemplar())
+				}
+				if !infSeen {
+					writeOpenMetricsSample(w, name+"_bucket", m, "le", "+Inf", float64(m.GetHistogram().GetSampleCount()), nil)
+				}
+				writeOpenMetricsSample(w, name+"_sum", m, "", "", m.GetHistogram().GetSampleSum(), nil)
+				writeOpenMetricsSample(w, name+"_count", m, "", "", float64(m.GetHistogram().GetSampleCount()), nil)
+			}
+		}
+	}
+	w.WriteString("# EOF\n")
+}
+
+func writeOpenMetricsSample(w *bytes.Buffer, name string, m *dto.Metric, extraName, extraValue string, value float64, exemplar *dto.Exemplar) {
+	w.WriteString(name)
+	labels := m.GetLabel()
+	if extraName != "" {
+		labels = append(labels[:len(labels):len(labels)], &dto.LabelPair{Name: &extraName, Value: &extraValue})
+	}
+	writeOpenMetricsLabels(w, labels)
+	w.WriteByte(' ')
+	w.WriteString(formatOpenMetricsFloat(value))
+	if m.TimestampMs != nil {
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(float64(m.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+	if exemplar != nil {
+		w.WriteString(" # ")
+		writeOpenMetricsLabels(w, exemplar.GetLabel())
+		if len(exemplar.GetLabel()) == 0 {
+			w.WriteString("{}")
+		}
+		w.WriteByte(' ')
+		w.WriteString(formatOpenMetricsFloat(exemplar.GetValue()))
+	}
+	w.WriteByte('\n')
+}
+
+func writeOpenMetricsLabels(w *bytes.Buffer, labels []*dto.LabelPair) {
+	if len(labels) == 0 {
+		return
+	}
+	w.WriteByte('{')
+	for i, lp := range labels {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(lp.GetName())
+		w.WriteString(`="`)
+		w.WriteString(escaper.Replace(lp.GetValue()))
+		w.WriteByte('"')
+	}
+	w.WriteByte('}')
+}
+
+func formatOpenMetricsFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escaper escapes the help texts and the label values.
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
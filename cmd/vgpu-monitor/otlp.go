@@ -0,0 +1,297 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/klog/v2"
+)
+
+// OTLPSink periodically gathers the samples registered for the /metrics
+// endpoint and pushes them to an OpenTelemetry collector with OTLP/HTTP in
+// its JSON encoding, for the clusters which do not scrape Prometheus
+// endpoints.
+type OTLPSink struct {
+	endpoint *url.URL
+	headers  map[string]string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	// start is the start time of the cumulative sums and histograms.
+	start time.Time
+}
+
+// NewOTLPSink returns an OTLPSink posting to endpoint, the URL of the metrics
+// receiver of the collector, e.g. http://otel-collector:4318/v1/metrics.
+// headers are key=value pairs added to the requests, e.g. for
+// authentication.
+func NewOTLPSink(endpoint string, headers []string, gatherer prometheus.Gatherer) (*OTLPSink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint %q: %v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported otlp endpoint scheme %q", u.Scheme)
+	}
+	s := &OTLPSink{
+		endpoint: u,
+		headers:  make(map[string]string),
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		start:    time.Now(),
+	}
+	for _, h := range headers {
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid otlp header %q, expected key=value", h)
+		}
+		s.headers[kv[0]] = kv[1]
+	}
+	return s, nil
+}
+
+// Run pushes the gathered samples every interval, it never returns.
+func (s *OTLPSink) Run(interval time.Duration) {
+	klog.Infof("Pushing OTLP metrics to %s every %v", s.endpoint.Redacted(), interval)
+	for {
+		time.Sleep(interval)
+		if err := s.Flush(); err != nil {
+			klog.Errorf("Failed to push metrics to otlp endpoint: %v", err)
+		}
+	}
+}
+
+// Flush gathers the current samples and pushes them to the endpoint.
+func (s *OTLPSink) Flush() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect along with the error.
+		klog.Warningf("Gathering metrics for otlp returned error: %v", err)
+	}
+	req := otlpRequest(families, s.start, time.Now())
+	if len(req.ResourceMetrics[0].ScopeMetrics[0].Metrics) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, s.endpoint.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp push returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP metrics request, in the JSON mapping of its protobuf messages: the
+// 64-bit integers are strings.
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value otlpAttrString `json:"value"`
+}
+
+type otlpAttrString struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpAttribute     `json:"attributes"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// otlpRequest converts the gathered families: the gauges and untyped samples
+// to gauges, the counters to monotonic cumulative sums, the histograms and
+// summaries to their OTLP counterparts. The labels become the attributes of
+// the data points, the node is an attribute of the resource.
+func otlpRequest(families []*dto.MetricFamily, start, now time.Time) otlpExportRequest {
+	startNano, nowNano := strconv.FormatInt(start.UnixNano(), 10), strconv.FormatInt(now.UnixNano(), 10)
+	resource := otlpResource{Attributes: []otlpAttribute{otlpString("service.name", "vgpu-monitor")}}
+	if nodeName != "" {
+		resource.Attributes = append(resource.Attributes, otlpString("k8s.node.name", nodeName))
+	}
+	metrics := []otlpMetric{}
+	for _, mf := range families {
+		metric := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		for _, m := range mf.GetMetric() {
+			attrs := make([]otlpAttribute, 0, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				attrs = append(attrs, otlpString(lp.GetName(), lp.GetValue()))
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				if metric.Sum == nil {
+					metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+				}
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberDataPoint{
+					Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: nowNano, AsDouble: m.GetCounter().GetValue()})
+			case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				if metric.Gauge == nil {
+					metric.Gauge = &otlpGauge{}
+				}
+				value := m.GetGauge().GetValue()
+				if m.Untyped != nil {
+					value = m.GetUntyped().GetValue()
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberDataPoint{
+					Attributes: attrs, TimeUnixNano: nowNano, AsDouble: value})
+			case dto.MetricType_HISTOGRAM:
+				if metric.Histogram == nil {
+					metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+				}
+				h := m.GetHistogram()
+				p := otlpHistogramDataPoint{Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: nowNano,
+					Count: strconv.FormatUint(h.GetSampleCount(), 10), Sum: h.GetSampleSum(),
+					BucketCounts: []string{}, ExplicitBounds: []float64{}}
+				// The Prometheus buckets are cumulative, the OTLP ones are not
+				// and end with the one above the last bound.
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					p.ExplicitBounds = append(p.ExplicitBounds, b.GetUpperBound())
+					p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+					prev = b.GetCumulativeCount()
+				}
+				p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, p)
+			case dto.MetricType_SUMMARY:
+				if metric.Summary == nil {
+					metric.Summary = &otlpSummary{}
+				}
+				sm := m.GetSummary()
+				p := otlpSummaryDataPoint{Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: nowNano,
+					Count: strconv.FormatUint(sm.GetSampleCount(), 10), Sum: sm.GetSampleSum(),
+					QuantileValues: []otlpQuantileValue{}}
+				for _, q := range sm.GetQuantile() {
+					p.QuantileValues = append(p.QuantileValues, otlpQuantileValue{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, p)
+			}
+		}
+		if metric.Gauge != nil || metric.Sum != nil || metric.Histogram != nil || metric.Summary != nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	return otlpExportRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "volcano.sh/vgpu-monitor"}, Metrics: metrics}},
+	}}}
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAttrString{StringValue: value}}
+}
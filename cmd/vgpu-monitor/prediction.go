@@ -0,0 +1,249 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Annotations the predictions are published in when enabled. A pod gets
+// ctrname,deviceuuid,memoryMiB,smutil: per vGPU, the node
+// deviceuuid,memoryMiB,utilization: per GPU.
+const (
+	PodPredictionAnnotation  = "volcano.sh/vgpu-predicted-usage"
+	NodePredictionAnnotation = "volcano.sh/node-vgpu-predicted-usage"
+)
+
+var (
+	ctrLabels = []string{"podnamespace", "podname", "ctrname", "deviceuuid"}
+
+	ctrMemoryPredictedDesc = prometheus.NewDesc(
+		"vgpu_container_device_memory_predicted_bytes",
+		"Device memory the container is predicted to use at the end of the prediction horizon",
+		ctrLabels, nil,
+	)
+	ctrSmPredictedDesc = prometheus.NewDesc(
+		"vgpu_container_device_sm_utilization_predicted",
+		"SM utilization the container is predicted to reach at the end of the prediction horizon",
+		ctrLabels, nil,
+	)
+	hostMemoryPredictedDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_memory_predicted_bytes",
+		"Device memory the GPU is predicted to have in use at the end of the prediction horizon",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	hostUtilizationPredictedDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_utilization_predicted",
+		"Utilization the GPU is predicted to reach at the end of the prediction horizon",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+)
+
+// ewma is a Holt double exponential smoothing of irregularly spaced
+// samples: the level follows the samples and the trend their slope, both
+// with the same half-life.
+type ewma struct {
+	time  time.Time
+	level float64
+	trend float64
+}
+
+func (e *ewma) observe(now time.Time, value float64, halfLife time.Duration) {
+	if e.time.IsZero() {
+		e.time, e.level = now, value
+		return
+	}
+	dt := now.Sub(e.time).Seconds()
+	if dt <= 0 {
+		return
+	}
+	alpha := 1 - math.Exp(-dt*math.Ln2/halfLife.Seconds())
+	expected := e.level + e.trend*dt
+	level := expected + alpha*(value-expected)
+	e.trend += alpha * ((level-e.level)/dt - e.trend)
+	e.level, e.time = level, now
+}
+
+// predict returns the value expected after horizon, never negative.
+func (e *ewma) predict(horizon time.Duration) float64 {
+	return math.Max(0, e.level+e.trend*horizon.Seconds())
+}
+
+type predictedUsage struct {
+	memory ewma
+	util   ewma
+}
+
+// usagePredictor keeps the smoothed usage of every container vGPU and GPU of
+// the node, fed with the snapshots of the node.
+type usagePredictor struct {
+	mutex    sync.Mutex
+	halfLife time.Duration
+	horizon  time.Duration
+	snap     NodeSnapshot
+	// containers are keyed by namespace/pod/container/uuid, devices by uuid.
+	containers map[string]*predictedUsage
+	devices    map[string]*predictedUsage
+}
+
+func newUsagePredictor(halfLife, horizon time.Duration) *usagePredictor {
+	return &usagePredictor{
+		halfLife:   halfLife,
+		horizon:    horizon,
+		containers: make(map[string]*predictedUsage),
+		devices:    make(map[string]*predictedUsage),
+	}
+}
+
+func sliceKey(d DeviceSnapshot, s SliceSnapshot) string {
+	return s.Namespace + "/" + s.Pod + "/" + s.Container + "/" + d.UUID
+}
+
+// Observe feeds the usage of snap, the containers and devices it doesn't
+// have anymore are forgotten.
+func (p *usagePredictor) Observe(snap NodeSnapshot) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	devices := make(map[string]*predictedUsage)
+	containers := make(map[string]*predictedUsage)
+	for _, d := range snap.Devices {
+		u, ok := p.devices[d.UUID]
+		if !ok {
+			u = &predictedUsage{}
+		}
+		u.memory.observe(snap.Time, float64(d.MemoryUsed), p.halfLife)
+		u.util.observe(snap.Time, float64(d.Utilization), p.halfLife)
+		devices[d.UUID] = u
+		for _, s := range d.Containers {
+			key := sliceKey(d, s)
+			u, ok := p.containers[key]
+			if !ok {
+				u = &predictedUsage{}
+			}
+			u.memory.observe(snap.Time, float64(s.MemoryUsed), p.halfLife)
+			u.util.observe(snap.Time, float64(s.SmUtil), p.halfLife)
+			containers[key] = u
+		}
+	}
+	p.devices, p.containers, p.snap = devices, containers, snap
+}
+
+// Run observes a snapshot of the node every interval and, when publish, the
+// predictions are annotated on the node and its pods. It never returns.
+func (p *usagePredictor) Run(cm *ClusterManager, interval time.Duration, publish bool) {
+	klog.Infof("Predicting usage every %v, half-life %v, horizon %v", interval, p.halfLife, p.horizon)
+	for {
+		p.Observe(cm.Snapshot())
+		if publish {
+			p.publish(cm)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (p *usagePredictor) publish(cm *ClusterManager) {
+	nodeAnno, podAnnos := p.annotations()
+	node, err := util.GetNode(p.snap.Node)
+	if err != nil {
+		klog.Errorf("Failed to get node %s: %v", p.snap.Node, err)
+		return
+	}
+	if node.Annotations[NodePredictionAnnotation] != nodeAnno {
+		if err := util.PatchNodeAnnotations(node, map[string]string{NodePredictionAnnotation: nodeAnno}); err != nil {
+			klog.Errorf("Failed to annotate node predictions: %v", err)
+		}
+	}
+	for key, anno := range podAnnos {
+		parts := strings.SplitN(key, "/", 2)
+		pod, err := cm.PodLister.Pods(parts[0]).Get(parts[1])
+		if err != nil || pod.Annotations[PodPredictionAnnotation] == anno {
+			continue
+		}
+		if err := util.PatchPodAnnotations(pod, map[string]string{PodPredictionAnnotation: anno}); err != nil {
+			klog.Errorf("Failed to annotate predictions of pod %s: %v", key, err)
+		}
+	}
+}
+
+// annotations encodes the predictions of the node and of every pod, keyed
+// by namespace/name, the memory in MiB.
+func (p *usagePredictor) annotations() (string, map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var node strings.Builder
+	pods := make(map[string][]string)
+	for _, d := range p.snap.Devices {
+		if u, ok := p.devices[d.UUID]; ok {
+			fmt.Fprintf(&node, "%s,%d,%d:", d.UUID, uint64(u.memory.predict(p.horizon))/(1024*1024), uint64(u.util.predict(p.horizon)))
+		}
+		for _, s := range d.Containers {
+			if u, ok := p.containers[sliceKey(d, s)]; ok {
+				key := s.Namespace + "/" + s.Pod
+				pods[key] = append(pods[key], fmt.Sprintf("%s,%s,%d,%d:", s.Container, d.UUID,
+					uint64(u.memory.predict(p.horizon))/(1024*1024), uint64(u.util.predict(p.horizon))))
+			}
+		}
+	}
+	res := make(map[string]string, len(pods))
+	for key, entries := range pods {
+		sort.Strings(entries)
+		res[key] = strings.Join(entries, "")
+	}
+	return node.String(), res
+}
+
+func describePrediction(ch chan<- *prometheus.Desc) {
+	ch <- ctrMemoryPredictedDesc
+	ch <- ctrSmPredictedDesc
+	ch <- hostMemoryPredictedDesc
+	ch <- hostUtilizationPredictedDesc
+}
+
+// collect exports the predictions of the last observed snapshot, nothing
+// while the predictor is disabled.
+func (p *usagePredictor) collect(ch chan<- prometheus.Metric) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, d := range p.snap.Devices {
+		if u, ok := p.devices[d.UUID]; ok {
+			ch <- prometheus.MustNewConstMetric(hostMemoryPredictedDesc, prometheus.GaugeValue, u.memory.predict(p.horizon), fmt.Sprint(d.Index), d.UUID)
+			ch <- prometheus.MustNewConstMetric(hostUtilizationPredictedDesc, prometheus.GaugeValue, u.util.predict(p.horizon), fmt.Sprint(d.Index), d.UUID)
+		}
+		for _, s := range d.Containers {
+			u, ok := p.containers[sliceKey(d, s)]
+			if !ok {
+				continue
+			}
+			labels := []string{s.Namespace, s.Pod, s.Container, d.UUID}
+			ch <- prometheus.MustNewConstMetric(ctrMemoryPredictedDesc, prometheus.GaugeValue, u.memory.predict(p.horizon), labels...)
+			ch <- prometheus.MustNewConstMetric(ctrSmPredictedDesc, prometheus.GaugeValue, u.util.predict(p.horizon), labels...)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+var (
+	memoryPressureDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_memory_pressure",
+		"Whether the memory used on the GPU is over the share of its physical memory of --memory-pressure-threshold",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	memoryPressureEvictionsDesc = prometheus.NewDesc(
+		"vgpu_memory_pressure_evictions_total",
+		"Number of pods evicted to bring the memory used on an overcommitted GPU back under the pressure threshold, by result",
+		[]string{"result"}, nil,
+	)
+)
+
+// pressureOrder is the order the pods of a GPU under memory pressure are
+// evicted in, by vGPU class, the guaranteed ones never are.
+var pressureOrder = map[string]int{util.BestEffort: 0, util.Restricted: 1}
+
+// PlanPressureRelief returns, for every device using more than threshold of
+// its physical memory, the pods to evict, the best-effort ones then the
+// restricted ones, those using the most memory first, until the memory
+// they use brings the device back under threshold. It also returns the
+// devices under pressure by uuid.
+func PlanPressureRelief(snap NodeSnapshot, threshold float64, class func(namespace, pod string) string) ([]ReclaimVictim, map[string]bool) {
+	var victims []ReclaimVictim
+	pressured := make(map[string]bool)
+	for _, d := range snap.Devices {
+		if d.MemoryTotal == 0 {
+			continue
+		}
+		limit := uint64(threshold * float64(d.MemoryTotal))
+		if d.MemoryUsed <= limit {
+			pressured[d.UUID] = false
+			continue
+		}
+		pressured[d.UUID] = true
+		excess := d.MemoryUsed - limit
+		used := make(map[string]*ReclaimVictim)
+		order := make(map[string]int)
+		for _, s := range d.Containers {
+			rank, ok := pressureOrder[class(s.Namespace, s.Pod)]
+			if !ok {
+				continue
+			}
+			key := s.Namespace + "/" + s.Pod
+			v, ok := used[key]
+			if !ok {
+				v = &ReclaimVictim{Namespace: s.Namespace, Pod: s.Pod, Device: d.UUID}
+				used[key] = v
+				order[key] = rank
+			}
+			v.Used += s.MemoryUsed
+			if s.MemoryUsed > s.MemoryLimit {
+				v.Over += s.MemoryUsed - s.MemoryLimit
+			}
+		}
+		candidates := make([]*ReclaimVictim, 0, len(used))
+		for _, v := range used {
+			if v.Used > 0 {
+				candidates = append(candidates, v)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			ki, kj := candidates[i].Namespace+"/"+candidates[i].Pod, candidates[j].Namespace+"/"+candidates[j].Pod
+			if order[ki] != order[kj] {
+				return order[ki] < order[kj]
+			}
+			if candidates[i].Used != candidates[j].Used {
+				return candidates[i].Used > candidates[j].Used
+			}
+			return ki < kj
+		})
+		var freed uint64
+		for _, v := range candidates {
+			if freed >= excess {
+				break
+			}
+			victims = append(victims, *v)
+			freed += v.Used
+		}
+	}
+	return victims, pressured
+}
+
+// memoryPressure watches the physical memory used on the GPUs, whose vGPUs
+// may be granted more than it when the memory is overcommitted, and evicts
+// pods of the GPUs running out of it before the workloads do.
+type memoryPressure struct {
+	threshold float64
+	dryRun    bool
+	// cooldown keeps an evicted pod from being evicted again while it
+	// terminates.
+	cooldown time.Duration
+	journal  *eventJournal
+
+	mutex     sync.Mutex
+	pressured map[string]bool
+	indexes   map[string]int
+	evicted   map[string]time.Time
+	results   map[string]float64
+}
+
+func newMemoryPressure(threshold float64, dryRun bool, cooldown time.Duration, journal *eventJournal) *memoryPressure {
+	return &memoryPressure{
+		threshold: threshold,
+		dryRun:    dryRun,
+		cooldown:  cooldown,
+		journal:   journal,
+		pressured: make(map[string]bool),
+		indexes:   make(map[string]int),
+		evicted:   make(map[string]time.Time),
+		results:   make(map[string]float64),
+	}
+}
+
+// Run checks the memory of the devices every interval, it never returns.
+func (p *memoryPressure) Run(cm *ClusterManager, interval time.Duration) {
+	klog.Infof("Checking the GPUs for memory pressure over %v of their memory every %v, dry run %v", p.threshold, interval, p.dryRun)
+	for {
+		p.Step(cm, cm.Snapshot(), time.Now())
+		time.Sleep(interval)
+	}
+}
+
+func (p *memoryPressure) Step(cm *ClusterManager, snap NodeSnapshot, now time.Time) {
+	class := func(namespace, name string) string {
+		pod, err := cm.PodLister.Pods(namespace).Get(name)
+		if err != nil {
+			return util.Guaranteed
+		}
+		return vgpuClass(pod)
+	}
+	victims, pressured := PlanPressureRelief(snap, p.threshold, class)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, d := range snap.Devices {
+		p.indexes[d.UUID] = d.Index
+		if pressured[d.UUID] == p.pressured[d.UUID] {
+			continue
+		}
+		msg := fmt.Sprintf("memory used %d of %d bytes, back under %v of the device", d.MemoryUsed, d.MemoryTotal, p.threshold)
+		if pressured[d.UUID] {
+			msg = fmt.Sprintf("memory used %d of %d bytes, over %v of the device", d.MemoryUsed, d.MemoryTotal, p.threshold)
+			klog.Warningf("Device %s under memory pressure: %s", d.UUID, msg)
+		}
+		if p.journal != nil {
+			p.journal.Append(Event{Time: now, Type: EventMemoryPressure, Node: snap.Node, Device: d.UUID, Message: msg})
+		}
+	}
+	p.pressured = pressured
+	for key, t := range p.evicted {
+		if now.Sub(t) > p.cooldown {
+			delete(p.evicted, key)
+		}
+	}
+	for _, v := range victims {
+		key := v.Namespace + "/" + v.Pod
+		if _, ok := p.evicted[key]; ok {
+			continue
+		}
+		klog.Infof("Relieving the memory pressure of device %s: evicting pod %s using %d bytes (dry run %v)", v.Device, key, v.Used, p.dryRun)
+		if p.dryRun {
+			p.results["dry-run"]++
+			continue
+		}
+		err := cm.containerLister.Clientset().CoreV1().Pods(v.Namespace).Evict(context.Background(), &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Namespace: v.Namespace, Name: v.Pod},
+		})
+		if err != nil {
+			klog.Errorf("Failed to evict pod %s: %v", key, err)
+			p.results["error"]++
+			continue
+		}
+		p.evicted[key] = now
+		p.results["evicted"]++
+	}
+}
+
+func describeMemoryPressure(ch chan<- *prometheus.Desc) {
+	ch <- memoryPressureDesc
+	ch <- memoryPressureEvictionsDesc
+}
+
+// collect exports the state of the last step, nothing while the check is
+// disabled.
+func (p *memoryPressure) collect(ch chan<- prometheus.Metric) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for uuid, v := range p.pressured {
+		ch <- prometheus.MustNewConstMetric(memoryPressureDesc, prometheus.GaugeValue, boolToFloat(v), fmt.Sprint(p.indexes[uuid]), uuid)
+	}
+	for result, v := range p.results {
+		ch <- prometheus.MustNewConstMetric(memoryPressureEvictionsDesc, prometheus.CounterValue, v, result)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanPressureRelief(t *testing.T) {
+	snap := NodeSnapshot{Devices: []DeviceSnapshot{
+		{
+			UUID:        "gpu-0",
+			MemoryTotal: 10000,
+			MemoryUsed:  9500,
+			Containers: []SliceSnapshot{
+				{Namespace: "ns", Pod: "guaranteed", MemoryLimit: 4000, MemoryUsed: 4000},
+				{Namespace: "ns", Pod: "restricted", MemoryLimit: 4000, MemoryUsed: 3000},
+				{Namespace: "ns", Pod: "be1", MemoryLimit: 2000, MemoryUsed: 500},
+				{Namespace: "ns", Pod: "be2", MemoryLimit: 2000, MemoryUsed: 2000},
+			},
+		},
+		{
+			UUID:        "gpu-1",
+			MemoryTotal: 10000,
+			MemoryUsed:  5000,
+			Containers: []SliceSnapshot{
+				{Namespace: "ns", Pod: "be3", MemoryLimit: 2000, MemoryUsed: 5000},
+			},
+		},
+		{UUID: "gpu-2"},
+	}}
+	classes := classes(map[string]string{
+		"ns/guaranteed": util.Guaranteed, "ns/be1": util.BestEffort, "ns/be2": util.BestEffort, "ns/be3": util.BestEffort,
+	})
+	testCases := []struct {
+		threshold float64
+		victims   []ReclaimVictim
+		pressured map[string]bool
+	}{
+		{
+			// The best-effort pods free 2500 of the 3500 over, the
+			// restricted one is needed too.
+			threshold: 0.6,
+			victims: []ReclaimVictim{
+				{Namespace: "ns", Pod: "be2", Device: "gpu-0", Used: 2000},
+				{Namespace: "ns", Pod: "be1", Device: "gpu-0", Used: 500},
+				{Namespace: "ns", Pod: "restricted", Device: "gpu-0", Used: 3000},
+			},
+			pressured: map[string]bool{"gpu-0": true, "gpu-1": false},
+		},
+		{
+			threshold: 0.8,
+			victims: []ReclaimVictim{
+				{Namespace: "ns", Pod: "be2", Device: "gpu-0", Used: 2000},
+			},
+			pressured: map[string]bool{"gpu-0": true, "gpu-1": false},
+		},
+		{
+			// The guaranteed pods are never evicted.
+			threshold: 0.1,
+			victims: []ReclaimVictim{
+				{Namespace: "ns", Pod: "be2", Device: "gpu-0", Used: 2000},
+				{Namespace: "ns", Pod: "be1", Device: "gpu-0", Used: 500},
+				{Namespace: "ns", Pod: "restricted", Device: "gpu-0", Used: 3000},
+				{Namespace: "ns", Pod: "be3", Device: "gpu-1", Over: 3000, Used: 5000},
+			},
+			pressured: map[string]bool{"gpu-0": true, "gpu-1": true},
+		},
+		{
+			threshold: 1,
+			pressured: map[string]bool{"gpu-0": false, "gpu-1": false},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			victims, pressured := PlanPressureRelief(snap, tc.threshold, classes)
+			require.Equal(t, tc.victims, victims)
+			require.Equal(t, tc.pressured, pressured)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var priorityInversionsDesc = prometheus.NewDesc(
+	"vgpu_priority_inversions_total",
+	"Times a container of the priority class was seen running kernels on the GPU while one of a higher class was, by class of the lower one",
+	[]string{"deviceuuid", "priority"}, nil,
+)
+
+// priorityClass returns the name of the priority libvgpu recorded in a
+// shared region, unknown for a priority out of the classes.
+func priorityClass(priority int) string {
+	if priority >= 0 && priority < len(util.TaskPriorityClasses) {
+		return util.TaskPriorityClasses[priority]
+	}
+	return "unknown"
+}
+
+// containerPriority returns the priority of the container within the
+// classes, an unknown one being the lowest.
+func containerPriority(c *nvidia.ContainerUsage) int {
+	priority := c.Info.GetPriority()
+	if priority < 0 || priority >= len(util.TaskPriorityClasses) {
+		return len(util.TaskPriorityClasses) - 1
+	}
+	return priority
+}
+
+type inversionKey struct {
+	uuid     string
+	priority string
+}
+
+// priorityInversions counts the inversions the contention feedback observes:
+// a container running kernels on a GPU while one of higher priority does,
+// which the blocking of the lower priorities should prevent.
+type priorityInversions struct {
+	mutex  sync.Mutex
+	counts map[inversionKey]float64
+}
+
+func newPriorityInversions() *priorityInversions {
+	return &priorityInversions{counts: make(map[inversionKey]float64)}
+}
+
+// observe records the inversions of the active containers of every device,
+// by priority.
+func (p *priorityInversions) observe(active map[string]UtilizationPerDevice) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for uuid, counts := range active {
+		higher := false
+		for priority, n := range counts {
+			if n == 0 {
+				continue
+			}
+			if higher {
+				p.counts[inversionKey{uuid: uuid, priority: priorityClass(priority)}] += float64(n)
+			}
+			higher = true
+		}
+	}
+}
+
+func describePriority(ch chan<- *prometheus.Desc) {
+	ch <- priorityInversionsDesc
+}
+
+func (p *priorityInversions) collect(ch chan<- prometheus.Metric) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	keys := make([]inversionKey, 0, len(p.counts))
+	for key := range p.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].uuid != keys[j].uuid {
+			return keys[i].uuid < keys[j].uuid
+		}
+		return keys[i].priority < keys[j].priority
+	})
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(priorityInversionsDesc, prometheus.CounterValue, p.counts[key], key.uuid, key.priority)
+	}
+}
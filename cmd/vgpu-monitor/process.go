@@ -0,0 +1,142 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// Descriptors of the processes on the GPUs, a series per process, only
+// exported with --process-metrics.
+var (
+	processMemoryDesc = prometheus.NewDesc(
+		"vgpu_process_memory_used_bytes",
+		"GPU device memory used by the process, empty pod labels for processes outside of pods",
+		[]string{"podnamespace", "podname", "ctrname", "deviceidx", "deviceuuid", "pid"}, nil,
+	)
+	processSmUtilizationDesc = prometheus.NewDesc(
+		"vgpu_process_sm_utilization",
+		"SM utilization in percent of the process measured by the driver, empty pod labels for processes outside of pods",
+		[]string{"podnamespace", "podname", "ctrname", "deviceidx", "deviceuuid", "pid"}, nil,
+	)
+)
+
+// deviceProcesses are the processes running on a device, by host pid with the
+// device memory they use.
+type deviceProcesses struct {
+	idx, uuid string
+	memory    map[uint32]uint64
+}
+
+func describeProcesses(ch chan<- *prometheus.Desc) {
+	if !processMetrics {
+		return
+	}
+	ch <- processMemoryDesc
+	ch <- processSmUtilizationDesc
+}
+
+// listDeviceProcesses returns the compute and graphics processes of the
+// device, nil when they can't be listed.
+func listDeviceProcesses(hdev nvml.Device, idx, uuid string) *deviceProcesses {
+	compute, ret := hdev.GetComputeRunningProcesses()
+	if ret != nvml.SUCCESS {
+		nvidia.RecordNVMLError("GetComputeRunningProcesses", ret)
+		klog.V(4).Infof("nvml get compute processes of device %s error ret=%v", uuid, ret)
+		return nil
+	}
+	graphics, ret := hdev.GetGraphicsRunningProcesses()
+	if ret != nvml.SUCCESS {
+		nvidia.RecordNVMLError("GetGraphicsRunningProcesses", ret)
+		klog.V(4).Infof("nvml get graphics processes of device %s error ret=%v", uuid, ret)
+	}
+	res := &deviceProcesses{idx: idx, uuid: uuid, memory: make(map[uint32]uint64)}
+	for _, p := range append(compute, graphics...) {
+		mem := p.UsedGpuMemory
+		// NVML reports NVML_VALUE_NOT_AVAILABLE when memory cannot be queried.
+		if mem == ^uint64(0) {
+			mem = 0
+		}
+		if mem >= res.memory[p.Pid] {
+			res.memory[p.Pid] = mem
+		}
+	}
+	return res
+}
+
+// pidContainerID returns the ID of the container of a host pid from its
+// cgroups, empty for a process outside of containers or not visible from
+// the monitor, which needs the host pid namespace.
+func pidContainerID(procRoot string, pid uint32) string {
+	data, err := os.ReadFile(filepath.Join(procRoot, fmt.Sprint(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	// Both the cgroup v1 and v2 paths end with the container ID under the
+	// runtimes of the kubelet, the last one is the most nested.
+	ids := containerIDPattern.FindAllString(string(data), -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// collectProcesses exports the memory and SM utilization of every process on
+// the devices, attributed to its container by the host pids libvgpu records
+// in the shared regions, then by its cgroups.
+func collectProcesses(ch chan<- prometheus.Metric, devices []*deviceProcesses, samples map[string]map[uint32]processUtilization,
+	matched []matchedContainer, pods []*corev1.Pod) {
+	type owner struct{ namespace, pod, container string }
+	byPid := make(map[uint32]owner)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		for _, pid := range mc.Usage.Info.HostPids() {
+			byPid[uint32(pid)] = owner{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName}
+		}
+	}
+	var containers map[string]podContainer
+	for _, d := range devices {
+		for pid, mem := range d.memory {
+			o, ok := byPid[pid]
+			if !ok {
+				if containers == nil {
+					containers = podContainers(pods)
+				}
+				if c, ok := containers[pidContainerID("/proc", pid)]; ok {
+					o = owner{c.pod.Namespace, c.pod.Name, c.name}
+				}
+				byPid[pid] = o
+			}
+			labels := []string{o.namespace, o.pod, o.container, d.idx, d.uuid, fmt.Sprint(pid)}
+			ch <- prometheus.MustNewConstMetric(processMemoryDesc, prometheus.GaugeValue, float64(mem), labels...)
+			if procs := samples[d.uuid]; procs != nil {
+				ch <- prometheus.MustNewConstMetric(processSmUtilizationDesc, prometheus.GaugeValue, procs[pid].sm, labels...)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/dcgm"
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptors of the profiling fields of the devices, only exported by the
+// dcgm source.
+var profilingDescs = map[string]*prometheus.Desc{
+	nvidia.ProfilingSMActive: prometheus.NewDesc(
+		"vgpu_host_gpu_sm_active_ratio",
+		"Share of the time at least one warp was resident on an SM of the GPU, averaged over its SMs",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	),
+	nvidia.ProfilingSMOccupancy: prometheus.NewDesc(
+		"vgpu_host_gpu_sm_occupancy_ratio",
+		"Warps resident on the SMs of the GPU relative to the maximum they can hold",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	),
+	nvidia.ProfilingTensorActive: prometheus.NewDesc(
+		"vgpu_host_gpu_tensor_active_ratio",
+		"Share of the cycles the tensor cores of the GPU were active",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	),
+	nvidia.ProfilingDRAMActive: prometheus.NewDesc(
+		"vgpu_host_gpu_dram_active_ratio",
+		"Share of the cycles the device memory interface of the GPU was sending or receiving data",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	),
+}
+
+// newMetricsSource returns the source of the device stats named by
+// --metrics-source.
+func newMetricsSource(name string) (nvidia.Source, error) {
+	switch name {
+	case "nvml":
+		return nvidia.NVMLSource{}, nil
+	case "dcgm":
+		return dcgm.NewSource(dcgmExporterURL, nvidia.NVMLSource{}), nil
+	}
+	return nil, fmt.Errorf("unknown metrics source %q, expected nvml or dcgm", name)
+}
+
+func describeProfiling(ch chan<- *prometheus.Desc) {
+	if metricsSource != "dcgm" {
+		return
+	}
+	for _, desc := range profilingDescs {
+		ch <- desc
+	}
+}
+
+// collectProfiling exports the profiling fields the source read for the
+// device.
+func collectProfiling(ch chan<- prometheus.Metric, stats nvidia.DeviceStats, idx string, uuid string) {
+	for field, value := range stats.Profiling {
+		if desc, ok := profilingDescs[field]; ok {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, idx, uuid)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// QoSAnnotation sets the vGPU class of a pod, guaranteed, restricted or
+// best-effort. Without it the class follows the QoS class of the pod,
+// burstable pods being restricted.
+const QoSAnnotation = "volcano.sh/vgpu-qos"
+
+var (
+	reclaimShortfallDesc = prometheus.NewDesc(
+		"vgpu_reclaim_shortfall_bytes",
+		"Device memory the guaranteed containers of the GPU are granted but can't get, taken by best-effort containers over their grant",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+	reclaimEvictionsDesc = prometheus.NewDesc(
+		"vgpu_reclaim_evictions_total",
+		"Number of best-effort pods evicted to give their memory back to guaranteed co-tenants, by result",
+		[]string{"result"}, nil,
+	)
+	reclaimMemoryDesc = prometheus.NewDesc(
+		"vgpu_reclaim_memory_bytes_total",
+		"Device memory used by the best-effort pods evicted to give it back to guaranteed co-tenants",
+		nil, nil,
+	)
+)
+
+// vgpuClass returns the vGPU class of the pod.
+func vgpuClass(pod *corev1.Pod) string {
+	switch c := pod.Annotations[QoSAnnotation]; c {
+	case util.Guaranteed, util.Restricted, util.BestEffort:
+		return c
+	}
+	switch pod.Annotations[util.TaskPriorityAnnotation] {
+	case "high":
+		return util.Guaranteed
+	case "low":
+		return util.BestEffort
+	}
+	return util.Restricted
+}
+
+// ReclaimVictim is a best-effort pod using more device memory than granted.
+type ReclaimVictim struct {
+	Namespace string
+	Pod       string
+	Device    string
+	// Over is the memory used beyond the grant, Used all the memory the pod
+	// uses on the device.
+	Over uint64
+	Used uint64
+}
+
+// PlanReclaim returns, for every device whose guaranteed containers are
+// short of the memory they are granted, the best-effort pods to evict, the
+// most over their grant first, until the shortfall is covered. It also
+// returns the shortfall of the devices by uuid.
+func PlanReclaim(snap NodeSnapshot, class func(namespace, pod string) string) ([]ReclaimVictim, map[string]uint64) {
+	var victims []ReclaimVictim
+	shortfalls := make(map[string]uint64)
+	for _, d := range snap.Devices {
+		var entitled uint64
+		used := make(map[string]*ReclaimVictim)
+		for _, s := range d.Containers {
+			switch class(s.Namespace, s.Pod) {
+			case util.Guaranteed:
+				if s.MemoryLimit > s.MemoryUsed {
+					entitled += s.MemoryLimit - s.MemoryUsed
+				}
+			case util.BestEffort:
+				key := s.Namespace + "/" + s.Pod
+				v, ok := used[key]
+				if !ok {
+					v = &ReclaimVictim{Namespace: s.Namespace, Pod: s.Pod, Device: d.UUID}
+					used[key] = v
+				}
+				v.Used += s.MemoryUsed
+				if s.MemoryUsed > s.MemoryLimit {
+					v.Over += s.MemoryUsed - s.MemoryLimit
+				}
+			}
+		}
+		free := uint64(0)
+		if d.MemoryTotal > d.MemoryUsed {
+			free = d.MemoryTotal - d.MemoryUsed
+		}
+		if entitled <= free {
+			continue
+		}
+		shortfall := entitled - free
+		shortfalls[d.UUID] = shortfall
+		var candidates []*ReclaimVictim
+		for _, v := range used {
+			if v.Over > 0 {
+				candidates = append(candidates, v)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Over != candidates[j].Over {
+				return candidates[i].Over > candidates[j].Over
+			}
+			return candidates[i].Namespace+"/"+candidates[i].Pod < candidates[j].Namespace+"/"+candidates[j].Pod
+		})
+		var freed uint64
+		for _, v := range candidates {
+			if freed >= shortfall {
+				break
+			}
+			victims = append(victims, *v)
+			freed += v.Used
+		}
+	}
+	return victims, shortfalls
+}
+
+// memoryReclaimer evicts the best-effort pods taking the memory granted to
+// guaranteed pods of the same GPU.
+type memoryReclaimer struct {
+	dryRun bool
+	// cooldown keeps an evicted pod from being evicted again while it
+	// terminates.
+	cooldown time.Duration
+
+	mutex      sync.Mutex
+	shortfalls map[string]uint64
+	indexes    map[string]int
+	evicted    map[string]time.Time
+	results    map[string]float64
+	reclaimed  float64
+}
+
+func newMemoryReclaimer(dryRun bool, cooldown time.Duration) *memoryReclaimer {
+	return &memoryReclaimer{
+		dryRun:     dryRun,
+		cooldown:   cooldown,
+		shortfalls: make(map[string]uint64),
+		indexes:    make(map[string]int),
+		evicted:    make(map[string]time.Time),
+		results:    make(map[string]float64),
+	}
+}
+
+// Run reclaims memory every interval, it never returns.
+func (r *memoryReclaimer) Run(cm *ClusterManager, interval time.Duration) {
+	klog.Infof("Reclaiming memory for guaranteed vGPUs every %v, dry run %v", interval, r.dryRun)
+	for {
+		r.Step(cm, cm.Snapshot(), time.Now())
+		time.Sleep(interval)
+	}
+}
+
+func (r *memoryReclaimer) Step(cm *ClusterManager, snap NodeSnapshot, now time.Time) {
+	class := func(namespace, name string) string {
+		pod, err := cm.PodLister.Pods(namespace).Get(name)
+		if err != nil {
+			return util.Restricted
+		}
+		return vgpuClass(pod)
+	}
+	victims, shortfalls := PlanReclaim(snap, class)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.shortfalls = shortfalls
+	for _, d := range snap.Devices {
+		r.indexes[d.UUID] = d.Index
+	}
+	for key, t := range r.evicted {
+		if now.Sub(t) > r.cooldown {
+			delete(r.evicted, key)
+		}
+	}
+	for _, v := range victims {
+		key := v.Namespace + "/" + v.Pod
+		if _, ok := r.evicted[key]; ok {
+			continue
+		}
+		klog.Infof("Reclaiming device %s: evicting best-effort pod %s using %d bytes, %d over its grant (dry run %v)",
+			v.Device, key, v.Used, v.Over, r.dryRun)
+		if r.dryRun {
+			r.results["dry-run"]++
+			continue
+		}
+		err := cm.containerLister.Clientset().CoreV1().Pods(v.Namespace).Evict(context.Background(), &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Namespace: v.Namespace, Name: v.Pod},
+		})
+		if err != nil {
+			klog.Errorf("Failed to evict pod %s: %v", key, err)
+			r.results["error"]++
+			continue
+		}
+		r.evicted[key] = now
+		r.results["evicted"]++
+		r.reclaimed += float64(v.Used)
+	}
+}
+
+func describeReclaim(ch chan<- *prometheus.Desc) {
+	ch <- reclaimShortfallDesc
+	ch <- reclaimEvictionsDesc
+	ch <- reclaimMemoryDesc
+}
+
+// collect exports the state of the last step, nothing while the reclaimer
+// is disabled.
+func (r *memoryReclaimer) collect(ch chan<- prometheus.Metric) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for uuid, v := range r.shortfalls {
+		ch <- prometheus.MustNewConstMetric(reclaimShortfallDesc, prometheus.GaugeValue, float64(v), fmt.Sprint(r.indexes[uuid]), uuid)
+	}
+	for result, v := range r.results {
+		ch <- prometheus.MustNewConstMetric(reclaimEvictionsDesc, prometheus.CounterValue, v, result)
+	}
+	ch <- prometheus.MustNewConstMetric(reclaimMemoryDesc, prometheus.CounterValue, r.reclaimed)
+}
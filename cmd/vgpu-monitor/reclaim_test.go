@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func classes(m map[string]string) func(namespace, pod string) string {
+	return func(namespace, pod string) string {
+		if c, ok := m[namespace+"/"+pod]; ok {
+			return c
+		}
+		return util.Restricted
+	}
+}
+
+func TestVGPUClass(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		output      string
+	}{
+		{annotations: nil, output: util.Restricted},
+		{annotations: map[string]string{QoSAnnotation: util.BestEffort, util.TaskPriorityAnnotation: "high"}, output: util.BestEffort},
+		{annotations: map[string]string{QoSAnnotation: "unknown", util.TaskPriorityAnnotation: "high"}, output: util.Guaranteed},
+		{annotations: map[string]string{util.TaskPriorityAnnotation: "low"}, output: util.BestEffort},
+		{annotations: map[string]string{util.TaskPriorityAnnotation: "medium"}, output: util.Restricted},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}}
+			require.Equal(t, tc.output, vgpuClass(pod))
+		})
+	}
+}
+
+func TestPlanReclaim(t *testing.T) {
+	// gpu-0 has 2000 free, the guaranteed pod is granted 8000 and uses 2000,
+	// it is short of 4000.
+	snap := NodeSnapshot{Devices: []DeviceSnapshot{{
+		UUID:        "gpu-0",
+		MemoryTotal: 16000,
+		MemoryUsed:  14000,
+		Containers: []SliceSnapshot{
+			{Namespace: "ns", Pod: "guaranteed", MemoryLimit: 8000, MemoryUsed: 2000},
+			{Namespace: "ns", Pod: "be1", MemoryLimit: 1000, MemoryUsed: 3000},
+			{Namespace: "ns", Pod: "be2", MemoryLimit: 2000, MemoryUsed: 3000},
+			{Namespace: "ns", Pod: "be2", MemoryLimit: 2000, MemoryUsed: 2000},
+			{Namespace: "ns", Pod: "be3", MemoryLimit: 2000, MemoryUsed: 2000},
+			{Namespace: "ns", Pod: "restricted", MemoryLimit: 1000, MemoryUsed: 2000},
+		},
+	}}}
+	testCases := []struct {
+		classes    map[string]string
+		victims    []ReclaimVictim
+		shortfalls map[string]uint64
+	}{
+		{
+			// be1 is the most over its grant but doesn't free enough, be3
+			// isn't over it.
+			classes: map[string]string{
+				"ns/guaranteed": util.Guaranteed, "ns/be1": util.BestEffort, "ns/be2": util.BestEffort, "ns/be3": util.BestEffort,
+			},
+			victims: []ReclaimVictim{
+				{Namespace: "ns", Pod: "be1", Device: "gpu-0", Over: 2000, Used: 3000},
+				{Namespace: "ns", Pod: "be2", Device: "gpu-0", Over: 1000, Used: 5000},
+			},
+			shortfalls: map[string]uint64{"gpu-0": 4000},
+		},
+		{
+			classes:    map[string]string{"ns/guaranteed": util.Guaranteed},
+			shortfalls: map[string]uint64{"gpu-0": 4000},
+		},
+		{
+			classes:    map[string]string{"ns/be1": util.BestEffort},
+			shortfalls: map[string]uint64{},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			victims, shortfalls := PlanReclaim(snap, classes(tc.classes))
+			require.Equal(t, tc.victims, victims)
+			require.Equal(t, tc.shortfalls, shortfalls)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var regionLabels = []string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}
+
+// Descriptors of the state libvgpu and the monitor share in the region of
+// every container device, to debug the core limiting: the feedback loop of
+// the monitor counts down the recent kernels of the containers and turns on
+// the utilization switch, or blocks the kernels, of those sharing a device
+// with higher priority work.
+var (
+	ctrRegionPriorityDesc = prometheus.NewDesc(
+		"vgpu_container_region_priority",
+		"Priority of the container in its shared region, 0 is the highest",
+		regionLabels, nil,
+	)
+	ctrRegionUtilizationSwitchDesc = prometheus.NewDesc(
+		"vgpu_container_region_utilization_switch",
+		"Whether the monitor turned on the core limit of the container, set while a task of higher or the same priority uses the device",
+		regionLabels, nil,
+	)
+	ctrRegionRecentKernelDesc = prometheus.NewDesc(
+		"vgpu_container_region_recent_kernel",
+		"Recent kernel counter of the container, set by libvgpu on a kernel launch and counted down by the monitor, negative while its kernels are blocked",
+		regionLabels, nil,
+	)
+	ctrRegionKernelBlockedDesc = prometheus.NewDesc(
+		"vgpu_container_region_kernel_blocked",
+		"Whether the monitor blocks the kernels of the container for a task of higher priority on the device",
+		regionLabels, nil,
+	)
+	ctrRegionDecoderUtilizationDesc = prometheus.NewDesc(
+		"vgpu_container_region_decoder_utilization_ratio",
+		"Decoder utilization of the container recorded by libvgpu as a ratio",
+		regionLabels, nil,
+	)
+	ctrRegionEncoderUtilizationDesc = prometheus.NewDesc(
+		"vgpu_container_region_encoder_utilization_ratio",
+		"Encoder utilization of the container recorded by libvgpu as a ratio",
+		regionLabels, nil,
+	)
+)
+
+func describeRegion(ch chan<- *prometheus.Desc) {
+	ch <- ctrRegionPriorityDesc
+	ch <- ctrRegionUtilizationSwitchDesc
+	ch <- ctrRegionRecentKernelDesc
+	ch <- ctrRegionKernelBlockedDesc
+	ch <- ctrRegionDecoderUtilizationDesc
+	ch <- ctrRegionEncoderUtilizationDesc
+}
+
+// collectRegion exports the state of the shared regions of the containers by
+// device. The regions of the supported layouts don't record the errors of the
+// CUDA calls nor a token bucket, the core limit is the utilization switch.
+func collectRegion(ch chan<- prometheus.Metric, matched []matchedContainer) {
+	for _, mc := range matched {
+		info := mc.Usage.Info
+		if info == nil {
+			continue
+		}
+		priority := float64(info.GetPriority())
+		utilizationSwitch := float64(info.GetUtilizationSwitch())
+		recentKernel := info.GetRecentKernel()
+		for i := 0; i < info.DeviceNum(); i++ {
+			labels := []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), info.DeviceUUID(i)}
+			ch <- prometheus.MustNewConstMetric(ctrRegionPriorityDesc, prometheus.GaugeValue, priority, labels...)
+			ch <- prometheus.MustNewConstMetric(ctrRegionUtilizationSwitchDesc, prometheus.GaugeValue, utilizationSwitch, labels...)
+			ch <- prometheus.MustNewConstMetric(ctrRegionRecentKernelDesc, prometheus.GaugeValue, float64(recentKernel), labels...)
+			ch <- prometheus.MustNewConstMetric(ctrRegionKernelBlockedDesc, prometheus.GaugeValue, boolToFloat(recentKernel < 0), labels...)
+			ch <- prometheus.MustNewConstMetric(ctrRegionDecoderUtilizationDesc, prometheus.GaugeValue, float64(info.DeviceDecUtil(i))/100, labels...)
+			ch <- prometheus.MustNewConstMetric(ctrRegionEncoderUtilizationDesc, prometheus.GaugeValue, float64(info.DeviceEncUtil(i))/100, labels...)
+		}
+	}
+}
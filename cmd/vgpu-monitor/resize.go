@@ -0,0 +1,295 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MemoryResizeAnnotation resizes the vGPU memory of the running
+	// containers of a pod, comma-separated container=memory pairs in the
+	// unit of volcano.sh/vgpu-memory, e.g. server=8192.
+	MemoryResizeAnnotation = "volcano.sh/vgpu-memory-resize"
+	// MemoryResizeStatusAnnotation reports the last resize of the pod,
+	// applied or rejected with the reason.
+	MemoryResizeStatusAnnotation = "volcano.sh/vgpu-memory-resize-status"
+
+	memoryResizeApplied = "applied"
+)
+
+var memoryResizesDesc = prometheus.NewDesc(
+	"vgpu_memory_resizes_total",
+	"Resizes of the vGPU memory of the containers requested with the "+MemoryResizeAnnotation+" annotation, by result: applied, rejected or error",
+	[]string{"result"}, nil,
+)
+
+// parseMemoryResize returns the memory of every container of the resize
+// annotation.
+func parseMemoryResize(value string) (map[string]int32, error) {
+	res := make(map[string]int32)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid container memory %q, expected container=memory", pair)
+		}
+		memory, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil || memory <= 0 {
+			return nil, fmt.Errorf("invalid memory %q of container %s", parts[1], parts[0])
+		}
+		res[parts[0]] = int32(memory)
+	}
+	return res, nil
+}
+
+// memoryResizer applies the resizes of the vGPU memory annotated on the
+// pods of the node to the shared regions of their containers, for the
+// inference services adjusting their quota to the traffic without a
+// restart. The grants of the pod are updated too, for the scheduler to
+// account for the new sizes.
+type memoryResizer struct {
+	mutex   sync.Mutex
+	results map[string]float64
+}
+
+func newMemoryResizer() *memoryResizer {
+	return &memoryResizer{results: make(map[string]float64)}
+}
+
+// Run applies the resizes every interval, it never returns.
+func (r *memoryResizer) Run(cm *ClusterManager, interval time.Duration) {
+	klog.Infof("Resizing the vGPU memory of the annotated pods every %v", interval)
+	for {
+		r.Step(cm)
+		time.Sleep(interval)
+	}
+}
+
+// memoryLimit is a limit to set in the shared region of a container.
+type memoryLimit struct {
+	info  nvidia.UsageInfo
+	idx   int
+	bytes uint64
+}
+
+func (r *memoryResizer) Step(cm *ClusterManager) {
+	pods, err := cm.PodLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list the pods to resize: %v", err)
+		return
+	}
+	// The limits are written in the shared regions before they are released.
+	matched := cm.MatchContainers(pods)
+	defer cm.ReleaseContainers(matched)
+	containers := make(map[string][]matchedContainer)
+	for _, mc := range matched {
+		if _, ok := mc.Pod.Annotations[MemoryResizeAnnotation]; ok && mc.Usage.Info != nil {
+			containers[string(mc.Pod.UID)] = append(containers[string(mc.Pod.UID)], mc)
+		}
+	}
+	if len(containers) == 0 {
+		return
+	}
+	node, err := util.GetNode(nodeName)
+	if err != nil {
+		klog.Errorf("Failed to get node %s: %v", nodeName, err)
+		return
+	}
+	capacity := make(map[string]int32)
+	for _, d := range util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered]) {
+		capacity[d.Id] = d.Devmem
+	}
+	granted := make(map[string]int32)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != nodeName || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			for _, cd := range ctr {
+				granted[cd.UUID] += cd.Usedmem
+			}
+		}
+	}
+	for _, pod := range pods {
+		if mcs, ok := containers[string(pod.UID)]; ok {
+			r.resize(pod, mcs, capacity, granted)
+		}
+	}
+}
+
+// resize applies the resize annotation of the pod to its running containers
+// mcs, within the capacity of the devices left by the grants. The grants
+// are updated on success.
+func (r *memoryResizer) resize(pod *corev1.Pod, mcs []matchedContainer, capacity, granted map[string]int32) {
+	key := pod.Namespace + "/" + pod.Name
+	assigned := util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+	limits, deltas, err := planMemoryResize(pod, mcs, assigned, capacity, granted)
+	if err != nil {
+		status := "rejected: " + err.Error()
+		if pod.Annotations[MemoryResizeStatusAnnotation] == status {
+			return
+		}
+		klog.Warningf("Rejecting the vGPU memory resize of pod %s: %v", key, err)
+		r.record("rejected")
+		if err := util.PatchPodAnnotations(pod, map[string]string{MemoryResizeStatusAnnotation: status}); err != nil {
+			klog.Errorf("Failed to report the vGPU memory resize of pod %s: %v", key, err)
+		}
+		return
+	}
+	if len(limits) == 0 && len(deltas) == 0 && pod.Annotations[MemoryResizeStatusAnnotation] == memoryResizeApplied {
+		return
+	}
+	// The grants are updated first, the scheduler must not place pods in
+	// the memory a container grows into.
+	annotations := map[string]string{MemoryResizeStatusAnnotation: memoryResizeApplied}
+	if len(deltas) > 0 {
+		annotations[util.AssignedIDsAnnotations] = util.EncodePodDevices(assigned)
+	}
+	if err := util.PatchPodAnnotations(pod, annotations); err != nil {
+		klog.Errorf("Failed to update the vGPU grants of pod %s: %v", key, err)
+		r.record("error")
+		return
+	}
+	for uuid, delta := range deltas {
+		granted[uuid] += delta
+	}
+	for _, l := range limits {
+		l.info.SetDeviceMemoryLimit(l.idx, l.bytes)
+	}
+	klog.Infof("Resized the vGPU memory of pod %s: %s", key, pod.Annotations[MemoryResizeAnnotation])
+	r.record(memoryResizeApplied)
+}
+
+// planMemoryResize returns the limits to set in the shared regions of the
+// containers and the changes of the grants by device, it updates assigned
+// with the new sizes. A container can't shrink below the memory it uses, nor
+// grow beyond the memory of its devices left by the other grants.
+func planMemoryResize(pod *corev1.Pod, mcs []matchedContainer, assigned util.PodDevices,
+	capacity, granted map[string]int32) ([]memoryLimit, map[string]int32, error) {
+	sizes, err := parseMemoryResize(pod.Annotations[MemoryResizeAnnotation])
+	if err != nil {
+		return nil, nil, err
+	}
+	indexes := make(map[string]int)
+	for i, ctr := range pod.Spec.Containers {
+		indexes[ctr.Name] = i
+	}
+	running := make(map[string]nvidia.UsageInfo)
+	for _, mc := range mcs {
+		running[mc.ContainerName] = mc.Usage.Info
+	}
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var limits []memoryLimit
+	deltas := make(map[string]int32)
+	unit := uint64(config.GPUMemoryFactor) << 20
+	if unit == 0 {
+		unit = 1 << 20
+	}
+	for _, name := range names {
+		size := sizes[name]
+		idx, ok := indexes[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("no container %s", name)
+		}
+		if idx >= len(assigned) || len(assigned[idx]) == 0 {
+			return nil, nil, fmt.Errorf("container %s has no vGPU", name)
+		}
+		info, ok := running[name]
+		if !ok {
+			// Resized once its hook creates the shared region.
+			continue
+		}
+		for j, cd := range assigned[idx] {
+			region := -1
+			for i := 0; i < info.DeviceNum(); i++ {
+				if info.DeviceUUID(i) == cd.UUID {
+					region = i
+					break
+				}
+			}
+			if region < 0 {
+				return nil, nil, fmt.Errorf("device %s of container %s not in its shared region", cd.UUID, name)
+			}
+			bytes := uint64(size) * unit
+			if used := info.DeviceMemoryTotal(region); bytes < used {
+				klog.V(4).Infof("Container %s of pod %s/%s uses %d bytes of device %s", name, pod.Namespace, pod.Name, used, cd.UUID)
+				return nil, nil, fmt.Errorf("container %s uses more than %d of device %s", name, size, cd.UUID)
+			}
+			if delta := size - cd.Usedmem; delta != 0 {
+				if delta > 0 && granted[cd.UUID]+deltas[cd.UUID]+delta > capacity[cd.UUID] {
+					return nil, nil, fmt.Errorf("device %s has %d left for container %s to grow by %d",
+						cd.UUID, capacity[cd.UUID]-granted[cd.UUID]-deltas[cd.UUID], name, delta)
+				}
+				deltas[cd.UUID] += delta
+				assigned[idx][j].Usedmem = size
+			}
+			if info.DeviceMemoryLimit(region) != bytes {
+				limits = append(limits, memoryLimit{info: info, idx: region, bytes: bytes})
+			}
+		}
+	}
+	return limits, deltas, nil
+}
+
+func (r *memoryResizer) record(result string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results[result]++
+}
+
+func describeResize(ch chan<- *prometheus.Desc) {
+	if memoryResizeInterval <= 0 {
+		return
+	}
+	ch <- memoryResizesDesc
+}
+
+// collect exports the results of the resizes, nothing while the resizes are
+// disabled.
+func (r *memoryResizer) collect(ch chan<- prometheus.Metric) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, result := range []string{memoryResizeApplied, "rejected", "error"} {
+		ch <- prometheus.MustNewConstMetric(memoryResizesDesc, prometheus.CounterValue, r.results[result], result)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeUsageInfo is the shared region of a container, in MiB, only the
+// methods planMemoryResize calls are implemented.
+type fakeUsageInfo struct {
+	nvidia.UsageInfo
+	uuids  []string
+	used   []uint64
+	limits []uint64
+}
+
+func (f *fakeUsageInfo) DeviceNum() int                   { return len(f.uuids) }
+func (f *fakeUsageInfo) DeviceUUID(idx int) string        { return f.uuids[idx] }
+func (f *fakeUsageInfo) DeviceMemoryTotal(idx int) uint64 { return f.used[idx] << 20 }
+func (f *fakeUsageInfo) DeviceMemoryLimit(idx int) uint64 { return f.limits[idx] << 20 }
+
+func TestParseMemoryResize(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output map[string]int32
+		err    bool
+	}{
+		{input: "server=8192, sidecar=1024", output: map[string]int32{"server": 8192, "sidecar": 1024}},
+		{input: "server=8192,,", output: map[string]int32{"server": 8192}},
+		{input: "", output: map[string]int32{}},
+		{input: "server", err: true},
+		{input: "=8192", err: true},
+		{input: "server=0", err: true},
+		{input: "server=8G", err: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			output, err := parseMemoryResize(tc.input)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.output, output)
+		})
+	}
+}
+
+func TestPlanMemoryResize(t *testing.T) {
+	info := &fakeUsageInfo{uuids: []string{"gpu-0"}, used: []uint64{3000}, limits: []uint64{4000}}
+	testCases := []struct {
+		resize  string
+		running bool
+		limits  []memoryLimit
+		deltas  map[string]int32
+		// usedmem is the size of the vGPU of the server after the call.
+		usedmem int32
+		err     bool
+	}{
+		{
+			resize:  "server=8000",
+			running: true,
+			limits:  []memoryLimit{{info: info, idx: 0, bytes: 8000 << 20}},
+			deltas:  map[string]int32{"gpu-0": 4000},
+			usedmem: 8000,
+		},
+		{
+			resize:  "server=3500",
+			running: true,
+			limits:  []memoryLimit{{info: info, idx: 0, bytes: 3500 << 20}},
+			deltas:  map[string]int32{"gpu-0": -500},
+			usedmem: 3500,
+		},
+		{resize: "server=4000", running: true, deltas: map[string]int32{}, usedmem: 4000},
+		// Resized once the shared region is created.
+		{resize: "server=8000", deltas: map[string]int32{}, usedmem: 4000},
+		// Below the memory used.
+		{resize: "server=2000", running: true, usedmem: 4000, err: true},
+		// Beyond the 4000 left on the device.
+		{resize: "server=10000", running: true, usedmem: 4000, err: true},
+		{resize: "sidecar=1000", running: true, usedmem: 4000, err: true},
+		{resize: "unknown=1000", running: true, usedmem: 4000, err: true},
+		{resize: "server=big", running: true, usedmem: 4000, err: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "ns",
+					Name:        "inference",
+					Annotations: map[string]string{MemoryResizeAnnotation: tc.resize},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "server"}, {Name: "sidecar"}}},
+			}
+			var mcs []matchedContainer
+			if tc.running {
+				mcs = append(mcs, matchedContainer{Pod: pod, ContainerName: "server", Usage: &nvidia.ContainerUsage{Info: info}})
+			}
+			assigned := util.PodDevices{{{UUID: "gpu-0", Usedmem: 4000}}, {}}
+			capacity := map[string]int32{"gpu-0": 16000}
+			granted := map[string]int32{"gpu-0": 12000}
+
+			limits, deltas, err := planMemoryResize(pod, mcs, assigned, capacity, granted)
+			require.Equal(t, tc.usedmem, assigned[0][0].Usedmem)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.limits, limits)
+			require.Equal(t, tc.deltas, deltas)
+		})
+	}
+}
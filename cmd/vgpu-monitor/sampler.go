@@ -0,0 +1,120 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Descriptors of the background sampling, left out with a --sample-interval
+// of 0.
+var (
+	sampleAgeDesc = prometheus.NewDesc(
+		"vgpu_monitor_sample_age_seconds",
+		"Seconds since the metrics served were sampled",
+		nil, nil,
+	)
+	sampleDurationDesc = prometheus.NewDesc(
+		"vgpu_monitor_sample_duration_seconds",
+		"Time the last sampling of the metrics took",
+		nil, nil,
+	)
+)
+
+// metricsSampler collects the metrics in the background and keeps the last
+// sample of every collector, the scrapes only serve it: their latency
+// doesn't grow with the containers of the node, at the cost of metrics up
+// to an interval old. It is itself the collector of its age and duration.
+type metricsSampler struct {
+	mutex     sync.Mutex
+	sampled   chan struct{}
+	metrics   map[string][]prometheus.Metric
+	sampledAt time.Time
+	duration  time.Duration
+}
+
+func newMetricsSampler() *metricsSampler {
+	return &metricsSampler{sampled: make(chan struct{})}
+}
+
+// Run samples the metrics by the collections, by collector name, every
+// interval, the first time right away.
+func (s *metricsSampler) Run(collects map[string]func(chan<- prometheus.Metric), interval time.Duration) {
+	for {
+		start := time.Now()
+		metrics := make(map[string][]prometheus.Metric, len(collects))
+		for name, collect := range collects {
+			metrics[name] = gatherMetrics(collect)
+		}
+		duration := time.Since(start)
+		if duration > interval {
+			klog.Warningf("Sampling the metrics took %s, longer than the sample interval %s", duration, interval)
+		}
+		s.mutex.Lock()
+		first := s.sampledAt.IsZero()
+		s.metrics, s.sampledAt, s.duration = metrics, start, duration
+		s.mutex.Unlock()
+		if first {
+			close(s.sampled)
+		}
+		time.Sleep(interval - duration)
+	}
+}
+
+// age returns how old the last sample is, false before the first one.
+func (s *metricsSampler) age() (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sampledAt.IsZero() {
+		return 0, false
+	}
+	return time.Since(s.sampledAt), true
+}
+
+// collect serves the last sample of the collector, it waits for the first
+// one.
+func (s *metricsSampler) collect(name string, ch chan<- prometheus.Metric) {
+	<-s.sampled
+	s.mutex.Lock()
+	metrics := s.metrics[name]
+	s.mutex.Unlock()
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+func (s *metricsSampler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sampleAgeDesc
+	ch <- sampleDurationDesc
+}
+
+// Collect exports the age and the duration of the last sample, nothing
+// before the first one.
+func (s *metricsSampler) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	sampledAt, duration := s.sampledAt, s.duration
+	s.mutex.Unlock()
+	if sampledAt.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(sampleAgeDesc, prometheus.GaugeValue, time.Since(sampledAt).Seconds())
+	ch <- prometheus.MustNewConstMetric(sampleDurationDesc, prometheus.GaugeValue, duration.Seconds())
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// containerMetricsReadyDesc tells whether the container series are served.
+// Until the containers of the monitor path and the pods of the node are
+// synced, the container series are left out rather than reported as zero,
+// so a restart of the monitor shows as a gap in the dashboards, not a dip.
+var containerMetricsReadyDesc = prometheus.NewDesc(
+	"vgpu_monitor_container_metrics_ready",
+	"Whether the container lister and the pod cache are synced and the container series are served",
+	nil, nil,
+)
+
+func describeScrape(ch chan<- *prometheus.Desc) {
+	ch <- containerMetricsReadyDesc
+}
+
+// ContainersReady reports whether the containers and the pods are synced,
+// the containers matched before may be missing or belong to unknown pods.
+func (c *ClusterManager) ContainersReady() bool {
+	return c.containerLister.Synced() && (c.podsSynced == nil || c.podsSynced())
+}
+
+// scrapeDeduper runs one collection at a time: the scrapes arriving while
+// one runs wait for it and get its metrics, they are all consistent with a
+// single snapshot of the node and the collection cost is paid once.
+type scrapeDeduper struct {
+	mutex    sync.Mutex
+	inflight *scrape
+}
+
+type scrape struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+}
+
+// do returns the metrics of the collection in flight, or of a new one by
+// collect when none is.
+func (d *scrapeDeduper) do(collect func(chan<- prometheus.Metric)) []prometheus.Metric {
+	d.mutex.Lock()
+	if s := d.inflight; s != nil {
+		d.mutex.Unlock()
+		<-s.done
+		return s.metrics
+	}
+	s := &scrape{done: make(chan struct{})}
+	d.inflight = s
+	d.mutex.Unlock()
+
+	s.metrics = gatherMetrics(collect)
+	d.mutex.Lock()
+	d.inflight = nil
+	d.mutex.Unlock()
+	close(s.done)
+	return s.metrics
+}
+
+// gatherMetrics returns the metrics collect sends.
+func gatherMetrics(collect func(chan<- prometheus.Metric)) []prometheus.Metric {
+	var res []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		res = append(res, m)
+	}
+	return res
+}
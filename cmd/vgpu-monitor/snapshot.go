@@ -0,0 +1,142 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// NodeSnapshot is the allocation and usage state of the GPUs of the node.
+type NodeSnapshot struct {
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	// ContainersReady is false until the containers and the pods are
+	// synced, the Containers of the devices are left empty until then.
+	ContainersReady bool             `json:"containersReady"`
+	Devices         []DeviceSnapshot `json:"devices"`
+}
+
+// DeviceSnapshot is a physical GPU or a MIG device of one, and the vGPU
+// slices carved out of it.
+type DeviceSnapshot struct {
+	Index int    `json:"index"`
+	UUID  string `json:"uuid"`
+	// Parent is the UUID of the GPU of a MIG device, MigProfile its profile.
+	Parent      string `json:"parent,omitempty"`
+	MigProfile  string `json:"migProfile,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Healthy     bool   `json:"healthy"`
+	MemoryTotal uint64 `json:"memoryTotal"`
+	MemoryUsed  uint64 `json:"memoryUsed"`
+	Utilization uint32 `json:"utilization"`
+	// Slices is the number of vGPUs the device plugin splits the device in.
+	Slices     int32           `json:"slices"`
+	Containers []SliceSnapshot `json:"containers"`
+}
+
+// SliceSnapshot is a container using a vGPU of a device.
+type SliceSnapshot struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// VDevice is the index of the device in the shared region of the
+	// container.
+	VDevice     int    `json:"vdevice"`
+	MemoryLimit uint64 `json:"memoryLimit"`
+	MemoryUsed  uint64 `json:"memoryUsed"`
+	SmLimit     uint64 `json:"smLimit"`
+	SmUtil      uint64 `json:"smUtil"`
+}
+
+// Snapshot assembles the state of the node from NVML, the device registry
+// annotation of the node and the shared regions of the containers.
+func (c *ClusterManager) Snapshot() NodeSnapshot {
+	snap := NodeSnapshot{Node: nodeName, Time: time.Now()}
+	registered := make(map[string]*util.DeviceInfo)
+	node, err := c.containerLister.Clientset().CoreV1().Nodes().Get(context.Background(), snap.Node, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Failed to get node %s: %v", snap.Node, err)
+	} else {
+		for _, d := range util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered]) {
+			registered[d.Id] = d
+		}
+	}
+	byUUID := make(map[string]int)
+	devices := c.containerLister.Devices()
+	for _, dev := range append(append([]nvidia.Device(nil), devices.Devices()...), devices.MigDevices()...) {
+		hdev, uuid := dev.Handle, dev.UUID
+		d := DeviceSnapshot{Index: dev.Index, UUID: uuid, Healthy: true, Containers: []SliceSnapshot{}}
+		if dev.Mig != nil {
+			d.Parent, d.MigProfile = dev.Mig.ParentUUID, dev.Mig.Profile
+		}
+		if memory, ret := hdev.GetMemoryInfo(); ret == nvml.SUCCESS {
+			d.MemoryTotal, d.MemoryUsed = memory.Total, memory.Used
+		} else if ret == nvml.ERROR_GPU_IS_LOST {
+			d.Healthy = false
+		}
+		if rates, ret := hdev.GetUtilizationRates(); ret == nvml.SUCCESS {
+			d.Utilization = rates.Gpu
+		}
+		if r, ok := registered[uuid]; ok {
+			d.Type, d.Slices = r.Type, r.Count
+			d.Healthy = d.Healthy && r.Health
+		}
+		byUUID[uuid] = len(snap.Devices)
+		snap.Devices = append(snap.Devices, d)
+	}
+	pods, err := c.PodLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list pods: %v", err)
+	}
+	snap.ContainersReady = err == nil && c.ContainersReady()
+	if !snap.ContainersReady {
+		return snap
+	}
+	matched := c.MatchContainers(pods)
+	defer c.ReleaseContainers(matched)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			idx, ok := byUUID[mc.Usage.Info.DeviceUUID(i)]
+			if !ok {
+				continue
+			}
+			snap.Devices[idx].Containers = append(snap.Devices[idx].Containers, SliceSnapshot{
+				Namespace:   mc.Pod.Namespace,
+				Pod:         mc.Pod.Name,
+				Container:   mc.ContainerName,
+				VDevice:     i,
+				MemoryLimit: mc.Usage.Info.DeviceMemoryLimit(i),
+				MemoryUsed:  mc.Usage.Info.DeviceMemoryTotal(i),
+				SmLimit:     mc.Usage.Info.DeviceSmLimit(i),
+				SmUtil:      mc.Usage.Info.DeviceSmUtil(i),
+			})
+		}
+	}
+	return snap
+}
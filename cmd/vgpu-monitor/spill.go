@@ -0,0 +1,103 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptors of the memory the vGPUs of the pods annotated with the host
+// memory fallback spill out of their GPU.
+var (
+	ctrMemorySpilledDesc = prometheus.NewDesc(
+		"vgpu_container_memory_spilled_bytes",
+		"Memory of the vGPU of a container with the host memory fallback held in host memory, what libvgpu accounts for over what the driver sees on the GPU",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	hostGPUMemorySpilledDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_memory_spilled_bytes",
+		"Memory of the vGPUs of the GPU held in host memory by the containers with the host memory fallback",
+		[]string{"deviceidx", "deviceuuid"}, nil,
+	)
+)
+
+func describeSpill(ch chan<- *prometheus.Desc) {
+	ch <- ctrMemorySpilledDesc
+	ch <- hostGPUMemorySpilledDesc
+}
+
+// memoryFallback reports whether the vGPUs of the pod spill to host memory.
+func memoryFallback(mc matchedContainer) bool {
+	return mc.Pod.Annotations[util.MemoryFallbackAnnotation] == util.MemoryFallbackHost
+}
+
+// collectSpill exports the memory the containers with the host memory
+// fallback spill, the memory libvgpu accounts for on each vGPU less what the
+// driver reports for the processes of the container on the GPU. The
+// processes of a device are listed when not in listed already.
+func collectSpill(ch chan<- prometheus.Metric, matched []matchedContainer, devices []nvidia.Device, listed []*deviceProcesses) {
+	procs := make(map[string]*deviceProcesses, len(listed))
+	for _, p := range listed {
+		procs[p.uuid] = p
+	}
+	byUUID := make(map[string]nvidia.Device, len(devices))
+	for _, d := range devices {
+		byUUID[d.UUID] = d
+	}
+	spilled := make(map[string]uint64)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil || !memoryFallback(mc) {
+			continue
+		}
+		pids := mc.Usage.Info.HostPids()
+		if len(pids) == 0 {
+			continue
+		}
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			uuid := mc.Usage.Info.DeviceUUID(i)
+			p, ok := procs[uuid]
+			if !ok {
+				if d, found := byUUID[uuid]; found {
+					p = listDeviceProcesses(d.Handle, fmt.Sprint(d.Index), uuid)
+				}
+				procs[uuid] = p
+			}
+			if p == nil {
+				continue
+			}
+			var resident uint64
+			for _, pid := range pids {
+				resident += p.memory[uint32(pid)]
+			}
+			var spill uint64
+			if total := mc.Usage.Info.DeviceMemoryTotal(i); total > resident {
+				spill = total - resident
+			}
+			spilled[uuid] += spill
+			ch <- prometheus.MustNewConstMetric(ctrMemorySpilledDesc, prometheus.GaugeValue, float64(spill),
+				mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), uuid)
+		}
+	}
+	for uuid, v := range spilled {
+		ch <- prometheus.MustNewConstMetric(hostGPUMemorySpilledDesc, prometheus.GaugeValue, float64(v), procs[uuid].idx, uuid)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptors of the health of the monitor itself.
+var (
+	collectionDurationDesc = prometheus.NewDesc(
+		"vgpu_monitor_collection_duration_seconds",
+		"Time the last completed collection of the metrics took, by collector: host or container",
+		[]string{"collector"}, nil,
+	)
+	nvmlErrorsDesc = prometheus.NewDesc(
+		"vgpu_monitor_nvml_errors_total",
+		"Failed NVML calls by api, the features not supported by a device are not counted",
+		[]string{"api"}, nil,
+	)
+	regionLoadErrorsDesc = prometheus.NewDesc(
+		"vgpu_monitor_shared_region_load_errors_total",
+		"Failed loads of the shared region of a container, retried on every update",
+		nil, nil,
+	)
+	containerCacheEntriesDesc = prometheus.NewDesc(
+		"vgpu_monitor_container_cache_entries",
+		"Containers of the hook path known to the monitor",
+		nil, nil,
+	)
+	containerCacheAddedDesc = prometheus.NewDesc(
+		"vgpu_monitor_container_cache_added_total",
+		"Containers of the hook path found since the monitor started",
+		nil, nil,
+	)
+	containerCacheRemovedDesc = prometheus.NewDesc(
+		"vgpu_monitor_container_cache_removed_total",
+		"Containers of the hook path removed since the monitor started, as their pod was gone",
+		nil, nil,
+	)
+	gpuPresentDesc = prometheus.NewDesc(
+		"vgpu_node_gpu_present",
+		"Whether the node has a GPU NVML can see, 0 when the monitor runs degraded on a node without GPU",
+		nil, nil,
+	)
+	oldestUnloadedContainerDesc = prometheus.NewDesc(
+		"vgpu_monitor_oldest_unloaded_container_age_seconds",
+		"Seconds since the oldest container whose shared region is not loaded was found, 0 when there is none",
+		nil, nil,
+	)
+)
+
+// collectorTelemetry records the duration of the collections of the
+// collectors and is itself the collector of the health of the monitor.
+type collectorTelemetry struct {
+	lister *nvidia.ContainerLister
+
+	mutex     sync.Mutex
+	durations map[string]time.Duration
+}
+
+func newCollectorTelemetry(lister *nvidia.ContainerLister) *collectorTelemetry {
+	return &collectorTelemetry{lister: lister, durations: make(map[string]time.Duration)}
+}
+
+func (t *collectorTelemetry) observe(collector string, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.durations[collector] = d
+}
+
+func (t *collectorTelemetry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collectionDurationDesc
+	ch <- nvmlErrorsDesc
+	ch <- regionLoadErrorsDesc
+	ch <- oldestUnloadedContainerDesc
+	ch <- gpuPresentDesc
+	ch <- containerCacheEntriesDesc
+	ch <- containerCacheAddedDesc
+	ch <- containerCacheRemovedDesc
+}
+
+func (t *collectorTelemetry) Collect(ch chan<- prometheus.Metric) {
+	lister, now := t.lister, time.Now()
+	t.mutex.Lock()
+	for collector, duration := range t.durations {
+		ch <- prometheus.MustNewConstMetric(collectionDurationDesc, prometheus.GaugeValue, duration.Seconds(), collector)
+	}
+	t.mutex.Unlock()
+	errors := nvidia.NVMLErrors()
+	apis := make([]string, 0, len(errors))
+	for api := range errors {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+	for _, api := range apis {
+		ch <- prometheus.MustNewConstMetric(nvmlErrorsDesc, prometheus.CounterValue, float64(errors[api]), api)
+	}
+	ch <- prometheus.MustNewConstMetric(regionLoadErrorsDesc, prometheus.CounterValue, float64(lister.RegionErrors()))
+	age := 0.0
+	if oldest := lister.OldestUnloaded(); !oldest.IsZero() {
+		age = now.Sub(oldest).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(oldestUnloadedContainerDesc, prometheus.GaugeValue, age)
+	ch <- prometheus.MustNewConstMetric(gpuPresentDesc, prometheus.GaugeValue, boolToFloat(lister.Devices().Present()))
+	entries, added, removed := lister.CacheStats()
+	ch <- prometheus.MustNewConstMetric(containerCacheEntriesDesc, prometheus.GaugeValue, float64(entries))
+	ch <- prometheus.MustNewConstMetric(containerCacheAddedDesc, prometheus.CounterValue, float64(added))
+	ch <- prometheus.MustNewConstMetric(containerCacheRemovedDesc, prometheus.CounterValue, float64(removed))
+}
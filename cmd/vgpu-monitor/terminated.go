@@ -0,0 +1,154 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Descriptors of the last usage of the containers which exited, kept for
+// --terminated-retention after they left the hook path or stopped running.
+var (
+	terminatedLabels = prometheus.Labels{"terminated": "true"}
+
+	ctrLastMemoryUsedDesc = prometheus.NewDesc(
+		"vgpu_container_last_memory_used_bytes",
+		"Device memory used by the terminated container on the vGPU when it was last seen",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, terminatedLabels,
+	)
+	ctrLastMemoryLimitDesc = prometheus.NewDesc(
+		"vgpu_container_last_memory_limit_bytes",
+		"Device memory limit of the terminated container on the vGPU",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, terminatedLabels,
+	)
+	ctrLastSmUtilizationDesc = prometheus.NewDesc(
+		"vgpu_container_last_sm_utilization_ratio",
+		"SM utilization of the terminated container on the vGPU when it was last seen",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, terminatedLabels,
+	)
+	ctrTerminatedTimeDesc = prometheus.NewDesc(
+		"vgpu_container_terminated_timestamp_seconds",
+		"Time the container was last seen on the vGPU",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, terminatedLabels,
+	)
+)
+
+// deviceSnapshot is the usage of a container device at a collection.
+type deviceSnapshot struct {
+	labels      []string
+	memoryUsed  uint64
+	memoryLimit uint64
+	smUtil      float64
+}
+
+// terminatedContainer is the last usage of a container which exited.
+type terminatedContainer struct {
+	devices []deviceSnapshot
+	seen    time.Time
+}
+
+// terminatedContainers keeps the last usage of every container, exported for
+// a while once it exits so that the post-mortem queries still find the final
+// memory and utilization of the jobs, whose series stop with their pod.
+type terminatedContainers struct {
+	retention time.Duration
+
+	mutex      sync.Mutex
+	live       map[string][]deviceSnapshot
+	lastSeen   time.Time
+	terminated map[string]*terminatedContainer
+}
+
+// newTerminatedContainers returns nil when the retention is disabled.
+func newTerminatedContainers(retention time.Duration) *terminatedContainers {
+	if retention <= 0 {
+		return nil
+	}
+	return &terminatedContainers{
+		retention:  retention,
+		live:       make(map[string][]deviceSnapshot),
+		terminated: make(map[string]*terminatedContainer),
+	}
+}
+
+func describeTerminated(ch chan<- *prometheus.Desc) {
+	if terminatedRetention <= 0 {
+		return
+	}
+	ch <- ctrLastMemoryUsedDesc
+	ch <- ctrLastMemoryLimitDesc
+	ch <- ctrLastSmUtilizationDesc
+	ch <- ctrTerminatedTimeDesc
+}
+
+// collect records the usage of the matched containers and exports the last
+// usage of those which were matched before and are not anymore, until the
+// retention expires. A container is last seen at the previous collection.
+func (t *terminatedContainers) collect(ch chan<- prometheus.Metric, matched []matchedContainer, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	live := make(map[string][]deviceSnapshot)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", mc.Usage.PodUID, mc.ContainerName)
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			live[key] = append(live[key], deviceSnapshot{
+				labels:      []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), mc.Usage.Info.DeviceUUID(i)},
+				memoryUsed:  mc.Usage.Info.DeviceMemoryTotal(i),
+				memoryLimit: mc.Usage.Info.DeviceMemoryLimit(i),
+				smUtil:      float64(mc.Usage.Info.DeviceSmUtil(i)) / 100,
+			})
+		}
+		// A restarted container is live again.
+		delete(t.terminated, key)
+	}
+	for key, devices := range t.live {
+		if _, ok := live[key]; !ok {
+			t.terminated[key] = &terminatedContainer{devices: devices, seen: t.lastSeen}
+		}
+	}
+	t.live, t.lastSeen = live, now
+
+	keys := make([]string, 0, len(t.terminated))
+	for key, c := range t.terminated {
+		if now.Sub(c.seen) > t.retention {
+			delete(t.terminated, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := t.terminated[key]
+		for _, d := range c.devices {
+			ch <- prometheus.MustNewConstMetric(ctrLastMemoryUsedDesc, prometheus.GaugeValue, float64(d.memoryUsed), d.labels...)
+			ch <- prometheus.MustNewConstMetric(ctrLastMemoryLimitDesc, prometheus.GaugeValue, float64(d.memoryLimit), d.labels...)
+			ch <- prometheus.MustNewConstMetric(ctrLastSmUtilizationDesc, prometheus.GaugeValue, d.smUtil, d.labels...)
+			ch <- prometheus.MustNewConstMetric(ctrTerminatedTimeDesc, prometheus.GaugeValue, float64(c.seen.Unix()), d.labels...)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// CoreBurstAnnotation overrides --core-qos-burst for the containers of a
+// pod, the SM percents a vGPU may run over its cores while it has tokens.
+const CoreBurstAnnotation = "volcano.sh/vgpu-cores-burst"
+
+var (
+	ctrCoreAchievedShareDesc = prometheus.NewDesc(
+		"vgpu_container_device_core_achieved_share",
+		"SM utilization in percent of the container over the last core QoS interval, measured by the driver",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrCoreGuaranteedShareDesc = prometheus.NewDesc(
+		"vgpu_container_device_core_guaranteed_share",
+		"SM percents guaranteed to the container, its vgpu-cores",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrCoreBurstTokensDesc = prometheus.NewDesc(
+		"vgpu_container_device_core_burst_tokens",
+		"Tokens left in the bucket of the container, in SM percent-seconds it may run over its guaranteed share",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrCoreQoSLimitDesc = prometheus.NewDesc(
+		"vgpu_container_device_core_qos_limit",
+		"SM limit in percent written in the shared region of the container, enforced by libvgpu",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+)
+
+// coreBucket is the token bucket of a vGPU of a container. Its tokens fill
+// at the guaranteed share and drain at the achieved one, in SM
+// percent-seconds, up to the burst times --core-qos-burst-duration.
+type coreBucket struct {
+	namespace, pod, container string
+	idx                       int
+	uuid                      string
+
+	share    uint64
+	burst    uint64
+	tokens   float64
+	achieved float64
+	limit    uint64
+	updated  time.Time
+}
+
+// limitFor returns the SM limit of the bucket, its share with the burst on
+// top while it has tokens.
+func (b *coreBucket) limitFor() uint64 {
+	if b.tokens <= 0 || b.burst == 0 {
+		return b.share
+	}
+	if b.share+b.burst > 100 {
+		return 100
+	}
+	return b.share + b.burst
+}
+
+// observe accounts for the utilization achieved since the last update.
+func (b *coreBucket) observe(achieved float64, now time.Time, depth time.Duration) {
+	capacity := float64(b.burst) * depth.Seconds()
+	if !b.updated.IsZero() {
+		b.tokens += (float64(b.share) - achieved) * now.Sub(b.updated).Seconds()
+	}
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	if b.tokens < 0 {
+		b.tokens = 0
+	}
+	b.achieved = achieved
+	b.updated = now
+}
+
+// coreQoS enforces the cores of the vGPUs as a guaranteed share of the SM
+// time with a burst, rather than the best-effort throttling libvgpu does
+// once a GPU is shared. Every interval it measures the SM utilization of
+// every container with the driver, updates its token bucket and writes the
+// resulting limit in its shared region, with the limiter of libvgpu always
+// on.
+type coreQoS struct {
+	sampler  *processSampler
+	burst    uint64
+	depth    time.Duration
+	mutex    sync.Mutex
+	buckets  map[string]*coreBucket
+	managed  map[string]bool
+	warnings map[string]bool
+}
+
+func newCoreQoS(burst uint64, depth time.Duration) *coreQoS {
+	return &coreQoS{
+		sampler:  newProcessSampler(),
+		burst:    burst,
+		depth:    depth,
+		buckets:  make(map[string]*coreBucket),
+		managed:  make(map[string]bool),
+		warnings: make(map[string]bool),
+	}
+}
+
+// Run enforces the shares every interval, it never returns.
+func (q *coreQoS) Run(cm *ClusterManager, interval time.Duration) {
+	klog.Infof("Enforcing the vGPU cores as token buckets every %v", interval)
+	for {
+		q.Step(cm, time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// Managed returns whether the limiter of the container is driven by the
+// token buckets, the contention feedback leaving it alone.
+func (q *coreQoS) Managed(c *nvidia.ContainerUsage) bool {
+	if q == nil {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.managed[c.PodUID+"/"+c.ContainerName]
+}
+
+func (q *coreQoS) Step(cm *ClusterManager, now time.Time) {
+	if err := cm.containerLister.Update(); err != nil {
+		klog.Errorf("Failed to update the containers of the core QoS: %v", err)
+		return
+	}
+	pods, err := cm.PodLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list the pods of the core QoS: %v", err)
+		return
+	}
+	samples := make(map[string]map[uint32]processUtilization)
+	for _, d := range cm.containerLister.Devices().Devices() {
+		samples[d.UUID] = q.sampler.Sample(d.Handle, d.UUID)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	seen := make(map[string]bool)
+	managed := make(map[string]bool)
+	matched := cm.MatchContainers(pods)
+	defer cm.ReleaseContainers(matched)
+	for _, mc := range matched {
+		info := mc.Usage.Info
+		if info == nil {
+			continue
+		}
+		ctrIdx := -1
+		for i, ctr := range mc.Pod.Spec.Containers {
+			if ctr.Name == mc.ContainerName {
+				ctrIdx = i
+			}
+		}
+		assigned := util.DecodePodDevices(mc.Pod.Annotations[util.AssignedIDsAnnotations])
+		if ctrIdx < 0 || ctrIdx >= len(assigned) {
+			continue
+		}
+		burst := q.burst
+		if value, ok := mc.Pod.Annotations[CoreBurstAnnotation]; ok {
+			v, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				key := mc.Pod.Namespace + "/" + mc.Pod.Name
+				if !q.warnings[key] {
+					klog.Warningf("Ignoring the invalid %s annotation %q of pod %s", CoreBurstAnnotation, value, key)
+					q.warnings[key] = true
+				}
+			} else {
+				burst = v
+			}
+		}
+		pids := info.HostPids()
+		ctrKey := mc.Usage.PodUID + "/" + mc.ContainerName
+		for i := 0; i < info.DeviceNum() && i < len(assigned[ctrIdx]); i++ {
+			share := uint64(assigned[ctrIdx][i].Usedcores)
+			// A vGPU with the whole GPU or no core limit isn't throttled.
+			if share == 0 || share >= 100 {
+				continue
+			}
+			uuid := info.DeviceUUID(i)
+			procs := samples[uuid]
+			if procs == nil {
+				continue
+			}
+			key := fmt.Sprintf("%s/%d", ctrKey, i)
+			b, ok := q.buckets[key]
+			if !ok {
+				b = &coreBucket{namespace: mc.Pod.Namespace, pod: mc.Pod.Name, container: mc.ContainerName, idx: i, uuid: uuid,
+					tokens: float64(burst) * q.depth.Seconds()}
+				q.buckets[key] = b
+			}
+			b.share, b.burst = share, burst
+			b.observe(sumUtilization(procs, pids).sm, now, q.depth)
+			b.limit = b.limitFor()
+			if info.DeviceSmLimit(i) != b.limit {
+				info.SetDeviceSmLimit(i, b.limit)
+			}
+			if info.GetUtilizationSwitch() != 1 {
+				info.SetUtilizationSwitch(1)
+			}
+			seen[key] = true
+			managed[ctrKey] = true
+		}
+	}
+	for key := range q.buckets {
+		if !seen[key] {
+			delete(q.buckets, key)
+		}
+	}
+	q.managed = managed
+}
+
+func describeCoreQoS(ch chan<- *prometheus.Desc) {
+	if coreQoSInterval <= 0 {
+		return
+	}
+	ch <- ctrCoreAchievedShareDesc
+	ch <- ctrCoreGuaranteedShareDesc
+	ch <- ctrCoreBurstTokensDesc
+	ch <- ctrCoreQoSLimitDesc
+}
+
+// collect exports the buckets of the containers, nothing while the core QoS
+// is disabled.
+func (q *coreQoS) collect(ch chan<- prometheus.Metric) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, b := range q.buckets {
+		labels := []string{b.namespace, b.pod, b.container, fmt.Sprint(b.idx), b.uuid}
+		ch <- prometheus.MustNewConstMetric(ctrCoreAchievedShareDesc, prometheus.GaugeValue, b.achieved, labels...)
+		ch <- prometheus.MustNewConstMetric(ctrCoreGuaranteedShareDesc, prometheus.GaugeValue, float64(b.share), labels...)
+		ch <- prometheus.MustNewConstMetric(ctrCoreBurstTokensDesc, prometheus.GaugeValue, b.tokens, labels...)
+		ch <- prometheus.MustNewConstMetric(ctrCoreQoSLimitDesc, prometheus.GaugeValue, float64(b.limit), labels...)
+	}
+}
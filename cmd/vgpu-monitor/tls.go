@@ -0,0 +1,142 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// certCheckInterval is the shortest interval between two checks of the
+// certificate files for a rotation.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of the metrics endpoint and verifies
+// the client certificates against the CA, both reloaded from their files
+// when they are rotated, as a mounted secret is.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mutex    sync.Mutex
+	checked  time.Time
+	modTimes map[string]time.Time
+	cert     *tls.Certificate
+	// clientCAs is nil when the client certificates are not verified.
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the certificate and the key files are needed to serve TLS")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// load reads the files, leaving the loaded certificates as they are when
+// one of them can't be read.
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate %s: %v", r.certFile, err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in the client CA file %s", r.caFile)
+		}
+	}
+	r.cert, r.clientCAs, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// current returns the certificate and the client CAs, reloaded first when
+// a file changed since they were loaded.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, r.clientCAs
+	}
+	r.checked = time.Now()
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil || info.ModTime().Equal(r.modTimes[f]) {
+			continue
+		}
+		if err := r.load(); err != nil {
+			klog.Errorf("Failed to reload the metrics certificates, serving the previous ones: %v", err)
+		} else {
+			klog.Infof("Reloaded the metrics certificates")
+		}
+		break
+	}
+	return r.cert, r.clientCAs
+}
+
+// TLSConfig returns the configuration of a server presenting the current
+// certificate, requiring a client certificate signed by the client CAs
+// when they are set.
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := r.current()
+			cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*cert}}
+			if clientCAs != nil {
+				cfg.ClientCAs = clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
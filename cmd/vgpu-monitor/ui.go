@@ -0,0 +1,45 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// registerUI serves the node dashboard under /ui/ and the snapshot it
+// renders under /ui/api/node.
+func registerUI(mux *http.ServeMux, cm *ClusterManager) {
+	static, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		klog.Fatalf("Failed to load embedded ui: %v", err)
+	}
+	mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/ui/api/node", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cm.Snapshot()); err != nil {
+			klog.Errorf("Failed to encode node snapshot: %v", err)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+var (
+	ctrDeviceEngineUtilizationDesc = prometheus.NewDesc(
+		"vgpu_container_device_utilization",
+		"Container device utilization in percent measured by the driver, by engine (sm, encoder, decoder)",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid", "engine"}, nil,
+	)
+	ctrDeviceSmUtilizationDriftDesc = prometheus.NewDesc(
+		"vgpu_container_device_sm_utilization_drift",
+		"Difference between the SM utilization reported in the shared region and the one measured by the driver",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+)
+
+// processUtilization is the average utilization of a process over the
+// samples taken by the driver since the previous collection.
+type processUtilization struct {
+	sm, enc, dec float64
+}
+
+// processSampler reads the per process utilization samples of the devices,
+// remembering the last sample seen on every device so that each collection
+// only averages the samples taken since the previous one.
+type processSampler struct {
+	mutex    sync.Mutex
+	lastSeen map[string]uint64
+}
+
+func newProcessSampler() *processSampler {
+	return &processSampler{lastSeen: make(map[string]uint64)}
+}
+
+// Sample returns the utilization of every process which ran on the device
+// since the previous call, keyed by host pid.
+func (s *processSampler) Sample(hdev nvml.Device, uuid string) map[uint32]processUtilization {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	samples, ret := hdev.GetProcessUtilization(s.lastSeen[uuid])
+	if ret == nvml.ERROR_NOT_FOUND {
+		// No sample since the last one, every process has been idle.
+		return map[uint32]processUtilization{}
+	}
+	if ret != nvml.SUCCESS {
+		nvidia.RecordNVMLError("GetProcessUtilization", ret)
+		klog.V(4).Infof("nvml get process utilization of device %s error ret=%v", uuid, ret)
+		return nil
+	}
+	sums := make(map[uint32]processUtilization)
+	counts := make(map[uint32]int)
+	for _, sample := range samples {
+		u := sums[sample.Pid]
+		u.sm += float64(sample.SmUtil)
+		u.enc += float64(sample.EncUtil)
+		u.dec += float64(sample.DecUtil)
+		sums[sample.Pid] = u
+		counts[sample.Pid]++
+		if sample.TimeStamp > s.lastSeen[uuid] {
+			s.lastSeen[uuid] = sample.TimeStamp
+		}
+	}
+	for pid, u := range sums {
+		n := float64(counts[pid])
+		sums[pid] = processUtilization{sm: u.sm / n, enc: u.enc / n, dec: u.dec / n}
+	}
+	return sums
+}
+
+func describeContainerUtilization(ch chan<- *prometheus.Desc) {
+	ch <- ctrDeviceEngineUtilizationDesc
+	ch <- ctrDeviceSmUtilizationDriftDesc
+}
+
+// collectContainerUtilization attributes the process samples of every device
+// to the containers through the host pids recorded in their shared region.
+// The shared region SM utilization misses short lived kernels, the drift
+// against the driver measurement tells how far off it is.
+func collectContainerUtilization(ch chan<- prometheus.Metric, matched []matchedContainer, samples map[string]map[uint32]processUtilization) {
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		pids := mc.Usage.Info.HostPids()
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			uuid := mc.Usage.Info.DeviceUUID(i)
+			procs, ok := samples[uuid]
+			if !ok || procs == nil {
+				continue
+			}
+			u := sumUtilization(procs, pids)
+			labels := []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), uuid}
+			for _, e := range []struct {
+				engine string
+				value  float64
+			}{{"sm", u.sm}, {"encoder", u.enc}, {"decoder", u.dec}} {
+				ch <- prometheus.MustNewConstMetric(ctrDeviceEngineUtilizationDesc, prometheus.GaugeValue, e.value,
+					append(labels, e.engine)...)
+			}
+			ch <- prometheus.MustNewConstMetric(ctrDeviceSmUtilizationDriftDesc, prometheus.GaugeValue,
+				float64(mc.Usage.Info.DeviceSmUtil(i))-u.sm, labels...)
+		}
+	}
+}
+
+// sumUtilization adds up the utilization of the given host pids.
+func sumUtilization(procs map[uint32]processUtilization, pids []int) processUtilization {
+	var u processUtilization
+	for _, pid := range pids {
+		p := procs[uint32(pid)]
+		u.sm += p.sm
+		u.enc += p.enc
+		u.dec += p.dec
+	}
+	return u
+}
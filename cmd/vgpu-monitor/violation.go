@@ -0,0 +1,106 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ctrMemoryLimitViolationsDesc = prometheus.NewDesc(
+		"vgpu_memory_limit_violations_total",
+		"Times the device memory used by the container went above its vgpu-memory limit since the monitor started",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+	ctrMemoryLimitOverageDesc = prometheus.NewDesc(
+		"vgpu_memory_limit_overage_bytes",
+		"Device memory used by the container above its vgpu-memory limit, 0 within it",
+		[]string{"podnamespace", "podname", "ctrname", "vdeviceid", "deviceuuid"}, nil,
+	)
+)
+
+// memoryViolation is the state of a container device against its memory
+// limit.
+type memoryViolation struct {
+	over  bool
+	count uint64
+}
+
+// memoryViolations counts the times every container device goes above its
+// memory limit, the hook should keep it within, before the overage runs its
+// co-tenants out of memory.
+type memoryViolations struct {
+	mutex  sync.Mutex
+	states map[string]*memoryViolation
+}
+
+func newMemoryViolations() *memoryViolations {
+	return &memoryViolations{states: make(map[string]*memoryViolation)}
+}
+
+func describeMemoryViolations(ch chan<- *prometheus.Desc) {
+	ch <- ctrMemoryLimitViolationsDesc
+	ch <- ctrMemoryLimitOverageDesc
+}
+
+// collect exports the violations and the current overage of every container
+// device with a memory limit, a violation is counted as the usage goes above
+// the limit, not on every collection it stays above.
+func (v *memoryViolations) collect(ch chan<- prometheus.Metric, matched []matchedContainer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	seen := make(map[string]bool)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			limit := mc.Usage.Info.DeviceMemoryLimit(i)
+			if limit == 0 {
+				continue
+			}
+			used := mc.Usage.Info.DeviceMemoryTotal(i)
+			key := fmt.Sprintf("%s/%s/%d", mc.Usage.PodUID, mc.ContainerName, i)
+			seen[key] = true
+			state, ok := v.states[key]
+			if !ok {
+				state = &memoryViolation{}
+				v.states[key] = state
+			}
+			over := used > limit
+			if over && !state.over {
+				state.count++
+			}
+			state.over = over
+			overage := uint64(0)
+			if over {
+				overage = used - limit
+			}
+			labels := []string{mc.Pod.Namespace, mc.Pod.Name, mc.ContainerName, fmt.Sprint(i), mc.Usage.Info.DeviceUUID(i)}
+			ch <- prometheus.MustNewConstMetric(ctrMemoryLimitViolationsDesc, prometheus.CounterValue, float64(state.count), labels...)
+			ch <- prometheus.MustNewConstMetric(ctrMemoryLimitOverageDesc, prometheus.GaugeValue, float64(overage), labels...)
+		}
+	}
+	for key := range v.states {
+		if !seen[key] {
+			delete(v.states, key)
+		}
+	}
+}
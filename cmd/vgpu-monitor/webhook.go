@@ -0,0 +1,309 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Conditions a webhook can be fired on.
+const (
+	ConditionContainerMemoryUsage = "ContainerMemoryUsage"
+	ConditionDeviceUnhealthy      = "DeviceUnhealthy"
+
+	defaultMemoryUsageThreshold = 0.9
+)
+
+// WebhookConfig is the content of the file passed by --webhook-config.
+type WebhookConfig struct {
+	Webhooks []WebhookSpec `json:"webhooks"`
+}
+
+// WebhookSpec describes one webhook and the condition it is fired on.
+type WebhookSpec struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Condition is one of ContainerMemoryUsage or DeviceUnhealthy.
+	Condition string `json:"condition"`
+	// Threshold is the ratio of the container memory limit above which
+	// ContainerMemoryUsage fires, 0.9 when unset.
+	Threshold float64 `json:"threshold,omitempty"`
+	// Payload is a text/template rendered with a WebhookEvent as the
+	// request body, the event is sent as JSON when unset.
+	Payload string `json:"payload,omitempty"`
+	// RepeatInterval fires again for a breach still ongoing after this
+	// duration, an ongoing breach is only reported once when unset.
+	RepeatInterval string `json:"repeatInterval,omitempty"`
+
+	payload        *template.Template
+	repeatInterval time.Duration
+}
+
+// WebhookEvent is the data a webhook payload is rendered with.
+type WebhookEvent struct {
+	Webhook    string    `json:"webhook"`
+	Condition  string    `json:"condition"`
+	Node       string    `json:"node"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Pod        string    `json:"pod,omitempty"`
+	Container  string    `json:"container,omitempty"`
+	DeviceUUID string    `json:"deviceuuid"`
+	Value      float64   `json:"value"`
+	Threshold  float64   `json:"threshold,omitempty"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+}
+
+// WebhookNotifier evaluates the webhook conditions against the containers
+// and devices of the node and posts an event for every new breach.
+type WebhookNotifier struct {
+	webhooks []*WebhookSpec
+	cm       *ClusterManager
+	nodeName string
+	client   *http.Client
+	// fired records when an ongoing breach was last reported, keyed by
+	// webhook name and breach subject.
+	fired map[string]time.Time
+}
+
+var payloadFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewWebhookNotifier loads the webhook definitions from configFile.
+func NewWebhookNotifier(configFile string, cm *ClusterManager) (*WebhookNotifier, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfg WebhookConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+	n := &WebhookNotifier{
+		cm:       cm,
+		nodeName: nodeName,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		fired:    make(map[string]time.Time),
+	}
+	for i := range cfg.Webhooks {
+		w := &cfg.Webhooks[i]
+		if w.Name == "" || w.URL == "" {
+			return nil, fmt.Errorf("webhook %d: name and url are required", i)
+		}
+		switch w.Condition {
+		case ConditionContainerMemoryUsage:
+			if w.Threshold <= 0 {
+				w.Threshold = defaultMemoryUsageThreshold
+			}
+		case ConditionDeviceUnhealthy:
+		default:
+			return nil, fmt.Errorf("webhook %s: unknown condition %q", w.Name, w.Condition)
+		}
+		if w.Payload != "" {
+			w.payload, err = template.New(w.Name).Funcs(payloadFuncs).Parse(w.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: invalid payload template: %v", w.Name, err)
+			}
+		}
+		if w.RepeatInterval != "" {
+			w.repeatInterval, err = time.ParseDuration(w.RepeatInterval)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: invalid repeatInterval: %v", w.Name, err)
+			}
+		}
+		n.webhooks = append(n.webhooks, w)
+	}
+	return n, nil
+}
+
+// Run evaluates the conditions every interval, it never returns.
+func (n *WebhookNotifier) Run(interval time.Duration) {
+	klog.Infof("Evaluating %d webhooks every %v", len(n.webhooks), interval)
+	for {
+		time.Sleep(interval)
+		n.Evaluate(time.Now())
+	}
+}
+
+// Evaluate fires the webhooks whose condition holds and forgets the breaches
+// which are over, so that they are reported again when they come back.
+func (n *WebhookNotifier) Evaluate(now time.Time) {
+	var memoryEvents, deviceEvents map[string]WebhookEvent
+	active := make(map[string]bool)
+	for _, w := range n.webhooks {
+		var events map[string]WebhookEvent
+		switch w.Condition {
+		case ConditionContainerMemoryUsage:
+			if memoryEvents == nil {
+				memoryEvents = n.containerMemoryEvents()
+			}
+			events = memoryEvents
+		case ConditionDeviceUnhealthy:
+			if deviceEvents == nil {
+				deviceEvents = n.unhealthyDeviceEvents()
+			}
+			events = deviceEvents
+		}
+		for subject, e := range events {
+			if w.Condition == ConditionContainerMemoryUsage && e.Value < w.Threshold {
+				continue
+			}
+			key := w.Name + "/" + subject
+			active[key] = true
+			last, ok := n.fired[key]
+			if ok && (w.repeatInterval == 0 || now.Sub(last) < w.repeatInterval) {
+				continue
+			}
+			e.Webhook = w.Name
+			e.Node = n.nodeName
+			e.Time = now
+			if w.Condition == ConditionContainerMemoryUsage {
+				e.Threshold = w.Threshold
+				e.Message = fmt.Sprintf("container %s/%s/%s uses %.0f%% of its memory limit on device %s",
+					e.Namespace, e.Pod, e.Container, e.Value*100, e.DeviceUUID)
+			}
+			if err := n.post(w, e); err != nil {
+				klog.Errorf("Failed to fire webhook %s: %v", w.Name, err)
+				continue
+			}
+			n.fired[key] = now
+		}
+	}
+	for key := range n.fired {
+		if !active[key] {
+			delete(n.fired, key)
+		}
+	}
+}
+
+// containerMemoryEvents returns the memory usage ratio of every container
+// device with a memory limit, keyed by container and device.
+func (n *WebhookNotifier) containerMemoryEvents() map[string]WebhookEvent {
+	events := make(map[string]WebhookEvent)
+	pods, err := n.cm.PodLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list pods: %v", err)
+		return events
+	}
+	matched := n.cm.MatchContainers(pods)
+	defer n.cm.ReleaseContainers(matched)
+	for _, mc := range matched {
+		if mc.Usage.Info == nil {
+			continue
+		}
+		for i := 0; i < mc.Usage.Info.DeviceNum(); i++ {
+			limit := mc.Usage.Info.DeviceMemoryLimit(i)
+			if limit == 0 {
+				continue
+			}
+			uuid := mc.Usage.Info.DeviceUUID(i)
+			key := fmt.Sprintf("%s/%s/%d", mc.Usage.PodUID, mc.ContainerName, i)
+			events[key] = WebhookEvent{
+				Condition:  ConditionContainerMemoryUsage,
+				Namespace:  mc.Pod.Namespace,
+				Pod:        mc.Pod.Name,
+				Container:  mc.ContainerName,
+				DeviceUUID: uuid,
+				Value:      float64(mc.Usage.Info.DeviceMemoryTotal(i)) / float64(limit),
+			}
+		}
+	}
+	return events
+}
+
+// unhealthyDeviceEvents returns the devices reported unhealthy by the device
+// plugin in the node annotation, or lost according to NVML.
+func (n *WebhookNotifier) unhealthyDeviceEvents() map[string]WebhookEvent {
+	events := make(map[string]WebhookEvent)
+	node, err := n.cm.containerLister.Clientset().CoreV1().Nodes().Get(context.Background(), n.nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Failed to get node %s: %v", n.nodeName, err)
+	} else {
+		for _, d := range util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered]) {
+			if d.Health {
+				continue
+			}
+			events[d.Id] = WebhookEvent{
+				Condition:  ConditionDeviceUnhealthy,
+				DeviceUUID: d.Id,
+				Message:    fmt.Sprintf("device %s on node %s is reported unhealthy by the device plugin", d.Id, n.nodeName),
+			}
+		}
+	}
+	for _, d := range n.cm.containerLister.Devices().Devices() {
+		uuid := d.UUID
+		if _, ret := d.Handle.GetMemoryInfo(); ret == nvml.ERROR_GPU_IS_LOST {
+			events[uuid] = WebhookEvent{
+				Condition:  ConditionDeviceUnhealthy,
+				DeviceUUID: uuid,
+				Message:    fmt.Sprintf("device %s on node %s has fallen off the bus", uuid, n.nodeName),
+			}
+		}
+	}
+	return events
+}
+
+func (n *WebhookNotifier) post(w *WebhookSpec, e WebhookEvent) error {
+	var body bytes.Buffer
+	if w.payload != nil {
+		if err := w.payload.Execute(&body, e); err != nil {
+			return fmt.Errorf("render payload: %v", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(e); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	klog.Infof("Fired webhook %s for %s: %s", w.Name, e.Condition, e.Message)
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// Descriptors of the hardware errors of the devices, to correlate the
+// failures of the vGPU workloads with the faults of their GPU.
+var (
+	hostGPUEccErrorsDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_ecc_errors_total",
+		"Memory ECC errors of the GPU by type, corrected or uncorrected, and counter, volatile since the last reset or aggregate over its lifetime",
+		[]string{"deviceidx", "deviceuuid", "type", "counter"}, nil,
+	)
+	hostGPUXidErrorsDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_xid_errors_total",
+		"Xid critical errors reported by the driver for the GPU since the monitor started, by xid",
+		[]string{"deviceidx", "deviceuuid", "xid"}, nil,
+	)
+	hostGPUXidLastSeenDesc = prometheus.NewDesc(
+		"vgpu_host_gpu_xid_last_seen_timestamp_seconds",
+		"Time of the last Xid critical error reported by the driver for the GPU, by xid",
+		[]string{"deviceidx", "deviceuuid", "xid"}, nil,
+	)
+)
+
+// collectEccErrors exports the ECC error counters of the device, left out
+// when ECC is disabled or not supported.
+func collectEccErrors(ch chan<- prometheus.Metric, hdev nvml.Device, idx string, uuid string) {
+	for errorType, typeName := range map[nvml.MemoryErrorType]string{
+		nvml.MEMORY_ERROR_TYPE_CORRECTED:   "corrected",
+		nvml.MEMORY_ERROR_TYPE_UNCORRECTED: "uncorrected",
+	} {
+		for counter, counterName := range map[nvml.EccCounterType]string{nvml.VOLATILE_ECC: "volatile", nvml.AGGREGATE_ECC: "aggregate"} {
+			n, ret := hdev.GetTotalEccErrors(errorType, counter)
+			if ret != nvml.SUCCESS {
+				nvidia.RecordNVMLError("GetTotalEccErrors", ret)
+				klog.V(4).Infof("nvml get %s %s ECC errors of device %s error ret=%v", counterName, typeName, uuid, ret)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(hostGPUEccErrorsDesc, prometheus.CounterValue, float64(n), idx, uuid, typeName, counterName)
+		}
+	}
+}
+
+// xidFallenOffBus is the Xid of a GPU gone from the bus, whose handle is
+// not valid anymore.
+const xidFallenOffBus = 79
+
+type xidKey struct {
+	uuid string
+	xid  uint64
+}
+
+// xidWatcher counts the Xid critical errors the driver reports for the
+// devices, recording each in the event journal.
+type xidWatcher struct {
+	journal *eventJournal
+	devices *nvidia.DeviceCache
+
+	mutex    sync.Mutex
+	indexes  map[string]string
+	counts   map[xidKey]uint64
+	lastSeen map[xidKey]time.Time
+}
+
+func newXidWatcher(journal *eventJournal, devices *nvidia.DeviceCache) *xidWatcher {
+	return &xidWatcher{
+		journal:  journal,
+		devices:  devices,
+		indexes:  make(map[string]string),
+		counts:   make(map[xidKey]uint64),
+		lastSeen: make(map[xidKey]time.Time),
+	}
+}
+
+// Run waits for the Xid events of the devices, it returns when the driver
+// can't report them.
+func (w *xidWatcher) Run() {
+	eventSet, ret := config.Nvml().EventSetCreate()
+	if ret != nvml.SUCCESS {
+		klog.Warningf("Could not create event set, not watching Xid errors: %v", ret)
+		return
+	}
+	defer eventSet.Free()
+	registered := 0
+	for _, d := range w.devices.Devices() {
+		hdev, uuid := d.Handle, d.UUID
+		supported, ret := hdev.GetSupportedEventTypes()
+		if ret != nvml.SUCCESS || supported&nvml.EventTypeXidCriticalError == 0 {
+			klog.Warningf("Device %s doesn't report Xid errors", uuid)
+			continue
+		}
+		if ret := hdev.RegisterEvents(nvml.EventTypeXidCriticalError, eventSet); ret != nvml.SUCCESS {
+			klog.Warningf("Failed to watch the Xid errors of device %s: %v", uuid, ret)
+			continue
+		}
+		w.mutex.Lock()
+		w.indexes[uuid] = fmt.Sprint(d.Index)
+		w.mutex.Unlock()
+		registered++
+	}
+	if registered == 0 {
+		return
+	}
+	for {
+		e, ret := eventSet.Wait(5000)
+		if ret == nvml.ERROR_TIMEOUT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			klog.Errorf("Error waiting for Xid events: %v", ret)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if e.EventType != nvml.EventTypeXidCriticalError {
+			continue
+		}
+		uuid, ret := e.Device.GetUUID()
+		if ret != nvml.SUCCESS {
+			klog.Errorf("Failed to get the device of Xid %d: %v", e.EventData, ret)
+			continue
+		}
+		w.record(uuid, e.EventData, time.Now())
+	}
+}
+
+func (w *xidWatcher) record(uuid string, xid uint64, now time.Time) {
+	klog.Warningf("Xid %d on device %s", xid, uuid)
+	w.mutex.Lock()
+	key := xidKey{uuid: uuid, xid: xid}
+	w.counts[key]++
+	w.lastSeen[key] = now
+	w.mutex.Unlock()
+	if xid == xidFallenOffBus {
+		w.devices.Invalidate()
+	}
+	if w.journal != nil {
+		w.journal.Append(Event{Time: now, Type: EventXid, Node: nodeName, Device: uuid,
+			Message: fmt.Sprintf("driver reported Xid %d", xid)})
+	}
+}
+
+func describeXid(ch chan<- *prometheus.Desc) {
+	ch <- hostGPUEccErrorsDesc
+	ch <- hostGPUXidErrorsDesc
+	ch <- hostGPUXidLastSeenDesc
+}
+
+func (w *xidWatcher) collect(ch chan<- prometheus.Metric) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	keys := make([]xidKey, 0, len(w.counts))
+	for key := range w.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].uuid != keys[j].uuid {
+			return keys[i].uuid < keys[j].uuid
+		}
+		return keys[i].xid < keys[j].xid
+	})
+	for _, key := range keys {
+		labels := []string{w.indexes[key.uuid], key.uuid, fmt.Sprint(key.xid)}
+		ch <- prometheus.MustNewConstMetric(hostGPUXidErrorsDesc, prometheus.CounterValue, float64(w.counts[key]), labels...)
+		ch <- prometheus.MustNewConstMetric(hostGPUXidLastSeenDesc, prometheus.GaugeValue, float64(w.lastSeen[key].Unix()), labels...)
+	}
+}
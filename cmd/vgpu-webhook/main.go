@@ -0,0 +1,174 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/quota"
+	"volcano.sh/k8s-device-plugin/pkg/webhook"
+)
+
+var (
+	bindAddress    string
+	metricsAddress string
+	tlsCertFile    string
+	tlsKeyFile     string
+	defaultMemory  int64
+	defaultCores   int64
+	schedulerName  string
+	enforceQuotas  bool
+
+	rootCmd = &cobra.Command{
+		Use:   "vgpu-webhook",
+		Short: "kubernetes vgpu admission webhook",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := start(); err != nil {
+				klog.Fatal(err)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.Flags().SortFlags = false
+	rootCmd.PersistentFlags().SortFlags = false
+
+	rootCmd.Flags().StringVar(&bindAddress, "bind-address", ":8443", "the address the admission webhooks bind to")
+	rootCmd.Flags().StringVar(&metricsAddress, "metrics-bind-address", ":9396", "the address the metrics endpoint binds to")
+	rootCmd.Flags().StringVar(&tlsCertFile, "tls-cert-file", "/etc/vgpu-webhook/tls.crt", "the certificate the webhooks are served with")
+	rootCmd.Flags().StringVar(&tlsKeyFile, "tls-private-key-file", "/etc/vgpu-webhook/tls.key", "the private key of the certificate")
+	rootCmd.Flags().Int64Var(&defaultMemory, "default-memory", 0, "the memory in MiB of the vGPUs requested without memory, the whole memory of the device when 0")
+	rootCmd.Flags().Int64Var(&defaultCores, "default-cores", 0, "the cores of the vGPUs requested without cores, left unset when 0")
+	rootCmd.Flags().BoolVar(&enforceQuotas, "enforce-quotas", false, "deny the pods exceeding a VGPUQuota of their namespace, the VGPUQuota resource must be defined")
+	rootCmd.Flags().StringVar(&schedulerName, "scheduler-name", "volcano", "the scheduler the pods requesting vGPUs with the default scheduler are given, left unchanged when empty")
+
+	// The resource names the containers request the vGPUs with.
+	rootCmd.PersistentFlags().AddGoFlagSet(util.GlobalFlagSet())
+}
+
+func start() error {
+	if err := util.SetupLogging(); err != nil {
+		return err
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return fmt.Errorf("failed to build kubeconfig: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to build clientset: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to build dynamic client: %v", err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(clientset, time.Hour)
+	nodeLister := informerFactory.Core().V1().Nodes().Lister()
+	var podLister listerscorev1.PodLister
+	var quotaLister cache.GenericLister
+	dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Hour)
+	if enforceQuotas {
+		podLister = informerFactory.Core().V1().Pods().Lister()
+		quotaLister = dynamicFactory.ForResource(v1alpha1.VGPUQuotaResource).Lister()
+	}
+	stopCh := make(chan struct{})
+	informerFactory.Start(stopCh)
+	dynamicFactory.Start(stopCh)
+	for typ, ok := range informerFactory.WaitForCacheSync(stopCh) {
+		if !ok {
+			return fmt.Errorf("failed to sync %v informer", typ)
+		}
+	}
+	for res, ok := range dynamicFactory.WaitForCacheSync(stopCh) {
+		if !ok {
+			return fmt.Errorf("failed to sync %v informer", res)
+		}
+	}
+
+	w := &webhook.Webhook{
+		Nodes: func() []*corev1.Node {
+			nodes, err := nodeLister.List(labels.Everything())
+			if err != nil {
+				klog.Errorf("Failed to list nodes: %v", err)
+			}
+			return nodes
+		},
+		DefaultMemory: defaultMemory,
+		DefaultCores:  defaultCores,
+		SchedulerName: schedulerName,
+	}
+	if enforceQuotas {
+		w.Quotas = func(namespace string) []*v1alpha1.VGPUQuota {
+			objs, err := quotaLister.ByNamespace(namespace).List(labels.Everything())
+			if err != nil {
+				klog.Errorf("Failed to list the VGPUQuotas of namespace %s: %v", namespace, err)
+			}
+			return quota.DecodeAll(objs)
+		}
+		w.Pods = func(namespace string) []*corev1.Pod {
+			pods, err := podLister.Pods(namespace).List(labels.Everything())
+			if err != nil {
+				klog.Errorf("Failed to list the pods of namespace %s: %v", namespace, err)
+			}
+			return pods
+		}
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(w)
+	metrics := http.NewServeMux()
+	metrics.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		klog.Infof("Serving metrics on %s", metricsAddress)
+		if err := http.ListenAndServe(metricsAddress, metrics); err != nil {
+			klog.Errorf("Failed to serve metrics: %v", err)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhook.MutatePath, w.ServeMutate)
+	mux.HandleFunc(webhook.ValidatePath, w.ServeValidate)
+	klog.Infof("Serving the vGPU admission webhooks on %s", bindAddress)
+	return http.ListenAndServeTLS(bindAddress, tlsCertFile, tlsKeyFile, mux)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		klog.Fatal(err)
+	}
+}
@@ -18,23 +18,40 @@ package main
 import (
 	"fmt"
 	"net/http"
-	_ "net/http/pprof"
 	"syscall"
+	"time"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	nvidiadevice "volcano.sh/k8s-device-plugin/pkg/plugin/vgpu"
 	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
 	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/profiling"
 )
 
 var (
 	failOnInitErrorFlag bool
 	migStrategyFlag     string
+	simulateGPUsFlag    int
+	pprofFlag           bool
+
+	allocationStatusIntervalFlag time.Duration
+	versionDriftConfigFlag       string
+	versionDriftIntervalFlag     time.Duration
+	evictOnDeviceFailureFlag     bool
+	driverCompatibilityFlag      string
+	allocationGCIntervalFlag     time.Duration
+	allocationGCGraceFlag        time.Duration
+	publishDevicesFlag           bool
+	configReloadIntervalFlag     time.Duration
+	drainTimeoutFlag             time.Duration
 
 	rootCmd = &cobra.Command{
 		Use:   "device-plugin",
@@ -69,17 +86,70 @@ func init() {
 	rootCmd.Flags().UintVar(&config.GPUMemoryFactor, "gpu-memory-factor", 1, "the default gpu memory block size is 1MB")
 	rootCmd.Flags().Float64Var(&config.DeviceCoresScaling, "device-cores-scaling", 1.0, "the ratio for NVIDIA device cores scaling")
 	rootCmd.Flags().StringVar(&config.NodeName, "node-name", viper.GetString("node-name"), "node name")
+	rootCmd.Flags().StringVar(&config.MemoryTier, "memory-tier", config.MemoryTierAuto, "where the memory of the GPUs comes from:\n\t\t[auto | dedicated | shared | coherent]")
+	rootCmd.Flags().Float64Var(&config.SharedMemoryFraction, "shared-memory-fraction", config.SharedMemoryFraction, "the share of the system RAM every GPU of the shared memory tier registers")
+	rootCmd.Flags().Float64Var(&config.CoherentMemoryFraction, "coherent-memory-fraction", 0, "the share of the system RAM every GPU of the coherent memory tier registers on top of its own memory")
+	rootCmd.Flags().StringVar(&config.AllocationPolicy, "allocation-policy", "", "the policy the devices assigned by the scheduler must satisfy, they are not checked when empty:\n\t\t[binpack | spread | topology | <name of a policy plugin>]")
+	rootCmd.Flags().StringVar(&config.ShadowAllocationPolicy, "shadow-allocation-policy", "", "a policy evaluated on every allocation without being enforced, its choices are logged and exported on /metrics")
+	rootCmd.Flags().StringVar(&config.DeviceSelectionPolicy, "device-selection-policy", "", "the policy choosing the devices of the containers among those of the type the scheduler assigned, overridden by the volcano.sh/vgpu-selection-policy pod annotation, the devices of the scheduler are kept when empty:\n\t\t[binpack | spread | topology | <name of a policy plugin>]")
+	rootCmd.Flags().StringSliceVar(&config.AllocationPolicyPlugins, "allocation-policy-plugin", nil, "the Go plugins to load custom allocation policies from")
+	rootCmd.Flags().StringSliceVar(&config.OPAPolicies, "opa-policy", nil, "the Rego policy files or directories allocations are admitted with")
+	rootCmd.Flags().StringVar(&config.CheckpointFile, "checkpoint-file", pluginapi.DevicePluginPath+"vgpu_checkpoint", "the file the allocations are recorded in to be recovered after a restart, disabled when empty")
+	rootCmd.Flags().StringVar(&config.CDISpecDirectory, "cdi-spec-dir", "", "the directory the CDI specs of the containers are written in, e.g. /var/run/cdi, for the container runtime to inject their devices instead of the kubelet, disabled when empty")
+	rootCmd.Flags().StringVar(&config.Isolation, "isolation", "", "how the cores of the pods are limited when they don't set the volcano.sh/vgpu-isolation annotation, libvgpu when empty:\n\t\t[libvgpu | mps]")
+	rootCmd.Flags().StringVar(&config.MPSPipeDirectory, "mps-pipe-directory", "/tmp/nvidia-mps", "the pipe directory of the MPS control daemon the pods isolated with mps connect to, the parent of the directories of the daemons per GPU with --mps-daemon")
+	rootCmd.Flags().BoolVar(&config.MPSDaemons, "mps-daemon", false, "run an MPS control daemon per GPU instead of connecting the pods to a daemon set up on the node")
+	rootCmd.Flags().DurationVar(&allocationStatusIntervalFlag, "allocation-status-interval", 0, "the interval between two writes of the allocation table of the node in its NodeVGPUAllocation status, disabled when 0")
+	rootCmd.Flags().StringVar(&versionDriftConfigFlag, "version-drift-config", "", "the file with the driver, CUDA and VBIOS versions expected per node pool, enables the version drift checks")
+	rootCmd.Flags().DurationVar(&versionDriftIntervalFlag, "version-drift-interval", 10*time.Minute, "the interval between two version drift checks")
+	rootCmd.Flags().BoolVar(&evictOnDeviceFailureFlag, "evict-on-device-failure", false, "evict the pods granted a vGPU of a GPU turning unhealthy, for them to be scheduled on healthy GPUs")
+	rootCmd.Flags().StringVar(&driverCompatibilityFlag, "driver-compatibility-config", "", "the file with the minimum driver and CUDA versions of the GPUs, by model, the devices are not advertised on older ones; the minimum versions of libvgpu when empty")
+	rootCmd.Flags().BoolVar(&publishDevicesFlag, "publish-vgpu-devices", false, "publish the devices registered as VGPUDevice resources besides the node annotations")
+	rootCmd.Flags().DurationVar(&allocationGCIntervalFlag, "allocation-gc-interval", time.Minute, "the interval between two sweeps of the vGPU assignments to the node of the pods never bound to it, disabled when 0")
+	rootCmd.Flags().DurationVar(&allocationGCGraceFlag, "allocation-gc-grace", 10*time.Minute, "how long after its assignment by the scheduler a pod is left to be bound to the node before its vGPU assignment is released")
+	rootCmd.Flags().DurationVar(&config.AnnotationReconcileInterval, "annotation-reconcile-interval", time.Minute, "the interval between two checks of the annotations registered on the node, those edited or removed by another writer are written back, only written with the registrations every 30s when 0")
+	rootCmd.Flags().DurationVar(&configReloadIntervalFlag, "config-reload-interval", 30*time.Second, "the interval between two reloads of the device config ConfigMap and the node config, applying their changes without a restart where safe, only loaded on start when 0")
+	rootCmd.Flags().DurationVar(&drainTimeoutFlag, "drain-timeout", 10*time.Minute, "how long a drain of the node waits for its vGPU pods to finish before the plugin exits, for ever when 0")
+	rootCmd.Flags().StringVar(&config.NvmlLibraryPath, "nvml-library", "", "the libnvidia-ml library to load, searched for in the dynamic linker path and the driver directories when empty")
+	rootCmd.Flags().BoolVar(&pprofFlag, "pprof", true, "serve the profiles of the runtime on /debug/pprof/ of port 6060 besides the metrics")
+	rootCmd.Flags().IntVar(&simulateGPUsFlag, "simulate-gpus", 0, "the number of fake A100 GPUs to serve instead of the GPUs of the node, for tests on nodes without GPUs")
 
 	rootCmd.PersistentFlags().AddGoFlagSet(util.GlobalFlagSet())
 	rootCmd.AddCommand(config.VersionCmd)
 }
 
 func start() error {
+	if err := util.SetupLogging(); err != nil {
+		return err
+	}
+	// The default registry has the Go runtime and process metrics.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if pprofFlag {
+		profiling.Register(mux)
+	}
 	go func() {
-		klog.Info("Starting pprof server, listen on port 6060")
-		klog.Info(http.ListenAndServe(":6060", nil))
+		klog.Infof("Starting metrics server, listen on port 6060, pprof %v", pprofFlag)
+		klog.Info(http.ListenAndServe(":6060", mux))
 	}()
 
+	if simulateGPUsFlag > 0 {
+		klog.Infof("Simulating %d GPUs", simulateGPUsFlag)
+		if err := config.Simulate(config.NodeName, simulateGPUsFlag); err != nil {
+			return err
+		}
+	} else if path, err := config.LoadNvmlLibrary(); err != nil {
+		klog.Errorf("Failed to find NVML: %v", err)
+	} else {
+		klog.Infof("Using NVML library %s", path)
+	}
+
+	switch config.MemoryTier {
+	case config.MemoryTierAuto, config.MemoryTierDedicated, config.MemoryTierShared, config.MemoryTierCoherent:
+	default:
+		return fmt.Errorf("unknown memory tier %q", config.MemoryTier)
+	}
+
 	klog.Info("Loading NVML")
 	if nvret := config.Nvml().Init(); nvret != nvml.SUCCESS {
 		klog.Infof("Failed to initialize NVML: %v.", nvret)
@@ -94,6 +164,25 @@ func start() error {
 	}
 	defer func() { klog.Info("Shutdown of NVML returned:", config.Nvml().Shutdown()) }()
 
+	for _, path := range config.AllocationPolicyPlugins {
+		if _, err := policy.LoadPlugin(path); err != nil {
+			return err
+		}
+	}
+	if config.ShadowAllocationPolicy != "" {
+		if _, err := policy.Get(config.ShadowAllocationPolicy); err != nil {
+			return err
+		}
+	}
+	if config.AllocationPolicy != "" {
+		if _, err := policy.Get(config.AllocationPolicy); err != nil {
+			return err
+		}
+	}
+	if err := nvidiadevice.LoadOPAPolicies(config.OPAPolicies); err != nil {
+		return err
+	}
+
 	klog.Info("Starting FS watcher.")
 	watcher, err := NewFSWatcher(pluginapi.DevicePluginPath)
 	if err != nil {
@@ -102,17 +191,109 @@ func start() error {
 	defer watcher.Close()
 
 	klog.Info("Starting OS watcher.")
-	sigs := NewOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	sigs := NewOSWatcher(syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	// The split count, the operating mode, the device filter, the scaling
+	// of the devices, the core limits, the selection policy and the
+	// isolation follow the device config and the node config over the
+	// flags, and their changes while the plugin runs.
+	reloader := nvidiadevice.NewConfigReloader(nvidiadevice.FlagsRuntimeConfig(), configReloadIntervalFlag)
+	if err := reloader.Load(); err != nil {
+		return err
+	}
+	prometheus.MustRegister(reloader)
 	nvidiaCfg := util.LoadNvidiaConfig()
 
 	cache := nvidiadevice.NewDeviceCache()
 	cache.Start()
 	defer cache.Stop()
+	prometheus.MustRegister(nvidiadevice.NewMemoryTierCollector(cache))
+	prometheus.MustRegister(nvidiadevice.NewAllocationCollector(cache))
+	prometheus.MustRegister(nvidiadevice.AllocationLatency)
+	prometheus.MustRegister(nvidiadevice.KubeletRegistrations)
+	mux.Handle(nvidiadevice.ScoresPath, nvidiadevice.NewScoreHandler(cache))
+
+	// The limits of the running containers are restored before the devices
+	// are advertised again.
+	if err := nvidiadevice.Recover(config.NodeName, cache.GetCache()); err != nil {
+		klog.Errorf("Failed to recover the allocations of the node: %v", err)
+	}
+
+	supported, err := nvidiadevice.CheckDriverCompatibility(cache.GetCache(), driverCompatibilityFlag)
+	if err != nil {
+		return fmt.Errorf("failed to check the driver compatibility: %v", err)
+	}
+	if !supported {
+		s := <-sigs
+		klog.Infof("Received signal %v, shutting down.", s)
+		return nil
+	}
 
 	register := nvidiadevice.NewDeviceRegister(cache)
+	if publishDevicesFlag {
+		publisher, err := nvidiadevice.NewDevicePublisher(config.NodeName)
+		if err != nil {
+			return fmt.Errorf("failed to create device publisher: %v", err)
+		}
+		register.PublishDevices(publisher)
+	}
 	register.Start()
 	defer register.Stop()
+	reloader.OnChange(register.Refresh)
+	reloader.Start()
+	defer reloader.Stop()
+	prometheus.MustRegister(register.Reconciler())
+
+	// A drain requested by SIGUSR1 or by the annotation of the node stops
+	// advertising the devices until its pods finished, DrainPath only
+	// reports its status.
+	drainer := nvidiadevice.NewDrainer(config.NodeName, drainTimeoutFlag)
+	drainer.Start()
+	defer drainer.Stop()
+	prometheus.MustRegister(drainer)
+	mux.Handle(nvidiadevice.DrainPath, drainer)
+
+	if allocationStatusIntervalFlag > 0 {
+		statusWriter, err := nvidiadevice.NewAllocationStatusWriter(cache, allocationStatusIntervalFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create allocation status writer: %v", err)
+		}
+		statusWriter.Start()
+		defer statusWriter.Stop()
+	}
+
+	if versionDriftConfigFlag != "" {
+		checker, err := nvidiadevice.NewVersionDriftChecker(cache, versionDriftConfigFlag, versionDriftIntervalFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create version drift checker: %v", err)
+		}
+		checker.Start()
+		defer checker.Stop()
+	}
+
+	if allocationGCIntervalFlag > 0 {
+		sweeper := nvidiadevice.NewAllocationSweeper(config.NodeName, allocationGCIntervalFlag, allocationGCGraceFlag)
+		sweeper.Start()
+		defer sweeper.Stop()
+		prometheus.MustRegister(sweeper)
+	}
+
+	failures := nvidiadevice.NewDeviceFailureHandler(cache, evictOnDeviceFailureFlag)
+	failures.Start()
+	defer failures.Stop()
+
+	if config.MPSDaemons {
+		daemons := nvidiadevice.NewMPSDaemons(cache)
+		daemons.Start()
+		defer daemons.Stop()
+	}
+
+	// The plugins failing to register are restarted after a backoff, reset
+	// once they all registered.
+	const minBackoff, maxBackoff = time.Second, 2 * time.Minute
+	backoff := minBackoff
+	var retry <-chan time.Time
+	reason := nvidiadevice.RegistrationStart
 
 	var plugins []*nvidiadevice.NvidiaDevicePlugin
 restart:
@@ -129,7 +310,7 @@ restart:
 	plugins = migStrategy.GetPlugins(nvidiaCfg, cache)
 
 	started := 0
-	pluginStartError := make(chan struct{})
+	retry = nil
 	for _, p := range plugins {
 		// Just continue if there are no devices to serve for plugin p.
 		if len(p.Devices()) == 0 {
@@ -142,11 +323,21 @@ restart:
 			klog.Info("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
 			klog.Info("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
 			klog.Info("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
-			close(pluginStartError)
+			nvidiadevice.KubeletRegistrations.Record(reason, err)
+			klog.Infof("Restarting the plugins in %v.", backoff)
+			retry = time.After(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
 			goto events
 		}
 		started++
 	}
+	if started > 0 {
+		nvidiadevice.KubeletRegistrations.Record(reason, nil)
+	}
+	backoff = minBackoff
 
 	if started == 0 {
 		klog.Info("No devices found. Waiting indefinitely.")
@@ -157,16 +348,44 @@ events:
 	// some messages, trigger a restart of the plugins, or exit the program.
 	for {
 		select {
-		// If there was an error starting any plugins, restart them all.
-		case <-pluginStartError:
+		// If there was an error starting any plugins, restart them all
+		// after the backoff.
+		case <-retry:
+			reason = nvidiadevice.RegistrationRetry
+			goto restart
+
+		// The split count or the whole GPU pool changed, the plugins
+		// register their devices again.
+		case <-reloader.Restarts():
+			klog.Info("Runtime configuration changed, restarting.")
+			reason, backoff = nvidiadevice.RegistrationConfigChange, minBackoff
 			goto restart
 
+		// The node started or stopped draining, the devices are
+		// advertised again with or without capacity.
+		case <-drainer.Changed():
+			klog.Info("Drain state changed, restarting.")
+			register.Refresh()
+			reason, backoff = nvidiadevice.RegistrationDrain, minBackoff
+			goto restart
+
+		// The pods of the drained node finished, the plugin exits.
+		case <-drainer.Done():
+			klog.Info("Node drained, shutting down.")
+			for _, p := range plugins {
+				p.Stop()
+			}
+			break events
+
 		// Detect a kubelet restart by watching for a newly created
 		// 'pluginapi.KubeletSocket' file. When this occurs, restart this loop,
 		// restarting all of the plugins in the process.
 		case event := <-watcher.Events:
 			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
 				klog.Infof("inotify: %s created, restarting.", pluginapi.KubeletSocket)
+				// The kubelet lost the registrations, they are retried
+				// from the shortest backoff.
+				reason, backoff = nvidiadevice.RegistrationKubeletRestart, minBackoff
 				goto restart
 			}
 
@@ -175,13 +394,20 @@ events:
 			klog.Infof("inotify: %s", err)
 
 		// Watch for any signals from the OS. On SIGHUP, restart this loop,
-		// restarting all of the plugins in the process. On all other
-		// signals, exit the loop and exit the program.
+		// restarting all of the plugins in the process. On SIGUSR1, drain
+		// the node. On all other signals, exit the loop and exit the
+		// program.
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
 				klog.Info("Received SIGHUP, restarting.")
+				reason = nvidiadevice.RegistrationSignal
 				goto restart
+			case syscall.SIGUSR1:
+				klog.Info("Received SIGUSR1, draining.")
+				if err := drainer.Drain(); err != nil {
+					klog.Errorf("Failed to drain: %v", err)
+				}
 			default:
 				klog.Infof("Received signal %v, shutting down.", s)
 				for _, p := range plugins {
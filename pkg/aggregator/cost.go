@@ -0,0 +1,163 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/yaml"
+)
+
+// VGPUResourceName is the resource the vGPU allocations are reported under.
+const VGPUResourceName = "volcano.sh/vgpu"
+
+// PriceTable is the hourly price of the GPU models, matched against the
+// device type registered by the device plugin.
+type PriceTable struct {
+	// Default is the price of the models matching no entry.
+	Default float64 `json:"default"`
+	// Models maps a substring of the device type, e.g. "A100", to its
+	// hourly price. The longest matching substring wins.
+	Models map[string]float64 `json:"models"`
+}
+
+// LoadPriceTable reads a PriceTable from a YAML file.
+func LoadPriceTable(path string) (*PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t PriceTable
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("unmarshal price table: %v", err)
+	}
+	return &t, nil
+}
+
+// HourlyPrice returns the price of a device of the given type.
+func (t *PriceTable) HourlyPrice(deviceType string) float64 {
+	price, matched := t.Default, ""
+	for model, p := range t.Models {
+		if strings.Contains(deviceType, model) && len(model) > len(matched) {
+			price, matched = p, model
+		}
+	}
+	return price
+}
+
+// AllocationShare returns the fraction of the physical GPU granted by an
+// allocation: the largest of its memory and core share, a slice holding
+// half of the memory costs half of the GPU even without a core limit.
+func AllocationShare(a ContainerAllocation, d DeviceSummary) float64 {
+	share := 0.0
+	if d.Memory > 0 {
+		share = float64(a.Memory) / float64(d.Memory)
+	}
+	if cores := float64(a.Cores) / 100; cores > share {
+		share = cores
+	}
+	if share > 1 {
+		share = 1
+	}
+	return share
+}
+
+// CostCollector exports the allocations of the summaries in the shape
+// OpenCost expects, priced with Prices. The metrics follow the names and
+// labels OpenCost reads, so that the vGPU slices are priced as fractions of
+// GPUs rather than as extended resources without cost.
+type CostCollector struct {
+	Summaries func() []ClusterSummary
+	Prices    *PriceTable
+	// TenantLabels are the tenant labels added to the container metrics.
+	TenantLabels []string
+
+	containerGPUAllocationDesc *prometheus.Desc
+	nodeGPUHourlyCostDesc      *prometheus.Desc
+	nodeGPUCountDesc           *prometheus.Desc
+	containerGPUHourlyCostDesc *prometheus.Desc
+}
+
+// NewCostCollector returns a CostCollector whose container metrics also
+// carry tenantLabels, taken from the Tenant of the allocations.
+func NewCostCollector(summaries func() []ClusterSummary, prices *PriceTable, tenantLabels []string) *CostCollector {
+	return &CostCollector{
+		Summaries:    summaries,
+		Prices:       prices,
+		TenantLabels: tenantLabels,
+		containerGPUAllocationDesc: prometheus.NewDesc(
+			"container_gpu_allocation",
+			"Fraction of physical GPUs granted to the container",
+			append([]string{"cluster_id", "namespace", "pod", "container", "node", "instance_type", "resource", "deviceuuid", "devicetype"}, tenantLabels...), nil,
+		),
+		nodeGPUHourlyCostDesc: prometheus.NewDesc(
+			"node_gpu_hourly_cost",
+			"Hourly cost of a GPU of the node",
+			[]string{"cluster_id", "node", "instance_type", "deviceuuid", "devicetype"}, nil,
+		),
+		nodeGPUCountDesc: prometheus.NewDesc(
+			"node_gpu_count",
+			"Number of physical GPUs of the node",
+			[]string{"cluster_id", "node", "instance_type"}, nil,
+		),
+		containerGPUHourlyCostDesc: prometheus.NewDesc(
+			"vgpu_container_gpu_hourly_cost",
+			"Hourly cost of the GPU share granted to the container",
+			append([]string{"cluster_id", "namespace", "pod", "container", "node", "deviceuuid", "devicetype"}, tenantLabels...), nil,
+		),
+	}
+}
+
+func (c *CostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.containerGPUAllocationDesc
+	ch <- c.nodeGPUHourlyCostDesc
+	ch <- c.nodeGPUCountDesc
+	ch <- c.containerGPUHourlyCostDesc
+}
+
+func (c *CostCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.Summaries() {
+		for _, n := range s.Nodes {
+			byUUID := make(map[string]DeviceSummary, len(n.Devices))
+			for _, d := range n.Devices {
+				byUUID[d.UUID] = d
+				ch <- prometheus.MustNewConstMetric(c.nodeGPUHourlyCostDesc, prometheus.GaugeValue,
+					c.Prices.HourlyPrice(d.Type), s.Cluster, n.Name, n.InstanceType, d.UUID, d.Type)
+			}
+			ch <- prometheus.MustNewConstMetric(c.nodeGPUCountDesc, prometheus.GaugeValue,
+				float64(len(n.Devices)), s.Cluster, n.Name, n.InstanceType)
+			for _, a := range n.Allocations {
+				d, ok := byUUID[a.DeviceUUID]
+				if !ok {
+					continue
+				}
+				tenant := make([]string, len(c.TenantLabels))
+				for i, name := range c.TenantLabels {
+					tenant[i] = a.Tenant[name]
+				}
+				share := AllocationShare(a, d)
+				ch <- prometheus.MustNewConstMetric(c.containerGPUAllocationDesc, prometheus.GaugeValue, share,
+					append([]string{s.Cluster, a.Namespace, a.Pod, a.Container, n.Name, n.InstanceType, VGPUResourceName, d.UUID, d.Type}, tenant...)...)
+				ch <- prometheus.MustNewConstMetric(c.containerGPUHourlyCostDesc, prometheus.GaugeValue, share*c.Prices.HourlyPrice(d.Type),
+					append([]string{s.Cluster, a.Namespace, a.Pod, a.Container, n.Name, d.UUID, d.Type}, tenant...)...)
+			}
+		}
+	}
+}
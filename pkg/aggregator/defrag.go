@@ -0,0 +1,448 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// DefragPath is where an aggregator serves the last defragmentation plans.
+const DefragPath = "/api/v1/defrag"
+
+// DefragAnnotation set to "false" on a pod keeps it from being evicted to
+// defragment a GPU.
+const DefragAnnotation = "volcano.sh/vgpu-defrag"
+
+// DefragPolicy selects the pods which may be moved to consolidate GPUs.
+type DefragPolicy struct {
+	// MaxPodMemory is the largest vGPU memory of a pod which may be moved,
+	// 0 for no limit.
+	MaxPodMemory int32
+	// ExcludeNamespaces are the namespaces whose pods are never moved.
+	ExcludeNamespaces []string
+}
+
+// Movable reports whether the pod may be evicted, it must be owned by a
+// controller which recreates it.
+func (p DefragPolicy) Movable(pod *corev1.Pod, allocations []ContainerAllocation) bool {
+	if pod.Annotations[DefragAnnotation] == "false" || metav1.GetControllerOf(pod) == nil {
+		return false
+	}
+	for _, ns := range p.ExcludeNamespaces {
+		if pod.Namespace == ns {
+			return false
+		}
+	}
+	var memory int32
+	for _, a := range allocations {
+		memory += a.Memory
+	}
+	return p.MaxPodMemory == 0 || memory <= p.MaxPodMemory
+}
+
+// Eviction is a pod moved away by a plan.
+type Eviction struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Memory    int32  `json:"memory"`
+}
+
+// DefragPlan frees Devices of Node for an unschedulable shape by evicting
+// pods which fit on other devices.
+type DefragPlan struct {
+	Shape     RequestShape `json:"shape"`
+	Pods      []string     `json:"pods"`
+	Node      string       `json:"node"`
+	Devices   []string     `json:"devices"`
+	Evictions []Eviction   `json:"evictions"`
+}
+
+// freeDevice is what is left of a device while planning.
+type freeDevice struct {
+	node   string
+	uuid   string
+	typ    string
+	total  int32
+	memory int32
+	slots  int32
+	cores  int32
+	allocs []ContainerAllocation
+}
+
+func (d *freeDevice) fits(memory, cores int32) bool {
+	return d.slots > 0 && d.memory >= memory && d.cores >= cores
+}
+
+func (d *freeDevice) take(memory, cores int32) {
+	d.slots--
+	d.memory -= memory
+	d.cores -= cores
+}
+
+func (d *freeDevice) release(a ContainerAllocation) {
+	d.slots++
+	d.memory += a.Memory
+	d.cores += a.Cores
+}
+
+// PlanDefrag returns, for the pending shapes which no GPU can host as is,
+// the node whose devices can be freed evicting the least memory of movable
+// pods, as long as the evicted pods fit elsewhere. The plans don't share
+// devices and evict at most maxEvictions pods in total.
+func PlanDefrag(summary ClusterSummary, pods []*corev1.Pod, pending []PendingShape, policy DefragPolicy, maxEvictions int) []DefragPlan {
+	podByName := make(map[string]*corev1.Pod, len(pods))
+	for _, pod := range pods {
+		podByName[pod.Namespace+"/"+pod.Name] = pod
+	}
+	var devices []*freeDevice
+	byUUID := make(map[string]*freeDevice)
+	podAllocs := make(map[string][]ContainerAllocation)
+	for _, n := range summary.Nodes {
+		for _, d := range n.Devices {
+			if !d.Health {
+				continue
+			}
+			fd := &freeDevice{
+				node:   n.Name,
+				uuid:   d.UUID,
+				typ:    d.Type,
+				total:  d.Memory,
+				memory: d.Memory - d.AllocatedMemory,
+				slots:  d.Count - d.Used,
+				cores:  100 - d.AllocatedCores,
+			}
+			devices = append(devices, fd)
+			byUUID[d.UUID] = fd
+		}
+		for _, a := range n.Allocations {
+			if fd, ok := byUUID[a.DeviceUUID]; ok {
+				fd.allocs = append(fd.allocs, a)
+			}
+			key := a.Namespace + "/" + a.Pod
+			podAllocs[key] = append(podAllocs[key], a)
+		}
+	}
+	movable := func(key string) bool {
+		pod, ok := podByName[key]
+		return ok && policy.Movable(pod, podAllocs[key])
+	}
+
+	var plans []DefragPlan
+	evictions := 0
+	for _, p := range pending {
+		plan, ok := planShape(devices, byUUID, podAllocs, movable, p.Shape)
+		if !ok || len(plan.Evictions) == 0 {
+			continue
+		}
+		if evictions+len(plan.Evictions) > maxEvictions {
+			break
+		}
+		evictions += len(plan.Evictions)
+		plan.Pods = p.Pods
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// planShape picks the cheapest node for shape and applies the plan to the
+// devices so that the next shapes are planned on what is left.
+func planShape(devices []*freeDevice, byUUID map[string]*freeDevice, podAllocs map[string][]ContainerAllocation, movable func(string) bool, shape RequestShape) (DefragPlan, bool) {
+	type candidate struct {
+		device  *freeDevice
+		victims []string
+		cost    int32
+	}
+	byNode := make(map[string][]candidate)
+	var nodes []string
+	for _, d := range devices {
+		need := shape.MemoryOn(d.total)
+		if need == 0 {
+			need = d.total
+		}
+		if d.total < need || !util.MatchGPUType(d.typ, shape.UseTypes, shape.NoUseTypes) {
+			continue
+		}
+		c := candidate{device: d}
+		// Free the device of its smallest movable pods until the shape fits.
+		allocs := append([]ContainerAllocation(nil), d.allocs...)
+		sort.Slice(allocs, func(i, j int) bool { return allocs[i].Memory < allocs[j].Memory })
+		memory, slots, cores := d.memory, d.slots, d.cores
+		for _, a := range allocs {
+			if slots > 0 && memory >= need && cores >= shape.Cores {
+				break
+			}
+			key := a.Namespace + "/" + a.Pod
+			if !movable(key) || containsString(c.victims, key) {
+				continue
+			}
+			c.victims = append(c.victims, key)
+			for _, pa := range podAllocs[key] {
+				if pa.DeviceUUID == d.uuid {
+					memory, slots, cores = memory+pa.Memory, slots+1, cores+pa.Cores
+					c.cost += pa.Memory
+				}
+			}
+		}
+		if slots == 0 || memory < need || cores < shape.Cores {
+			continue
+		}
+		if _, ok := byNode[d.node]; !ok {
+			nodes = append(nodes, d.node)
+		}
+		byNode[d.node] = append(byNode[d.node], c)
+	}
+
+	var best *DefragPlan
+	var bestCost int32
+	for _, node := range nodes {
+		cands := byNode[node]
+		if len(cands) < int(shape.Count) {
+			continue
+		}
+		sort.Slice(cands, func(i, j int) bool { return cands[i].cost < cands[j].cost })
+		cands = cands[:shape.Count]
+		plan := DefragPlan{Shape: shape, Node: node}
+		var cost int32
+		var victims []string
+		excluded := make(map[string]bool)
+		for _, c := range cands {
+			plan.Devices = append(plan.Devices, c.device.uuid)
+			excluded[c.device.uuid] = true
+			cost += c.cost
+			for _, v := range c.victims {
+				if !containsString(victims, v) {
+					victims = append(victims, v)
+				}
+			}
+		}
+		if best != nil && cost >= bestCost {
+			continue
+		}
+		if !relocatable(devices, byUUID, podAllocs, victims, excluded, false) {
+			continue
+		}
+		for _, v := range victims {
+			var memory int32
+			for _, a := range podAllocs[v] {
+				memory += a.Memory
+			}
+			ns, name := splitKey(v)
+			plan.Evictions = append(plan.Evictions, Eviction{Namespace: ns, Pod: name, Memory: memory})
+		}
+		best, bestCost = &plan, cost
+	}
+	if best == nil {
+		return DefragPlan{}, false
+	}
+
+	// Commit the plan: the victims move, the shape takes the freed devices.
+	excluded := make(map[string]bool)
+	for _, uuid := range best.Devices {
+		excluded[uuid] = true
+	}
+	var victims []string
+	for _, e := range best.Evictions {
+		victims = append(victims, e.Namespace+"/"+e.Pod)
+	}
+	relocatable(devices, byUUID, podAllocs, victims, excluded, true)
+	for _, uuid := range best.Devices {
+		d := byUUID[uuid]
+		need := shape.MemoryOn(d.total)
+		if need == 0 {
+			need = d.memory
+		}
+		d.take(need, shape.Cores)
+	}
+	return *best, true
+}
+
+// relocatable reports whether the allocations of the victims fit on the
+// devices not excluded once released, and applies the moves when commit.
+func relocatable(devices []*freeDevice, byUUID map[string]*freeDevice, podAllocs map[string][]ContainerAllocation, victims []string, excluded map[string]bool, commit bool) bool {
+	state := make(map[*freeDevice]freeDevice, len(devices))
+	for _, d := range devices {
+		state[d] = *d
+	}
+	for _, v := range victims {
+		for _, a := range podAllocs[v] {
+			if d, ok := byUUID[a.DeviceUUID]; ok {
+				d.release(a)
+			}
+		}
+	}
+	ok := true
+	for _, v := range victims {
+		for _, a := range podAllocs[v] {
+			placed := false
+			for _, d := range devices {
+				if excluded[d.uuid] || d.uuid == a.DeviceUUID || !d.fits(a.Memory, a.Cores) {
+					continue
+				}
+				d.take(a.Memory, a.Cores)
+				placed = true
+				break
+			}
+			if !placed {
+				ok = false
+			}
+		}
+	}
+	if !ok || !commit {
+		for d, saved := range state {
+			*d = saved
+		}
+	}
+	return ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1]
+}
+
+var (
+	defragPlansDesc = prometheus.NewDesc(
+		"vgpu_defrag_plans",
+		"Number of defragmentation plans of the last run",
+		nil, nil,
+	)
+	defragEvictionsDesc = prometheus.NewDesc(
+		"vgpu_defrag_evictions_total",
+		"Number of pods evicted to defragment GPUs, by result",
+		[]string{"result"}, nil,
+	)
+	defragFreedMemoryDesc = prometheus.NewDesc(
+		"vgpu_defrag_freed_memory_total",
+		"vGPU memory of the pods evicted to defragment GPUs",
+		nil, nil,
+	)
+)
+
+// Defragmenter periodically plans the defragmentation of the cluster and,
+// unless DryRun, evicts the pods of the plans within Budget evictions per
+// BudgetWindow.
+type Defragmenter struct {
+	Client       kubernetes.Interface
+	Policy       DefragPolicy
+	DryRun       bool
+	Budget       int
+	BudgetWindow time.Duration
+
+	mutex       sync.Mutex
+	plans       []DefragPlan
+	evicted     []time.Time
+	results     map[string]float64
+	freedMemory float64
+}
+
+// Run plans and applies the defragmentation every interval, it never
+// returns. state returns the summary, the pods and the scale-up hints of
+// the cluster.
+func (d *Defragmenter) Run(interval time.Duration, state func() (ClusterSummary, []*corev1.Pod, ScaleUpHints)) {
+	klog.Infof("Defragmenting GPUs every %v, dry run %v", interval, d.DryRun)
+	for {
+		d.Step(state())
+		time.Sleep(interval)
+	}
+}
+
+// Step plans the defragmentation of the pending shapes of hints and evicts
+// the pods of the plans. It is best-effort, the devices freed are not held
+// for the pending pods and may be taken by others first.
+func (d *Defragmenter) Step(summary ClusterSummary, pods []*corev1.Pod, hints ScaleUpHints) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.results == nil {
+		d.results = make(map[string]float64)
+	}
+	now := time.Now()
+	kept := d.evicted[:0]
+	for _, t := range d.evicted {
+		if now.Sub(t) < d.BudgetWindow {
+			kept = append(kept, t)
+		}
+	}
+	d.evicted = kept
+
+	d.plans = PlanDefrag(summary, pods, hints.Pending, d.Policy, d.Budget-len(d.evicted))
+	for _, plan := range d.plans {
+		klog.Infof("Defragmenting devices %v of node %s for %v, evicting %v", plan.Devices, plan.Node, plan.Pods, plan.Evictions)
+		if d.DryRun {
+			continue
+		}
+		for _, e := range plan.Evictions {
+			err := d.Client.CoreV1().Pods(e.Namespace).Evict(context.Background(), &policyv1beta1.Eviction{
+				ObjectMeta: metav1.ObjectMeta{Namespace: e.Namespace, Name: e.Pod},
+			})
+			if err != nil {
+				// A disruption budget refusing the eviction is retried on the
+				// next run.
+				klog.Errorf("Failed to evict pod %s/%s: %v", e.Namespace, e.Pod, err)
+				d.results["error"]++
+				continue
+			}
+			d.evicted = append(d.evicted, now)
+			d.results["evicted"]++
+			d.freedMemory += float64(e.Memory)
+		}
+	}
+}
+
+// Plans returns the plans of the last run.
+func (d *Defragmenter) Plans() []DefragPlan {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]DefragPlan{}, d.plans...)
+}
+
+func (d *Defragmenter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- defragPlansDesc
+	ch <- defragEvictionsDesc
+	ch <- defragFreedMemoryDesc
+}
+
+func (d *Defragmenter) Collect(ch chan<- prometheus.Metric) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(defragPlansDesc, prometheus.GaugeValue, float64(len(d.plans)))
+	for result, v := range d.results {
+		ch <- prometheus.MustNewConstMetric(defragEvictionsDesc, prometheus.CounterValue, v, result)
+	}
+	ch <- prometheus.MustNewConstMetric(defragFreedMemoryDesc, prometheus.CounterValue, d.freedMemory)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func controlledPod(namespace, name string, annotations map[string]string) *corev1.Pod {
+	controller := true
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       namespace,
+		Name:            name,
+		Annotations:     annotations,
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: name, Controller: &controller}},
+	}}
+}
+
+// fragmentedCluster has 8000 MiB free on gpu-a, 4000 on gpu-b and 12000 on
+// gpu-c, no GPU can take 14000 MiB as is.
+func fragmentedCluster() ClusterSummary {
+	device := func(uuid string, used, allocated int32) DeviceSummary {
+		return DeviceSummary{UUID: uuid, Type: "NVIDIA-A100", Health: true, Count: 10, Used: used, Memory: 16000, AllocatedMemory: allocated}
+	}
+	alloc := func(pod, uuid string, memory int32) ContainerAllocation {
+		return ContainerAllocation{Namespace: "ns", Pod: pod, Container: "main", DeviceUUID: uuid, Memory: memory}
+	}
+	return ClusterSummary{Nodes: []NodeSummary{
+		{
+			Name:    "n1",
+			Devices: []DeviceSummary{device("gpu-a", 2, 8000), device("gpu-b", 1, 12000)},
+			Allocations: []ContainerAllocation{
+				alloc("small1", "gpu-a", 4000), alloc("small2", "gpu-a", 4000), alloc("big", "gpu-b", 12000),
+			},
+		},
+		{
+			Name:        "n2",
+			Devices:     []DeviceSummary{device("gpu-c", 1, 4000)},
+			Allocations: []ContainerAllocation{alloc("small3", "gpu-c", 4000)},
+		},
+	}}
+}
+
+func TestPlanDefrag(t *testing.T) {
+	pods := []*corev1.Pod{
+		controlledPod("ns", "small1", nil),
+		controlledPod("ns", "small2", nil),
+		controlledPod("ns", "big", nil),
+		controlledPod("ns", "small3", nil),
+	}
+	pending := []PendingShape{{Shape: RequestShape{Count: 1, Memory: 14000}, Pods: []string{"ns/pending"}}}
+	testCases := []struct {
+		pods         []*corev1.Pod
+		pending      []PendingShape
+		policy       DefragPolicy
+		maxEvictions int
+		output       []DefragPlan
+	}{
+		{
+			// Moving small3 to gpu-a is cheaper than moving small1 and
+			// small2 to gpu-c.
+			pods:         pods,
+			pending:      pending,
+			maxEvictions: 5,
+			output: []DefragPlan{{
+				Shape:     pending[0].Shape,
+				Pods:      []string{"ns/pending"},
+				Node:      "n2",
+				Devices:   []string{"gpu-c"},
+				Evictions: []Eviction{{Namespace: "ns", Pod: "small3", Memory: 4000}},
+			}},
+		},
+		{
+			pods:         []*corev1.Pod{pods[0], pods[1], pods[2], controlledPod("ns", "small3", map[string]string{DefragAnnotation: "false"})},
+			pending:      pending,
+			maxEvictions: 5,
+			output: []DefragPlan{{
+				Shape:   pending[0].Shape,
+				Pods:    []string{"ns/pending"},
+				Node:    "n1",
+				Devices: []string{"gpu-a"},
+				Evictions: []Eviction{
+					{Namespace: "ns", Pod: "small1", Memory: 4000},
+					{Namespace: "ns", Pod: "small2", Memory: 4000},
+				},
+			}},
+		},
+		{
+			pods:         pods,
+			pending:      pending,
+			policy:       DefragPolicy{ExcludeNamespaces: []string{"ns"}},
+			maxEvictions: 5,
+		},
+		{
+			pods:         pods,
+			pending:      pending,
+			policy:       DefragPolicy{MaxPodMemory: 3000},
+			maxEvictions: 5,
+		},
+		{
+			pods:         pods,
+			pending:      pending,
+			maxEvictions: 0,
+		},
+		{
+			// A shape fitting as is needs no plan.
+			pods:         pods,
+			pending:      []PendingShape{{Shape: RequestShape{Count: 1, Memory: 4000}, Pods: []string{"ns/pending"}}},
+			maxEvictions: 5,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, PlanDefrag(fragmentedCluster(), tc.pods, tc.pending, tc.policy, tc.maxEvictions))
+		})
+	}
+}
+
+func TestRelocatable(t *testing.T) {
+	newDevices := func() ([]*freeDevice, map[string]*freeDevice, map[string][]ContainerAllocation) {
+		a := &freeDevice{node: "n1", uuid: "gpu-a", total: 16000, memory: 8000, slots: 8, cores: 100}
+		b := &freeDevice{node: "n1", uuid: "gpu-b", total: 16000, memory: 4000, slots: 9, cores: 100}
+		podAllocs := map[string][]ContainerAllocation{
+			"ns/small": {{Namespace: "ns", Pod: "small", DeviceUUID: "gpu-a", Memory: 3000}},
+			"ns/large": {{Namespace: "ns", Pod: "large", DeviceUUID: "gpu-a", Memory: 6000}},
+		}
+		return []*freeDevice{a, b}, map[string]*freeDevice{"gpu-a": a, "gpu-b": b}, podAllocs
+	}
+	testCases := []struct {
+		victims []string
+		commit  bool
+		output  bool
+		// memory is what is left of gpu-a and gpu-b after the call.
+		memory []int32
+	}{
+		{victims: []string{"ns/small"}, output: true, memory: []int32{8000, 4000}},
+		{victims: []string{"ns/small"}, commit: true, output: true, memory: []int32{11000, 1000}},
+		{victims: []string{"ns/large"}, commit: true, output: false, memory: []int32{8000, 4000}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			devices, byUUID, podAllocs := newDevices()
+			excluded := map[string]bool{"gpu-a": true}
+			require.Equal(t, tc.output, relocatable(devices, byUUID, podAllocs, tc.victims, excluded, tc.commit))
+			require.Equal(t, tc.memory, []int32{devices[0].memory, devices[1].memory})
+		})
+	}
+}
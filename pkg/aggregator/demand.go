@@ -0,0 +1,164 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// PendingDemandPath is where an aggregator serves the pending vGPU demand
+// of its cluster.
+const PendingDemandPath = "/api/v1/pending-demand"
+
+// PoolDemand is the vGPU demand of the pods waiting for the nodes of a
+// pool, the nodes with the same value of the node group label.
+type PoolDemand struct {
+	// Pool is empty for the pods which don't select a pool.
+	Pool string `json:"pool"`
+	Pods int    `json:"pods"`
+	// VGPUs, Memory and Cores are the sums of the requests of the pods,
+	// Memory in the unit the devices are registered with. The memory of
+	// the requests of whole GPUs is unknown and not counted.
+	VGPUs  int64 `json:"vgpus"`
+	Memory int64 `json:"memory"`
+	Cores  int64 `json:"cores"`
+	// Oldest is when the pod waiting the longest was created.
+	Oldest time.Time `json:"oldest"`
+}
+
+// PendingDemand is the vGPU demand of the pods of a cluster the scheduler
+// couldn't place for lack of vGPU resources.
+type PendingDemand struct {
+	Cluster string       `json:"cluster"`
+	Time    time.Time    `json:"time"`
+	Pools   []PoolDemand `json:"pools"`
+}
+
+// InsufficientVGPU reports whether the scheduler gave up on placing the pod
+// for lack of vGPU resources, after the message of its scheduling
+// condition.
+func InsufficientVGPU(pod *corev1.Pod) bool {
+	if !Unschedulable(pod) || len(RequestShapes(pod)) == 0 {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type != corev1.PodScheduled {
+			continue
+		}
+		msg := strings.ToLower(c.Message)
+		for _, name := range []string{util.ResourceName, util.ResourceMem, util.ResourceCores} {
+			if strings.Contains(msg, strings.ToLower(name)) {
+				return true
+			}
+		}
+		return strings.Contains(msg, "gpu")
+	}
+	return false
+}
+
+// BuildPendingDemand sums the requests of the pods waiting for vGPUs by the
+// value of groupLabel their node selector requires.
+func BuildPendingDemand(cluster string, pods []*corev1.Pod, groupLabel string, now time.Time) PendingDemand {
+	demand := PendingDemand{Cluster: cluster, Time: now, Pools: []PoolDemand{}}
+	byPool := make(map[string]*PoolDemand)
+	for _, pod := range pods {
+		if !InsufficientVGPU(pod) {
+			continue
+		}
+		pool := pod.Spec.NodeSelector[groupLabel]
+		d, ok := byPool[pool]
+		if !ok {
+			d = &PoolDemand{Pool: pool}
+			byPool[pool] = d
+		}
+		d.Pods++
+		for _, s := range RequestShapes(pod) {
+			d.VGPUs += int64(s.Count)
+			d.Memory += int64(s.Count) * int64(s.Memory)
+			d.Cores += int64(s.Count) * int64(s.Cores)
+		}
+		if d.Oldest.IsZero() || pod.CreationTimestamp.Time.Before(d.Oldest) {
+			d.Oldest = pod.CreationTimestamp.Time
+		}
+	}
+	for _, d := range byPool {
+		demand.Pools = append(demand.Pools, *d)
+	}
+	sort.Slice(demand.Pools, func(i, j int) bool { return demand.Pools[i].Pool < demand.Pools[j].Pool })
+	return demand
+}
+
+var (
+	demandLabels = []string{"cluster", "pool"}
+
+	demandPodsDesc = prometheus.NewDesc(
+		"vgpu_pending_demand_pods",
+		"Number of pods waiting for vGPU resources",
+		demandLabels, nil,
+	)
+	demandVGPUsDesc = prometheus.NewDesc(
+		"vgpu_pending_demand_vgpus",
+		"vGPUs requested by the pods waiting for vGPU resources",
+		demandLabels, nil,
+	)
+	demandMemoryDesc = prometheus.NewDesc(
+		"vgpu_pending_demand_memory",
+		"Device memory requested by the pods waiting for vGPU resources",
+		demandLabels, nil,
+	)
+	demandCoresDesc = prometheus.NewDesc(
+		"vgpu_pending_demand_cores",
+		"Device cores requested by the pods waiting for vGPU resources",
+		demandLabels, nil,
+	)
+	demandOldestDesc = prometheus.NewDesc(
+		"vgpu_pending_demand_oldest_seconds",
+		"Age of the pod waiting the longest for vGPU resources",
+		demandLabels, nil,
+	)
+)
+
+// DemandCollector exports the pools of the demand returned by Demand.
+type DemandCollector struct {
+	Demand func() PendingDemand
+}
+
+func (c DemandCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- demandPodsDesc
+	ch <- demandVGPUsDesc
+	ch <- demandMemoryDesc
+	ch <- demandCoresDesc
+	ch <- demandOldestDesc
+}
+
+func (c DemandCollector) Collect(ch chan<- prometheus.Metric) {
+	demand := c.Demand()
+	for _, d := range demand.Pools {
+		ch <- prometheus.MustNewConstMetric(demandPodsDesc, prometheus.GaugeValue, float64(d.Pods), demand.Cluster, d.Pool)
+		ch <- prometheus.MustNewConstMetric(demandVGPUsDesc, prometheus.GaugeValue, float64(d.VGPUs), demand.Cluster, d.Pool)
+		ch <- prometheus.MustNewConstMetric(demandMemoryDesc, prometheus.GaugeValue, float64(d.Memory), demand.Cluster, d.Pool)
+		ch <- prometheus.MustNewConstMetric(demandCoresDesc, prometheus.GaugeValue, float64(d.Cores), demand.Cluster, d.Pool)
+		ch <- prometheus.MustNewConstMetric(demandOldestDesc, prometheus.GaugeValue, demand.Time.Sub(d.Oldest).Seconds(), demand.Cluster, d.Pool)
+	}
+}
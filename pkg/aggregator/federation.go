@@ -0,0 +1,130 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// SummaryPath is where an aggregator serves the summary of its cluster.
+const SummaryPath = "/api/v1/summary"
+
+// Peer is the aggregator of another cluster.
+type Peer struct {
+	Name string
+	// URL is the base URL of the aggregator, SummaryPath is appended to it.
+	URL string
+}
+
+// ParsePeer parses a peer given as name=url.
+func ParsePeer(s string) (Peer, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Peer{}, fmt.Errorf("invalid peer %q, expected name=url", s)
+	}
+	return Peer{Name: parts[0], URL: strings.TrimSuffix(parts[1], "/")}, nil
+}
+
+// Federation keeps the last summary pulled from every peer.
+type Federation struct {
+	peers  []Peer
+	client *http.Client
+
+	mutex     sync.RWMutex
+	summaries map[string]ClusterSummary
+}
+
+// NewFederation returns a Federation of peers, the summaries are empty
+// until the first Refresh.
+func NewFederation(peers []Peer) *Federation {
+	return &Federation{
+		peers:     peers,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		summaries: make(map[string]ClusterSummary),
+	}
+}
+
+// Run refreshes the summaries every interval, it never returns.
+func (f *Federation) Run(interval time.Duration) {
+	klog.Infof("Federating %d clusters every %v", len(f.peers), interval)
+	for {
+		f.Refresh()
+		time.Sleep(interval)
+	}
+}
+
+// Refresh pulls the summary of every peer. A peer which fails keeps its
+// last summary with the error recorded.
+func (f *Federation) Refresh() {
+	var wg sync.WaitGroup
+	for _, p := range f.peers {
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			s, err := f.pull(p)
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if err != nil {
+				klog.Errorf("Failed to pull summary of cluster %s: %v", p.Name, err)
+				s = f.summaries[p.Name]
+				s.Error = err.Error()
+			}
+			// The peer name wins over the name the cluster gives itself.
+			s.Cluster = p.Name
+			f.summaries[p.Name] = s
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (f *Federation) pull(p Peer) (ClusterSummary, error) {
+	var s ClusterSummary
+	resp, err := f.client.Get(p.URL + SummaryPath)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return s, fmt.Errorf("summary returned status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return s, fmt.Errorf("decode summary: %v", err)
+	}
+	return s, nil
+}
+
+// Summaries returns the last summary of every peer, sorted by cluster.
+func (f *Federation) Summaries() []ClusterSummary {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	res := make([]ClusterSummary, 0, len(f.summaries))
+	for _, s := range f.summaries {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Cluster < res[j].Cluster })
+	return res
+}
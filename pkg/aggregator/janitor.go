@@ -0,0 +1,224 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// Reasons a node lock is released by the janitor.
+const (
+	LockExpired = "expired"
+	LockNoOwner = "no-owner"
+)
+
+// StaleLock is a node lock the janitor releases.
+type StaleLock struct {
+	Node   string
+	Reason string
+	// Value is the lock annotation found stale, the lock is only released
+	// while the node still has it.
+	Value string
+	// Age is how long the node has been locked.
+	Age time.Duration
+	// Memory is the vGPU memory the terminated pods still had to allocate.
+	Memory int64
+}
+
+func terminated(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// reserving reports whether the pod holds a vGPU reservation on node, the
+// scheduler assigned it devices the device plugin didn't allocate yet.
+func reserving(pod *corev1.Pod, node string) bool {
+	return pod.Annotations[util.AssignedNodeAnnotations] == node && pod.Annotations[util.DeviceBindPhase] == util.DeviceBindAllocating
+}
+
+func pendingMemory(pod *corev1.Pod) int64 {
+	var memory int64
+	for _, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsToAllocateAnnotations]) {
+		for _, d := range ctr {
+			memory += int64(d.Usedmem)
+		}
+	}
+	return memory
+}
+
+// FindStaleLock returns the lock of node if it must be released: it is older
+// than ttl or, older than grace, no pod of the node is waiting for its
+// devices.
+func FindStaleLock(node *corev1.Node, pods []*corev1.Pod, lockName string, ttl, grace time.Duration, now time.Time) *StaleLock {
+	value, ok := node.Annotations[lockName]
+	if !ok {
+		return nil
+	}
+	lockTime, err := lock.ParseNodeLock(value)
+	if err != nil {
+		klog.Warningf("Invalid lock %q on node %s: %v", value, node.Name, err)
+		return &StaleLock{Node: node.Name, Reason: LockExpired, Value: value}
+	}
+	stale := &StaleLock{Node: node.Name, Value: value, Age: now.Sub(lockTime)}
+	if stale.Age > ttl {
+		stale.Reason = LockExpired
+		return stale
+	}
+	if stale.Age < grace {
+		return nil
+	}
+	waiting := false
+	for _, pod := range pods {
+		if !reserving(pod, node.Name) {
+			continue
+		}
+		if !terminated(pod) {
+			waiting = true
+			continue
+		}
+		stale.Memory += pendingMemory(pod)
+	}
+	if waiting {
+		return nil
+	}
+	stale.Reason = LockNoOwner
+	return stale
+}
+
+var (
+	janitorReleasedDesc = prometheus.NewDesc(
+		"vgpu_node_lock_released_total",
+		"Number of node locks released by the janitor, by reason",
+		[]string{"reason"}, nil,
+	)
+	janitorReclaimedSecondsDesc = prometheus.NewDesc(
+		"vgpu_node_lock_reclaimed_seconds_total",
+		"Time the nodes whose lock was released early would have stayed locked until the lock expired",
+		nil, nil,
+	)
+	janitorReclaimedMemoryDesc = prometheus.NewDesc(
+		"vgpu_reservation_reclaimed_memory_total",
+		"vGPU memory left to allocate by the terminated pods of the released node locks",
+		nil, nil,
+	)
+)
+
+// errLockChanged is returned when the lock of a node was taken again or
+// renewed since it was found stale.
+var errLockChanged = errors.New("lock changed")
+
+// LockJanitor releases the node locks no pod waits on anymore, so that a
+// scheduler cycle interrupted between locking a node and binding its pod
+// doesn't keep the node out of scheduling until the lock expires.
+type LockJanitor struct {
+	LockName string
+	TTL      time.Duration
+	// Grace is how long a lock is kept while no pod waits on
+	// it, the scheduler locks the node before it annotates the pod.
+	Grace time.Duration
+
+	mutex            sync.Mutex
+	released         map[string]float64
+	reclaimedSeconds float64
+	reclaimedMemory  float64
+}
+
+// Run releases the stale locks of the state returned by list every
+// interval. It never returns.
+func (j *LockJanitor) Run(interval time.Duration, list func() ([]*corev1.Node, []*corev1.Pod)) {
+	klog.Infof("Releasing stale %s node locks every %v, ttl %v", j.LockName, interval, j.TTL)
+	for {
+		nodes, pods := list()
+		j.Step(nodes, pods, time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// Step releases the stale locks of nodes.
+func (j *LockJanitor) Step(nodes []*corev1.Node, pods []*corev1.Pod, now time.Time) {
+	for _, node := range nodes {
+		stale := FindStaleLock(node, pods, j.LockName, j.TTL, j.Grace, now)
+		if stale == nil {
+			continue
+		}
+		err := j.release(stale)
+		if errors.Is(err, errLockChanged) {
+			klog.V(3).Infof("Kept %s lock of node %s, taken again since it was listed", stale.Reason, node.Name)
+			continue
+		}
+		if err != nil {
+			klog.Errorf("Failed to release %s lock of node %s: %v", stale.Reason, node.Name, err)
+			continue
+		}
+		klog.Infof("Released %s lock of node %s, held for %v", stale.Reason, node.Name, stale.Age)
+		j.mutex.Lock()
+		if j.released == nil {
+			j.released = make(map[string]float64)
+		}
+		j.released[stale.Reason]++
+		if stale.Reason != LockExpired {
+			j.reclaimedSeconds += (j.TTL - stale.Age).Seconds()
+		}
+		j.reclaimedMemory += float64(stale.Memory)
+		j.mutex.Unlock()
+	}
+}
+
+// release removes the stale lock from the latest version of its node. The
+// nodes are listed from a cache, a lock renewed or taken again since then
+// has another value and is kept, as is one not stale anymore by the live
+// clock.
+func (j *LockJanitor) release(stale *StaleLock) error {
+	return lock.NodeUpdates().Mutate(stale.Node, func(node *corev1.Node) error {
+		value, ok := node.Annotations[j.LockName]
+		if !ok || value != stale.Value {
+			return errLockChanged
+		}
+		if lockTime, err := lock.ParseNodeLock(value); err == nil {
+			age := time.Since(lockTime)
+			if (stale.Reason == LockExpired && age <= j.TTL) || age < j.Grace {
+				return errLockChanged
+			}
+		}
+		delete(node.Annotations, j.LockName)
+		return nil
+	})
+}
+
+func (j *LockJanitor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- janitorReleasedDesc
+	ch <- janitorReclaimedSecondsDesc
+	ch <- janitorReclaimedMemoryDesc
+}
+
+func (j *LockJanitor) Collect(ch chan<- prometheus.Metric) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for reason, v := range j.released {
+		ch <- prometheus.MustNewConstMetric(janitorReleasedDesc, prometheus.CounterValue, v, reason)
+	}
+	ch <- prometheus.MustNewConstMetric(janitorReclaimedSecondsDesc, prometheus.CounterValue, j.reclaimedSeconds)
+	ch <- prometheus.MustNewConstMetric(janitorReclaimedMemoryDesc, prometheus.CounterValue, j.reclaimedMemory)
+}
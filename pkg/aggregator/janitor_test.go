@@ -0,0 +1,126 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+const testLock = "volcano.sh/mutex.lock"
+
+func lockedNode(lockTime time.Time) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node",
+		Annotations: map[string]string{testLock: lockTime.Format(time.RFC3339)},
+	}}
+}
+
+func TestFindStaleLock(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ttl, grace := 5*time.Minute, 30*time.Second
+	reserving := func(phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Annotations: map[string]string{
+				util.AssignedNodeAnnotations:          "node",
+				util.DeviceBindPhase:                  util.DeviceBindAllocating,
+				util.AssignedIDsToAllocateAnnotations: util.EncodePodDevices(util.PodDevices{{{UUID: "gpu-0", Usedmem: 1024}}}),
+			}},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+	testCases := []struct {
+		node   *corev1.Node
+		pods   []*corev1.Pod
+		output *StaleLock
+	}{
+		{node: &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}},
+		{node: lockedNode(now.Add(-10 * time.Second))},
+		{
+			node:   lockedNode(now.Add(-10 * time.Minute)),
+			pods:   []*corev1.Pod{reserving(corev1.PodRunning)},
+			output: &StaleLock{Node: "node", Reason: LockExpired, Value: lockedNode(now.Add(-10 * time.Minute)).Annotations[testLock], Age: 10 * time.Minute},
+		},
+		{node: lockedNode(now.Add(-time.Minute)), pods: []*corev1.Pod{reserving(corev1.PodRunning)}},
+		{
+			node:   lockedNode(now.Add(-time.Minute)),
+			pods:   []*corev1.Pod{reserving(corev1.PodFailed)},
+			output: &StaleLock{Node: "node", Reason: LockNoOwner, Value: lockedNode(now.Add(-time.Minute)).Annotations[testLock], Age: time.Minute, Memory: 1024},
+		},
+		{
+			node:   &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: map[string]string{testLock: "invalid"}}},
+			output: &StaleLock{Node: "node", Reason: LockExpired, Value: "invalid"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, FindStaleLock(tc.node, tc.pods, testLock, ttl, grace, now))
+		})
+	}
+}
+
+func TestLockJanitorStep(t *testing.T) {
+	expired := time.Now().Add(-10 * time.Minute)
+	testCases := []struct {
+		// update changes the lock of the node between the list and the
+		// release.
+		update   func(node *corev1.Node)
+		released bool
+	}{
+		{update: func(node *corev1.Node) {}, released: true},
+		{update: func(node *corev1.Node) {
+			node.Annotations[testLock] = time.Now().Format(time.RFC3339)
+		}},
+		{update: func(node *corev1.Node) {
+			delete(node.Annotations, testLock)
+		}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			listed := lockedNode(expired)
+			live := listed.DeepCopy()
+			tc.update(live)
+			client := fake.NewSimpleClientset(live)
+			require.NoError(t, lock.UseClient(client))
+
+			j := &LockJanitor{LockName: testLock, TTL: 5 * time.Minute, Grace: 30 * time.Second}
+			j.Step([]*corev1.Node{listed}, nil, time.Now())
+
+			node, err := client.CoreV1().Nodes().Get(context.Background(), "node", metav1.GetOptions{})
+			require.NoError(t, err)
+			if tc.released {
+				require.NotContains(t, node.Annotations, testLock)
+				require.Equal(t, float64(1), j.released[LockExpired])
+				return
+			}
+			require.Equal(t, live.Annotations, node.Annotations)
+			require.Zero(t, j.released[LockExpired])
+		})
+	}
+}
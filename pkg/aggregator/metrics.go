@@ -0,0 +1,102 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deviceLabels = []string{"cluster", "node", "deviceuuid", "devicetype"}
+
+	deviceSlotsDesc = prometheus.NewDesc(
+		"vgpu_cluster_device_slots",
+		"Number of vGPUs the physical GPU is split in",
+		deviceLabels, nil,
+	)
+	deviceSlotsUsedDesc = prometheus.NewDesc(
+		"vgpu_cluster_device_slots_allocated",
+		"Number of vGPUs of the physical GPU granted to pods",
+		deviceLabels, nil,
+	)
+	deviceMemoryDesc = prometheus.NewDesc(
+		"vgpu_cluster_device_memory",
+		"Memory of the physical GPU registered by the device plugin",
+		deviceLabels, nil,
+	)
+	deviceMemoryAllocatedDesc = prometheus.NewDesc(
+		"vgpu_cluster_device_memory_allocated",
+		"Memory of the physical GPU granted to pods",
+		deviceLabels, nil,
+	)
+	deviceCoresAllocatedDesc = prometheus.NewDesc(
+		"vgpu_cluster_device_cores_allocated",
+		"Percentage of the physical GPU cores granted to pods",
+		deviceLabels, nil,
+	)
+	deviceHealthyDesc = prometheus.NewDesc(
+		"vgpu_cluster_device_healthy",
+		"Whether the device plugin reports the physical GPU healthy",
+		deviceLabels, nil,
+	)
+	clusterUpDesc = prometheus.NewDesc(
+		"vgpu_cluster_up",
+		"Whether the last summary of the cluster could be pulled",
+		[]string{"cluster"}, nil,
+	)
+)
+
+// SummaryCollector exports the summaries returned by Summaries, the local
+// cluster and the federated ones alike.
+type SummaryCollector struct {
+	Summaries func() []ClusterSummary
+}
+
+func (c SummaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceSlotsDesc
+	ch <- deviceSlotsUsedDesc
+	ch <- deviceMemoryDesc
+	ch <- deviceMemoryAllocatedDesc
+	ch <- deviceCoresAllocatedDesc
+	ch <- deviceHealthyDesc
+	ch <- clusterUpDesc
+}
+
+func (c SummaryCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.Summaries() {
+		up := 1.0
+		if s.Error != "" {
+			up = 0
+		}
+		ch <- prometheus.MustNewConstMetric(clusterUpDesc, prometheus.GaugeValue, up, s.Cluster)
+		for _, n := range s.Nodes {
+			for _, d := range n.Devices {
+				labels := []string{s.Cluster, n.Name, d.UUID, d.Type}
+				ch <- prometheus.MustNewConstMetric(deviceSlotsDesc, prometheus.GaugeValue, float64(d.Count), labels...)
+				ch <- prometheus.MustNewConstMetric(deviceSlotsUsedDesc, prometheus.GaugeValue, float64(d.Used), labels...)
+				ch <- prometheus.MustNewConstMetric(deviceMemoryDesc, prometheus.GaugeValue, float64(d.Memory), labels...)
+				ch <- prometheus.MustNewConstMetric(deviceMemoryAllocatedDesc, prometheus.GaugeValue, float64(d.AllocatedMemory), labels...)
+				ch <- prometheus.MustNewConstMetric(deviceCoresAllocatedDesc, prometheus.GaugeValue, float64(d.AllocatedCores), labels...)
+				healthy := 0.0
+				if d.Health {
+					healthy = 1
+				}
+				ch <- prometheus.MustNewConstMetric(deviceHealthyDesc, prometheus.GaugeValue, healthy, labels...)
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// ScaleUpHintsPath is where an aggregator serves the scale-up hints of its
+// cluster.
+const ScaleUpHintsPath = "/api/v1/scaleup-hints"
+
+// NodeTemplatePrefix is the prefix of the tags the cluster autoscaler builds
+// the template of an empty node group from.
+const NodeTemplatePrefix = "k8s.io/cluster-autoscaler/node-template/"
+
+// RequestShape is the vGPU request of a container.
+type RequestShape struct {
+	Count int32 `json:"count"`
+	// Memory is the memory of every vGPU, in the unit the device plugin
+	// registers the devices with. 0 asks for whole GPUs.
+	Memory int32 `json:"memory"`
+	// MemoryPercentage is the memory of every vGPU as a percentage of the
+	// memory of its GPU, when Memory is 0.
+	MemoryPercentage int32 `json:"memoryPercentage,omitempty"`
+	Cores            int32 `json:"cores"`
+	// UseTypes and NoUseTypes are the GPU models the pod is restricted to
+	// and excluded from.
+	UseTypes   []string `json:"useTypes,omitempty"`
+	NoUseTypes []string `json:"noUseTypes,omitempty"`
+}
+
+func (s RequestShape) key() string {
+	return fmt.Sprintf("%d/%d/%d/%d/%s/%s", s.Count, s.Memory, s.MemoryPercentage, s.Cores, strings.Join(s.UseTypes, ","), strings.Join(s.NoUseTypes, ","))
+}
+
+// MemoryOn returns the memory of every vGPU of the shape on a GPU of total
+// memory, 0 for whole GPUs.
+func (s RequestShape) MemoryOn(total int32) int32 {
+	if s.Memory == 0 && s.MemoryPercentage > 0 {
+		return total * s.MemoryPercentage / 100
+	}
+	return s.Memory
+}
+
+// PendingShape is a shape of request unschedulable pods are waiting for.
+type PendingShape struct {
+	Shape RequestShape `json:"shape"`
+	// Pods are the namespace/name of the pods waiting for the shape.
+	Pods []string `json:"pods"`
+	// NodeGroups are the node groups an empty node of which fits the shape,
+	// none means no scale-up would help.
+	NodeGroups []string `json:"nodeGroups"`
+}
+
+// NodeGroupTemplate is what a new node of a node group brings, built from a
+// registered node of the group.
+type NodeGroupTemplate struct {
+	Name       string `json:"name"`
+	DeviceType string `json:"deviceType"`
+	Devices    int    `json:"devices"`
+	// DeviceMemory is the memory of one device, Split the number of vGPUs it
+	// is split in.
+	DeviceMemory int32 `json:"deviceMemory"`
+	Split        int32 `json:"split"`
+	// Capacity is the extended resource capacity of an empty node.
+	Capacity map[string]int64 `json:"capacity"`
+	// Tags are the cluster autoscaler node-template tags to set on the node
+	// group so that it can scale from zero.
+	Tags map[string]string `json:"tags"`
+}
+
+// ScaleUpHints are the vGPU requests of a cluster which can't be scheduled
+// and the node groups which would fit them.
+type ScaleUpHints struct {
+	Cluster    string              `json:"cluster"`
+	Time       time.Time           `json:"time"`
+	Pending    []PendingShape      `json:"pending"`
+	NodeGroups []NodeGroupTemplate `json:"nodeGroups"`
+}
+
+// Unschedulable reports whether the scheduler gave up on placing the pod.
+func Unschedulable(pod *corev1.Pod) bool {
+	if pod.Spec.NodeName != "" || pod.Status.Phase != corev1.PodPending {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled {
+			return c.Status == corev1.ConditionFalse && c.Reason == corev1.PodReasonUnschedulable
+		}
+	}
+	return false
+}
+
+// RequestShapes returns the vGPU requests of the containers of pod.
+func RequestShapes(pod *corev1.Pod) []RequestShape {
+	useTypes, noUseTypes := util.GPUTypeFilters(pod.Annotations)
+	var shapes []RequestShape
+	for _, ctr := range pod.Spec.Containers {
+		count, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceName)]
+		if !ok || count.Value() == 0 {
+			continue
+		}
+		shape := RequestShape{Count: int32(count.Value()), UseTypes: useTypes, NoUseTypes: noUseTypes}
+		if mem, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceMem)]; ok {
+			shape.Memory = int32(mem.Value())
+		}
+		if pct, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceMemPercentage)]; ok {
+			shape.MemoryPercentage = int32(pct.Value())
+		}
+		if cores, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceCores)]; ok {
+			shape.Cores = int32(cores.Value())
+		}
+		shapes = append(shapes, shape)
+	}
+	return shapes
+}
+
+// Fits reports whether an empty node of the group can host the shape.
+func (g NodeGroupTemplate) Fits(s RequestShape) bool {
+	if int(s.Count) > g.Devices || s.Memory > g.DeviceMemory || s.MemoryPercentage > 100 || s.Cores > 100 {
+		return false
+	}
+	return util.MatchGPUType(g.DeviceType, s.UseTypes, s.NoUseTypes)
+}
+
+// NodeGroupTemplates builds a template for every value of the groupLabel
+// of the nodes with registered devices, from the first node of the group.
+func NodeGroupTemplates(nodes []*corev1.Node, groupLabel string) []NodeGroupTemplate {
+	groups := make(map[string]NodeGroupTemplate)
+	for _, node := range nodes {
+		group := node.Labels[groupLabel]
+		if group == "" {
+			continue
+		}
+		if _, ok := groups[group]; ok {
+			continue
+		}
+		registered := util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered])
+		if len(registered) == 0 {
+			continue
+		}
+		g := NodeGroupTemplate{
+			Name:         group,
+			DeviceType:   registered[0].Type,
+			Devices:      len(registered),
+			DeviceMemory: registered[0].Devmem,
+			Split:        registered[0].Count,
+		}
+		var count, memory int64
+		for _, d := range registered {
+			count += int64(d.Count)
+			memory += int64(d.Devmem)
+		}
+		g.Capacity = map[string]int64{
+			util.ResourceName:          count,
+			util.ResourceMem:           memory,
+			util.ResourceCores:         int64(100 * len(registered)),
+			util.ResourceMemPercentage: int64(100 * len(registered)),
+		}
+		g.Tags = map[string]string{
+			NodeTemplatePrefix + "label/" + groupLabel: group,
+		}
+		for name, v := range g.Capacity {
+			g.Tags[NodeTemplatePrefix+"resources/"+name] = fmt.Sprint(v)
+		}
+		groups[group] = g
+	}
+	res := make([]NodeGroupTemplate, 0, len(groups))
+	for _, g := range groups {
+		res = append(res, g)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// BuildScaleUpHints groups the requests of the unschedulable pods by shape
+// and matches them against the node groups of groupLabel.
+func BuildScaleUpHints(cluster string, nodes []*corev1.Node, pods []*corev1.Pod, groupLabel string, now time.Time) ScaleUpHints {
+	hints := ScaleUpHints{
+		Cluster:    cluster,
+		Time:       now,
+		Pending:    []PendingShape{},
+		NodeGroups: NodeGroupTemplates(nodes, groupLabel),
+	}
+	byShape := make(map[string]int)
+	for _, pod := range pods {
+		if !Unschedulable(pod) {
+			continue
+		}
+		for _, shape := range RequestShapes(pod) {
+			idx, ok := byShape[shape.key()]
+			if !ok {
+				p := PendingShape{Shape: shape, NodeGroups: []string{}}
+				for _, g := range hints.NodeGroups {
+					if g.Fits(shape) {
+						p.NodeGroups = append(p.NodeGroups, g.Name)
+					}
+				}
+				idx = len(hints.Pending)
+				byShape[shape.key()] = idx
+				hints.Pending = append(hints.Pending, p)
+			}
+			name := pod.Namespace + "/" + pod.Name
+			// A pod of several containers of the same shape counts once.
+			if waiting := hints.Pending[idx].Pods; len(waiting) == 0 || waiting[len(waiting)-1] != name {
+				hints.Pending[idx].Pods = append(waiting, name)
+			}
+		}
+	}
+	sort.Slice(hints.Pending, func(i, j int) bool { return hints.Pending[i].Shape.key() < hints.Pending[j].Shape.key() })
+	return hints
+}
+
+var (
+	shapeLabels = []string{"cluster", "count", "memory", "cores", "gputype", "nogputype"}
+
+	pendingPodsDesc = prometheus.NewDesc(
+		"vgpu_cluster_pending_pods",
+		"Number of unschedulable pods waiting for a shape of vGPU request",
+		shapeLabels, nil,
+	)
+	pendingNodeGroupsDesc = prometheus.NewDesc(
+		"vgpu_cluster_pending_fitting_node_groups",
+		"Number of node groups a new node of which would fit a shape of vGPU request unschedulable pods are waiting for",
+		shapeLabels, nil,
+	)
+)
+
+// ScaleUpCollector exports the pending shapes of the hints returned by
+// Hints.
+type ScaleUpCollector struct {
+	Hints func() ScaleUpHints
+}
+
+func (c ScaleUpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingPodsDesc
+	ch <- pendingNodeGroupsDesc
+}
+
+func (c ScaleUpCollector) Collect(ch chan<- prometheus.Metric) {
+	hints := c.Hints()
+	for _, p := range hints.Pending {
+		labels := []string{hints.Cluster, fmt.Sprint(p.Shape.Count), fmt.Sprint(p.Shape.Memory), fmt.Sprint(p.Shape.Cores),
+			strings.Join(p.Shape.UseTypes, ","), strings.Join(p.Shape.NoUseTypes, ",")}
+		ch <- prometheus.MustNewConstMetric(pendingPodsDesc, prometheus.GaugeValue, float64(len(p.Pods)), labels...)
+		ch <- prometheus.MustNewConstMetric(pendingNodeGroupsDesc, prometheus.GaugeValue, float64(len(p.NodeGroups)), labels...)
+	}
+}
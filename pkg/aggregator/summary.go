@@ -0,0 +1,162 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package aggregator summarizes the vGPU capacity and allocation of a
+// cluster from the annotations the device plugin and the scheduler write on
+// nodes and pods, and federates the summaries of several clusters.
+package aggregator
+
+import (
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// ClusterSummary is the vGPU capacity and allocation of a cluster.
+type ClusterSummary struct {
+	Cluster string        `json:"cluster"`
+	Time    time.Time     `json:"time"`
+	Nodes   []NodeSummary `json:"nodes"`
+	// Error is set on a federated summary which could not be refreshed, the
+	// nodes are then the last ones received.
+	Error string `json:"error,omitempty"`
+}
+
+// NodeSummary is the vGPU capacity and allocation of a node.
+type NodeSummary struct {
+	Name string `json:"name"`
+	// InstanceType is the node.kubernetes.io/instance-type label of the
+	// node, if any.
+	InstanceType string                `json:"instanceType,omitempty"`
+	Devices      []DeviceSummary       `json:"devices"`
+	Allocations  []ContainerAllocation `json:"allocations"`
+}
+
+// ContainerAllocation is a vGPU granted to a container.
+type ContainerAllocation struct {
+	Namespace  string `json:"namespace"`
+	Pod        string `json:"pod"`
+	Container  string `json:"container"`
+	DeviceUUID string `json:"deviceuuid"`
+	Memory     int32  `json:"memory"`
+	Cores      int32  `json:"cores"`
+	// Tenant are the tenant labels of the namespace, keyed by metric label
+	// name, as resolved by the cluster the allocation belongs to.
+	Tenant map[string]string `json:"tenant,omitempty"`
+}
+
+// Labels of the instance type of a node.
+const (
+	InstanceTypeLabel     = "node.kubernetes.io/instance-type"
+	BetaInstanceTypeLabel = "beta.kubernetes.io/instance-type"
+)
+
+// DeviceSummary is a physical GPU as registered by the device plugin, with
+// what the pods bound to the node are granted of it.
+type DeviceSummary struct {
+	UUID   string `json:"uuid"`
+	Type   string `json:"type"`
+	Health bool   `json:"health"`
+	// Count is the number of vGPUs the device is split in, Used the number
+	// granted.
+	Count int32 `json:"count"`
+	Used  int32 `json:"used"`
+	// Memory and AllocatedMemory are in the unit the device plugin registers
+	// the device with, MiB unless a memory factor is set.
+	Memory          int32 `json:"memory"`
+	AllocatedMemory int32 `json:"allocatedMemory"`
+	AllocatedCores  int32 `json:"allocatedCores"`
+}
+
+// Summarize builds the summary of the nodes with registered vGPU devices
+// from the assigned devices of the pods which are not terminated.
+func Summarize(cluster string, nodes []*corev1.Node, pods []*corev1.Pod, now time.Time) ClusterSummary {
+	summary := ClusterSummary{Cluster: cluster, Time: now, Nodes: []NodeSummary{}}
+	devices := make(map[string]map[string]*DeviceSummary)
+	for _, node := range nodes {
+		registered := util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered])
+		if len(registered) == 0 {
+			continue
+		}
+		ns := NodeSummary{Name: node.Name, InstanceType: node.Labels[InstanceTypeLabel], Allocations: []ContainerAllocation{}}
+		if ns.InstanceType == "" {
+			ns.InstanceType = node.Labels[BetaInstanceTypeLabel]
+		}
+		for _, d := range registered {
+			ns.Devices = append(ns.Devices, DeviceSummary{
+				UUID:   d.Id,
+				Type:   d.Type,
+				Health: d.Health,
+				Count:  d.Count,
+				Memory: d.Devmem,
+			})
+		}
+		summary.Nodes = append(summary.Nodes, ns)
+	}
+	// Index the devices once the nodes slice is no longer growing.
+	nodeIndex := make(map[string]int, len(summary.Nodes))
+	for i := range summary.Nodes {
+		n := &summary.Nodes[i]
+		nodeIndex[n.Name] = i
+		byUUID := make(map[string]*DeviceSummary, len(n.Devices))
+		for j := range n.Devices {
+			byUUID[n.Devices[j].UUID] = &n.Devices[j]
+		}
+		devices[n.Name] = byUUID
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		nodeName := pod.Spec.NodeName
+		if nodeName == "" {
+			nodeName = pod.Annotations[util.AssignedNodeAnnotations]
+		}
+		byUUID, ok := devices[nodeName]
+		if !ok {
+			continue
+		}
+		node := &summary.Nodes[nodeIndex[nodeName]]
+		for idx, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			ctrName := ""
+			if idx < len(pod.Spec.Containers) {
+				ctrName = pod.Spec.Containers[idx].Name
+			}
+			for _, cd := range ctr {
+				d, ok := byUUID[cd.UUID]
+				if !ok {
+					continue
+				}
+				d.Used++
+				d.AllocatedMemory += cd.Usedmem
+				d.AllocatedCores += cd.Usedcores
+				node.Allocations = append(node.Allocations, ContainerAllocation{
+					Namespace:  pod.Namespace,
+					Pod:        pod.Name,
+					Container:  ctrName,
+					DeviceUUID: cd.UUID,
+					Memory:     cd.Usedmem,
+					Cores:      cd.Usedcores,
+				})
+			}
+		}
+	}
+	sort.Slice(summary.Nodes, func(i, j int) bool { return summary.Nodes[i].Name < summary.Nodes[j].Name })
+	return summary
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VGPUDeviceResource is the resource of the VGPUDevices.
+var VGPUDeviceResource = SchemeGroupVersion.WithResource("vgpudevices")
+
+// NodeLabel is the label of the VGPUDevices with the name of their node.
+const NodeLabel = GroupName + "/node"
+
+// VGPUDevice is a GPU registered by the device plugin of its node, named
+// after its lowercased UUID. It has what the volcano.sh/node-vgpu-register
+// annotation of the node encodes, with the vGPUs granted on the GPU.
+type VGPUDevice struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VGPUDeviceSpec   `json:"spec"`
+	Status VGPUDeviceStatus `json:"status,omitempty"`
+}
+
+// VGPUDeviceSpec is the registration of the GPU.
+type VGPUDeviceSpec struct {
+	NodeName string `json:"nodeName"`
+	UUID     string `json:"uuid"`
+	Index    int    `json:"index"`
+	// Type is the model of the GPU, e.g. NVIDIA-Tesla T4.
+	Type string `json:"type"`
+	// Count is the number of vGPUs the GPU is split in.
+	Count int32 `json:"count"`
+	// Memory is the memory registered, in blocks of the gpu memory factor
+	// of the device plugin, 1MiB by default.
+	Memory int32 `json:"memory"`
+	// Cores is the SM percentage of the GPU.
+	Cores int32 `json:"cores"`
+	// Mode is how the GPU is shared, hami-core or mig.
+	Mode string `json:"mode"`
+}
+
+// VGPUDeviceStatus is the health and occupancy of the GPU.
+type VGPUDeviceStatus struct {
+	// UpdateTime is when the device plugin last wrote the status.
+	UpdateTime metav1.Time `json:"updateTime,omitempty"`
+	Healthy    bool        `json:"healthy"`
+	// Used, UsedMemory and UsedCores are the vGPUs, memory and cores
+	// granted, the memory in the blocks of Memory.
+	Used       int32      `json:"used"`
+	UsedMemory int32      `json:"usedMemory"`
+	UsedCores  int32      `json:"usedCores"`
+	Pods       []PodSlice `json:"pods,omitempty"`
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package v1alpha1 holds the vgpu.volcano.sh custom resources. They are
+// read and written with the dynamic client, the types are converted from
+// and to unstructured objects.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the vGPU custom resources.
+const GroupName = "vgpu.volcano.sh"
+
+// SchemeGroupVersion is the group version of the resources of the package.
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// NodeVGPUAllocationResource is the resource of the NodeVGPUAllocations.
+var NodeVGPUAllocationResource = SchemeGroupVersion.WithResource("nodevgpuallocations")
+
+// NodeVGPUAllocation is the allocation table of the vGPUs of a node, named
+// after the node and written by its device plugin.
+type NodeVGPUAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status NodeVGPUAllocationStatus `json:"status,omitempty"`
+}
+
+// NodeVGPUAllocationStatus is the occupancy of the GPUs of the node.
+type NodeVGPUAllocationStatus struct {
+	// UpdateTime is when the device plugin last wrote the status.
+	UpdateTime metav1.Time    `json:"updateTime,omitempty"`
+	Devices    []DeviceStatus `json:"devices"`
+}
+
+// DeviceStatus is the occupancy of a GPU.
+type DeviceStatus struct {
+	UUID    string `json:"uuid"`
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	Healthy bool   `json:"healthy"`
+	// Count is the number of vGPUs the device is split in, Used how many
+	// are granted.
+	Count int32 `json:"count"`
+	Used  int32 `json:"used"`
+	// Memory is the device memory in MiB, UsedMemory the memory granted.
+	Memory     int32 `json:"memory"`
+	UsedMemory int32 `json:"usedMemory"`
+	// Cores is the SM percentage available, UsedCores the percentage
+	// granted.
+	Cores     int32      `json:"cores"`
+	UsedCores int32      `json:"usedCores"`
+	Pods      []PodSlice `json:"pods,omitempty"`
+}
+
+// PodSlice is the vGPU of a device granted to a container.
+type PodSlice struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	Memory    int32  `json:"memory"`
+	Cores     int32  `json:"cores"`
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VGPUQuotaResource is the resource of the VGPUQuotas.
+var VGPUQuotaResource = SchemeGroupVersion.WithResource("vgpuquotas")
+
+// VGPUQuota limits the vGPUs the pods of its namespace are granted in
+// total, the pods beyond it are denied by the admission webhook.
+type VGPUQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VGPUQuotaSpec   `json:"spec"`
+	Status VGPUQuotaStatus `json:"status,omitempty"`
+}
+
+// VGPUQuotaSpec is the limits of the quota.
+type VGPUQuotaSpec struct {
+	Hard VGPUQuotaLimits `json:"hard"`
+}
+
+// VGPUQuotaLimits are the totals of the namespace, a nil one is not
+// limited.
+type VGPUQuotaLimits struct {
+	// VGPUs is the number of vGPUs.
+	VGPUs *int64 `json:"vgpus,omitempty"`
+	// Memory is the device memory in MiB.
+	Memory *int64 `json:"memory,omitempty"`
+	// Cores is the sum of the SM percentages, 100 per whole GPU.
+	Cores *int64 `json:"cores,omitempty"`
+}
+
+// VGPUQuotaStatus is the usage of the quota, written by the aggregator.
+type VGPUQuotaStatus struct {
+	UpdateTime metav1.Time    `json:"updateTime,omitempty"`
+	Used       VGPUQuotaUsage `json:"used"`
+}
+
+// VGPUQuotaUsage is what the pods of the namespace are granted or request.
+type VGPUQuotaUsage struct {
+	VGPUs  int64 `json:"vgpus"`
+	Memory int64 `json:"memory"`
+	Cores  int64 `json:"cores"`
+}
+
+// Add returns the sum of the usages.
+func (u VGPUQuotaUsage) Add(v VGPUQuotaUsage) VGPUQuotaUsage {
+	return VGPUQuotaUsage{VGPUs: u.VGPUs + v.VGPUs, Memory: u.Memory + v.Memory, Cores: u.Cores + v.Cores}
+}
@@ -17,29 +17,51 @@ limitations under the License.
 package lock
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/nodeupdate"
 )
 
-const MaxLockRetry = 5
+// LockTTL is how long a node lock is held before it expires and the node
+// can be locked again. Holders of long reservations renew it.
+var LockTTL = 5 * time.Minute
+
+var (
+	kubeClient kubernetes.Interface
 
-var kubeClient kubernetes.Interface
+	queueMutex  sync.Mutex
+	queueClient kubernetes.Interface
+	nodeQueue   *nodeupdate.Queue
+)
 
 func GetClient() kubernetes.Interface {
 	return kubeClient
 }
 
-// NewClient connects to an API server
-func NewClient() (kubernetes.Interface, error) {
+// NodeUpdates returns the queue every write to the nodes goes through, so
+// that the lock, registration and health writers don't overwrite each other.
+func NodeUpdates() *nodeupdate.Queue {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if nodeQueue == nil || queueClient != kubeClient {
+		nodeQueue, queueClient = nodeupdate.NewQueue(kubeClient), kubeClient
+	}
+	return nodeQueue
+}
+
+// NewConfig returns the in-cluster config of the API server, or the one of
+// $KUBECONFIG or ~/.kube/config out of a cluster.
+func NewConfig() (*rest.Config, error) {
 	kubeConfig := os.Getenv("KUBECONFIG")
 	if kubeConfig == "" {
 		kubeConfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
@@ -47,9 +69,15 @@ func NewClient() (kubernetes.Interface, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
-		if err != nil {
-			return nil, err
-		}
+	}
+	return config, err
+}
+
+// NewClient connects to an API server
+func NewClient() (kubernetes.Interface, error) {
+	config, err := NewConfig()
+	if err != nil {
+		return nil, err
 	}
 	client, err := kubernetes.NewForConfig(config)
 	kubeClient = client
@@ -62,33 +90,23 @@ func UseClient(client kubernetes.Interface) error {
 	return nil
 }
 
+// ParseNodeLock decodes the time of a lock annotation, as the scheduler
+// parses it.
+func ParseNodeLock(value string) (time.Time, error) {
+	return time.Parse(time.RFC3339, value)
+}
+
 func setNodeLock(nodeName string, lockName string) error {
-	ctx := context.Background()
-	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-	if err != nil {
-		klog.Errorln("get node failed", err.Error())
-		return err
-	}
-	if _, ok := node.ObjectMeta.Annotations[lockName]; ok {
-		return fmt.Errorf("node %s is locked", nodeName)
-	}
-	newNode := node.DeepCopy()
-	newNode.ObjectMeta.Annotations[lockName] = time.Now().Format(time.RFC3339)
-	_, err = kubeClient.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{})
-	for i := 0; i < MaxLockRetry && err != nil; i++ {
-		klog.ErrorS(err, "Failed to update node", "node", nodeName, "retry", i)
-		time.Sleep(100 * time.Millisecond)
-		node, err = kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-		if err != nil {
-			klog.ErrorS(err, "Failed to get node when retry to update", "node", nodeName)
-			continue
+	err := NodeUpdates().Mutate(nodeName, func(node *corev1.Node) error {
+		if _, ok := node.ObjectMeta.Annotations[lockName]; ok {
+			return fmt.Errorf("node %s is locked", nodeName)
 		}
-		newNode := node.DeepCopy()
-		newNode.ObjectMeta.Annotations[lockName] = time.Now().Format(time.RFC3339)
-		_, err = kubeClient.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{})
-	}
+		node.ObjectMeta.Annotations[lockName] = time.Now().Format(time.RFC3339)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("setNodeLock exceeds retry count %d", MaxLockRetry)
+		klog.ErrorS(err, "Failed to set node lock", "node", nodeName)
+		return err
 	}
 	klog.V(3).InfoS("Node lock set", "node", nodeName)
 	return nil
@@ -96,59 +114,44 @@ func setNodeLock(nodeName string, lockName string) error {
 
 // ReleaseNodeLock releases a certain lock on a certain device
 func ReleaseNodeLock(nodeName string, lockName string) error {
-	ctx := context.Background()
-	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-	if err != nil {
-		return err
+	if err := NodeUpdates().RemoveAnnotations(nodeName, lockName); err != nil {
+		return fmt.Errorf("releaseNodeLock of %s: %v", nodeName, err)
 	}
-	if _, ok := node.ObjectMeta.Annotations[lockName]; !ok {
-		klog.V(3).InfoS("Node lock not set", "node", nodeName, "lock", lockName)
-		return nil
-	}
-	newNode := node.DeepCopy()
-	delete(newNode.ObjectMeta.Annotations, lockName)
-	_, err = kubeClient.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{})
-	for i := 0; i < MaxLockRetry && err != nil; i++ {
-		klog.ErrorS(err, "Failed to update node", "node", nodeName, "retry", i)
-		time.Sleep(100 * time.Millisecond)
-		node, err = kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-		if err != nil {
-			klog.ErrorS(err, "Failed to get node when retry to update", "node", nodeName)
-			continue
+	klog.V(3).InfoS("Node lock released", "node", nodeName)
+	return nil
+}
+
+// RenewNodeLock restarts the TTL of a lock held on a node, so that
+// reservations outliving LockTTL don't expire.
+func RenewNodeLock(nodeName string, lockName string) error {
+	err := NodeUpdates().Mutate(nodeName, func(node *corev1.Node) error {
+		if _, ok := node.ObjectMeta.Annotations[lockName]; !ok {
+			return fmt.Errorf("node %s is not locked", nodeName)
 		}
-		newNode := node.DeepCopy()
-		delete(newNode.ObjectMeta.Annotations, lockName)
-		_, err = kubeClient.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{})
-	}
+		node.ObjectMeta.Annotations[lockName] = time.Now().Format(time.RFC3339)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("releaseNodeLock exceeds retry count %d", MaxLockRetry)
+		return err
 	}
-	klog.V(3).InfoS("Node lock released", "node", nodeName)
+	klog.V(3).InfoS("Node lock renewed", "node", nodeName)
 	return nil
 }
 
 // LockNode locks a device on a certain node
 func LockNode(nodeName string, lockName string) error {
-	ctx := context.Background()
-	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
-	if _, ok := node.ObjectMeta.Annotations[lockName]; !ok {
-		return setNodeLock(nodeName, lockName)
-	}
-	lockTime, err := time.Parse(time.RFC3339, node.ObjectMeta.Annotations[lockName])
-	if err != nil {
-		return err
-	}
-	if time.Since(lockTime) > time.Minute*5 {
-		klog.InfoS("Node lock expired", "node", nodeName, "lockTime", lockTime)
-		err = ReleaseNodeLock(nodeName, lockName)
-		if err != nil {
-			klog.ErrorS(err, "Failed to release node lock", "node", nodeName)
-			return err
+	return NodeUpdates().Mutate(nodeName, func(node *corev1.Node) error {
+		if value, ok := node.ObjectMeta.Annotations[lockName]; ok {
+			lockTime, err := ParseNodeLock(value)
+			if err != nil {
+				return err
+			}
+			if time.Since(lockTime) <= LockTTL {
+				return fmt.Errorf("node %s has been locked within %v", nodeName, LockTTL)
+			}
+			klog.InfoS("Node lock expired", "node", nodeName, "lockTime", lockTime)
 		}
-		return setNodeLock(nodeName, lockName)
-	}
-	return fmt.Errorf("node %s has been locked within 5 minutes", nodeName)
+		node.ObjectMeta.Annotations[lockName] = time.Now().Format(time.RFC3339)
+		return nil
+	})
 }
@@ -0,0 +1,89 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lock
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testLock = "volcano.sh/mutex.lock"
+
+func TestParseNodeLock(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output time.Time
+		err    bool
+	}{
+		{input: "2024-05-01T10:00:00Z", output: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{input: time.Unix(1700000000, 0).Format(time.RFC3339), output: time.Unix(1700000000, 0)},
+		{input: "", err: true},
+		{input: "2024-05-01T10:00:00Z,vgpu-device-plugin-abcde", err: true},
+		{input: "1700000000", err: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			output, err := ParseNodeLock(tc.input)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, tc.output.Equal(output), "expected %v, got %v", tc.output, output)
+		})
+	}
+}
+
+func TestLockNode(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		err         bool
+	}{
+		{annotations: map[string]string{}},
+		{annotations: map[string]string{testLock: time.Now().Add(-2 * LockTTL).Format(time.RFC3339)}},
+		{annotations: map[string]string{testLock: time.Now().Format(time.RFC3339)}, err: true},
+		{annotations: map[string]string{testLock: "invalid"}, err: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: tc.annotations}})
+			require.NoError(t, UseClient(client))
+
+			err := LockNode("node", testLock)
+			node, getErr := client.CoreV1().Nodes().Get(context.Background(), "node", metav1.GetOptions{})
+			require.NoError(t, getErr)
+			if tc.err {
+				require.Error(t, err)
+				require.Equal(t, tc.annotations, node.Annotations)
+				return
+			}
+			require.NoError(t, err)
+			lockTime, err := ParseNodeLock(node.Annotations[testLock])
+			require.NoError(t, err)
+			require.WithinDuration(t, time.Now(), lockTime, time.Minute)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// VGPUMonitorClient is the client API for VGPUMonitor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type VGPUMonitorClient interface {
+	// StreamUsage sends the full usage first, then at every interval only the
+	// devices and containers whose usage changed and those which are gone.
+	StreamUsage(ctx context.Context, in *StreamUsageRequest, opts ...grpc.CallOption) (VGPUMonitor_StreamUsageClient, error)
+	// WatchContainerUsage sends an event for every container in the watch
+	// first, then at every interval one for each container whose usage
+	// changed, which appeared or which is gone.
+	WatchContainerUsage(ctx context.Context, in *WatchContainerUsageRequest, opts ...grpc.CallOption) (VGPUMonitor_WatchContainerUsageClient, error)
+}
+
+type vGPUMonitorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVGPUMonitorClient(cc grpc.ClientConnInterface) VGPUMonitorClient {
+	return &vGPUMonitorClient{cc}
+}
+
+func (c *vGPUMonitorClient) StreamUsage(ctx context.Context, in *StreamUsageRequest, opts ...grpc.CallOption) (VGPUMonitor_StreamUsageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_VGPUMonitor_serviceDesc.Streams[0], "/vgpu.monitor.v1.VGPUMonitor/StreamUsage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &vGPUMonitorStreamUsageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type VGPUMonitor_StreamUsageClient interface {
+	Recv() (*UsageUpdate, error)
+	grpc.ClientStream
+}
+
+type vGPUMonitorStreamUsageClient struct {
+	grpc.ClientStream
+}
+
+func (x *vGPUMonitorStreamUsageClient) Recv() (*UsageUpdate, error) {
+	m := new(UsageUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *vGPUMonitorClient) WatchContainerUsage(ctx context.Context, in *WatchContainerUsageRequest, opts ...grpc.CallOption) (VGPUMonitor_WatchContainerUsageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_VGPUMonitor_serviceDesc.Streams[1], "/vgpu.monitor.v1.VGPUMonitor/WatchContainerUsage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &vGPUMonitorWatchContainerUsageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type VGPUMonitor_WatchContainerUsageClient interface {
+	Recv() (*ContainerUsageEvent, error)
+	grpc.ClientStream
+}
+
+type vGPUMonitorWatchContainerUsageClient struct {
+	grpc.ClientStream
+}
+
+func (x *vGPUMonitorWatchContainerUsageClient) Recv() (*ContainerUsageEvent, error) {
+	m := new(ContainerUsageEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VGPUMonitorServer is the server API for VGPUMonitor service.
+// All implementations must embed UnimplementedVGPUMonitorServer
+// for forward compatibility
+type VGPUMonitorServer interface {
+	// StreamUsage sends the full usage first, then at every interval only the
+	// devices and containers whose usage changed and those which are gone.
+	StreamUsage(*StreamUsageRequest, VGPUMonitor_StreamUsageServer) error
+	// WatchContainerUsage sends an event for every container in the watch
+	// first, then at every interval one for each container whose usage
+	// changed, which appeared or which is gone.
+	WatchContainerUsage(*WatchContainerUsageRequest, VGPUMonitor_WatchContainerUsageServer) error
+	mustEmbedUnimplementedVGPUMonitorServer()
+}
+
+// UnimplementedVGPUMonitorServer must be embedded to have forward compatible implementations.
+type UnimplementedVGPUMonitorServer struct {
+}
+
+func (UnimplementedVGPUMonitorServer) StreamUsage(*StreamUsageRequest, VGPUMonitor_StreamUsageServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUsage not implemented")
+}
+func (UnimplementedVGPUMonitorServer) WatchContainerUsage(*WatchContainerUsageRequest, VGPUMonitor_WatchContainerUsageServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchContainerUsage not implemented")
+}
+func (UnimplementedVGPUMonitorServer) mustEmbedUnimplementedVGPUMonitorServer() {}
+
+// UnsafeVGPUMonitorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VGPUMonitorServer will
+// result in compilation errors.
+type UnsafeVGPUMonitorServer interface {
+	mustEmbedUnimplementedVGPUMonitorServer()
+}
+
+func RegisterVGPUMonitorServer(s grpc.ServiceRegistrar, srv VGPUMonitorServer) {
+	s.RegisterService(&_VGPUMonitor_serviceDesc, srv)
+}
+
+func _VGPUMonitor_StreamUsage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamUsageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VGPUMonitorServer).StreamUsage(m, &vGPUMonitorStreamUsageServer{stream})
+}
+
+type VGPUMonitor_StreamUsageServer interface {
+	Send(*UsageUpdate) error
+	grpc.ServerStream
+}
+
+type vGPUMonitorStreamUsageServer struct {
+	grpc.ServerStream
+}
+
+func (x *vGPUMonitorStreamUsageServer) Send(m *UsageUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _VGPUMonitor_WatchContainerUsage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchContainerUsageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VGPUMonitorServer).WatchContainerUsage(m, &vGPUMonitorWatchContainerUsageServer{stream})
+}
+
+type VGPUMonitor_WatchContainerUsageServer interface {
+	Send(*ContainerUsageEvent) error
+	grpc.ServerStream
+}
+
+type vGPUMonitorWatchContainerUsageServer struct {
+	grpc.ServerStream
+}
+
+func (x *vGPUMonitorWatchContainerUsageServer) Send(m *ContainerUsageEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _VGPUMonitor_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "vgpu.monitor.v1.VGPUMonitor",
+	HandlerType: (*VGPUMonitorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamUsage",
+			Handler:       _VGPUMonitor_StreamUsage_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchContainerUsage",
+			Handler:       _VGPUMonitor_WatchContainerUsage_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "usage.proto",
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dcgm reads the stats of the GPUs from DCGM, through the metrics
+// endpoint of the dcgm-exporter of the node, for the profiling fields NVML
+// doesn't expose.
+package dcgm
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/monitor/nvidia"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/klog/v2"
+)
+
+// DefaultURL is the metrics endpoint of a dcgm-exporter on the node.
+const DefaultURL = "http://localhost:9400/metrics"
+
+// DCGM fields read from the exporter. The memory is exported in MiB and the
+// utilization in percent, the profiling fields as ratios. The MIG devices
+// have no utilization, the activity of their graphics engine stands for it.
+const (
+	fieldFBUsed         = "DCGM_FI_DEV_FB_USED"
+	fieldGPUUtil        = "DCGM_FI_DEV_GPU_UTIL"
+	fieldGREngineActive = "DCGM_FI_PROF_GR_ENGINE_ACTIVE"
+	fieldSMActive       = "DCGM_FI_PROF_SM_ACTIVE"
+	fieldSMOccupancy    = "DCGM_FI_PROF_SM_OCCUPANCY"
+	fieldTensorActive   = "DCGM_FI_PROF_PIPE_TENSOR_ACTIVE"
+	fieldDRAMActive     = "DCGM_FI_PROF_DRAM_ACTIVE"
+)
+
+var profilingFields = map[string]string{
+	fieldSMActive:     nvidia.ProfilingSMActive,
+	fieldSMOccupancy:  nvidia.ProfilingSMOccupancy,
+	fieldTensorActive: nvidia.ProfilingTensorActive,
+	fieldDRAMActive:   nvidia.ProfilingDRAMActive,
+}
+
+// Source reads the stats of the GPUs from a dcgm-exporter, the devices it
+// doesn't report are read from the fallback source.
+type Source struct {
+	url      string
+	client   *http.Client
+	fallback nvidia.Source
+}
+
+func NewSource(url string, fallback nvidia.Source) *Source {
+	return &Source{
+		url:      url,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		fallback: fallback,
+	}
+}
+
+func (s *Source) Name() string {
+	return "dcgm"
+}
+
+func (s *Source) Sample(devices []nvidia.Device) map[string]nvidia.DeviceStats {
+	if len(devices) == 0 {
+		return nil
+	}
+	// The exporter labels the series of a MIG device with the UUID of its
+	// GPU and its GPU instance.
+	instances := make(map[string]string)
+	for _, d := range devices {
+		if d.Mig == nil {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", d.Mig.ParentUUID, d.Mig.GPUInstanceID)
+		if _, ok := instances[key]; !ok {
+			instances[key] = d.UUID
+		}
+	}
+	res, err := s.scrape(instances)
+	if err != nil {
+		klog.Errorf("Failed to read the DCGM fields from %s, falling back to %s: %v", s.url, s.fallback.Name(), err)
+		res = make(map[string]nvidia.DeviceStats)
+	}
+	var missing []nvidia.Device
+	for _, d := range devices {
+		if stats, ok := res[d.UUID]; !ok || !stats.HasMemory || !stats.HasUtilization {
+			missing = append(missing, d)
+		}
+	}
+	for uuid, fallback := range s.fallback.Sample(missing) {
+		stats := res[uuid]
+		if !stats.HasMemory {
+			stats.MemoryUsed, stats.HasMemory = fallback.MemoryUsed, fallback.HasMemory
+		}
+		if !stats.HasUtilization {
+			stats.Utilization, stats.HasUtilization = fallback.Utilization, fallback.HasUtilization
+		}
+		res[uuid] = stats
+	}
+	return res
+}
+
+// scrape returns the stats of the GPUs and the MIG devices the exporter
+// reports, by UUID.
+func (s *Source) scrape(instances map[string]string) (map[string]nvidia.DeviceStats, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseFamilies(families, instances), nil
+}
+
+// parseFamilies reads the fields of the GPUs from the metric families of
+// the exporter, and those of the MIG devices of instances, by GPU UUID/GPU
+// instance ID. The first series of a device is kept when the exporter
+// splits it by pod.
+func parseFamilies(families map[string]*dto.MetricFamily, instances map[string]string) map[string]nvidia.DeviceStats {
+	res := make(map[string]nvidia.DeviceStats)
+	for name, family := range families {
+		for _, m := range family.GetMetric() {
+			uuid, instance := "", ""
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "UUID":
+					uuid = l.GetValue()
+				case "GPU_I_ID":
+					instance = l.GetValue()
+				}
+			}
+			if uuid == "" {
+				continue
+			}
+			if instance != "" {
+				if uuid = instances[uuid+"/"+instance]; uuid == "" {
+					continue
+				}
+			}
+			value, ok := metricValue(m)
+			if !ok {
+				continue
+			}
+			stats := res[uuid]
+			switch name {
+			case fieldFBUsed:
+				if !stats.HasMemory {
+					stats.MemoryUsed, stats.HasMemory = uint64(value)*1024*1024, true
+				}
+			case fieldGPUUtil:
+				if !stats.HasUtilization {
+					stats.Utilization, stats.HasUtilization = value/100, true
+				}
+			case fieldGREngineActive:
+				if instance != "" && !stats.HasUtilization {
+					stats.Utilization, stats.HasUtilization = value, true
+				}
+			default:
+				field, ok := profilingFields[name]
+				if !ok {
+					continue
+				}
+				if stats.Profiling == nil {
+					stats.Profiling = make(map[string]float64)
+				}
+				if _, ok := stats.Profiling[field]; !ok {
+					stats.Profiling[field] = value
+				}
+			}
+			res[uuid] = stats
+		}
+	}
+	return res
+}
+
+func metricValue(m *dto.Metric) (float64, bool) {
+	switch {
+	case m.GetGauge() != nil:
+		return m.GetGauge().GetValue(), true
+	case m.GetCounter() != nil:
+		return m.GetCounter().GetValue(), true
+	case m.GetUntyped() != nil:
+		return m.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
@@ -31,7 +31,6 @@ import (
 	v0 "volcano.sh/k8s-device-plugin/pkg/monitor/nvidia/v0"
 	v1 "volcano.sh/k8s-device-plugin/pkg/monitor/nvidia/v1"
 
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -55,10 +54,22 @@ type UsageInfo interface {
 	DeviceMemoryOffset(idx int) uint64
 	DeviceMemoryTotal(idx int) uint64
 	DeviceSmUtil(idx int) uint64
+	DeviceDecUtil(idx int) uint64
+	DeviceEncUtil(idx int) uint64
 	IsValidUUID(idx int) bool
 	DeviceUUID(idx int) string
 	DeviceMemoryLimit(idx int) uint64
+	// SetDeviceMemoryLimit sets the memory limit of the device, the hook
+	// enforces it on the next allocations.
+	SetDeviceMemoryLimit(idx int, v uint64)
+	DeviceSmLimit(idx int) uint64
+	// SetDeviceSmLimit sets the SM limit of the device, the limiter of the
+	// hook follows it on the next kernel launches.
+	SetDeviceSmLimit(idx int, v uint64)
 	LastKernelTime() int64
+	ProcNum() int
+	// HostPids returns the host pids of the processes attached to the region.
+	HostPids() []int
 	//UsedMemory(idx int) (uint64, error)
 	GetPriority() int
 	GetRecentKernel() int32
@@ -70,15 +81,40 @@ type UsageInfo interface {
 type ContainerUsage struct {
 	PodUID        string
 	ContainerName string
-	data          []byte
-	Info          UsageInfo
+	// CacheFile is the shared region created by libvgpu, empty until the
+	// first cuInit in the container.
+	CacheFile    string
+	MajorVersion int32
+	MinorVersion int32
+	data         []byte
+	// Info is nil when the shared region is missing or its layout is not
+	// known to the monitor.
+	Info UsageInfo
+	// FirstSeen is when the lister found the container.
+	FirstSeen time.Time
+	// refs counts the users of the shared region, which is unmapped once
+	// the container is gone and it is released by the last of them.
+	refs    int
+	removed bool
 }
 
 type ContainerLister struct {
 	containerPath string
 	containers    map[string]*ContainerUsage
-	mutex         sync.Mutex
-	clientset     *kubernetes.Clientset
+	// byPod indexes the containers by pod UID and container name.
+	byPod     map[string]map[string]*ContainerUsage
+	mutex     sync.Mutex
+	clientset *kubernetes.Clientset
+	devices   *DeviceCache
+	// synced is set once the containers were listed successfully.
+	synced bool
+	// regionErrors counts the shared regions which failed to load.
+	regionErrors uint64
+	// added and removed count the containers found and gone.
+	added, removed uint64
+	// watching is set while Watch keeps the containers current, Update only
+	// scans the path when it is dirty then.
+	watching, dirty bool
 }
 
 func NewContainerLister() (*ContainerLister, error) {
@@ -99,7 +135,9 @@ func NewContainerLister() (*ContainerLister, error) {
 	return &ContainerLister{
 		containerPath: filepath.Join(hookPath, "containers"),
 		containers:    make(map[string]*ContainerUsage),
+		byPod:         make(map[string]map[string]*ContainerUsage),
 		clientset:     clientset,
+		devices:       NewDeviceCache(),
 	}, nil
 }
 
@@ -111,66 +149,210 @@ func (l *ContainerLister) UnLock() {
 	l.mutex.Unlock()
 }
 
+// ListContainers returns the containers by name, the lister must be locked.
 func (l *ContainerLister) ListContainers() map[string]*ContainerUsage {
 	return l.containers
 }
 
+// PodContainers returns the containers of the pod by name, the lister must be
+// locked.
+func (l *ContainerLister) PodContainers(podUID string) map[string]*ContainerUsage {
+	return l.byPod[podUID]
+}
+
+// Acquire keeps the shared region of the container mapped until it is
+// released, even once the container is gone, the lister must be locked.
+func (l *ContainerLister) Acquire(c *ContainerUsage) {
+	c.refs++
+}
+
+// Release releases the containers acquired, unmapping the shared regions of
+// those gone with no other user.
+func (l *ContainerLister) Release(usages ...*ContainerUsage) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, c := range usages {
+		c.refs--
+		if c.refs == 0 && c.removed {
+			syscall.Munmap(c.data)
+		}
+	}
+}
+
+// AcquireContainers returns the containers of the monitor path by name,
+// acquired, for use without locking the lister.
+func (l *ContainerLister) AcquireContainers() map[string]*ContainerUsage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	res := make(map[string]*ContainerUsage, len(l.containers))
+	for name, c := range l.containers {
+		c.refs++
+		res[name] = c
+	}
+	return res
+}
+
+// ReleaseContainers releases the containers of AcquireContainers.
+func (l *ContainerLister) ReleaseContainers(containers map[string]*ContainerUsage) {
+	usages := make([]*ContainerUsage, 0, len(containers))
+	for _, c := range containers {
+		usages = append(usages, c)
+	}
+	l.Release(usages...)
+}
+
+func (l *ContainerLister) add(name string, usage *ContainerUsage) {
+	l.containers[name] = usage
+	if l.byPod[usage.PodUID] == nil {
+		l.byPod[usage.PodUID] = make(map[string]*ContainerUsage)
+	}
+	l.byPod[usage.PodUID][usage.ContainerName] = usage
+}
+
+func (l *ContainerLister) remove(name string) {
+	c, ok := l.containers[name]
+	if !ok {
+		return
+	}
+	if c.refs > 0 {
+		c.removed = true
+	} else {
+		syscall.Munmap(c.data)
+	}
+	l.removed++
+	delete(l.containers, name)
+	delete(l.byPod[c.PodUID], c.ContainerName)
+	if len(l.byPod[c.PodUID]) == 0 {
+		delete(l.byPod, c.PodUID)
+	}
+}
+
+// Synced reports whether the containers of the monitor path were listed
+// successfully at least once, they are not known to be complete before.
+func (l *ContainerLister) Synced() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.synced
+}
+
+// RegionErrors returns the number of times a shared region failed to load.
+func (l *ContainerLister) RegionErrors() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.regionErrors
+}
+
+// CacheStats returns the number of containers known and the number of
+// containers found and gone since the monitor started.
+func (l *ContainerLister) CacheStats() (entries int, added, removed uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.containers), l.added, l.removed
+}
+
+// OldestUnloaded returns when the oldest container whose shared region is
+// not loaded yet was found, zero when there is none.
+func (l *ContainerLister) OldestUnloaded() time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var res time.Time
+	for _, c := range l.containers {
+		if c.Info == nil && (res.IsZero() || c.FirstSeen.Before(res)) {
+			res = c.FirstSeen
+		}
+	}
+	return res
+}
+
+// Path returns the directory of the containers written by the hook.
+func (l *ContainerLister) Path() string {
+	return l.containerPath
+}
+
+// Devices returns the GPUs of the node shared by the users of the lister.
+func (l *ContainerLister) Devices() *DeviceCache {
+	return l.devices
+}
+
 func (l *ContainerLister) Clientset() *kubernetes.Clientset {
 	return l.clientset
 }
 
 func (l *ContainerLister) Update() error {
+	l.mutex.Lock()
+	current := l.watching && !l.dirty
+	l.mutex.Unlock()
+	if current {
+		return nil
+	}
 	pods, err := l.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
 
+	podUIDs := make(map[string]bool, len(pods.Items))
+	for _, pod := range pods.Items {
+		podUIDs[string(pod.UID)] = true
+	}
+
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	entries, err := os.ReadDir(l.containerPath)
 	if err != nil {
 		return err
 	}
+	// The regions which failed to load are retried on the next update, even
+	// when watching: libvgpu writes them through a mapping, with no event.
+	retry := false
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			continue
 		}
 		dirName := filepath.Join(l.containerPath, entry.Name())
-		if !isValidPod(entry.Name(), pods) {
+		if !podUIDs[strings.Split(entry.Name(), "_")[0]] {
 			dirInfo, err := os.Stat(dirName)
 			if err == nil && dirInfo.ModTime().Add(time.Second*300).After(time.Now()) {
 				continue
 			}
 			klog.Infof("Removing dirname %s in monitorpath", dirName)
-			if c, ok := l.containers[entry.Name()]; ok {
-				syscall.Munmap(c.data)
-				delete(l.containers, entry.Name())
-			}
+			l.remove(entry.Name())
 			_ = os.RemoveAll(dirName)
 			continue
 		}
-		if _, ok := l.containers[entry.Name()]; ok {
+		if c, ok := l.containers[entry.Name()]; ok && c.Info != nil {
 			continue
 		}
 		usage, err := loadCache(dirName)
 		if err != nil {
+			l.regionErrors++
+			retry = true
 			klog.Errorf("Failed to load cache: %s, error: %v", dirName, err)
 			continue
 		}
 		if usage == nil {
-			// no cuInit in container
-			continue
+			// no cuInit in container yet, keep the container without shared
+			// region and retry on the next update.
+			usage = &ContainerUsage{}
 		}
 		usage.PodUID = strings.Split(entry.Name(), "_")[0]
 		usage.ContainerName = strings.Split(entry.Name(), "_")[1]
-		l.containers[entry.Name()] = usage
-		klog.Infof("Adding ctr dirname %s in monitorpath", dirName)
+		prev, known := l.containers[entry.Name()]
+		usage.FirstSeen = time.Now()
+		if known {
+			usage.FirstSeen = prev.FirstSeen
+		}
+		l.add(entry.Name(), usage)
+		if !known {
+			l.added++
+			klog.Infof("Adding ctr dirname %s in monitorpath", dirName)
+		}
 	}
+	l.synced, l.dirty = true, retry
 	return nil
 }
 
 func loadCache(fpath string) (*ContainerUsage, error) {
-	klog.Infof("Checking path %s", fpath)
+	klog.V(4).Infof("Checking path %s", fpath)
 	files, err := os.ReadDir(fpath)
 	if err != nil {
 		return nil, err
@@ -193,7 +375,7 @@ func loadCache(fpath string) (*ContainerUsage, error) {
 		break
 	}
 	if cacheFile == "" {
-		klog.Infof("No cache file in %s", fpath)
+		klog.V(4).Infof("No cache file in %s", fpath)
 		return nil, nil
 	}
 	info, err := os.Stat(cacheFile)
@@ -212,7 +394,7 @@ func loadCache(fpath string) (*ContainerUsage, error) {
 	defer func(f *os.File) {
 		_ = f.Close()
 	}(f)
-	usage := &ContainerUsage{}
+	usage := &ContainerUsage{CacheFile: cacheFile}
 	usage.data, err = syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
 	if err != nil {
 		klog.Errorf("Failed to mmap cache file: %s, error: %v", cacheFile, err)
@@ -226,19 +408,14 @@ func loadCache(fpath string) (*ContainerUsage, error) {
 	if info.Size() == 1197897 {
 		usage.Info = v0.CastSpec(usage.data)
 	} else if head.majorVersion == 1 {
+		usage.MajorVersion, usage.MinorVersion = head.majorVersion, head.minorVersion
 		usage.Info = v1.CastSpec(usage.data)
 	} else {
+		// Keep the container visible as running an incompatible libvgpu.
+		klog.V(3).Infof("unknown cache file size %d version %d.%d", info.Size(), head.majorVersion, head.minorVersion)
+		usage.MajorVersion, usage.MinorVersion = head.majorVersion, head.minorVersion
 		_ = syscall.Munmap(usage.data)
-		return nil, fmt.Errorf("unknown cache file size %d version %d.%d", info.Size(), head.majorVersion, head.minorVersion)
+		usage.data = nil
 	}
 	return usage, nil
 }
-
-func isValidPod(name string, pods *corev1.PodList) bool {
-	for _, val := range pods.Items {
-		if strings.Contains(name, string(val.UID)) {
-			return true
-		}
-	}
-	return false
-}
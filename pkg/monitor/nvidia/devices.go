@@ -0,0 +1,311 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvidia
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/klog/v2"
+)
+
+// Device is a GPU of the node with its NVML handle, or a MIG device of one:
+// the Index and the Minor of a MIG device are those of its GPU.
+type Device struct {
+	Index  int
+	UUID   string
+	Minor  int
+	Handle nvml.Device
+	// Mig is nil for the GPUs.
+	Mig *MigInfo
+}
+
+// MigInfo is the placement of a MIG device in its GPU.
+type MigInfo struct {
+	ParentUUID        string
+	GPUInstanceID     int
+	ComputeInstanceID int
+	// Profile is the MIG profile of the device, e.g. 1g.5gb.
+	Profile string
+}
+
+// DeviceCache initializes NVML once and keeps the handles of the GPUs of
+// the node, the handles are looked up again only when the GPUs change.
+type DeviceCache struct {
+	mutex       sync.Mutex
+	initialized bool
+	stale       bool
+	// closed is set by Shutdown, NVML is not initialized again after it.
+	closed     bool
+	devices    []Device
+	migDevices []Device
+	// initFailures counts the failed initializations of NVML since it was
+	// last initialized, the next one is not tried before nextInit.
+	initFailures int
+	nextInit     time.Time
+	initErr      nvml.Return
+}
+
+// The initialization of NVML is retried with a backoff, from initBackoff
+// doubling up to maxInitBackoff, not to fail on every scrape without GPU.
+const (
+	initBackoff    = 10 * time.Second
+	maxInitBackoff = 10 * time.Minute
+)
+
+func NewDeviceCache() *DeviceCache {
+	return &DeviceCache{stale: true}
+}
+
+// Devices returns the GPUs of the node, the slice must not be modified.
+func (c *DeviceCache) Devices() []Device {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	if !c.initialized {
+		if time.Now().Before(c.nextInit) {
+			return nil
+		}
+		if ret := config.Nvml().Init(); ret != nvml.SUCCESS {
+			RecordNVMLError("Init", ret)
+			if c.initFailures == 0 {
+				klog.Warningf("nvml Init err= %v, running without GPUs and retrying with a backoff", ret)
+			} else {
+				klog.V(4).Infof("nvml Init err= %v", ret)
+			}
+			backoff := maxInitBackoff
+			if c.initFailures < 6 {
+				backoff = initBackoff << c.initFailures
+			}
+			c.initFailures++
+			c.nextInit, c.initErr = time.Now().Add(backoff), ret
+			return nil
+		}
+		if c.initFailures > 0 {
+			klog.Infof("nvml initialized after %d failures", c.initFailures)
+		}
+		c.initialized, c.initFailures, c.initErr = true, 0, nvml.SUCCESS
+	}
+	if c.stale {
+		c.devices = lookupDevices()
+		c.migDevices = lookupMigDevices(c.devices)
+		c.stale = false
+		klog.Infof("Found %d GPUs and %d MIG devices", len(c.devices), len(c.migDevices))
+	}
+	return c.devices
+}
+
+// MigDevices returns the MIG devices of the GPUs in MIG mode, the slice must
+// not be modified.
+func (c *DeviceCache) MigDevices() []Device {
+	c.Devices()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.migDevices
+}
+
+// Initialized reports whether NVML was initialized, Devices retries it
+// until it is.
+func (c *DeviceCache) Initialized() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.initialized
+}
+
+// Present reports whether the node has a GPU NVML can see.
+func (c *DeviceCache) Present() bool {
+	return len(c.Devices()) > 0
+}
+
+// NoGPU reports whether NVML failed to initialize because the node has no
+// NVIDIA driver, as the nodes without GPU of a mixed cluster: the monitor
+// runs degraded rather than failing.
+func (c *DeviceCache) NoGPU() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch c.initErr {
+	case nvml.ERROR_LIBRARY_NOT_FOUND, nvml.ERROR_DRIVER_NOT_LOADED, nvml.ERROR_NO_PERMISSION:
+		return !c.initialized
+	}
+	return false
+}
+
+// Shutdown shuts NVML down, Devices returns no GPUs after it.
+func (c *DeviceCache) Shutdown() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	c.devices, c.migDevices = nil, nil
+	if !c.initialized {
+		return
+	}
+	c.initialized = false
+	klog.Infof("Shutdown of NVML returned: %v", config.Nvml().Shutdown())
+}
+
+// Invalidate makes the next Devices look the GPUs up again, after they
+// changed.
+func (c *DeviceCache) Invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stale = true
+}
+
+// lookupDevices returns the GPUs NVML reports, those whose handle or UUID
+// can't be read are left out.
+func lookupDevices() []Device {
+	n, ret := config.Nvml().DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		RecordNVMLError("DeviceGetCount", ret)
+		klog.Errorf("nvml GetDeviceCount err= %v", ret)
+		return nil
+	}
+	var res []Device
+	for i := 0; i < n; i++ {
+		hdev, ret := config.Nvml().DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			RecordNVMLError("DeviceGetHandleByIndex", ret)
+			klog.Errorf("nvml get handle of device %d err= %v", i, ret)
+			continue
+		}
+		uuid, ret := hdev.GetUUID()
+		if ret != nvml.SUCCESS {
+			RecordNVMLError("GetUUID", ret)
+			klog.Errorf("nvml get uuid of device %d err= %v", i, ret)
+			continue
+		}
+		minor, ret := hdev.GetMinorNumber()
+		if ret != nvml.SUCCESS {
+			minor = -1
+		}
+		res = append(res, Device{Index: i, UUID: uuid, Minor: minor, Handle: hdev})
+	}
+	return res
+}
+
+// lookupMigDevices returns the MIG devices of the GPUs in MIG mode.
+func lookupMigDevices(gpus []Device) []Device {
+	var res []Device
+	for _, gpu := range gpus {
+		current, _, ret := gpu.Handle.GetMigMode()
+		if ret != nvml.SUCCESS || current != nvml.DEVICE_MIG_ENABLE {
+			// MIG is not supported by the GPU or not enabled.
+			continue
+		}
+		n, ret := gpu.Handle.GetMaxMigDeviceCount()
+		if ret != nvml.SUCCESS {
+			RecordNVMLError("GetMaxMigDeviceCount", ret)
+			klog.Errorf("nvml get max MIG device count of device %s err= %v", gpu.UUID, ret)
+			continue
+		}
+		for i := 0; i < n; i++ {
+			hmig, ret := gpu.Handle.GetMigDeviceHandleByIndex(i)
+			if ret != nvml.SUCCESS {
+				// The MIG devices don't fill all the slots.
+				continue
+			}
+			uuid, ret := hmig.GetUUID()
+			if ret != nvml.SUCCESS {
+				RecordNVMLError("GetUUID", ret)
+				klog.Errorf("nvml get uuid of MIG device %d of device %s err= %v", i, gpu.UUID, ret)
+				continue
+			}
+			gi, ret := hmig.GetGpuInstanceId()
+			if ret != nvml.SUCCESS {
+				RecordNVMLError("GetGpuInstanceId", ret)
+				continue
+			}
+			ci, ret := hmig.GetComputeInstanceId()
+			if ret != nvml.SUCCESS {
+				RecordNVMLError("GetComputeInstanceId", ret)
+				continue
+			}
+			res = append(res, Device{Index: gpu.Index, UUID: uuid, Minor: gpu.Minor, Handle: hmig, Mig: &MigInfo{
+				ParentUUID:        gpu.UUID,
+				GPUInstanceID:     gi,
+				ComputeInstanceID: ci,
+				Profile:           migProfile(hmig),
+			}})
+		}
+	}
+	return res
+}
+
+// migProfile returns the profile of a MIG device from its name, e.g. 1g.5gb
+// for NVIDIA A100-SXM4-40GB MIG 1g.5gb, or from its slices and memory.
+func migProfile(hmig nvml.Device) string {
+	if name, ret := hmig.GetName(); ret == nvml.SUCCESS {
+		if i := strings.LastIndex(name, "MIG "); i >= 0 {
+			return name[i+len("MIG "):]
+		}
+	}
+	attrs, ret := hmig.GetAttributes()
+	if ret != nvml.SUCCESS {
+		return ""
+	}
+	return fmt.Sprintf("%dg.%dgb", attrs.GpuInstanceSliceCount, (attrs.MemorySizeMB+1023)/1024)
+}
+
+// changed reports whether the GPUs of the node are not the ones cached: a
+// GPU appeared, was removed or replaced, or fell off the bus, or its MIG
+// devices were reconfigured.
+func (c *DeviceCache) changed() bool {
+	devices := c.Devices()
+	if !c.Initialized() {
+		return false
+	}
+	n, ret := config.Nvml().DeviceGetCount()
+	if ret != nvml.SUCCESS || n != len(devices) {
+		return true
+	}
+	for _, d := range devices {
+		uuid, ret := d.Handle.GetUUID()
+		if ret != nvml.SUCCESS || uuid != d.UUID {
+			return true
+		}
+	}
+	migDevices := lookupMigDevices(devices)
+	cached := c.MigDevices()
+	if len(migDevices) != len(cached) {
+		return true
+	}
+	for i, d := range migDevices {
+		if d.UUID != cached[i].UUID {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks every interval whether the GPUs changed, the handles are
+// looked up again when they did.
+func (c *DeviceCache) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if c.changed() {
+			klog.Infof("The GPUs of the node changed, looking them up again")
+			c.Invalidate()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvidia
+
+import (
+	"sync"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+var nvmlErrors = struct {
+	mutex  sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// RecordNVMLError counts a failed call of the NVML api, the success and the
+// features the device doesn't support or has no data for are not failures.
+func RecordNVMLError(api string, ret nvml.Return) {
+	switch ret {
+	case nvml.SUCCESS, nvml.ERROR_NOT_SUPPORTED, nvml.ERROR_NOT_FOUND:
+		return
+	}
+	nvmlErrors.mutex.Lock()
+	defer nvmlErrors.mutex.Unlock()
+	nvmlErrors.counts[api]++
+}
+
+// NVMLErrors returns the failed calls counted by NVML api.
+func NVMLErrors() map[string]uint64 {
+	nvmlErrors.mutex.Lock()
+	defer nvmlErrors.mutex.Unlock()
+	res := make(map[string]uint64, len(nvmlErrors.counts))
+	for api, n := range nvmlErrors.counts {
+		res[api] = n
+	}
+	return res
+}
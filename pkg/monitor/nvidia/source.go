@@ -0,0 +1,89 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvidia
+
+import (
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/klog/v2"
+)
+
+// Profiling fields, exported by the sources able to read the profiling
+// counters of the GPUs, as ratios between 0 and 1.
+const (
+	ProfilingSMActive     = "sm_active"
+	ProfilingSMOccupancy  = "sm_occupancy"
+	ProfilingTensorActive = "tensor_active"
+	ProfilingDRAMActive   = "dram_active"
+)
+
+// DeviceStats are the stats of a GPU read by a Source.
+type DeviceStats struct {
+	// MemoryUsed is the device memory used in bytes, valid with HasMemory.
+	MemoryUsed uint64
+	HasMemory  bool
+	// Utilization is the share of the time the GPU was running kernels,
+	// valid with HasUtilization.
+	Utilization    float64
+	HasUtilization bool
+	// Profiling are the profiling fields read, by name.
+	Profiling map[string]float64
+}
+
+// Source reads the stats of the GPUs for the monitor.
+type Source interface {
+	// Name is the name of the source, e.g. nvml.
+	Name() string
+	// Sample reads the stats of the devices, by UUID. The devices whose
+	// stats can't be read are left out.
+	Sample(devices []Device) map[string]DeviceStats
+}
+
+// NVMLSource reads the stats of the GPUs through their NVML handles, it
+// has no profiling fields.
+type NVMLSource struct{}
+
+func (NVMLSource) Name() string {
+	return "nvml"
+}
+
+func (s NVMLSource) Sample(devices []Device) map[string]DeviceStats {
+	res := make(map[string]DeviceStats, len(devices))
+	for _, d := range devices {
+		res[d.UUID] = s.sampleDevice(d)
+	}
+	return res
+}
+
+func (NVMLSource) sampleDevice(d Device) DeviceStats {
+	var stats DeviceStats
+	memory, ret := d.Handle.GetMemoryInfo()
+	if ret == nvml.SUCCESS {
+		stats.MemoryUsed, stats.HasMemory = memory.Used, true
+	} else {
+		RecordNVMLError("GetMemoryInfo", ret)
+		klog.Error("nvml get memory error ret=", ret)
+	}
+	// The MIG devices don't report their utilization.
+	util, ret := d.Handle.GetUtilizationRates()
+	if ret == nvml.SUCCESS {
+		stats.Utilization, stats.HasUtilization = float64(util.Gpu)/100, true
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		RecordNVMLError("GetUtilizationRates", ret)
+		klog.Error(ret)
+	}
+	return stats
+}
@@ -16,7 +16,10 @@ limitations under the License.
 
 package v0
 
-import "unsafe"
+import (
+	"bytes"
+	"unsafe"
+)
 
 const maxDevices = 16
 
@@ -129,18 +132,44 @@ func (s Spec) DeviceSmUtil(idx int) uint64 {
 	return v
 }
 
+func (s Spec) DeviceDecUtil(idx int) uint64 {
+	v := uint64(0)
+	for _, p := range s.sr.procs {
+		v += p.deviceUtil[idx].decUtil
+	}
+	return v
+}
+
+func (s Spec) DeviceEncUtil(idx int) uint64 {
+	v := uint64(0)
+	for _, p := range s.sr.procs {
+		v += p.deviceUtil[idx].encUtil
+	}
+	return v
+}
+
 func (s Spec) IsValidUUID(idx int) bool {
 	return s.sr.uuids[idx].uuid[0] != 0
 }
 
+// DeviceUUID returns the UUID of the device up to its terminating NUL, a
+// GPU-, a MIG- or the longer legacy MIG-GPU- UUID.
 func (s Spec) DeviceUUID(idx int) string {
-	return string(s.sr.uuids[idx].uuid[:])
+	uuid := s.sr.uuids[idx].uuid[:]
+	if i := bytes.IndexByte(uuid, 0); i >= 0 {
+		uuid = uuid[:i]
+	}
+	return string(uuid)
 }
 
 func (s Spec) DeviceMemoryLimit(idx int) uint64 {
 	return s.sr.limit[idx]
 }
 
+func (s Spec) SetDeviceMemoryLimit(idx int, v uint64) {
+	s.sr.limit[idx] = v
+}
+
 func (s Spec) LastKernelTime() int64 {
 	return 0
 }
@@ -155,6 +184,10 @@ func CastSpec(data []byte) Spec {
 //		return 0, nil
 //	}
 
+func (s Spec) ProcNum() int {
+	return int(s.sr.procnum)
+}
+
 func (s Spec) GetPriority() int {
 	return int(s.sr.priority)
 }
@@ -174,3 +207,21 @@ func (s Spec) GetUtilizationSwitch() int32 {
 func (s Spec) SetUtilizationSwitch(v int32) {
 	s.sr.utilizationSwitch = v
 }
+
+func (s Spec) HostPids() []int {
+	var pids []int
+	for i := 0; i < int(s.sr.procnum) && i < len(s.sr.procs); i++ {
+		if p := s.sr.procs[i].hostpid; p != 0 {
+			pids = append(pids, int(p))
+		}
+	}
+	return pids
+}
+
+func (s Spec) DeviceSmLimit(idx int) uint64 {
+	return s.sr.smLimit[idx]
+}
+
+func (s Spec) SetDeviceSmLimit(idx int, v uint64) {
+	s.sr.smLimit[idx] = v
+}
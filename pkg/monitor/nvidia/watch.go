@@ -0,0 +1,107 @@
+/*
+Copyright 2024 The HAMi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvidia
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// watchDebounce is how long the changes of the container path settle
+// before it is scanned, a container creates its directory and its files in
+// a burst.
+const watchDebounce = 500 * time.Millisecond
+
+// Watch keeps the containers current from the changes of the container path
+// rather than from the scans of every Update, Update then only scans after
+// a change, or every resync for the pods deleted, which change no file. It
+// returns when stopCh is closed, or with an error when the path can't be
+// watched and Update keeps scanning.
+func (l *ContainerLister) Watch(resync time.Duration, stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(l.containerPath); err != nil {
+		return err
+	}
+	// The cache file of a container is created in its directory on its
+	// first cuInit.
+	if dirs, err := filepath.Glob(filepath.Join(l.containerPath, "*")); err == nil {
+		for _, dir := range dirs {
+			_ = watcher.Add(dir)
+		}
+	}
+	l.setWatching(true)
+	defer l.setWatching(false)
+	klog.Infof("Watching the containers in %s, resync every %v", l.containerPath, resync)
+
+	debounce := time.NewTimer(watchDebounce)
+	resyncTicker := time.NewTicker(resync)
+	defer resyncTicker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			debounce.Stop()
+			return nil
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if e.Op&fsnotify.Create != 0 && filepath.Dir(e.Name) == l.containerPath {
+				_ = watcher.Add(e.Name)
+			}
+			l.markDirty()
+			debounce.Reset(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Events may have been lost, e.g. on a queue overflow.
+			klog.Warningf("Error watching the containers in %s: %v", l.containerPath, err)
+			l.markDirty()
+			debounce.Reset(watchDebounce)
+		case <-debounce.C:
+			l.scan()
+		case <-resyncTicker.C:
+			l.markDirty()
+			l.scan()
+		}
+	}
+}
+
+func (l *ContainerLister) scan() {
+	if err := l.Update(); err != nil {
+		klog.Errorf("Failed to update the containers: %v", err)
+	}
+}
+
+func (l *ContainerLister) setWatching(watching bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.watching, l.dirty = watching, true
+}
+
+func (l *ContainerLister) markDirty() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.dirty = true
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nodeupdate serializes the writes to the annotations and labels of
+// the nodes. The writes to a node are coalesced and applied on its latest
+// version with a resourceVersion checked update, retried with backoff on
+// conflicts, so that concurrent writers never overwrite each other.
+package nodeupdate
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// MaxRetries is how many times a write failing for another reason than a
+// conflict is retried before its callers get the error.
+const MaxRetries = 5
+
+// Mutation changes a node, it returns an error to be dropped without
+// writing, the other writes of the node being applied anyway.
+type Mutation func(node *corev1.Node) error
+
+type mutation struct {
+	fn   Mutation
+	done chan error
+}
+
+// update is what is pending for a node. A nil value deletes the key.
+type update struct {
+	annotations map[string]*string
+	labels      map[string]*string
+	mutations   []mutation
+	// waiters are the callers of the annotation and label writes.
+	waiters []chan error
+}
+
+func newUpdate() *update {
+	return &update{annotations: make(map[string]*string), labels: make(map[string]*string)}
+}
+
+// merge adds the newer writes of u to v, the newer values win.
+func (v *update) merge(u *update) {
+	for k, val := range u.annotations {
+		v.annotations[k] = val
+	}
+	for k, val := range u.labels {
+		v.labels[k] = val
+	}
+	v.mutations = append(v.mutations, u.mutations...)
+	v.waiters = append(v.waiters, u.waiters...)
+}
+
+// Queue applies the writes of the nodes one node at a time.
+type Queue struct {
+	client kubernetes.Interface
+	queue  workqueue.RateLimitingInterface
+
+	mutex   sync.Mutex
+	pending map[string]*update
+	// conflicts counts the writes another writer got ahead of.
+	conflicts uint64
+}
+
+// NewQueue returns a Queue writing with client, its worker runs until the
+// process exits.
+func NewQueue(client kubernetes.Interface) *Queue {
+	q := &Queue{
+		client: client,
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(10*time.Millisecond, 10*time.Second), "node-updates"),
+		pending: make(map[string]*update),
+	}
+	go q.run()
+	return q
+}
+
+func (q *Queue) enqueue(node string, fn func(u *update)) {
+	q.mutex.Lock()
+	u, ok := q.pending[node]
+	if !ok {
+		u = newUpdate()
+		q.pending[node] = u
+	}
+	fn(u)
+	q.mutex.Unlock()
+	q.queue.Add(node)
+}
+
+// Patch sets the annotations and labels of the node, the empty ones are
+// left untouched, and waits for them to be written.
+func (q *Queue) Patch(node string, annotations, labels map[string]string) error {
+	done := make(chan error, 1)
+	q.enqueue(node, func(u *update) {
+		for k, v := range annotations {
+			v := v
+			u.annotations[k] = &v
+		}
+		for k, v := range labels {
+			v := v
+			u.labels[k] = &v
+		}
+		u.waiters = append(u.waiters, done)
+	})
+	return <-done
+}
+
+// RemoveAnnotations deletes annotations of the node and waits for it.
+func (q *Queue) RemoveAnnotations(node string, keys ...string) error {
+	done := make(chan error, 1)
+	q.enqueue(node, func(u *update) {
+		for _, k := range keys {
+			u.annotations[k] = nil
+		}
+		u.waiters = append(u.waiters, done)
+	})
+	return <-done
+}
+
+// Mutate applies fn on the latest version of the node and waits for the
+// result to be written. fn may be called again after a conflict.
+func (q *Queue) Mutate(node string, fn Mutation) error {
+	done := make(chan error, 1)
+	q.enqueue(node, func(u *update) {
+		u.mutations = append(u.mutations, mutation{fn: fn, done: done})
+	})
+	return <-done
+}
+
+// Conflicts returns how many writes conflicted with a concurrent update of
+// their node and were retried.
+func (q *Queue) Conflicts() uint64 {
+	return atomic.LoadUint64(&q.conflicts)
+}
+
+func (q *Queue) run() {
+	for q.next() {
+	}
+}
+
+func (q *Queue) next() bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	node := item.(string)
+
+	q.mutex.Lock()
+	u, ok := q.pending[node]
+	delete(q.pending, node)
+	q.mutex.Unlock()
+	if !ok {
+		return true
+	}
+
+	err := q.write(node, u)
+	if err == nil {
+		q.queue.Forget(item)
+		return true
+	}
+	if apierrors.IsConflict(err) {
+		atomic.AddUint64(&q.conflicts, 1)
+	} else if q.queue.NumRequeues(item) >= MaxRetries {
+		klog.Errorf("Failed to update node %s, giving up after %d retries: %v", node, MaxRetries, err)
+		q.queue.Forget(item)
+		u.finish(err)
+		return true
+	}
+	klog.V(3).InfoS("Retrying node update", "node", node, "err", err)
+	// The writes enqueued meanwhile are newer.
+	q.mutex.Lock()
+	if newer, ok := q.pending[node]; ok {
+		u.merge(newer)
+	}
+	q.pending[node] = u
+	q.mutex.Unlock()
+	q.queue.AddRateLimited(item)
+	return true
+}
+
+// write applies u on the latest version of the node. The callers are
+// notified on success, the mutations which failed are dropped and their
+// callers notified whatever the result.
+func (q *Queue) write(name string, u *update) error {
+	ctx := context.Background()
+	node, err := q.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			u.finish(err)
+			return nil
+		}
+		return err
+	}
+	newNode := node.DeepCopy()
+	if newNode.Annotations == nil {
+		newNode.Annotations = make(map[string]string)
+	}
+	if newNode.Labels == nil {
+		newNode.Labels = make(map[string]string)
+	}
+	apply(newNode.Annotations, u.annotations)
+	apply(newNode.Labels, u.labels)
+	var applied []mutation
+	for _, m := range u.mutations {
+		// A mutation works on its own copy so that a failing one leaves no
+		// partial change behind.
+		candidate := newNode.DeepCopy()
+		if err := m.fn(candidate); err != nil {
+			m.done <- err
+			continue
+		}
+		newNode = candidate
+		applied = append(applied, m)
+	}
+	u.mutations = applied
+	if apiequality.Semantic.DeepEqual(node, newNode) {
+		u.finish(nil)
+		return nil
+	}
+	// The update carries the resourceVersion of node, it fails with a
+	// conflict if another writer updated the node meanwhile.
+	if _, err := q.client.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	u.finish(nil)
+	return nil
+}
+
+func apply(values map[string]string, changes map[string]*string) {
+	for k, v := range changes {
+		if v == nil {
+			delete(values, k)
+		} else {
+			values[k] = *v
+		}
+	}
+}
+
+func (u *update) finish(err error) {
+	for _, done := range u.waiters {
+		done <- err
+	}
+	for _, m := range u.mutations {
+		m.done <- err
+	}
+}
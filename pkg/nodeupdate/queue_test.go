@@ -0,0 +1,151 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeupdate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func newNode(annotations map[string]string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: annotations}}
+}
+
+func getNode(t *testing.T, client *fake.Clientset) *corev1.Node {
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node", metav1.GetOptions{})
+	require.NoError(t, err)
+	return node
+}
+
+func TestQueueMerge(t *testing.T) {
+	client := fake.NewSimpleClientset(newNode(map[string]string{"old": "1", "kept": "1"}))
+	q := NewQueue(client)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	wg.Add(len(errs))
+	go func() {
+		defer wg.Done()
+		errs[0] = q.Patch("node", map[string]string{"a": "1"}, map[string]string{"l": "1"})
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = q.Patch("node", map[string]string{"b": "1"}, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[2] = q.RemoveAnnotations("node", "old")
+	}()
+	go func() {
+		defer wg.Done()
+		errs[3] = q.Mutate("node", func(node *corev1.Node) error {
+			node.Annotations["c"] = node.Annotations["kept"] + "2"
+			return nil
+		})
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	node := getNode(t, client)
+	require.Equal(t, map[string]string{"kept": "1", "a": "1", "b": "1", "c": "12"}, node.Annotations)
+	require.Equal(t, map[string]string{"l": "1"}, node.Labels)
+}
+
+func TestQueueMutationError(t *testing.T) {
+	client := fake.NewSimpleClientset(newNode(nil))
+	q := NewQueue(client)
+
+	err := q.Mutate("node", func(node *corev1.Node) error {
+		node.Annotations["dropped"] = "1"
+		return fmt.Errorf("locked")
+	})
+	require.EqualError(t, err, "locked")
+	require.NoError(t, q.Patch("node", map[string]string{"a": "1"}, nil))
+	require.Equal(t, map[string]string{"a": "1"}, getNode(t, client).Annotations)
+}
+
+func TestQueueRetry(t *testing.T) {
+	testCases := []struct {
+		// failures is how many updates fail with err.
+		failures  int
+		err       error
+		conflicts uint64
+		output    map[string]string
+		fail      bool
+	}{
+		{
+			failures:  MaxRetries + 1,
+			err:       apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, "node", fmt.Errorf("modified")),
+			conflicts: MaxRetries + 1,
+			output:    map[string]string{"a": "1"},
+		},
+		{
+			failures: 1,
+			err:      apierrors.NewInternalError(fmt.Errorf("unavailable")),
+			output:   map[string]string{"a": "1"},
+		},
+		{
+			failures: MaxRetries + 1,
+			err:      apierrors.NewInternalError(fmt.Errorf("unavailable")),
+			fail:     true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			client := fake.NewSimpleClientset(newNode(nil))
+			failures := 0
+			client.PrependReactor("update", "nodes", func(action ktesting.Action) (bool, runtime.Object, error) {
+				if failures < tc.failures {
+					failures++
+					return true, nil, tc.err
+				}
+				return false, nil, nil
+			})
+			q := NewQueue(client)
+
+			err := q.Patch("node", map[string]string{"a": "1"}, nil)
+			if tc.fail {
+				require.Error(t, err)
+				require.Empty(t, getNode(t, client).Annotations)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.conflicts, q.Conflicts())
+			require.Equal(t, tc.output, getNode(t, client).Annotations)
+		})
+	}
+}
+
+func TestQueueNodeNotFound(t *testing.T) {
+	q := NewQueue(fake.NewSimpleClientset())
+	err := q.Patch("node", map[string]string{"a": "1"}, nil)
+	require.True(t, apierrors.IsNotFound(err))
+}
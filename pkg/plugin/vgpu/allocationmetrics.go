@@ -0,0 +1,253 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+var (
+	deviceAllocatableSlotsDesc = prometheus.NewDesc(
+		"vgpu_device_allocatable_slots",
+		"vGPUs a GPU is split in",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceAllocatedSlotsDesc = prometheus.NewDesc(
+		"vgpu_device_allocated_slots",
+		"vGPUs of a GPU allocated to the pods of the node",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceAllocatableMemoryDesc = prometheus.NewDesc(
+		"vgpu_device_allocatable_memory_bytes",
+		"Memory of a GPU the vGPUs can be granted",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceAllocatedMemoryDesc = prometheus.NewDesc(
+		"vgpu_device_allocated_memory_bytes",
+		"Memory of a GPU granted to the vGPUs of the pods of the node",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceAllocatableCoresDesc = prometheus.NewDesc(
+		"vgpu_device_allocatable_cores",
+		"SM percentage of a GPU the vGPUs can be granted, 100 for a whole device",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceAllocatedCoresDesc = prometheus.NewDesc(
+		"vgpu_device_allocated_cores",
+		"SM percentage of a GPU granted to the vGPUs of the pods of the node",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceLargestFreeMemoryDesc = prometheus.NewDesc(
+		"vgpu_device_largest_free_memory_bytes",
+		"Largest memory a new vGPU of a GPU can be granted, 0 when the GPU is unhealthy or has no vGPU left",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	deviceAllocationsDesc = prometheus.NewDesc(
+		"vgpu_device_allocations",
+		"Distinct containers granted vGPUs of a GPU",
+		[]string{"deviceuuid", "devicetype"}, nil,
+	)
+	nodeFragmentationDesc = prometheus.NewDesc(
+		"vgpu_node_memory_fragmentation_ratio",
+		"Share of the free memory of the healthy GPUs of the node stranded on GPUs already in use",
+		nil, nil,
+	)
+	nodePhysicalMemoryDesc = prometheus.NewDesc(
+		"vgpu_node_physical_memory_bytes",
+		"Memory of the GPUs of the node",
+		nil, nil,
+	)
+	nodeQuotaMemoryDesc = prometheus.NewDesc(
+		"vgpu_node_quota_memory_bytes",
+		"Memory of the GPUs of the node the vGPUs can be granted, the physical memory scaled by the overcommit ratio",
+		nil, nil,
+	)
+	nodeAllocatedMemoryDesc = prometheus.NewDesc(
+		"vgpu_node_allocated_memory_bytes",
+		"Memory of the GPUs of the node granted to the vGPUs of its pods",
+		nil, nil,
+	)
+	nodeSchedulableMemoryDesc = prometheus.NewDesc(
+		"vgpu_node_schedulable_memory_bytes",
+		"Memory of the healthy GPUs of the node with a vGPU left which can still be granted",
+		nil, nil,
+	)
+	nodeOvercommitRatioDesc = prometheus.NewDesc(
+		"vgpu_node_memory_overcommit_ratio",
+		"Memory overcommit of the node, the memory the vGPUs can be granted over the physical memory of the GPUs",
+		nil, nil,
+	)
+	podAllocatedSlotsDesc = prometheus.NewDesc(
+		"vgpu_pod_allocated_slots",
+		"vGPUs of a GPU allocated to a container",
+		[]string{"namespace", "pod", "container", "deviceuuid"}, nil,
+	)
+	podAllocatedMemoryDesc = prometheus.NewDesc(
+		"vgpu_pod_allocated_memory_bytes",
+		"Memory of a GPU granted to a container",
+		[]string{"namespace", "pod", "container", "deviceuuid"}, nil,
+	)
+	podAllocatedCoresDesc = prometheus.NewDesc(
+		"vgpu_pod_allocated_cores",
+		"SM percentage of a GPU granted to a container",
+		[]string{"namespace", "pod", "container", "deviceuuid"}, nil,
+	)
+)
+
+// AllocationCollector exports what the GPUs of the node can be allocated
+// and what the pods are, from the assignments of the scheduler rather than
+// from the usage the monitor measures.
+type AllocationCollector struct {
+	deviceCache *DeviceCache
+}
+
+func NewAllocationCollector(deviceCache *DeviceCache) *AllocationCollector {
+	return &AllocationCollector{deviceCache: deviceCache}
+}
+
+func (c *AllocationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceAllocatableSlotsDesc
+	ch <- deviceAllocatedSlotsDesc
+	ch <- deviceAllocatableMemoryDesc
+	ch <- deviceAllocatedMemoryDesc
+	ch <- deviceAllocatableCoresDesc
+	ch <- deviceAllocatedCoresDesc
+	ch <- deviceLargestFreeMemoryDesc
+	ch <- deviceAllocationsDesc
+	ch <- nodeFragmentationDesc
+	ch <- nodePhysicalMemoryDesc
+	ch <- nodeQuotaMemoryDesc
+	ch <- nodeAllocatedMemoryDesc
+	ch <- nodeSchedulableMemoryDesc
+	ch <- nodeOvercommitRatioDesc
+	ch <- podAllocatedSlotsDesc
+	ch <- podAllocatedMemoryDesc
+	ch <- podAllocatedCoresDesc
+}
+
+func (c *AllocationCollector) Collect(ch chan<- prometheus.Metric) {
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		klog.Errorf("Failed to list the pods of the node: %v", err)
+		return
+	}
+	factor := float64(config.GPUMemoryFactor)
+	if factor == 0 {
+		factor = 1
+	}
+	const mib = 1024 * 1024
+	cached := c.deviceCache.GetCache()
+	devices := nodeLedger(cached, pods, "")
+	known := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		known[d.ID] = true
+		ch <- prometheus.MustNewConstMetric(deviceAllocatableSlotsDesc, prometheus.GaugeValue, float64(d.Count), d.ID, d.Type)
+		ch <- prometheus.MustNewConstMetric(deviceAllocatedSlotsDesc, prometheus.GaugeValue, float64(d.Used), d.ID, d.Type)
+		ch <- prometheus.MustNewConstMetric(deviceAllocatableMemoryDesc, prometheus.GaugeValue, float64(d.Totalmem)*factor*mib, d.ID, d.Type)
+		ch <- prometheus.MustNewConstMetric(deviceAllocatedMemoryDesc, prometheus.GaugeValue, float64(d.Usedmem)*factor*mib, d.ID, d.Type)
+		ch <- prometheus.MustNewConstMetric(deviceAllocatableCoresDesc, prometheus.GaugeValue, float64(d.Totalcore), d.ID, d.Type)
+		ch <- prometheus.MustNewConstMetric(deviceAllocatedCoresDesc, prometheus.GaugeValue, float64(d.Usedcores), d.ID, d.Type)
+		// The memory of a GPU is granted by quota, a new vGPU can be given
+		// all of what is free as long as a vGPU is left.
+		largest := 0.0
+		if d.Health && d.Used < d.Count && d.Freemem() > 0 {
+			largest = float64(d.Freemem()) * factor * mib
+		}
+		ch <- prometheus.MustNewConstMetric(deviceLargestFreeMemoryDesc, prometheus.GaugeValue, largest, d.ID, d.Type)
+	}
+	ch <- prometheus.MustNewConstMetric(nodeFragmentationDesc, prometheus.GaugeValue, policy.Fragmentation(devices))
+	var physical float64
+	for _, d := range cached {
+		physical += float64(d.Memory) * mib
+	}
+	c.collectNode(ch, devices, physical, factor*mib)
+
+	// A container may be granted several vGPUs of the same GPU, they are
+	// summed in a series per device.
+	type key struct{ namespace, pod, container, uuid string }
+	type grant struct{ slots, memory, cores float64 }
+	grants := make(map[key]*grant)
+	var order []key
+	for _, pod := range pods {
+		for i, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			ctrName := ""
+			if i < len(pod.Spec.Containers) {
+				ctrName = pod.Spec.Containers[i].Name
+			}
+			for _, cd := range ctr {
+				if !known[cd.UUID] {
+					continue
+				}
+				k := key{pod.Namespace, pod.Name, ctrName, cd.UUID}
+				g, ok := grants[k]
+				if !ok {
+					g = &grant{}
+					grants[k] = g
+					order = append(order, k)
+				}
+				g.slots++
+				g.memory += float64(cd.Usedmem) * factor * mib
+				g.cores += float64(cd.Usedcores)
+			}
+		}
+	}
+	allocations := make(map[string]int)
+	for _, k := range order {
+		allocations[k.uuid]++
+	}
+	for _, d := range devices {
+		ch <- prometheus.MustNewConstMetric(deviceAllocationsDesc, prometheus.GaugeValue, float64(allocations[d.ID]), d.ID, d.Type)
+	}
+	for _, k := range order {
+		g := grants[k]
+		ch <- prometheus.MustNewConstMetric(podAllocatedSlotsDesc, prometheus.GaugeValue, g.slots, k.namespace, k.pod, k.container, k.uuid)
+		ch <- prometheus.MustNewConstMetric(podAllocatedMemoryDesc, prometheus.GaugeValue, g.memory, k.namespace, k.pod, k.container, k.uuid)
+		ch <- prometheus.MustNewConstMetric(podAllocatedCoresDesc, prometheus.GaugeValue, g.cores, k.namespace, k.pod, k.container, k.uuid)
+	}
+}
+
+// collectNode exports the memory capacity of the node and what of it is
+// granted, by the scale of the memory blocks of the ledger in bytes. The
+// ledger holds the memory of the devices scaled by their overcommit, the
+// physical memory is in bytes.
+func (c *AllocationCollector) collectNode(ch chan<- prometheus.Metric, devices []*policy.Device, physical float64, scale float64) {
+	var quota, allocated, schedulable float64
+	for _, d := range devices {
+		quota += float64(d.Totalmem) * scale
+		allocated += float64(d.Usedmem) * scale
+		if !d.Health || d.Used >= d.Count {
+			continue
+		}
+		if free := d.Freemem(); free > 0 {
+			schedulable += float64(free) * scale
+		}
+	}
+	ratio := 1.0
+	if physical > 0 {
+		ratio = quota / physical
+	}
+	ch <- prometheus.MustNewConstMetric(nodePhysicalMemoryDesc, prometheus.GaugeValue, physical)
+	ch <- prometheus.MustNewConstMetric(nodeQuotaMemoryDesc, prometheus.GaugeValue, quota)
+	ch <- prometheus.MustNewConstMetric(nodeAllocatedMemoryDesc, prometheus.GaugeValue, allocated)
+	ch <- prometheus.MustNewConstMetric(nodeSchedulableMemoryDesc, prometheus.GaugeValue, schedulable)
+	ch <- prometheus.MustNewConstMetric(nodeOvercommitRatioDesc, prometheus.GaugeValue, ratio)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// AllocationStatusWriter writes the allocation table of the node in the
+// status of its NodeVGPUAllocation.
+type AllocationStatusWriter struct {
+	deviceCache *DeviceCache
+	client      dynamic.Interface
+	interval    time.Duration
+	stopCh      chan struct{}
+}
+
+func NewAllocationStatusWriter(deviceCache *DeviceCache, interval time.Duration) (*AllocationStatusWriter, error) {
+	cfg, err := lock.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &AllocationStatusWriter{
+		deviceCache: deviceCache,
+		client:      client,
+		interval:    interval,
+		stopCh:      make(chan struct{}),
+	}, nil
+}
+
+func (w *AllocationStatusWriter) Start() {
+	go w.Run()
+}
+
+func (w *AllocationStatusWriter) Stop() {
+	close(w.stopCh)
+}
+
+// allocationStatus builds the status from the devices of the node and the
+// devices assigned to its pods, the memory in MiB.
+func allocationStatus(devices []*Device, pods []corev1.Pod) v1alpha1.NodeVGPUAllocationStatus {
+	factor := int32(config.GPUMemoryFactor)
+	if factor == 0 {
+		factor = 1
+	}
+	status := v1alpha1.NodeVGPUAllocationStatus{Devices: []v1alpha1.DeviceStatus{}}
+	byUUID := make(map[string]int)
+	for _, d := range nodeLedger(devices, pods, "") {
+		byUUID[d.ID] = len(status.Devices)
+		status.Devices = append(status.Devices, v1alpha1.DeviceStatus{
+			UUID:       d.ID,
+			Index:      d.Index,
+			Type:       d.Type,
+			Healthy:    d.Health,
+			Count:      d.Count,
+			Used:       d.Used,
+			Memory:     d.Totalmem * factor,
+			UsedMemory: d.Usedmem * factor,
+			Cores:      d.Totalcore,
+			UsedCores:  d.Usedcores,
+		})
+	}
+	for _, pod := range pods {
+		for i, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			ctrName := ""
+			if i < len(pod.Spec.Containers) {
+				ctrName = pod.Spec.Containers[i].Name
+			}
+			for _, cd := range ctr {
+				idx, ok := byUUID[cd.UUID]
+				if !ok {
+					continue
+				}
+				status.Devices[idx].Pods = append(status.Devices[idx].Pods, v1alpha1.PodSlice{
+					Namespace: pod.Namespace,
+					Name:      pod.Name,
+					Container: ctrName,
+					Memory:    cd.Usedmem * factor,
+					Cores:     cd.Usedcores,
+				})
+			}
+		}
+	}
+	return status
+}
+
+// Write updates the status of the NodeVGPUAllocation of the node, creating
+// it owned by the node if it doesn't exist yet.
+func (w *AllocationStatusWriter) Write() error {
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		return err
+	}
+	status := allocationStatus(w.deviceCache.GetCache(), pods)
+	ctx := context.Background()
+	resource := w.client.Resource(v1alpha1.NodeVGPUAllocationResource)
+	obj, err := resource.Get(ctx, config.NodeName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		obj, err = w.create(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	var current v1alpha1.NodeVGPUAllocation
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &current); err != nil {
+		return fmt.Errorf("decode %s: %v", config.NodeName, err)
+	}
+	if reflect.DeepEqual(current.Status.Devices, status.Devices) && time.Since(current.Status.UpdateTime.Time) < 10*w.interval {
+		return nil
+	}
+	status.UpdateTime = metav1.Now()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return err
+	}
+	obj.Object["status"] = content
+	_, err = resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+func (w *AllocationStatusWriter) create(ctx context.Context) (*unstructured.Unstructured, error) {
+	node, err := util.GetNode(config.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	alloc := &v1alpha1.NodeVGPUAllocation{
+		TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "NodeVGPUAllocation"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: config.NodeName,
+			// The allocation table goes away with the node.
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "Node", Name: node.Name, UID: node.UID}},
+		},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(alloc)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Creating NodeVGPUAllocation %s", config.NodeName)
+	return w.client.Resource(v1alpha1.NodeVGPUAllocationResource).Create(ctx, &unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+}
+
+// Run writes the status every interval until stopped.
+func (w *AllocationStatusWriter) Run() {
+	klog.Infof("Writing the allocation status of node %s every %v", config.NodeName, w.interval)
+	for {
+		if err := w.Write(); err != nil {
+			klog.Errorf("Failed to write allocation status: %v", err)
+		}
+		select {
+		case <-w.stopCh:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"sync"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
-	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
 )
 
 type DeviceCache struct {
@@ -35,7 +34,7 @@ type DeviceCache struct {
 
 func NewDeviceCache() *DeviceCache {
 	skipMigEnabledGPUs := true
-	if config.Mode == "mig" {
+	if CurrentRuntimeConfig().Mode == "mig" {
 		skipMigEnabledGPUs = false
 	}
 	return &DeviceCache{
@@ -61,6 +60,7 @@ func (d *DeviceCache) RemoveNotifyChannel(name string) {
 func (d *DeviceCache) Start() {
 	d.cache = d.Devices()
 	go d.CheckHealth(d.stopCh, d.cache, d.unhealthy)
+	go watchLostDevices(d.stopCh, d.cache, d.unhealthy)
 	go d.notify()
 }
 
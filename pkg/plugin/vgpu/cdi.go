@@ -0,0 +1,190 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+const (
+	// cdiKind is the vendor and class of the CDI devices of the plugin, a
+	// device per container.
+	cdiKind    = "volcano.sh/vgpu"
+	cdiVersion = "0.5.0"
+	// cdiAnnotation requests the CDI devices of a container from runtimes
+	// without CDI support in the CRI.
+	cdiAnnotation = "cdi.k8s.io/volcano-vgpu"
+	cdiSpecPrefix = "volcano.sh-vgpu-"
+)
+
+// cdiControlNodes are the device nodes of the driver every container of the
+// GPUs needs, those missing on the node are left out.
+var cdiControlNodes = []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools"}
+
+type cdiSpec struct {
+	CDIVersion string      `json:"cdiVersion"`
+	Kind       string      `json:"kind"`
+	Devices    []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string   `json:"name"`
+	ContainerEdits cdiEdits `json:"containerEdits"`
+}
+
+type cdiEdits struct {
+	Env         []string        `json:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty"`
+	Mounts      []cdiMount      `json:"mounts,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path string `json:"path"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// cdiDeviceName is the name of the CDI device of a container.
+func cdiDeviceName(podUID, ctrName string) string {
+	return podUID + "_" + ctrName
+}
+
+func cdiSpecPath(name string) string {
+	return filepath.Join(config.CDISpecDirectory, cdiSpecPrefix+name+".json")
+}
+
+// cdiResponse moves the devices, mounts and environment of the response into
+// the CDI spec of the container, which the response requests instead.
+func (m *NvidiaDevicePlugin) cdiResponse(podUID, ctrName string, devreq util.ContainerDevices, response *pluginapi.ContainerAllocateResponse) error {
+	var edits cdiEdits
+	for k, v := range response.Envs {
+		edits.Env = append(edits.Env, k+"="+v)
+	}
+	sort.Strings(edits.Env)
+	paths := make(map[string]bool)
+	for _, d := range m.Devices() {
+		for _, dev := range devreq {
+			if strings.HasPrefix(dev.UUID, d.ID) {
+				for _, p := range d.Paths {
+					paths[p] = true
+				}
+			}
+		}
+	}
+	for _, p := range cdiControlNodes {
+		if _, err := os.Stat(p); err == nil {
+			paths[p] = true
+		}
+	}
+	for p := range paths {
+		edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode{Path: p})
+	}
+	sort.Slice(edits.DeviceNodes, func(i, j int) bool { return edits.DeviceNodes[i].Path < edits.DeviceNodes[j].Path })
+	for _, mnt := range response.Mounts {
+		options := []string{"rw", "nosuid", "nodev", "bind"}
+		if mnt.ReadOnly {
+			options[0] = "ro"
+		}
+		edits.Mounts = append(edits.Mounts, cdiMount{HostPath: mnt.HostPath, ContainerPath: mnt.ContainerPath, Options: options})
+	}
+
+	name := cdiDeviceName(podUID, ctrName)
+	spec := cdiSpec{CDIVersion: cdiVersion, Kind: cdiKind, Devices: []cdiDevice{{Name: name, ContainerEdits: edits}}}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.CDISpecDirectory, 0755); err != nil {
+		return fmt.Errorf("create CDI spec directory: %v", err)
+	}
+	// The runtime watches the directory, it must not read a partial spec.
+	path := cdiSpecPath(name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("write CDI spec: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("write CDI spec: %v", err)
+	}
+	response.Envs, response.Mounts, response.Devices = nil, nil, nil
+	response.Annotations = map[string]string{cdiAnnotation: cdiKind + "=" + name}
+	return nil
+}
+
+// removeCDISpecs deletes the CDI specs of the containers older than grace
+// whose pod is gone from the node, listed after the specs for a pod
+// allocated meanwhile to be kept. It returns how many were deleted.
+func removeCDISpecs(node string, grace time.Duration, now time.Time) (int, error) {
+	if config.CDISpecDirectory == "" {
+		return 0, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(config.CDISpecDirectory, cdiSpecPrefix+"*.json"))
+	if err != nil {
+		return 0, err
+	}
+	old := make(map[string]string, len(paths))
+	for _, p := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), cdiSpecPrefix), ".json")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			continue
+		}
+		if info, err := os.Stat(p); err != nil || now.Sub(info.ModTime()) < grace {
+			continue
+		}
+		old[p] = name[:i]
+	}
+	if len(old) == 0 {
+		return 0, nil
+	}
+	pods, err := listNodePods(node)
+	if err != nil {
+		return 0, err
+	}
+	keep := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		keep[string(pod.UID)] = true
+	}
+	removed := 0
+	for p, uid := range old {
+		if keep[uid] {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			klog.Warningf("Failed to remove CDI spec %s: %v", p, err)
+			continue
+		}
+		klog.Infof("Removed CDI spec %s of a gone pod", p)
+		removed++
+	}
+	return removed, nil
+}
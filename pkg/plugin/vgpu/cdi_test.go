@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// useCDISpecDirectory makes the plugin write the CDI specs in a temporary
+// directory.
+func useCDISpecDirectory(t *testing.T) string {
+	dir := t.TempDir()
+	specDir := config.CDISpecDirectory
+	t.Cleanup(func() { config.CDISpecDirectory = specDir })
+	config.CDISpecDirectory = dir
+	return dir
+}
+
+func TestCDIResponse(t *testing.T) {
+	dir := useCDISpecDirectory(t)
+	controlNode := filepath.Join(t.TempDir(), "nvidiactl")
+	require.NoError(t, os.WriteFile(controlNode, nil, 0644))
+	controlNodes := cdiControlNodes
+	defer func() { cdiControlNodes = controlNodes }()
+	cdiControlNodes = []string{controlNode, filepath.Join(dir, "missing")}
+
+	m := &NvidiaDevicePlugin{migStrategy: "none", deviceCache: &DeviceCache{cache: []*Device{
+		{Device: pluginapi.Device{ID: "GPU-0"}, Paths: []string{"/dev/nvidia0"}},
+		{Device: pluginapi.Device{ID: "GPU-1"}, Paths: []string{"/dev/nvidia1"}},
+	}}}
+	response := &pluginapi.ContainerAllocateResponse{
+		Envs:    map[string]string{"CUDA_DEVICE_MEMORY_LIMIT_0": "1024m", "NVIDIA_VISIBLE_DEVICES": "GPU-0"},
+		Mounts:  []*pluginapi.Mount{{HostPath: "/usr/local/vgpu/libvgpu.so", ContainerPath: "/usr/local/vgpu/libvgpu.so", ReadOnly: true}},
+		Devices: []*pluginapi.DeviceSpec{{HostPath: "/dev/nvidia0", ContainerPath: "/dev/nvidia0"}},
+	}
+	require.NoError(t, m.cdiResponse("uid", "main", util.ContainerDevices{{UUID: "GPU-0"}}, response))
+
+	require.Equal(t, &pluginapi.ContainerAllocateResponse{
+		Annotations: map[string]string{cdiAnnotation: "volcano.sh/vgpu=uid_main"},
+	}, response)
+	data, err := os.ReadFile(filepath.Join(dir, "volcano.sh-vgpu-uid_main.json"))
+	require.NoError(t, err)
+	var spec cdiSpec
+	require.NoError(t, json.Unmarshal(data, &spec))
+	require.Equal(t, cdiSpec{
+		CDIVersion: cdiVersion,
+		Kind:       cdiKind,
+		Devices: []cdiDevice{{
+			Name: "uid_main",
+			ContainerEdits: cdiEdits{
+				Env:         []string{"CUDA_DEVICE_MEMORY_LIMIT_0=1024m", "NVIDIA_VISIBLE_DEVICES=GPU-0"},
+				DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidia0"}, {Path: controlNode}},
+				Mounts: []cdiMount{{
+					HostPath:      "/usr/local/vgpu/libvgpu.so",
+					ContainerPath: "/usr/local/vgpu/libvgpu.so",
+					Options:       []string{"ro", "nosuid", "nodev", "bind"},
+				}},
+			},
+		}},
+	}, spec)
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func TestRemoveCDISpecs(t *testing.T) {
+	dir := useCDISpecDirectory(t)
+	now := time.Now()
+	grace := 5 * time.Minute
+	write := func(name string, mtime time.Time) {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, []byte("{}"), 0644))
+		require.NoError(t, os.Chtimes(p, mtime, mtime))
+	}
+	write(cdiSpecPrefix+"uid-gone_main.json", now.Add(-time.Hour))
+	write(cdiSpecPrefix+"uid-bound_main.json", now.Add(-time.Hour))
+	write(cdiSpecPrefix+"uid-assigned_main.json", now.Add(-time.Hour))
+	write(cdiSpecPrefix+"uid-succeeded_main.json", now.Add(-time.Hour))
+	// Written for a pod allocated after the pods were listed.
+	write(cdiSpecPrefix+"uid-new_main.json", now.Add(-time.Second))
+	write(cdiSpecPrefix+"invalid.json", now.Add(-time.Hour))
+	write("other-vendor.json", now.Add(-time.Hour))
+	useTestClient(t,
+		testPod("bound", "node1", "", corev1.PodRunning),
+		testPod("assigned", "", "node1", corev1.PodPending),
+		testPod("succeeded", "node1", "", corev1.PodSucceeded),
+	)
+
+	removed, err := removeCDISpecs("node1", grace, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{
+		"other-vendor.json",
+		cdiSpecPrefix + "invalid.json",
+		cdiSpecPrefix + "uid-assigned_main.json",
+		cdiSpecPrefix + "uid-bound_main.json",
+		cdiSpecPrefix + "uid-new_main.json",
+	}, names)
+}
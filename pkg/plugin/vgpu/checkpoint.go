@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// AllocationRecord is a container the plugin allocated vGPUs to.
+type AllocationRecord struct {
+	PodUID    string                `json:"podUID"`
+	Namespace string                `json:"namespace"`
+	Pod       string                `json:"pod"`
+	Container string                `json:"container"`
+	Devices   util.ContainerDevices `json:"devices"`
+	Time      time.Time             `json:"time"`
+}
+
+func (r AllocationRecord) key() string {
+	return r.PodUID + "/" + r.Container
+}
+
+// Checkpoint is the record of the allocations of the plugin, kept in a file
+// next to the kubelet checkpoint so that it survives reboots.
+type Checkpoint struct {
+	path    string
+	mutex   sync.Mutex
+	Records map[string]AllocationRecord `json:"records"`
+}
+
+var (
+	checkpointOnce sync.Once
+	checkpoint     *Checkpoint
+)
+
+// allocationCheckpoint returns the checkpoint of config.CheckpointFile,
+// loaded on first use. nil when the checkpoint is disabled.
+func allocationCheckpoint() *Checkpoint {
+	checkpointOnce.Do(func() {
+		if config.CheckpointFile == "" {
+			return
+		}
+		ck, err := LoadCheckpoint(config.CheckpointFile)
+		if err != nil {
+			klog.Errorf("Failed to load checkpoint %s, starting from an empty one: %v", config.CheckpointFile, err)
+			ck = &Checkpoint{path: config.CheckpointFile, Records: make(map[string]AllocationRecord)}
+		}
+		checkpoint = ck
+	})
+	return checkpoint
+}
+
+// LoadCheckpoint reads the checkpoint of path, empty if it doesn't exist.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	ck := &Checkpoint{path: path, Records: make(map[string]AllocationRecord)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ck, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, ck); err != nil {
+		return nil, fmt.Errorf("unmarshal checkpoint: %v", err)
+	}
+	if ck.Records == nil {
+		ck.Records = make(map[string]AllocationRecord)
+	}
+	return ck, nil
+}
+
+// save writes the checkpoint through a temporary file so that a crash never
+// leaves a truncated one. The mutex must be held.
+func (c *Checkpoint) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Add records an allocation, replacing the previous one of the container.
+func (c *Checkpoint) Add(r AllocationRecord) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Records[r.key()] = r
+	return c.save()
+}
+
+// AddAll records the allocations of several containers in one write.
+func (c *Checkpoint) AddAll(records []AllocationRecord) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, r := range records {
+		c.Records[r.key()] = r
+	}
+	return c.save()
+}
+
+// List returns the recorded allocations.
+func (c *Checkpoint) List() []AllocationRecord {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := make([]AllocationRecord, 0, len(c.Records))
+	for _, r := range c.Records {
+		res = append(res, r)
+	}
+	return res
+}
+
+// Replace sets the recorded allocations.
+func (c *Checkpoint) Replace(records []AllocationRecord) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Records = make(map[string]AllocationRecord, len(records))
+	for _, r := range records {
+		c.Records[r.key()] = r
+	}
+	return c.save()
+}
+
+// Prune drops the recorded allocations keep rejects, it returns how many.
+func (c *Checkpoint) Prune(keep func(r AllocationRecord) bool) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pruned := 0
+	for k, r := range c.Records {
+		if !keep(r) {
+			delete(c.Records, k)
+			pruned++
+		}
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	return pruned, c.save()
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// DriverUnsupportedCondition is the node condition which is True when the
+// driver or CUDA version of the node is older than the minimum supported,
+// the plugin then advertising no device.
+const DriverUnsupportedCondition corev1.NodeConditionType = "VGPUDriverUnsupported"
+
+// DriverUnsupportedAnnotation tells why the plugin doesn't advertise the
+// devices of the node, removed once the driver is supported.
+const DriverUnsupportedAnnotation = "volcano.sh/vgpu-driver-unsupported"
+
+// MinimumVersions are the oldest driver and CUDA versions supported, an
+// empty one is not checked.
+type MinimumVersions struct {
+	Driver string `yaml:"driver"`
+	CUDA   string `yaml:"cuda"`
+}
+
+// DriverCompatibilityConfig is the minimum versions of every GPU, those of
+// the entry of Models with the longest key the model name of the GPU contains,
+// case insensitive, and otherwise the Default ones. The versions a model
+// leaves empty are those of Default.
+type DriverCompatibilityConfig struct {
+	Default MinimumVersions            `yaml:"default"`
+	Models  map[string]MinimumVersions `yaml:"models"`
+}
+
+// DefaultDriverCompatibility is the minimum versions libvgpu runs on.
+var DefaultDriverCompatibility = DriverCompatibilityConfig{
+	Default: MinimumVersions{Driver: "440", CUDA: "10.2"},
+}
+
+// LoadDriverCompatibilityConfig reads the minimum versions from path, the
+// default ones when it is empty.
+func LoadDriverCompatibilityConfig(path string) (*DriverCompatibilityConfig, error) {
+	if path == "" {
+		c := DefaultDriverCompatibility
+		return &c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c DriverCompatibilityConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal driver compatibility config: %v", err)
+	}
+	return &c, nil
+}
+
+// Minimum returns the minimum versions of the model.
+func (c *DriverCompatibilityConfig) Minimum(model string) MinimumVersions {
+	res := c.Default
+	// The longest key is the most specific, e.g. A100-SXM4-80GB over A100.
+	longest := ""
+	for key := range c.Models {
+		if util.ContainsGPUType(model, []string{key}) && len(key) > len(longest) {
+			longest = key
+		}
+	}
+	if longest != "" {
+		m := c.Models[longest]
+		if m.Driver != "" {
+			res.Driver = m.Driver
+		}
+		if m.CUDA != "" {
+			res.CUDA = m.CUDA
+		}
+	}
+	return res
+}
+
+// compareVersions compares the dot separated versions number by number,
+// the missing ones being 0, e.g. 535 < 535.129.03 < 550.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		if x == "" {
+			xn, xerr = 0, nil
+		}
+		if y == "" {
+			yn, yerr = 0, nil
+		}
+		if xerr != nil || yerr != nil {
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+			continue
+		}
+		if xn != yn {
+			if xn < yn {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// unsupportedVersions returns why the running versions don't support the
+// devices, nil when they do.
+func unsupportedVersions(c *DriverCompatibilityConfig, devices []*Device) []string {
+	var driver, cuda string
+	for _, r := range runningVersions(nil) {
+		switch r.component {
+		case ComponentDriver:
+			driver = r.version
+		case ComponentCUDA:
+			cuda = r.version
+		}
+	}
+	var problems []string
+	seen := make(map[string]bool)
+	for _, d := range devices {
+		model := ""
+		if ndev, ret := config.Nvml().DeviceGetHandleByUUID(d.ID); ret == nvml.SUCCESS {
+			model, _ = config.Nvml().DeviceGetName(ndev)
+		}
+		min := c.Minimum(model)
+		for _, v := range []struct{ component, running, minimum string }{
+			{ComponentDriver, driver, min.Driver},
+			{ComponentCUDA, cuda, min.CUDA},
+		} {
+			if v.minimum == "" {
+				continue
+			}
+			var problem string
+			if v.running == "" {
+				problem = fmt.Sprintf("%s version unknown, %s or later required", v.component, v.minimum)
+			} else if compareVersions(v.running, v.minimum) < 0 {
+				problem = fmt.Sprintf("%s %s is older than %s", v.component, v.running, v.minimum)
+			} else {
+				continue
+			}
+			if model != "" {
+				problem += " for " + model
+			}
+			if !seen[problem] {
+				seen[problem] = true
+				problems = append(problems, problem)
+			}
+		}
+	}
+	return problems
+}
+
+// CheckDriverCompatibility compares the driver and CUDA versions with the
+// minimum ones of the devices and reflects it in the VGPUDriverUnsupported
+// condition and annotation of the node. It returns false when the devices
+// must not be advertised, their registration being removed from the node.
+func CheckDriverCompatibility(devices []*Device, path string) (bool, error) {
+	c, err := LoadDriverCompatibilityConfig(path)
+	if err != nil {
+		return false, err
+	}
+	problems := unsupportedVersions(c, devices)
+	node, err := util.GetNode(config.NodeName)
+	if err != nil {
+		return false, err
+	}
+	cond := corev1.NodeCondition{
+		Type:    DriverUnsupportedCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  "DriverSupported",
+		Message: "driver and CUDA versions are supported",
+	}
+	if len(problems) > 0 {
+		cond.Status, cond.Reason, cond.Message = corev1.ConditionTrue, "DriverTooOld", strings.Join(problems, "; ")
+		klog.Errorf("Not advertising the devices of node %s: %s", config.NodeName, cond.Message)
+		if err := util.PatchNodeAnnotations(node, map[string]string{DriverUnsupportedAnnotation: cond.Message}); err != nil {
+			return false, err
+		}
+		if err := lock.NodeUpdates().RemoveAnnotations(config.NodeName, util.NodeNvidiaDeviceRegistered); err != nil {
+			return false, err
+		}
+	} else if _, ok := node.Annotations[DriverUnsupportedAnnotation]; ok {
+		if err := lock.NodeUpdates().RemoveAnnotations(config.NodeName, DriverUnsupportedAnnotation); err != nil {
+			return false, err
+		}
+	}
+	if err := setNodeCondition(node, cond); err != nil {
+		return false, err
+	}
+	return len(problems) == 0, nil
+}
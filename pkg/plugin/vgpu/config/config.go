@@ -17,7 +17,9 @@ limitations under the License.
 package config
 
 import (
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/NVIDIA/go-nvlib/pkg/nvlib/device"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
@@ -39,6 +41,12 @@ type NvidiaConfig struct {
 	DisableCoreLimit             bool                   `yaml:"disableCoreLimit"`
 	MigGeometriesList            []AllowedMigGeometries `yaml:"knownMigGeometries"`
 	GPUMemoryFactor              uint                   `yaml:"gpuMemoryFactor"`
+	// DeviceMemoryScalingByModel overrides DeviceMemoryScaling for the GPU
+	// models, by a part of their name.
+	DeviceMemoryScalingByModel map[string]float64 `yaml:"deviceMemoryScalingByModel"`
+	// NodeMemoryScaling is the devicememoryscaling of the node config,
+	// overriding both on the node.
+	NodeMemoryScaling float64 `yaml:"-"`
 }
 
 var (
@@ -77,8 +85,89 @@ var (
 	NodeName           string
 	RuntimeSocketFlag  string
 	DisableCoreLimit   bool
+
+	// AllocationPolicy is the policy the devices assigned by the scheduler
+	// are checked with, they are trusted when empty.
+	AllocationPolicy string
+	// ShadowAllocationPolicy is evaluated on every allocation without
+	// enforcing it, to compare its choices with the scheduler's.
+	ShadowAllocationPolicy string
+	// DeviceSelectionPolicy re-places the containers on the devices it
+	// prefers among those of the type the scheduler assigned, the devices
+	// of the scheduler are kept when empty. Pods override it with the
+	// selection policy annotation.
+	DeviceSelectionPolicy string
+	// AllocationPolicyPlugins are Go plugins registering custom policies.
+	AllocationPolicyPlugins []string
+	// OPAPolicies are the Rego files or directories of the admission
+	// policies every allocation is evaluated against.
+	OPAPolicies []string
+	// CheckpointFile is where the allocations of the plugin are recorded to
+	// be recovered after a restart, they are not recorded when empty.
+	CheckpointFile string
+	// MPSPipeDirectory is the pipe directory of the MPS control daemon of
+	// the node, the containers isolated with MPS are its clients.
+	MPSPipeDirectory string
+	// MPSDaemons runs an MPS control daemon per GPU, with its pipes in a
+	// directory of MPSPipeDirectory named after the GPU.
+	MPSDaemons bool
+	// Isolation is how the cores of the pods are limited when they don't
+	// select it, libvgpu when empty.
+	Isolation string
+	// CDISpecDirectory is where the CDI specs of the containers are
+	// written for the container runtime to inject their devices, mounts
+	// and environment, the kubelet passes them directly when empty.
+	CDISpecDirectory string
+	// AnnotationReconcileInterval is the interval between two checks of the
+	// annotations the plugin registers on its node, only checked when they
+	// are registered again when 0.
+	AnnotationReconcileInterval time.Duration
+	// DeviceMemoryScaling is the memory overcommit of the GPUs of the node.
+	DeviceMemoryScaling MemoryScaling
 )
 
+// MemoryScaling is how many times their physical memory the vGPUs of the
+// GPUs can be granted.
+type MemoryScaling struct {
+	// Cluster is the deviceMemoryScaling of the ConfigMap, the scheduler
+	// scales the memory every device registers by it.
+	Cluster float64
+	// Models overrides Cluster for the GPU models, that of the longest key
+	// the model name contains, case insensitive.
+	Models map[string]float64
+	// Node overrides Cluster and Models on the node when set.
+	Node float64
+}
+
+// Of returns the overcommit of a GPU of the model, 1 when none is set.
+func (s MemoryScaling) Of(model string) float64 {
+	if s.Node > 0 {
+		return s.Node
+	}
+	// The longest key is the most specific, e.g. A100-SXM4-80GB over A100.
+	longest, res := "", s.Cluster
+	for key, scaling := range s.Models {
+		if scaling > 0 && strings.Contains(strings.ToUpper(model), strings.ToUpper(key)) && len(key) > len(longest) {
+			longest, res = key, scaling
+		}
+	}
+	if res <= 0 {
+		return 1
+	}
+	return res
+}
+
+// Registered returns the memory a GPU of the model registers for the
+// scheduler, scaling it by Cluster, to grant Of(model) times its physical
+// memory.
+func (s MemoryScaling) Registered(model string, physical int32) int32 {
+	cluster := s.Cluster
+	if cluster <= 0 {
+		cluster = 1
+	}
+	return int32(float64(physical) * s.Of(model) / cluster)
+}
+
 type MigTemplate struct {
 	Name   string `yaml:"name"`
 	Memory int32  `yaml:"memory"`
@@ -135,14 +224,48 @@ type FilterDevice struct {
 	Index []uint `json:"index"`
 }
 
+// Filtered reports whether the device of the index and UUID is filtered
+// out, none is by a nil filter.
+func (f *FilterDevice) Filtered(index uint, uuid string) bool {
+	if f == nil {
+		return false
+	}
+	for _, i := range f.Index {
+		if i == index {
+			return true
+		}
+	}
+	for _, u := range f.UUID {
+		if u == uuid {
+			return true
+		}
+	}
+	return false
+}
+
 type DevicePluginConfigs struct {
-	Nodeconfig []struct {
-		Name                string        `json:"name"`
-		OperatingMode       string        `json:"operatingmode"`
-		Devicememoryscaling float64       `json:"devicememoryscaling"`
-		Devicecorescaling   float64       `json:"devicecorescaling"`
-		Devicesplitcount    uint          `json:"devicesplitcount"`
-		Migstrategy         string        `json:"migstrategy"`
-		FilterDevice        *FilterDevice `json:"filterdevices"`
-	} `json:"nodeconfig"`
+	Nodeconfig []NodeConfig `json:"nodeconfig"`
+}
+
+// NodeConfig is the configuration of a node in the node config file,
+// overriding the flags and the device config on that node.
+type NodeConfig struct {
+	Name                string        `json:"name"`
+	OperatingMode       string        `json:"operatingmode"`
+	Devicememoryscaling float64       `json:"devicememoryscaling"`
+	Devicecorescaling   float64       `json:"devicecorescaling"`
+	Devicesplitcount    uint          `json:"devicesplitcount"`
+	Migstrategy         string        `json:"migstrategy"`
+	FilterDevice        *FilterDevice `json:"filterdevices"`
+	// DeviceSelectionPolicy overrides --device-selection-policy on
+	// the node.
+	DeviceSelectionPolicy string `json:"deviceselectionpolicy"`
+	// Isolation overrides --isolation on the node.
+	Isolation string `json:"isolation"`
+	// ReservedDevices are the devices of the node kept out of the vGPU
+	// pool, e.g. for the host processes.
+	ReservedDevices *FilterDevice `json:"reserveddevices"`
+	// WholeDevices are the devices of the node advertised whole with the
+	// whole GPU resource, the others being shared as vGPUs.
+	WholeDevices *FilterDevice `json:"wholedevices"`
 }
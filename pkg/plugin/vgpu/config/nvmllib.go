@@ -0,0 +1,159 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvlib/device"
+	"github.com/NVIDIA/go-nvml/pkg/dl"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+const nvmlLibraryName = "libnvidia-ml.so.1"
+
+var (
+	// NvmlLibraryPath is the libnvidia-ml to load, it is searched for when
+	// empty.
+	NvmlLibraryPath string
+	// DriverRoot is where the driver is installed when it is not in /, as
+	// with a driver container, its library directories are searched first.
+	DriverRoot = os.Getenv("NVIDIA_DRIVER_ROOT")
+)
+
+// nvmlLibraryDirectories are the directories libnvidia-ml is searched in
+// after the dynamic linker search path, for the architecture first.
+func nvmlLibraryDirectories(goarch string) []string {
+	multiarch := map[string]string{
+		"amd64":   "x86_64-linux-gnu",
+		"arm64":   "aarch64-linux-gnu",
+		"ppc64le": "powerpc64le-linux-gnu",
+	}[goarch]
+	var dirs []string
+	if multiarch != "" {
+		dirs = append(dirs, "/usr/lib/"+multiarch, "/lib/"+multiarch, "/usr/lib/"+multiarch+"/nvidia/current")
+	}
+	dirs = append(dirs,
+		"/usr/lib64", "/lib64", "/usr/lib", "/lib",
+		// The driver of the GPU operator, and the installs of GKE.
+		"/usr/local/nvidia/lib64", "/usr/local/nvidia/lib", "/home/kubernetes/bin/nvidia/lib64",
+		// WSL2 exposes the library of the Windows driver there.
+		"/usr/lib/wsl/lib",
+	)
+	return dirs
+}
+
+// nvmlLibraryCandidates returns the paths libnvidia-ml is tried at, in
+// order, the first one being the bare name searched by the dynamic linker.
+func nvmlLibraryCandidates() []string {
+	if NvmlLibraryPath != "" {
+		return []string{NvmlLibraryPath}
+	}
+	var roots []string
+	if DriverRoot != "" && DriverRoot != "/" {
+		roots = append(roots, DriverRoot)
+	}
+	roots = append(roots, "/run/nvidia/driver", "")
+	res := []string{nvmlLibraryName}
+	for _, root := range roots {
+		for _, dir := range nvmlLibraryDirectories(runtime.GOARCH) {
+			res = append(res, filepath.Join(root+dir, nvmlLibraryName))
+		}
+	}
+	return res
+}
+
+// elfMachines are the ELF machines of the architectures the plugin runs on.
+var elfMachines = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64le": elf.EM_PPC64,
+}
+
+// probeNvmlLibrary returns why the library at path can't be loaded, nil
+// when it can.
+func probeNvmlLibrary(path string) error {
+	if filepath.IsAbs(path) {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		if f, err := elf.Open(path); err == nil {
+			machine := f.Machine
+			f.Close()
+			if want, ok := elfMachines[runtime.GOARCH]; ok && machine != want {
+				return fmt.Errorf("library is built for %v, the plugin runs on %s", machine, runtime.GOARCH)
+			}
+		}
+	}
+	lib := dl.New(path, dl.RTLD_LAZY|dl.RTLD_GLOBAL)
+	if err := lib.Open(); err != nil {
+		return err
+	}
+	err := lib.Lookup("nvmlInit_v2")
+	lib.Close()
+	if err != nil {
+		return fmt.Errorf("not an NVML library: %v", err)
+	}
+	return nil
+}
+
+// runsOnWSL reports whether the node is a WSL2 virtual machine.
+func runsOnWSL() bool {
+	data, err := os.ReadFile("/proc/version")
+	return err == nil && strings.Contains(strings.ToLower(string(data)), "microsoft")
+}
+
+// LoadNvmlLibrary searches for libnvidia-ml and makes Nvml use the first
+// one which loads, returning its path. The error lists every path tried and
+// why it failed.
+func LoadNvmlLibrary() (string, error) {
+	var tried []string
+	seen := make(map[string]bool)
+	for _, path := range nvmlLibraryCandidates() {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		err := probeNvmlLibrary(path)
+		if err == nil {
+			lock.Lock()
+			defer lock.Unlock()
+			nvmllib = nvml.New(nvml.WithLibraryPath(path))
+			globalDevice = device.New(nvmllib)
+			return path, nil
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		tried = append(tried, fmt.Sprintf("%s: %v", path, err))
+	}
+	msg := fmt.Sprintf("no loadable %s found in the dynamic linker path nor in the driver directories", nvmlLibraryName)
+	if len(tried) > 0 {
+		msg += ", tried:\n\t" + strings.Join(tried, "\n\t")
+	}
+	if runsOnWSL() {
+		msg += "\nthe node runs on WSL2, mount its /usr/lib/wsl directory in the container"
+	} else {
+		msg += "\nmount the driver libraries in the container with the NVIDIA container runtime, set NVIDIA_DRIVER_ROOT to the root of a driver container or --nvml-library to the library"
+	}
+	return "", fmt.Errorf("%s", msg)
+}
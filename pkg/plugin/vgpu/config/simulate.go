@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/NVIDIA/go-nvlib/pkg/nvlib/device"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
+)
+
+// simulatedNvml is a fake DGX A100 answering the calls the plugin makes
+// through the library, so that the plugin runs on nodes without GPUs.
+type simulatedNvml struct {
+	*dgxa100.Server
+}
+
+// Simulate replaces the NVML library with a fake node of count A100 GPUs,
+// count must be between 1 and 8. The device UUIDs are derived from node so
+// that a restarted plugin registers the same devices. It must be called
+// before the library is initialized.
+func Simulate(node string, count int) error {
+	s := &simulatedNvml{Server: dgxa100.New()}
+	if count < 1 || count > len(s.Devices) {
+		return fmt.Errorf("invalid number of simulated GPUs %d, expected 1 to %d", count, len(s.Devices))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(node))
+	for i, d := range s.Devices {
+		d.(*dgxa100.Device).UUID = fmt.Sprintf("GPU-%08x-0000-0000-0000-%012x", h.Sum32(), i)
+	}
+
+	s.DeviceGetCountFunc = func() (int, nvml.Return) {
+		return count, nvml.SUCCESS
+	}
+	getHandleByIndex := s.DeviceGetHandleByIndexFunc
+	s.DeviceGetHandleByIndexFunc = func(index int) (nvml.Device, nvml.Return) {
+		if index >= count {
+			return nil, nvml.ERROR_INVALID_ARGUMENT
+		}
+		return getHandleByIndex(index)
+	}
+	s.DeviceGetUUIDFunc = func(d nvml.Device) (string, nvml.Return) {
+		return d.GetUUID()
+	}
+	s.DeviceGetNameFunc = func(d nvml.Device) (string, nvml.Return) {
+		return d.GetName()
+	}
+	s.DeviceGetMinorNumberFunc = func(d nvml.Device) (int, nvml.Return) {
+		return d.GetMinorNumber()
+	}
+	s.DeviceGetMemoryInfoFunc = func(d nvml.Device) (nvml.Memory, nvml.Return) {
+		return d.GetMemoryInfo()
+	}
+	s.DeviceGetMigModeFunc = func(d nvml.Device) (int, int, nvml.Return) {
+		return d.GetMigMode()
+	}
+	s.DeviceGetVbiosVersionFunc = func(d nvml.Device) (string, nvml.Return) {
+		return "92.00.45.00.03", nvml.SUCCESS
+	}
+	// The GPUs of a DGX A100 are paired under PCIe switches.
+	s.DeviceGetTopologyCommonAncestorFunc = func(d1, d2 nvml.Device) (nvml.GpuTopologyLevel, nvml.Return) {
+		m1, ret := d1.GetMinorNumber()
+		if ret != nvml.SUCCESS {
+			return 0, ret
+		}
+		m2, ret := d2.GetMinorNumber()
+		if ret != nvml.SUCCESS {
+			return 0, ret
+		}
+		if m1/2 == m2/2 {
+			return nvml.TOPOLOGY_SINGLE, nvml.SUCCESS
+		}
+		return nvml.TOPOLOGY_SYSTEM, nvml.SUCCESS
+	}
+	s.DeviceGetTemperatureFunc = func(d nvml.Device, sensor nvml.TemperatureSensors) (uint32, nvml.Return) {
+		return 40, nvml.SUCCESS
+	}
+	// There are no events to watch, the health checks give up on the
+	// devices being healthy.
+	s.EventSetCreateFunc = func() (nvml.EventSet, nvml.Return) {
+		return nil, nvml.ERROR_NOT_SUPPORTED
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	nvmllib = s
+	globalDevice = device.New(nvmllib)
+	return nil
+}
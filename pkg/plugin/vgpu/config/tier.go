@@ -0,0 +1,133 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// The memory tiers of a GPU.
+const (
+	// MemoryTierAuto detects the tier, shared when the GPU reports no
+	// memory of its own and dedicated otherwise.
+	MemoryTierAuto = "auto"
+	// MemoryTierDedicated is the memory of a discrete GPU.
+	MemoryTierDedicated = "dedicated"
+	// MemoryTierShared is memory carved from the system RAM, as on
+	// integrated GPUs.
+	MemoryTierShared = "shared"
+	// MemoryTierCoherent is the memory of a GPU coherent with the CPU, which
+	// can also allocate system RAM, as on Grace Hopper.
+	MemoryTierCoherent = "coherent"
+)
+
+var (
+	// MemoryTier is the tier of the memory of the GPUs of the node.
+	MemoryTier = MemoryTierAuto
+	// SharedMemoryFraction is the share of the system RAM a GPU of the
+	// shared tier registers.
+	SharedMemoryFraction = 0.5
+	// CoherentMemoryFraction is the share of the system RAM a GPU of the
+	// coherent tier registers on top of its own memory.
+	CoherentMemoryFraction float64
+)
+
+// MemoryTiers is the memory of a GPU in bytes, Device its own and Host the
+// part of the system RAM it registers.
+type MemoryTiers struct {
+	Tier   string
+	Device uint64
+	Host   uint64
+}
+
+func (t MemoryTiers) Total() uint64 {
+	return t.Device + t.Host
+}
+
+// Split divides the memory granted on the GPU between its tiers, in
+// proportion to their size, the GPU allocating from both.
+func (t MemoryTiers) Split(granted uint64) (device, host uint64) {
+	if t.Host == 0 || t.Total() == 0 {
+		return granted, 0
+	}
+	device = uint64(float64(granted) * float64(t.Device) / float64(t.Total()))
+	return device, granted - device
+}
+
+// SystemMemory returns the RAM of the node in bytes.
+func SystemMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse MemTotal: %v", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+}
+
+// DeviceMemory returns the memory tiers of the GPU.
+func DeviceMemory(d nvml.Device) (MemoryTiers, error) {
+	memory, ret := Nvml().DeviceGetMemoryInfo(d)
+	tier := MemoryTier
+	if tier == MemoryTierAuto || tier == "" {
+		tier = MemoryTierDedicated
+		if ret == nvml.ERROR_NOT_SUPPORTED || (ret == nvml.SUCCESS && memory.Total == 0) {
+			tier = MemoryTierShared
+		}
+	}
+	res := MemoryTiers{Tier: tier}
+	if tier != MemoryTierShared {
+		if ret != nvml.SUCCESS {
+			return res, fmt.Errorf("error getting memory info of device: %v", ret)
+		}
+		res.Device = memory.Total
+	}
+	fraction := 0.0
+	switch tier {
+	case MemoryTierShared:
+		fraction = SharedMemoryFraction
+	case MemoryTierCoherent:
+		fraction = CoherentMemoryFraction
+	case MemoryTierDedicated:
+	default:
+		return res, fmt.Errorf("unknown memory tier %q", tier)
+	}
+	if fraction > 0 {
+		system, err := SystemMemory()
+		if err != nil {
+			return res, err
+		}
+		res.Host = uint64(float64(system) * fraction)
+	}
+	return res, nil
+}
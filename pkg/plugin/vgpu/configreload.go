@@ -0,0 +1,381 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// DeviceConfigMap is the ConfigMap of the device config of the cluster.
+const DeviceConfigMap = "volcano-vgpu-device-config"
+
+var (
+	configInfoDesc = prometheus.NewDesc(
+		"vgpu_plugin_config_info",
+		"Runtime configuration the device plugin runs with, by hash, the one of the node annotation",
+		[]string{"hash"}, nil,
+	)
+	configReloadsDesc = prometheus.NewDesc(
+		"vgpu_plugin_config_reloads_total",
+		"Changes of the runtime configuration of the device plugin, by result: applied, restarted when the plugins registered again, invalid or error",
+		[]string{"result"}, nil,
+	)
+	configRestartRequiredDesc = prometheus.NewDesc(
+		"vgpu_plugin_config_restart_required",
+		"Whether the runtime configuration changed in a way only applied once the device plugin is restarted",
+		nil, nil,
+	)
+)
+
+// RuntimeConfig is the configuration of the device plugin the device config
+// and the node config may change while it runs, over the flags.
+type RuntimeConfig struct {
+	// DeviceSplitCount is the number of vGPUs of a GPU the plugins
+	// register with the kubelet, changing it registers them again.
+	DeviceSplitCount uint `json:"deviceSplitCount"`
+	// Mode and FilterDevice decide the devices of the node, listed once
+	// when the plugin starts, they are only applied on its next start.
+	Mode         string               `json:"mode"`
+	FilterDevice *config.FilterDevice `json:"filterDevice,omitempty"`
+	// The others only apply to the next allocations and registrations of
+	// the node annotations.
+	MemoryScaling         config.MemoryScaling `json:"memoryScaling"`
+	DeviceCoresScaling    float64              `json:"deviceCoresScaling"`
+	DisableCoreLimit      bool                 `json:"disableCoreLimit"`
+	DeviceSelectionPolicy string               `json:"deviceSelectionPolicy,omitempty"`
+	Isolation             string               `json:"isolation,omitempty"`
+	// ReservedDevices and WholeDevices only come from the node config,
+	// there are no flags for them. The whole devices are advertised whole,
+	// changing them registers the plugins again.
+	ReservedDevices *config.FilterDevice `json:"reservedDevices,omitempty"`
+	WholeDevices    *config.FilterDevice `json:"wholeDevices,omitempty"`
+}
+
+// runtimeConfig is the RuntimeConfig the plugin runs with, replaced as a
+// whole on every change for the allocations and registrations running
+// meanwhile to keep reading a consistent one.
+var runtimeConfig atomic.Value
+
+// CurrentRuntimeConfig returns the runtime configuration the plugin runs
+// with, the one of the flags before the configuration is loaded.
+func CurrentRuntimeConfig() RuntimeConfig {
+	if c, ok := runtimeConfig.Load().(RuntimeConfig); ok {
+		return c
+	}
+	return FlagsRuntimeConfig()
+}
+
+// FlagsRuntimeConfig returns the runtime configuration of the flags.
+func FlagsRuntimeConfig() RuntimeConfig {
+	return RuntimeConfig{
+		DeviceSplitCount:      config.DeviceSplitCount,
+		Mode:                  config.Mode,
+		FilterDevice:          config.DevicePluginFilterDevice,
+		MemoryScaling:         config.DeviceMemoryScaling,
+		DeviceCoresScaling:    config.DeviceCoresScaling,
+		DisableCoreLimit:      config.DisableCoreLimit,
+		DeviceSelectionPolicy: config.DeviceSelectionPolicy,
+		Isolation:             config.Isolation,
+	}
+}
+
+// NewRuntimeConfig returns the runtime configuration of the device config
+// of the cluster and the config of the node over base, either may be nil.
+func NewRuntimeConfig(base RuntimeConfig, cluster *config.NvidiaConfig, node *config.NodeConfig) RuntimeConfig {
+	res := base
+	if res.Mode == "" {
+		res.Mode = "hami-core"
+	}
+	if cluster != nil {
+		res.MemoryScaling.Cluster = cluster.DeviceMemoryScaling
+		res.MemoryScaling.Models = cluster.DeviceMemoryScalingByModel
+		res.DisableCoreLimit = cluster.DisableCoreLimit
+	}
+	if node == nil {
+		return res
+	}
+	if node.Devicememoryscaling > 0 {
+		res.MemoryScaling.Node = node.Devicememoryscaling
+	}
+	if node.Devicecorescaling > 0 {
+		res.DeviceCoresScaling = node.Devicecorescaling
+	}
+	if node.Devicesplitcount > 0 {
+		res.DeviceSplitCount = node.Devicesplitcount
+	}
+	if node.FilterDevice != nil && (len(node.FilterDevice.UUID) > 0 || len(node.FilterDevice.Index) > 0) {
+		res.FilterDevice = node.FilterDevice
+	}
+	if len(node.OperatingMode) > 0 {
+		res.Mode = node.OperatingMode
+	}
+	if len(node.DeviceSelectionPolicy) > 0 {
+		res.DeviceSelectionPolicy = node.DeviceSelectionPolicy
+	}
+	if len(node.Isolation) > 0 {
+		res.Isolation = node.Isolation
+	}
+	if node.ReservedDevices != nil && (len(node.ReservedDevices.UUID) > 0 || len(node.ReservedDevices.Index) > 0) {
+		res.ReservedDevices = node.ReservedDevices
+	}
+	if node.WholeDevices != nil && (len(node.WholeDevices.UUID) > 0 || len(node.WholeDevices.Index) > 0) {
+		res.WholeDevices = node.WholeDevices
+	}
+	return res
+}
+
+// Validate returns an error if the configuration can't be run with.
+func (c RuntimeConfig) Validate() error {
+	if c.DeviceSplitCount == 0 {
+		return fmt.Errorf("device split count must be positive")
+	}
+	if c.DeviceSelectionPolicy != "" {
+		if _, err := policy.Get(c.DeviceSelectionPolicy); err != nil {
+			return err
+		}
+	}
+	switch c.Isolation {
+	case "", IsolationLibvgpu, IsolationMPS:
+	default:
+		return fmt.Errorf("unknown isolation %q", c.Isolation)
+	}
+	return nil
+}
+
+// Hash returns a short hash of the configuration, the same for the same
+// settings on every node.
+func (c RuntimeConfig) Hash() string {
+	// The maps of the configuration are marshalled with sorted keys.
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Apply sets the configuration of the plugin, read with
+// CurrentRuntimeConfig.
+func (c RuntimeConfig) Apply() {
+	runtimeConfig.Store(c)
+}
+
+// LoadRuntimeConfig reads the device config ConfigMap and the node config
+// file for the runtime configuration over base. A missing ConfigMap or node
+// config leaves the settings of base, failing to read either is an error
+// returned with the configuration of the other.
+func LoadRuntimeConfig(base RuntimeConfig) (RuntimeConfig, error) {
+	var cluster *config.NvidiaConfig
+	var res error
+	configs, err := util.LoadConfigFromCM(DeviceConfigMap)
+	switch {
+	case err == nil:
+		cluster = &configs.NvidiaConfig
+	case !apierrors.IsNotFound(err):
+		res = fmt.Errorf("failed to read ConfigMap %s: %v", DeviceConfigMap, err)
+	}
+	node, err := util.LoadNodeConfig(util.NodeConfigFile, config.NodeName)
+	if err != nil && !os.IsNotExist(err) {
+		res = fmt.Errorf("failed to read node config %s: %v", util.NodeConfigFile, err)
+	}
+	return NewRuntimeConfig(base, cluster, node), res
+}
+
+// ConfigReloader loads the runtime configuration when the plugin starts and
+// follows its changes every interval: those applying to the next allocations
+// are applied right away, a new split count or whole GPU pool once the
+// devices are registered again with the kubelet, while the devices of the node are only listed
+// again on the next start of the plugin.
+type ConfigReloader struct {
+	base     RuntimeConfig
+	interval time.Duration
+	stopCh   chan struct{}
+	// restarts is sent to when the plugins need to register again.
+	restarts chan struct{}
+	// onChange is called after every change applied.
+	onChange func()
+
+	mutex           sync.Mutex
+	active          RuntimeConfig
+	restartRequired bool
+	results         map[string]float64
+}
+
+// NewConfigReloader returns a reloader of the configuration over base, the
+// configuration of the flags, checked every interval, only loaded once when
+// 0.
+func NewConfigReloader(base RuntimeConfig, interval time.Duration) *ConfigReloader {
+	return &ConfigReloader{
+		base:     base,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+		restarts: make(chan struct{}, 1),
+		results:  make(map[string]float64),
+	}
+}
+
+// Load loads and applies the configuration the plugin starts with.
+func (r *ConfigReloader) Load() error {
+	c, err := LoadRuntimeConfig(r.base)
+	if err != nil {
+		klog.Warningf("Starting without the whole runtime configuration: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	c.Apply()
+	r.mutex.Lock()
+	r.active = c
+	r.mutex.Unlock()
+	klog.Infof("Running with runtime configuration %s: %+v", c.Hash(), c)
+	return nil
+}
+
+// OnChange calls fn after every change of the configuration applied.
+func (r *ConfigReloader) OnChange(fn func()) {
+	r.onChange = fn
+}
+
+// Restarts is sent to when the plugins must register with the kubelet again
+// for a change of the configuration.
+func (r *ConfigReloader) Restarts() <-chan struct{} {
+	return r.restarts
+}
+
+// Active returns the configuration the plugin runs with.
+func (r *ConfigReloader) Active() RuntimeConfig {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.active
+}
+
+func (r *ConfigReloader) Start() {
+	if r.interval <= 0 {
+		return
+	}
+	go r.Run()
+}
+
+func (r *ConfigReloader) Stop() {
+	close(r.stopCh)
+}
+
+// Run reloads the configuration every interval until the reloader is stopped.
+func (r *ConfigReloader) Run() {
+	klog.Infof("Reloading the runtime configuration every %v", r.interval)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.Reload()
+		}
+	}
+}
+
+// Reload loads the configuration and applies what changed.
+func (r *ConfigReloader) Reload() {
+	next, err := LoadRuntimeConfig(r.base)
+	if err != nil {
+		klog.Errorf("Failed to reload the runtime configuration: %v", err)
+		r.record("error")
+		return
+	}
+	r.mutex.Lock()
+	prev := r.active
+	// The devices of the node are kept until the plugin restarts.
+	restartRequired := next.Mode != prev.Mode || !reflect.DeepEqual(next.FilterDevice, prev.FilterDevice)
+	if restartRequired && !r.restartRequired {
+		klog.Warningf("The operating mode or the device filter of the node changed to %q and %v, restart the device plugin to apply them",
+			next.Mode, next.FilterDevice)
+	}
+	r.restartRequired = restartRequired
+	next.Mode, next.FilterDevice = prev.Mode, prev.FilterDevice
+	r.mutex.Unlock()
+	if reflect.DeepEqual(next, prev) {
+		return
+	}
+	if err := next.Validate(); err != nil {
+		klog.Errorf("Not applying the runtime configuration %s: %v", next.Hash(), err)
+		r.record("invalid")
+		return
+	}
+	klog.Infof("Applying runtime configuration %s: %+v", next.Hash(), next)
+	next.Apply()
+	r.mutex.Lock()
+	r.active = next
+	r.mutex.Unlock()
+	if next.DeviceSplitCount != prev.DeviceSplitCount || !reflect.DeepEqual(next.WholeDevices, prev.WholeDevices) {
+		r.record("restarted")
+		select {
+		case r.restarts <- struct{}{}:
+		default:
+		}
+	} else {
+		r.record("applied")
+	}
+	if r.onChange != nil {
+		r.onChange()
+	}
+}
+
+func (r *ConfigReloader) record(result string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results[result]++
+}
+
+func (r *ConfigReloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- configInfoDesc
+	ch <- configReloadsDesc
+	ch <- configRestartRequiredDesc
+}
+
+func (r *ConfigReloader) Collect(ch chan<- prometheus.Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(configInfoDesc, prometheus.GaugeValue, 1, r.active.Hash())
+	results := make([]string, 0, len(r.results))
+	for result := range r.results {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	for _, result := range results {
+		ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, r.results[result], result)
+	}
+	restart := 0.0
+	if r.restartRequired {
+		restart = 1
+	}
+	ch <- prometheus.MustNewConstMetric(configRestartRequiredDesc, prometheus.GaugeValue, restart)
+}
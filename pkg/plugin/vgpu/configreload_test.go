@@ -0,0 +1,117 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+)
+
+func TestNewRuntimeConfig(t *testing.T) {
+	base := RuntimeConfig{
+		DeviceSplitCount:   10,
+		MemoryScaling:      config.MemoryScaling{Cluster: 1},
+		DeviceCoresScaling: 1,
+		FilterDevice:       &config.FilterDevice{Index: []uint{0}},
+	}
+	testCases := []struct {
+		base    RuntimeConfig
+		cluster *config.NvidiaConfig
+		node    *config.NodeConfig
+		output  RuntimeConfig
+	}{
+		{
+			base: base,
+			output: RuntimeConfig{
+				DeviceSplitCount:   10,
+				Mode:               "hami-core",
+				MemoryScaling:      config.MemoryScaling{Cluster: 1},
+				DeviceCoresScaling: 1,
+				FilterDevice:       &config.FilterDevice{Index: []uint{0}},
+			},
+		},
+		{
+			base: base,
+			cluster: &config.NvidiaConfig{
+				DeviceMemoryScaling:        2,
+				DeviceMemoryScalingByModel: map[string]float64{"A100": 1.5},
+				DisableCoreLimit:           true,
+			},
+			node: &config.NodeConfig{
+				OperatingMode:         "mig",
+				Devicememoryscaling:   3,
+				Devicecorescaling:     2,
+				Devicesplitcount:      4,
+				DeviceSelectionPolicy: "spread",
+				Isolation:             IsolationMPS,
+				ReservedDevices:       &config.FilterDevice{UUID: []string{"gpu-1"}},
+				WholeDevices:          &config.FilterDevice{Index: []uint{2}},
+			},
+			output: RuntimeConfig{
+				DeviceSplitCount:      4,
+				Mode:                  "mig",
+				FilterDevice:          &config.FilterDevice{Index: []uint{0}},
+				MemoryScaling:         config.MemoryScaling{Cluster: 2, Models: map[string]float64{"A100": 1.5}, Node: 3},
+				DeviceCoresScaling:    2,
+				DisableCoreLimit:      true,
+				DeviceSelectionPolicy: "spread",
+				Isolation:             IsolationMPS,
+				ReservedDevices:       &config.FilterDevice{UUID: []string{"gpu-1"}},
+				WholeDevices:          &config.FilterDevice{Index: []uint{2}},
+			},
+		},
+		{
+			// Empty device filters of the node keep those of base.
+			base: base,
+			node: &config.NodeConfig{FilterDevice: &config.FilterDevice{}, ReservedDevices: &config.FilterDevice{}},
+			output: RuntimeConfig{
+				DeviceSplitCount:   10,
+				Mode:               "hami-core",
+				MemoryScaling:      config.MemoryScaling{Cluster: 1},
+				DeviceCoresScaling: 1,
+				FilterDevice:       &config.FilterDevice{Index: []uint{0}},
+			},
+		},
+		{
+			base: RuntimeConfig{DeviceSplitCount: 10, Mode: "mps"},
+			output: RuntimeConfig{
+				DeviceSplitCount: 10,
+				Mode:             "mps",
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, NewRuntimeConfig(tc.base, tc.cluster, tc.node))
+		})
+	}
+}
+
+func TestCurrentRuntimeConfig(t *testing.T) {
+	defer runtimeConfig.Store(CurrentRuntimeConfig())
+
+	c := RuntimeConfig{DeviceSplitCount: 4, Mode: "hami-core"}
+	c.Apply()
+	require.Equal(t, c, CurrentRuntimeConfig())
+	c.DeviceSplitCount = 8
+	require.Equal(t, uint(4), CurrentRuntimeConfig().DeviceSplitCount)
+}
@@ -0,0 +1,309 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// DrainPath is where the plugin serves the status of the drain of the node.
+const DrainPath = "/api/v1/drain"
+
+// The states of the drain of the node.
+const (
+	DrainServing  = "serving"
+	DrainDraining = util.NodeDraining
+	DrainDrained  = util.NodeDrained
+)
+
+var (
+	drainStateDesc = prometheus.NewDesc(
+		"vgpu_plugin_drain_state",
+		"Whether the device plugin is in the drain state: serving, draining until the vGPU pods of the node finished, or drained",
+		[]string{"state"}, nil,
+	)
+	drainPodsDesc = prometheus.NewDesc(
+		"vgpu_plugin_drain_pods",
+		"Pods of the node still granted vGPUs or whole GPUs while the device plugin drains",
+		nil, nil,
+	)
+)
+
+// draining is 1 while the devices are advertised without capacity for new
+// pods.
+var draining int32
+
+func nodeDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// drainedDevices returns the devices advertised unhealthy, for the kubelet
+// not to grant them to new pods.
+func drainedDevices(devices []*Device) []*Device {
+	res := make([]*Device, 0, len(devices))
+	for _, dev := range devices {
+		d := *dev
+		d.Health = pluginapi.Unhealthy
+		res = append(res, &d)
+	}
+	return res
+}
+
+// DrainStatus is the status of the drain of a node.
+type DrainStatus struct {
+	Node  string `json:"node"`
+	State string `json:"state"`
+	// Started is when the drain started, unset while serving.
+	Started *time.Time `json:"started,omitempty"`
+	// Pods are the pods still granted vGPUs or whole GPUs.
+	Pods []string `json:"pods,omitempty"`
+}
+
+// Drainer drains the device plugin of the node for the maintenance of its
+// GPUs, e.g. a driver upgrade: the devices are advertised without capacity,
+// for the scheduler and the kubelet, until the pods granted some finished or
+// the timeout expired, then the plugin is done. The drain is recorded in the
+// NodeDrainAnnotation of the node, which also starts it when set by hand,
+// and lasts until the annotation is removed, across restarts.
+type Drainer struct {
+	node     string
+	timeout  time.Duration
+	interval time.Duration
+	stopCh   chan struct{}
+	changed  chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mutex   sync.Mutex
+	state   string
+	started time.Time
+	pods    []string
+}
+
+// NewDrainer returns the drainer of node, waiting at most timeout for its
+// pods to finish, for ever when 0.
+func NewDrainer(node string, timeout time.Duration) *Drainer {
+	return &Drainer{
+		node:     node,
+		timeout:  timeout,
+		interval: 10 * time.Second,
+		stopCh:   make(chan struct{}),
+		changed:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		state:    DrainServing,
+	}
+}
+
+// Start resumes the drain the node records, then follows its annotation.
+func (d *Drainer) Start() {
+	d.sync()
+	// The devices are first advertised in the state resumed.
+	select {
+	case <-d.changed:
+	default:
+	}
+	go d.Run()
+}
+
+func (d *Drainer) Stop() {
+	close(d.stopCh)
+}
+
+func (d *Drainer) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+			d.sync()
+		}
+	}
+}
+
+// Changed receives when the drain starts or is cancelled, for the devices to
+// be advertised again.
+func (d *Drainer) Changed() <-chan struct{} {
+	return d.changed
+}
+
+// Done is closed once a drain started by the plugin is over.
+func (d *Drainer) Done() <-chan struct{} {
+	return d.done
+}
+
+// Drain starts the drain of the node.
+func (d *Drainer) Drain() error {
+	if err := lock.NodeUpdates().Patch(d.node, map[string]string{util.NodeDrainAnnotation: util.NodeDraining}, nil); err != nil {
+		return fmt.Errorf("failed to annotate node %s: %v", d.node, err)
+	}
+	d.transition(DrainDraining, time.Now())
+	return nil
+}
+
+// Status returns the status of the drain.
+func (d *Drainer) Status() DrainStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := DrainStatus{Node: d.node, State: d.state, Pods: d.pods}
+	if d.state != DrainServing {
+		started := d.started
+		s.Started = &started
+	}
+	return s
+}
+
+// transition moves the drain to state, the devices being advertised again
+// when they start or stop serving.
+func (d *Drainer) transition(state string, now time.Time) {
+	d.mutex.Lock()
+	prev := d.state
+	if prev == state {
+		d.mutex.Unlock()
+		return
+	}
+	d.state = state
+	if prev == DrainServing {
+		d.started = now
+	}
+	if state == DrainServing {
+		d.pods = nil
+	}
+	d.mutex.Unlock()
+	klog.Infof("Drain of node %s: %s -> %s", d.node, prev, state)
+	if (prev == DrainServing) == (state == DrainServing) {
+		return
+	}
+	if state == DrainServing {
+		atomic.StoreInt32(&draining, 0)
+	} else {
+		atomic.StoreInt32(&draining, 1)
+	}
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// sync follows the annotation of the node and, while draining, waits for its
+// pods to finish.
+func (d *Drainer) sync() {
+	node, err := util.GetNode(d.node)
+	if err != nil {
+		klog.Errorf("Failed to get node %s for its drain: %v", d.node, err)
+		return
+	}
+	annotation, ok := node.Annotations[util.NodeDrainAnnotation]
+	switch {
+	case !ok:
+		d.transition(DrainServing, time.Time{})
+		return
+	case annotation == util.NodeDrained:
+		// A plugin restarted once drained keeps serving nothing.
+		d.transition(DrainDrained, time.Now())
+		return
+	default:
+		d.transition(DrainDraining, time.Now())
+	}
+
+	pods, err := listNodePods(d.node)
+	if err != nil {
+		klog.Errorf("Failed to list the pods of node %s for its drain: %v", d.node, err)
+		return
+	}
+	remaining := drainPods(pods)
+	d.mutex.Lock()
+	d.pods = remaining
+	started := d.started
+	d.mutex.Unlock()
+	timedOut := d.timeout > 0 && time.Since(started) >= d.timeout
+	if len(remaining) > 0 && !timedOut {
+		klog.Infof("Draining node %s, waiting for %d pods: %v", d.node, len(remaining), remaining)
+		return
+	}
+	if len(remaining) > 0 {
+		klog.Warningf("Drain of node %s timed out after %v, %d pods still running: %v", d.node, d.timeout, len(remaining), remaining)
+	}
+	if err := lock.NodeUpdates().Patch(d.node, map[string]string{util.NodeDrainAnnotation: util.NodeDrained}, nil); err != nil {
+		klog.Errorf("Failed to annotate node %s drained: %v", d.node, err)
+		return
+	}
+	d.transition(DrainDrained, time.Now())
+	d.doneOnce.Do(func() { close(d.done) })
+}
+
+// drainPods returns the pods granted vGPUs or whole GPUs, by namespace and
+// name.
+func drainPods(pods []corev1.Pod) []string {
+	whole, err := wholeGrants(pods)
+	if err != nil {
+		klog.Errorf("Failed to read the devices granted whole by the kubelet: %v", err)
+	}
+	var res []string
+	for _, pod := range pods {
+		if len(util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])) > 0 || len(whole[string(pod.UID)]) > 0 {
+			res = append(res, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ServeHTTP returns the status of the drain. The drain is only requested by
+// annotating the node or signalling the plugin, the API being unauthenticated.
+func (d *Drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.Status()); err != nil {
+		klog.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (d *Drainer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- drainStateDesc
+	ch <- drainPodsDesc
+}
+
+func (d *Drainer) Collect(ch chan<- prometheus.Metric) {
+	status := d.Status()
+	for _, state := range []string{DrainServing, DrainDraining, DrainDrained} {
+		value := 0.0
+		if status.State == state {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(drainStateDesc, prometheus.GaugeValue, value, state)
+	}
+	ch <- prometheus.MustNewConstMetric(drainPodsDesc, prometheus.GaugeValue, float64(len(status.Pods)))
+}
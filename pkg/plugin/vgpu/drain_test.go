@@ -0,0 +1,158 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// changed reports whether the drainer signalled a change of the devices.
+func changed(d *Drainer) bool {
+	select {
+	case <-d.Changed():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDrainerTransition(t *testing.T) {
+	defer func() { draining = 0 }()
+	d := NewDrainer("node1", 0)
+	start := time.Unix(1700000000, 0)
+
+	d.transition(DrainServing, start)
+	require.False(t, changed(d))
+	require.Equal(t, DrainStatus{Node: "node1", State: DrainServing}, d.Status())
+
+	d.transition(DrainDraining, start)
+	require.True(t, changed(d))
+	require.True(t, nodeDraining())
+	require.Equal(t, DrainStatus{Node: "node1", State: DrainDraining, Started: &start}, d.Status())
+
+	// The devices stay unadvertised once drained, since the drain started.
+	d.mutex.Lock()
+	d.pods = []string{"ns/pod"}
+	d.mutex.Unlock()
+	d.transition(DrainDrained, start.Add(time.Minute))
+	require.False(t, changed(d))
+	require.True(t, nodeDraining())
+	require.Equal(t, DrainStatus{Node: "node1", State: DrainDrained, Started: &start, Pods: []string{"ns/pod"}}, d.Status())
+
+	d.transition(DrainServing, time.Time{})
+	require.True(t, changed(d))
+	require.False(t, nodeDraining())
+	require.Equal(t, DrainStatus{Node: "node1", State: DrainServing}, d.Status())
+}
+
+func TestDrainerSync(t *testing.T) {
+	defer func() { draining = 0 }()
+	vgpuPod := testPod("vgpu", "node1", "node1", corev1.PodRunning)
+	vgpuPod.Annotations[util.AssignedIDsAnnotations] = util.EncodePodDevices(util.PodDevices{{{UUID: "GPU-0", Type: "NVIDIA", Usedmem: 1024, Usedcores: 10}}})
+	testCases := []struct {
+		annotations map[string]string
+		running     []*corev1.Pod
+		// started is how long ago the drain started, when it did.
+		started time.Duration
+		timeout time.Duration
+		state   string
+		pods    []string
+		// annotation is that of the node after the sync.
+		annotation string
+		done       bool
+	}{
+		{state: DrainServing},
+		{
+			annotations: map[string]string{util.NodeDrainAnnotation: util.NodeDrained},
+			state:       DrainDrained,
+			annotation:  util.NodeDrained,
+		},
+		{
+			annotations: map[string]string{util.NodeDrainAnnotation: util.NodeDraining},
+			running:     []*corev1.Pod{vgpuPod, testPod("cpu", "node1", "", corev1.PodRunning)},
+			state:       DrainDraining,
+			pods:        []string{"ns/vgpu"},
+			annotation:  util.NodeDraining,
+		},
+		{
+			annotations: map[string]string{util.NodeDrainAnnotation: util.NodeDraining},
+			running:     []*corev1.Pod{testPod("cpu", "node1", "", corev1.PodRunning)},
+			state:       DrainDrained,
+			annotation:  util.NodeDrained,
+			done:        true,
+		},
+		{
+			annotations: map[string]string{util.NodeDrainAnnotation: util.NodeDraining},
+			running:     []*corev1.Pod{vgpuPod},
+			started:     time.Hour,
+			timeout:     30 * time.Minute,
+			state:       DrainDrained,
+			pods:        []string{"ns/vgpu"},
+			annotation:  util.NodeDrained,
+			done:        true,
+		},
+		{
+			annotations: map[string]string{util.NodeDrainAnnotation: util.NodeDraining},
+			running:     []*corev1.Pod{vgpuPod},
+			started:     time.Minute,
+			timeout:     30 * time.Minute,
+			state:       DrainDraining,
+			pods:        []string{"ns/vgpu"},
+			annotation:  util.NodeDraining,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: tc.annotations}}
+			objects := []runtime.Object{node}
+			for _, pod := range tc.running {
+				objects = append(objects, pod)
+			}
+			client := useTestClient(t, objects...)
+			d := NewDrainer("node1", tc.timeout)
+			if tc.started > 0 {
+				d.transition(DrainDraining, time.Now().Add(-tc.started))
+			}
+
+			d.sync()
+			status := d.Status()
+			require.Equal(t, tc.state, status.State)
+			require.Equal(t, tc.pods, status.Pods)
+			require.Equal(t, tc.state != DrainServing, nodeDraining())
+			node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tc.annotation, node.Annotations[util.NodeDrainAnnotation])
+			select {
+			case <-d.Done():
+				require.True(t, tc.done)
+			default:
+				require.False(t, tc.done)
+			}
+		})
+	}
+}
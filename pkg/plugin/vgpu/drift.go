@@ -0,0 +1,295 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// VersionDriftCondition is the node condition which is True when the
+// driver, CUDA or VBIOS versions of the node aren't the expected ones.
+const VersionDriftCondition corev1.NodeConditionType = "VGPUVersionDrift"
+
+// Components of the versions checked for drift.
+const (
+	ComponentDriver = "driver"
+	ComponentCUDA   = "cuda"
+	ComponentVBIOS  = "vbios"
+)
+
+// ExpectedVersions are the versions the nodes of a pool must run, an empty
+// one is not checked. A version matches the running ones it is equal to or
+// a prefix of up to a dot, e.g. 535 matches 535.129.03.
+type ExpectedVersions struct {
+	Driver string `yaml:"driver"`
+	CUDA   string `yaml:"cuda"`
+	VBIOS  string `yaml:"vbios"`
+}
+
+// VersionDriftConfig maps the node pools, the values of PoolLabel, to their
+// expected versions, the nodes of the other pools expecting Default.
+type VersionDriftConfig struct {
+	PoolLabel string                      `yaml:"poolLabel"`
+	Default   ExpectedVersions            `yaml:"default"`
+	Pools     map[string]ExpectedVersions `yaml:"pools"`
+}
+
+func LoadVersionDriftConfig(path string) (*VersionDriftConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c VersionDriftConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal version drift config: %v", err)
+	}
+	return &c, nil
+}
+
+// Expected returns the versions expected on a node of the given labels.
+func (c *VersionDriftConfig) Expected(labels map[string]string) ExpectedVersions {
+	if c.PoolLabel != "" {
+		if v, ok := c.Pools[labels[c.PoolLabel]]; ok {
+			return v
+		}
+	}
+	return c.Default
+}
+
+func (e ExpectedVersions) of(component string) string {
+	switch component {
+	case ComponentDriver:
+		return e.Driver
+	case ComponentCUDA:
+		return e.CUDA
+	case ComponentVBIOS:
+		return e.VBIOS
+	}
+	return ""
+}
+
+func versionMatches(expected, running string) bool {
+	return expected == "" || running == expected || strings.HasPrefix(running, expected+".")
+}
+
+// VersionDrift is a version found different from the expected one, Device
+// is empty for the versions of the node.
+type VersionDrift struct {
+	Component string
+	Device    string
+	Expected  string
+	Running   string
+}
+
+// runningVersion is a version of the node or, for the VBIOS, of a device.
+type runningVersion struct {
+	component string
+	device    string
+	version   string
+}
+
+func runningVersions(devices []*Device) []runningVersion {
+	var res []runningVersion
+	if v, ret := config.Nvml().SystemGetDriverVersion(); ret == nvml.SUCCESS {
+		res = append(res, runningVersion{component: ComponentDriver, version: v})
+	} else {
+		klog.Warningf("Failed to get driver version: %v", ret)
+	}
+	if v, ret := config.Nvml().SystemGetCudaDriverVersion(); ret == nvml.SUCCESS {
+		res = append(res, runningVersion{component: ComponentCUDA, version: fmt.Sprintf("%d.%d", v/1000, v%1000/10)})
+	} else {
+		klog.Warningf("Failed to get CUDA driver version: %v", ret)
+	}
+	for _, d := range devices {
+		ndev, ret := config.Nvml().DeviceGetHandleByUUID(d.ID)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if v, ret := config.Nvml().DeviceGetVbiosVersion(ndev); ret == nvml.SUCCESS {
+			res = append(res, runningVersion{component: ComponentVBIOS, device: d.ID, version: v})
+		}
+	}
+	return res
+}
+
+// FindVersionDrift compares the running versions with the expected ones.
+func FindVersionDrift(expected ExpectedVersions, running []runningVersion) []VersionDrift {
+	var drift []VersionDrift
+	for _, r := range running {
+		e := expected.of(r.component)
+		if !versionMatches(e, r.version) {
+			drift = append(drift, VersionDrift{Component: r.component, Device: r.device, Expected: e, Running: r.version})
+		}
+	}
+	return drift
+}
+
+var (
+	versionInfoDesc = prometheus.NewDesc(
+		"vgpu_node_version_info",
+		"Running driver, CUDA and VBIOS versions of the node, the VBIOS ones by device",
+		[]string{"component", "deviceuuid", "version"}, nil,
+	)
+	versionDriftDesc = prometheus.NewDesc(
+		"vgpu_node_version_drift",
+		"1 when a running version differs from the expected one of the node pool",
+		[]string{"component", "deviceuuid", "expected", "running"}, nil,
+	)
+)
+
+// VersionDriftChecker exports the versions of the node and their drift and
+// reflects it in the VGPUVersionDrift condition of the node.
+type VersionDriftChecker struct {
+	deviceCache *DeviceCache
+	config      *VersionDriftConfig
+	interval    time.Duration
+	stopCh      chan struct{}
+
+	mutex    sync.Mutex
+	running  []runningVersion
+	expected ExpectedVersions
+}
+
+func NewVersionDriftChecker(deviceCache *DeviceCache, path string, interval time.Duration) (*VersionDriftChecker, error) {
+	c, err := LoadVersionDriftConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	checker := &VersionDriftChecker{
+		deviceCache: deviceCache,
+		config:      c,
+		interval:    interval,
+		stopCh:      make(chan struct{}),
+	}
+	prometheus.MustRegister(checker)
+	return checker, nil
+}
+
+func (c *VersionDriftChecker) Start() {
+	go c.Run()
+}
+
+func (c *VersionDriftChecker) Stop() {
+	close(c.stopCh)
+}
+
+// Check compares the running versions with the ones expected on the node
+// and updates its condition.
+func (c *VersionDriftChecker) Check() error {
+	node, err := util.GetNode(config.NodeName)
+	if err != nil {
+		return err
+	}
+	expected := c.config.Expected(node.Labels)
+	running := runningVersions(c.deviceCache.GetCache())
+	drift := FindVersionDrift(expected, running)
+
+	c.mutex.Lock()
+	c.running, c.expected = running, expected
+	c.mutex.Unlock()
+
+	cond := corev1.NodeCondition{
+		Type:    VersionDriftCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  "VersionsExpected",
+		Message: "driver, CUDA and VBIOS versions are the expected ones",
+	}
+	if len(drift) > 0 {
+		var msgs []string
+		for _, d := range drift {
+			what := d.Component
+			if d.Device != "" {
+				what += " of " + d.Device
+			}
+			msgs = append(msgs, fmt.Sprintf("%s is %s, expected %s", what, d.Running, d.Expected))
+		}
+		cond.Status, cond.Reason, cond.Message = corev1.ConditionTrue, "VersionMismatch", strings.Join(msgs, "; ")
+		klog.Warningf("Versions of node %s drifted: %s", config.NodeName, cond.Message)
+	}
+	return setNodeCondition(node, cond)
+}
+
+// setNodeCondition sets the condition of the node unless it already has it
+// with the same status and message.
+func setNodeCondition(node *corev1.Node, cond corev1.NodeCondition) error {
+	for _, old := range node.Status.Conditions {
+		if old.Type == cond.Type && old.Status == cond.Status && old.Message == cond.Message {
+			return nil
+		}
+	}
+	now := metav1.Now()
+	cond.LastHeartbeatTime, cond.LastTransitionTime = now, now
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"conditions": []corev1.NodeCondition{cond}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = lock.GetClient().CoreV1().Nodes().PatchStatus(context.Background(), node.Name, patch)
+	return err
+}
+
+// Run checks the versions every interval until stopped.
+func (c *VersionDriftChecker) Run() {
+	klog.Infof("Checking the driver, CUDA and VBIOS versions of node %s every %v", config.NodeName, c.interval)
+	for {
+		if err := c.Check(); err != nil {
+			klog.Errorf("Failed to check version drift: %v", err)
+		}
+		select {
+		case <-c.stopCh:
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+func (c *VersionDriftChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- versionInfoDesc
+	ch <- versionDriftDesc
+}
+
+func (c *VersionDriftChecker) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, r := range c.running {
+		ch <- prometheus.MustNewConstMetric(versionInfoDesc, prometheus.GaugeValue, 1, r.component, r.device, r.version)
+		e := c.expected.of(r.component)
+		drift := 0.0
+		if !versionMatches(e, r.version) {
+			drift = 1
+		}
+		ch <- prometheus.MustNewConstMetric(versionDriftDesc, prometheus.GaugeValue, drift, r.component, r.device, e, r.version)
+	}
+}
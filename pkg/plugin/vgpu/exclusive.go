@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+const (
+	// ModeAnnotation selects how the vGPUs of a pod share their devices with
+	// the other pods, shared by default.
+	ModeAnnotation = "volcano.sh/vgpu-mode"
+	// ModeExclusive grants every vGPU of the pod all the memory and cores
+	// of its device, which no other pod may share, still through libvgpu
+	// and the vGPU resources.
+	ModeExclusive = "exclusive"
+)
+
+func exclusiveMode(pod *corev1.Pod) bool {
+	return pod.Annotations[ModeAnnotation] == ModeExclusive
+}
+
+// grantExclusive grants the containers of an exclusive pod the whole of the
+// devices the scheduler assigned them, failing when another pod has a vGPU
+// of one of them. The grants are written in the assigned devices of the pod
+// for the scheduler to account for them.
+func (m *NvidiaDevicePlugin) grantExclusive(nodename string, a *podAllocation) error {
+	pods, err := listNodePods(nodename)
+	if err != nil {
+		return err
+	}
+	byUUID := make(map[string]*policy.Device)
+	for _, d := range nodeLedger(m.Devices(), pods, a.pod.UID) {
+		byUUID[d.ID] = d
+	}
+	whole := make(map[string]*policy.Device)
+	for i, c := range a.pending {
+		if c.init {
+			continue
+		}
+		devices := make(util.ContainerDevices, 0, len(c.devices))
+		for _, dev := range c.devices {
+			d, ok := byUUID[dev.UUID]
+			if !ok {
+				return fmt.Errorf("exclusive pod assigned unknown device %s", dev.UUID)
+			}
+			if d.Used > 0 {
+				return fmt.Errorf("exclusive pod assigned device %s shared by %d vGPUs of other pods", dev.UUID, d.Used)
+			}
+			dev.Usedmem, dev.Usedcores = d.Totalmem, d.Totalcore
+			devices = append(devices, dev)
+			whole[dev.UUID] = d
+		}
+		a.pending[i].devices = devices
+	}
+
+	assigned := util.DecodePodDevices(a.pod.Annotations[util.AssignedIDsAnnotations])
+	changed := false
+	for _, ctr := range assigned {
+		for i, dev := range ctr {
+			if d, ok := whole[dev.UUID]; ok && (dev.Usedmem != d.Totalmem || dev.Usedcores != d.Totalcore) {
+				ctr[i].Usedmem, ctr[i].Usedcores = d.Totalmem, d.Totalcore
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	encoded := util.EncodePodDevices(assigned)
+	if err := util.PatchPodAnnotations(a.pod, map[string]string{util.AssignedIDsAnnotations: encoded}); err != nil {
+		return err
+	}
+	klog.Infof("Granted exclusive pod %s/%s its whole devices: %s", a.pod.Namespace, a.pod.Name, encoded)
+	a.pod.Annotations[util.AssignedIDsAnnotations] = encoded
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// DeviceFailedReason is the reason of the events of a GPU marked unhealthy,
+// on the node and on the pods granted a vGPU of it.
+const DeviceFailedReason = "VGPUDeviceFailed"
+
+// lostDeviceInterval is the interval between two probes of the GPUs for
+// the ones gone from the bus, which may not raise an Xid.
+const lostDeviceInterval = 10 * time.Second
+
+// watchLostDevices marks unhealthy the devices NVML lost, a GPU which fell
+// off the bus or was unplugged.
+func watchLostDevices(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+	if strings.ToLower(os.Getenv(envDisableHealthChecks)) == "all" {
+		return
+	}
+	lost := make(map[string]bool)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(lostDeviceInterval):
+		}
+		for _, d := range devices {
+			if lost[d.ID] {
+				continue
+			}
+			if ret := probeDevice(d); ret == nvml.ERROR_GPU_IS_LOST || ret == nvml.ERROR_NOT_FOUND {
+				klog.Warningf("Device %s is lost: %v; marking it unhealthy", d.ID, ret)
+				lost[d.ID] = true
+				unhealthy <- d
+			}
+		}
+	}
+}
+
+// probeDevice queries the device, returning the error of NVML.
+func probeDevice(d *Device) nvml.Return {
+	uuid, _, _, err := getDevicePlacement(d)
+	if err != nil {
+		return nvml.SUCCESS
+	}
+	h, ret := config.Nvml().DeviceGetHandleByUUID(uuid)
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	_, ret = config.Nvml().DeviceGetUUID(h)
+	return ret
+}
+
+// DeviceFailureHandler reports the GPUs marked unhealthy with events of the
+// node and of the pods granted a vGPU of them, and optionally evicts these
+// pods for them to be scheduled on healthy GPUs.
+type DeviceFailureHandler struct {
+	deviceCache *DeviceCache
+	evict       bool
+	unhealthy   chan *Device
+	stopCh      chan struct{}
+
+	mutex  sync.Mutex
+	failed map[string]bool
+}
+
+func NewDeviceFailureHandler(deviceCache *DeviceCache, evict bool) *DeviceFailureHandler {
+	return &DeviceFailureHandler{
+		deviceCache: deviceCache,
+		evict:       evict,
+		unhealthy:   make(chan *Device, 16),
+		stopCh:      make(chan struct{}),
+		failed:      make(map[string]bool),
+	}
+}
+
+func (h *DeviceFailureHandler) Start() {
+	h.deviceCache.AddNotifyChannel("failure", h.unhealthy)
+	go h.Run()
+}
+
+func (h *DeviceFailureHandler) Stop() {
+	h.deviceCache.RemoveNotifyChannel("failure")
+	close(h.stopCh)
+}
+
+// Run handles the unhealthy devices until stopped, every device once.
+func (h *DeviceFailureHandler) Run() {
+	for {
+		select {
+		case <-h.stopCh:
+			return
+		case d := <-h.unhealthy:
+			h.mutex.Lock()
+			failed := h.failed[d.ID]
+			h.failed[d.ID] = true
+			h.mutex.Unlock()
+			if !failed {
+				h.handle(d)
+			}
+		}
+	}
+}
+
+func (h *DeviceFailureHandler) handle(d *Device) {
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		klog.Errorf("Failed to list the pods of failed device %s: %v", d.ID, err)
+	}
+	bound := devicePods(pods, d.ID)
+	names := make([]string, 0, len(bound))
+	for _, pod := range bound {
+		names = append(names, pod.Namespace+"/"+pod.Name)
+	}
+	msg := fmt.Sprintf("GPU %s is unhealthy", d.ID)
+	if len(names) > 0 {
+		msg += ", granted to " + strings.Join(names, ", ")
+	}
+	klog.Warning(msg)
+	recordEvent(corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: config.NodeName, UID: types.UID(config.NodeName)}, msg)
+	for _, pod := range bound {
+		ref := corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+		podMsg := fmt.Sprintf("GPU %s of the pod is unhealthy", d.ID)
+		if h.evict {
+			podMsg += ", evicting the pod"
+		}
+		recordEvent(ref, podMsg)
+		if !h.evict {
+			continue
+		}
+		err := lock.GetClient().CoreV1().Pods(pod.Namespace).Evict(context.Background(), &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+		})
+		if err != nil {
+			klog.Errorf("Failed to evict pod %s/%s of failed device %s: %v", pod.Namespace, pod.Name, d.ID, err)
+			continue
+		}
+		klog.Infof("Evicted pod %s/%s of failed device %s", pod.Namespace, pod.Name, d.ID)
+	}
+}
+
+// devicePods returns the pods granted a vGPU of the device.
+func devicePods(pods []corev1.Pod, uuid string) []*corev1.Pod {
+	var res []*corev1.Pod
+	for i := range pods {
+		found := false
+		for _, ctr := range util.DecodePodDevices(pods[i].Annotations[util.AssignedIDsAnnotations]) {
+			for _, cd := range ctr {
+				if cd.UUID == uuid {
+					found = true
+				}
+			}
+		}
+		if found {
+			res = append(res, &pods[i])
+		}
+	}
+	return res
+}
+
+// recordEvent records a warning event of the object.
+func recordEvent(ref corev1.ObjectReference, msg string) {
+	now := metav1.NewTime(time.Now())
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: ref,
+		Reason:         DeviceFailedReason,
+		Message:        msg,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "volcano-vgpu-device-plugin", Host: config.NodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := lock.GetClient().CoreV1().Events(namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		klog.Errorf("Failed to record the event of %s %s: %v", ref.Kind, ref.Name, err)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// podMemoryFallback reports whether the vGPUs of the pod spill to host
+// memory. Only the pods of a priority lower than high may, the others keep
+// the memory of their GPU to themselves.
+func podMemoryFallback(pod *corev1.Pod) (bool, error) {
+	switch mode := pod.Annotations[util.MemoryFallbackAnnotation]; mode {
+	case "", util.MemoryFallbackNone:
+		return false, nil
+	case util.MemoryFallbackHost:
+	default:
+		return false, fmt.Errorf("unknown vGPU memory fallback %q of annotation %s, expected %s or %s",
+			mode, util.MemoryFallbackAnnotation, util.MemoryFallbackHost, util.MemoryFallbackNone)
+	}
+	priority, ok, err := podTaskPriority(pod)
+	if err != nil {
+		return false, err
+	}
+	if ok && priority == 0 {
+		return false, fmt.Errorf("vGPU memory fallback of annotation %s is not allowed for the pods of %s priority %s",
+			util.MemoryFallbackAnnotation, util.TaskPriorityAnnotation, util.TaskPriorityClasses[0])
+	}
+	return true, nil
+}
+
+// checkMemoryFallback returns an error if the memory fallback annotation of
+// the pod isn't a known mode or isn't allowed for its priority.
+func checkMemoryFallback(a *podAllocation) error {
+	_, err := podMemoryFallback(a.pod)
+	return err
+}
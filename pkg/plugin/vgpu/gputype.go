@@ -0,0 +1,68 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// checkGPUTypes verifies that the devices of the containers of the pod are
+// of the GPU models its annotations allow.
+func checkGPUTypes(a *podAllocation) error {
+	include, exclude := util.GPUTypeFilters(a.pod.Annotations)
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	for _, c := range a.pending {
+		if c.init {
+			continue
+		}
+		for _, dev := range c.devices {
+			model := deviceModel(dev.UUID)
+			if !util.MatchGPUType(model, include, exclude) {
+				return fmt.Errorf("device %s of container %s is a %q, not a GPU type the pod allows: include %v, exclude %v",
+					dev.UUID, c.container.Name, model, include, exclude)
+			}
+		}
+	}
+	return nil
+}
+
+// deviceModel returns the NVML name of the device.
+func deviceModel(uuid string) string {
+	return strings.TrimPrefix(deviceType(uuid), util.NvidiaGPUDevice+"-")
+}
+
+// encodeNodeGPUTypes encodes the models of the devices for
+// NodeGPUTypesAnnotation.
+func encodeNodeGPUTypes(devices []*util.DeviceInfo) string {
+	seen := make(map[string]bool)
+	var models []string
+	for _, d := range devices {
+		model := strings.TrimPrefix(d.Type, util.NvidiaGPUDevice+"-")
+		if !seen[model] {
+			seen[model] = true
+			models = append(models, model)
+		}
+	}
+	sort.Strings(models)
+	return strings.Join(models, ",")
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/slo"
+)
+
+// AllocationLatency records the bind and allocate phases of the handshakes
+// of the pods of the node.
+var AllocationLatency = slo.NewRecorder()
+
+// beginHandshake reads the correlation ID and the assignment time of the
+// pod, a pod seen for the first time gets a new correlation ID unless the
+// scheduler gave it one, and its bind phase is observed.
+func (a *podAllocation) beginHandshake() {
+	annotations := a.pod.Annotations
+	a.correlationID = annotations[util.CorrelationIDAnnotation]
+	if a.correlationID == "" {
+		a.correlationID = string(uuid.NewUUID())
+	}
+	if t, ok := slo.ParseTime(annotations[util.HandshakeStartAnnotation]); ok {
+		// The plugin restarted in the middle of the allocation of the pod.
+		a.assigned = t
+		return
+	}
+	if t, ok := slo.ParseTime(annotations[util.AssignedTimeAnnotations]); ok {
+		a.assigned = t
+		AllocationLatency.Observe(slo.PhaseBind, a.correlationID, a.started.Sub(t))
+	}
+}
+
+// handshakeAnnotations returns the annotations propagating the handshake to
+// the monitor, with the allocated time once no container is left, when the
+// allocate phase is observed.
+func (a *podAllocation) handshakeAnnotations(now time.Time) map[string]string {
+	res := map[string]string{util.CorrelationIDAnnotation: a.correlationID}
+	if !a.assigned.IsZero() {
+		res[util.HandshakeStartAnnotation] = slo.FormatTime(a.assigned)
+	}
+	if len(a.pending) == 0 {
+		res[util.AllocatedTimeAnnotation] = slo.FormatTime(now)
+		AllocationLatency.Observe(slo.PhaseAllocate, a.correlationID, now.Sub(a.started))
+	}
+	return res
+}
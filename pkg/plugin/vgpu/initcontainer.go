@@ -0,0 +1,134 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// requestsVGPU returns the number of vGPUs the container requests.
+func requestsVGPU(ctr corev1.Container) int {
+	count, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceName)]
+	if !ok {
+		return 0
+	}
+	return int(count.Value())
+}
+
+// podGrantedDevices merges the devices of dtype assigned to the containers
+// of the pod, a device granted to several of them once with the sum of
+// their grants, the devices granted the most memory first.
+func podGrantedDevices(dtype string, assigned util.PodDevices) util.ContainerDevices {
+	var res util.ContainerDevices
+	index := make(map[string]int)
+	for _, ctr := range assigned {
+		for _, dev := range ctr {
+			if dev.Type != dtype {
+				continue
+			}
+			i, ok := index[dev.UUID]
+			if !ok {
+				index[dev.UUID] = len(res)
+				res = append(res, dev)
+				continue
+			}
+			res[i].Usedmem += dev.Usedmem
+			res[i].Usedcores += dev.Usedcores
+			if res[i].Usedcores > 100 {
+				res[i].Usedcores = 100
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Usedmem > res[j].Usedmem
+	})
+	return res
+}
+
+// initContainerDevices returns the devices of an init container requesting
+// vGPUs. The scheduler assigns devices to the containers of the pod only, an
+// init container runs to completion before them and, as the kubelet does
+// with device IDs, reuses what they are granted: it gets the devices most
+// granted to the pod, limited to the memory and cores it requests, capped
+// by what the pod is granted on each. A memory percentage is of the devices
+// of the ledger.
+func initContainerDevices(dtype string, ctr corev1.Container, assigned util.PodDevices, ledger []*policy.Device) (util.ContainerDevices, error) {
+	count := requestsVGPU(ctr)
+	granted := podGrantedDevices(dtype, assigned)
+	if count > len(granted) {
+		return nil, fmt.Errorf("init container %s requests %d vGPUs, its pod is granted %d devices", ctr.Name, count, len(granted))
+	}
+	req := &util.ContainerDeviceRequest{}
+	if q, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceMem)]; ok {
+		req.Memreq = int32(q.Value())
+	}
+	if q, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceMemPercentage)]; ok {
+		req.MemPercentagereq = int32(q.Value())
+	}
+	byUUID := make(map[string]*policy.Device, len(ledger))
+	for _, d := range ledger {
+		byUUID[d.ID] = d
+	}
+	var cores int32
+	if q, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceCores)]; ok {
+		cores = int32(q.Value())
+	}
+	res := make(util.ContainerDevices, 0, count)
+	for _, dev := range granted[:count] {
+		var mem int32
+		if d, ok := byUUID[dev.UUID]; ok && (req.Memreq > 0 || req.MemPercentagereq > 0) {
+			mem = policy.RequestMemory(req, d)
+		} else {
+			mem = req.Memreq
+		}
+		if mem > 0 && mem < dev.Usedmem {
+			dev.Usedmem = mem
+		}
+		// No cores granted is no limit.
+		if cores > 0 && (dev.Usedcores == 0 || cores < dev.Usedcores) {
+			dev.Usedcores = cores
+		}
+		res = append(res, dev)
+	}
+	return res, nil
+}
+
+// initContainerAllocations returns the init containers of the pod with the
+// vGPUs they request, in the order the kubelet allocates them, before the
+// containers of the pod.
+func initContainerAllocations(dtype string, pod *corev1.Pod, devices []*Device) ([]containerAllocation, error) {
+	ledger := nodeLedger(devices, nil, "")
+	var res []containerAllocation
+	assigned := util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+	for _, ctr := range pod.Spec.InitContainers {
+		if requestsVGPU(ctr) == 0 {
+			continue
+		}
+		devices, err := initContainerDevices(dtype, ctr, assigned, ledger)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, containerAllocation{container: ctr, devices: devices, init: true})
+	}
+	return res, nil
+}
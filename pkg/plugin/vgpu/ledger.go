@@ -0,0 +1,180 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// listNodePods returns the pods bound or assigned by the scheduler to the
+// node which are still running or about to run, read from the cache of the
+// pods of the node.
+func listNodePods(nodename string) ([]corev1.Pod, error) {
+	pods, err := nodePods(nodename).List()
+	if err != nil {
+		return nil, err
+	}
+	var res []corev1.Pod
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		res = append(res, *pod.DeepCopy())
+	}
+	return res, nil
+}
+
+// nodeLedger returns the devices with the vGPUs, memory and cores granted to
+// the pods, as recorded in their assigned devices annotation. The memory is
+// counted in blocks of config.GPUMemoryFactor MiB like in the annotations,
+// that of a device scaled by its overcommit. The pod exclude, usually the one being allocated, is not counted.
+func nodeLedger(devices []*Device, pods []corev1.Pod, exclude types.UID) []*policy.Device {
+	factor := int32(config.GPUMemoryFactor)
+	if factor == 0 {
+		factor = 1
+	}
+	cfg := CurrentRuntimeConfig()
+	switches := pcieSwitches(devices)
+	res := make([]*policy.Device, 0, len(devices))
+	byUUID := make(map[string]*policy.Device, len(devices))
+	for _, d := range devices {
+		index, _ := strconv.Atoi(d.Index)
+		devtype := deviceType(d.ID)
+		pd := &policy.Device{
+			ID:         d.ID,
+			Index:      index,
+			Type:       devtype,
+			Health:     d.Health == "" || strings.EqualFold(d.Health, "healthy"),
+			Numa:       -1,
+			Switch:     -1,
+			Count:      int32(cfg.DeviceSplitCount),
+			Totalmem:   int32(float64(int32(d.Memory)/factor) * cfg.MemoryScaling.Of(devtype)),
+			Totalcore:  int32(float64(util.DeviceLimit) * cfg.DeviceCoresScaling),
+			Namespaces: make(map[string]int32),
+		}
+		if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+			pd.Numa = int(d.Topology.Nodes[0].ID)
+		}
+		if sw, ok := switches[d.ID]; ok {
+			pd.Switch = sw
+		}
+		res = append(res, pd)
+		byUUID[d.ID] = pd
+	}
+	for _, pod := range pods {
+		if pod.UID == exclude {
+			continue
+		}
+		for _, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			for _, cd := range ctr {
+				pd, ok := byUUID[cd.UUID]
+				if !ok {
+					continue
+				}
+				pd.Used++
+				pd.Usedmem += cd.Usedmem
+				pd.Usedcores += cd.Usedcores
+				pd.Namespaces[pod.Namespace]++
+			}
+		}
+	}
+	return res
+}
+
+// deviceType returns the type the device is registered with in the node
+// annotation.
+func deviceType(uuid string) string {
+	ndev, ret := config.Nvml().DeviceGetHandleByUUID(uuid)
+	if ret != nvml.SUCCESS {
+		return ""
+	}
+	model, ret := config.Nvml().DeviceGetName(ndev)
+	if ret != nvml.SUCCESS {
+		return ""
+	}
+	return fmt.Sprintf("%v-%v", util.NvidiaGPUDevice, model)
+}
+
+// copyLedger returns a copy of the ledger which can be granted devices.
+func copyLedger(ledger []*policy.Device) []*policy.Device {
+	res := make([]*policy.Device, 0, len(ledger))
+	for _, d := range ledger {
+		c := *d
+		c.Namespaces = make(map[string]int32, len(d.Namespaces))
+		for ns, n := range d.Namespaces {
+			c.Namespaces[ns] = n
+		}
+		res = append(res, &c)
+	}
+	return res
+}
+
+// grantDevices accounts the devices granted to a container of a pod of
+// namespace in the ledger.
+func grantDevices(ledger []*policy.Device, namespace string, devreq util.ContainerDevices) {
+	for _, cd := range devreq {
+		for _, d := range ledger {
+			if d.ID == cd.UUID {
+				d.Used++
+				d.Usedmem += cd.Usedmem
+				d.Usedcores += cd.Usedcores
+				d.Namespaces[namespace]++
+				break
+			}
+		}
+	}
+}
+
+// checkPlacement verifies with the allocation policy that the devices the
+// scheduler assigned to the container are acceptable on the ledger, which
+// is left untouched.
+func (m *NvidiaDevicePlugin) checkPlacement(ledger []*policy.Device, current *corev1.Pod, devreq util.ContainerDevices) error {
+	ledger = copyLedger(ledger)
+	for _, cd := range devreq {
+		var dev *policy.Device
+		for _, d := range ledger {
+			if d.ID == cd.UUID {
+				dev = d
+				break
+			}
+		}
+		if dev == nil {
+			return fmt.Errorf("device %s is not managed by this plugin", cd.UUID)
+		}
+		req := &util.ContainerDeviceRequest{
+			Nums:     int32(len(devreq)),
+			Type:     cd.Type,
+			Memreq:   cd.Usedmem,
+			Coresreq: cd.Usedcores,
+		}
+		if !m.allocationPolicy.Filter(req, dev) {
+			return fmt.Errorf("allocation policy %s rejects device %s", m.allocationPolicy.Name(), cd.UUID)
+		}
+		// The next device of the same request sees this one granted.
+		grantDevices(ledger, current.Namespace, util.ContainerDevices{cd})
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// MemorySplitAnnotation sets the memory of each vGPU of the containers of a
+// pod, semicolon separated container=memory,memory,... entries in the unit
+// of volcano.sh/vgpu-memory, e.g. trainer=8000,4000. A pod with a single
+// vGPU container may leave the container out.
+const MemorySplitAnnotation = "volcano.sh/vgpu-memory-split"
+
+// parseMemorySplit returns the memory of the vGPUs of every container of the
+// split annotation, by container name, the empty name standing for the only
+// vGPU container of the pod.
+func parseMemorySplit(value string) (map[string][]int32, error) {
+	res := make(map[string][]int32)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, list := "", entry
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			name, list = strings.TrimSpace(parts[0]), parts[1]
+		}
+		var memory []int32
+		for _, s := range strings.Split(list, ",") {
+			mem, err := strconv.ParseInt(strings.TrimSpace(s), 10, 32)
+			if err != nil || mem <= 0 {
+				return nil, fmt.Errorf("invalid vGPU memory %q in %q", s, entry)
+			}
+			memory = append(memory, int32(mem))
+		}
+		res[name] = memory
+	}
+	if _, ok := res[""]; ok && len(res) > 1 {
+		return nil, fmt.Errorf("vGPU memory split %q mixes entries with and without container", value)
+	}
+	return res, nil
+}
+
+// splitMemory grants the vGPUs of the containers of the pod the memory of
+// the split annotation, each on a distinct device, out of what the scheduler
+// granted them. The grants are written in the assigned devices of the pod
+// for the scheduler to account for the memory left over.
+func (m *NvidiaDevicePlugin) splitMemory(a *podAllocation) error {
+	value, ok := a.pod.Annotations[MemorySplitAnnotation]
+	if !ok {
+		return nil
+	}
+	split, err := parseMemorySplit(value)
+	if err != nil {
+		return err
+	}
+	if memory, ok := split[""]; ok {
+		if n := countVGPUContainers(a.pod); n != 1 {
+			return fmt.Errorf("vGPU memory split %q has no container but the pod has %d vGPU containers", value, n)
+		}
+		for _, c := range a.pending {
+			if !c.init {
+				split = map[string][]int32{c.container.Name: memory}
+			}
+		}
+	}
+
+	assigned := util.DecodePodDevices(a.pod.Annotations[util.AssignedIDsAnnotations])
+	changed := false
+	for i, c := range a.pending {
+		memory, ok := split[c.container.Name]
+		if c.init || !ok {
+			continue
+		}
+		if len(memory) != len(c.devices) {
+			return fmt.Errorf("vGPU memory split of container %s has %d values for %d vGPUs", c.container.Name, len(memory), len(c.devices))
+		}
+		seen := make(map[string]bool)
+		devices := make(util.ContainerDevices, 0, len(c.devices))
+		for j, dev := range c.devices {
+			if seen[dev.UUID] {
+				return fmt.Errorf("vGPUs of container %s with split memory share device %s", c.container.Name, dev.UUID)
+			}
+			seen[dev.UUID] = true
+			if memory[j] > dev.Usedmem {
+				return fmt.Errorf("vGPU %d of container %s is split %d memory out of the %d granted, request the largest as %s",
+					j, c.container.Name, memory[j], dev.Usedmem, util.ResourceMem)
+			}
+			if memory[j] != dev.Usedmem {
+				dev.Usedmem = memory[j]
+				changed = true
+			}
+			devices = append(devices, dev)
+		}
+		a.pending[i].devices = devices
+		for idx, ctr := range a.pod.Spec.Containers {
+			if ctr.Name != c.container.Name {
+				continue
+			}
+			if idx < len(assigned) {
+				assigned[idx] = replaceDevices(assigned[idx], devices)
+			}
+			if idx < len(a.toAllocate) {
+				a.toAllocate[idx] = replaceDevices(a.toAllocate[idx], devices)
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	encoded := util.EncodePodDevices(assigned)
+	if err := util.PatchPodAnnotations(a.pod, map[string]string{
+		util.AssignedIDsAnnotations:           encoded,
+		util.AssignedIDsToAllocateAnnotations: util.EncodePodDevices(a.toAllocate),
+	}); err != nil {
+		return err
+	}
+	klog.Infof("Split the vGPU memory of pod %s/%s: %s", a.pod.Namespace, a.pod.Name, encoded)
+	a.pod.Annotations[util.AssignedIDsAnnotations] = encoded
+	return nil
+}
+
+// countVGPUContainers returns the number of containers of the pod requesting
+// vGPUs.
+func countVGPUContainers(pod *corev1.Pod) int {
+	n := 0
+	for _, ctr := range pod.Spec.Containers {
+		if count, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceName)]; ok && count.Value() > 0 {
+			n++
+		}
+	}
+	return n
+}
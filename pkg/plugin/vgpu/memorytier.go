@@ -0,0 +1,85 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+)
+
+var (
+	memoryTierCapacityDesc = prometheus.NewDesc(
+		"vgpu_device_memory_tier_capacity_bytes",
+		"Memory a GPU registers, by tier: its own or the system RAM it shares",
+		[]string{"deviceuuid", "tier", "source"}, nil,
+	)
+	memoryTierGrantedDesc = prometheus.NewDesc(
+		"vgpu_device_memory_tier_granted_bytes",
+		"Memory granted to the vGPUs of a GPU, split between its tiers in proportion to their size",
+		[]string{"deviceuuid", "tier", "source"}, nil,
+	)
+)
+
+// MemoryTierCollector exports the memory tiers of the GPUs of the node and
+// how much of each the vGPUs are granted.
+type MemoryTierCollector struct {
+	deviceCache *DeviceCache
+}
+
+func NewMemoryTierCollector(deviceCache *DeviceCache) *MemoryTierCollector {
+	return &MemoryTierCollector{deviceCache: deviceCache}
+}
+
+func (c *MemoryTierCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- memoryTierCapacityDesc
+	ch <- memoryTierGrantedDesc
+}
+
+func (c *MemoryTierCollector) Collect(ch chan<- prometheus.Metric) {
+	devices := c.deviceCache.GetCache()
+	tiers := make(map[string]config.MemoryTiers, len(devices))
+	for _, d := range devices {
+		t := d.Tiers
+		if t.Tier == "" {
+			t = config.MemoryTiers{Tier: config.MemoryTierDedicated, Device: d.Memory * 1024 * 1024}
+		}
+		tiers[d.ID] = t
+		ch <- prometheus.MustNewConstMetric(memoryTierCapacityDesc, prometheus.GaugeValue, float64(t.Device), d.ID, t.Tier, "device")
+		if t.Host > 0 {
+			ch <- prometheus.MustNewConstMetric(memoryTierCapacityDesc, prometheus.GaugeValue, float64(t.Host), d.ID, t.Tier, "host")
+		}
+	}
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		klog.Errorf("Failed to list the pods of the node: %v", err)
+		return
+	}
+	factor := uint64(config.GPUMemoryFactor)
+	if factor == 0 {
+		factor = 1
+	}
+	for _, d := range nodeLedger(devices, pods, "") {
+		t := tiers[d.ID]
+		device, host := t.Split(uint64(d.Usedmem) * factor * 1024 * 1024)
+		ch <- prometheus.MustNewConstMetric(memoryTierGrantedDesc, prometheus.GaugeValue, float64(device), d.ID, t.Tier, "device")
+		if t.Host > 0 {
+			ch <- prometheus.MustNewConstMetric(memoryTierGrantedDesc, prometheus.GaugeValue, float64(host), d.ID, t.Tier, "host")
+		}
+	}
+}
@@ -62,7 +62,7 @@ type migStrategyMixed struct{}
 
 // migStrategyNone
 func (s *migStrategyNone) GetPlugins(cfg *config.NvidiaConfig, cache *DeviceCache) []*NvidiaDevicePlugin {
-	return []*NvidiaDevicePlugin{
+	plugins := []*NvidiaDevicePlugin{
 		NewNvidiaDevicePlugin(
 			//"nvidia.com/gpu",
 			util.ResourceName,
@@ -82,7 +82,24 @@ func (s *migStrategyNone) GetPlugins(cfg *config.NvidiaConfig, cache *DeviceCach
 			gpuallocator.NewBestEffortPolicy(),
 			pluginapi.DevicePluginPath+"nvidia-gpu-cores.sock",
 			cfg),
+		NewNvidiaDevicePlugin(
+			util.ResourceMemPercentage,
+			cache,
+			gpuallocator.NewBestEffortPolicy(),
+			pluginapi.DevicePluginPath+"nvidia-gpu-memory-percentage.sock",
+			cfg),
 	}
+	// The whole GPU pool is only advertised on the nodes configuring one,
+	// not to take over the resource of another device plugin.
+	if CurrentRuntimeConfig().Mode != "mig" && len(vgpuPool(cache.GetCache())) < len(cache.GetCache()) {
+		plugins = append(plugins, NewNvidiaDevicePlugin(
+			util.ResourceWholeGPU,
+			cache,
+			gpuallocator.NewBestEffortPolicy(),
+			pluginapi.DevicePluginPath+"nvidia-whole-gpu.sock",
+			cfg))
+	}
+	return plugins
 }
 
 func (s *migStrategyNone) MatchesResource(mig *nvml.Device, resource string) bool {
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+const (
+	// IsolationAnnotation selects how the cores of the vGPUs of a pod are
+	// limited, by the isolation of the node by default.
+	IsolationAnnotation = "volcano.sh/vgpu-isolation"
+	// IsolationMPS runs every container as a client of the MPS server of the
+	// GPU, its cores being the share of the SMs it may run threads on.
+	IsolationMPS = "mps"
+	// IsolationLibvgpu time-slices the kernels of the containers with the
+	// limiter of libvgpu.
+	IsolationLibvgpu = "libvgpu"
+
+	mpsPipeDirectory = "/tmp/nvidia-mps"
+)
+
+func mpsIsolated(pod *corev1.Pod) bool {
+	if isolation, ok := pod.Annotations[IsolationAnnotation]; ok {
+		return isolation == IsolationMPS
+	}
+	return CurrentRuntimeConfig().Isolation == IsolationMPS
+}
+
+// mpsHostPipeDirectory returns the pipe directory of the MPS control daemon
+// serving the devices, the one of the GPU when the plugin runs a daemon per
+// GPU, whose clients use a single GPU.
+func mpsHostPipeDirectory(devices util.ContainerDevices) (string, error) {
+	if !config.MPSDaemons {
+		return config.MPSPipeDirectory, nil
+	}
+	uuid := ""
+	for _, dev := range devices {
+		if uuid != "" && dev.UUID != uuid {
+			return "", fmt.Errorf("MPS isolation with a daemon per GPU serves one GPU per container, requested %s and %s", uuid, dev.UUID)
+		}
+		uuid = dev.UUID
+	}
+	return filepath.Join(config.MPSPipeDirectory, uuid), nil
+}
+
+// checkMPS returns an error if no MPS control daemon listens in the pipe
+// directory of the devices.
+func checkMPS(devices util.ContainerDevices) error {
+	dir, err := mpsHostPipeDirectory(devices)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "control")); err != nil {
+		return fmt.Errorf("MPS isolation requested but no MPS control daemon in %s: %v", dir, err)
+	}
+	return nil
+}
+
+// mpsEnvs turns the limits of envs into the ones of an MPS client. The SMs
+// are partitioned by the MPS server rather than time-sliced by libvgpu,
+// which keeps enforcing the memory limits.
+func mpsEnvs(envs map[string]string, devices util.ContainerDevices) {
+	envs["CUDA_MPS_PIPE_DIRECTORY"] = mpsPipeDirectory
+	if len(devices) == 0 {
+		return
+	}
+	if cores := devices[0].Usedcores; cores > 0 && cores < util.DeviceLimit {
+		envs["CUDA_MPS_ACTIVE_THREAD_PERCENTAGE"] = fmt.Sprint(cores)
+	}
+	envs["CUDA_DEVICE_SM_LIMIT"] = "0"
+	var limits []string
+	for i, dev := range devices {
+		limits = append(limits, fmt.Sprintf("%d=%vM", i, dev.Usedmem*int32(config.GPUMemoryFactor)))
+	}
+	envs["CUDA_MPS_PINNED_DEVICE_MEM_LIMIT"] = strings.Join(limits, ",")
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+)
+
+// mpsControl is the MPS control program of the driver.
+const mpsControl = "nvidia-cuda-mps-control"
+
+// MPSDaemons runs an MPS control daemon per GPU of the node, restarting the
+// ones which exit, so that the pods isolated with MPS don't depend on a
+// daemon set up on the node.
+type MPSDaemons struct {
+	deviceCache *DeviceCache
+	interval    time.Duration
+	stopCh      chan struct{}
+	doneCh      chan struct{}
+}
+
+func NewMPSDaemons(deviceCache *DeviceCache) *MPSDaemons {
+	return &MPSDaemons{
+		deviceCache: deviceCache,
+		interval:    10 * time.Second,
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+}
+
+func (d *MPSDaemons) Start() {
+	go d.Run()
+}
+
+// Stop stops the daemons, the clients connected lose their GPU.
+func (d *MPSDaemons) Stop() {
+	close(d.stopCh)
+	<-d.doneCh
+}
+
+// Run starts the missing daemons every interval until stopped.
+func (d *MPSDaemons) Run() {
+	defer close(d.doneCh)
+	klog.Infof("Running an MPS control daemon per GPU in %s", config.MPSPipeDirectory)
+	for {
+		for _, dev := range d.deviceCache.GetCache() {
+			if err := startMPSDaemon(dev.ID); err != nil {
+				klog.Errorf("Failed to start the MPS control daemon of device %s: %v", dev.ID, err)
+			}
+		}
+		select {
+		case <-d.stopCh:
+			for _, dev := range d.deviceCache.GetCache() {
+				stopMPSDaemon(dev.ID)
+			}
+			return
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+// mpsDaemonEnv returns the environment of the daemon of the device, or of
+// the control program talking to it.
+func mpsDaemonEnv(uuid string) []string {
+	dir := filepath.Join(config.MPSPipeDirectory, uuid)
+	return append(os.Environ(),
+		"CUDA_VISIBLE_DEVICES="+uuid,
+		"CUDA_MPS_PIPE_DIRECTORY="+dir,
+		"CUDA_MPS_LOG_DIRECTORY="+filepath.Join(dir, "log"),
+	)
+}
+
+// startMPSDaemon starts the daemon of the device unless its control pipe
+// already exists.
+func startMPSDaemon(uuid string) error {
+	dir := filepath.Join(config.MPSPipeDirectory, uuid)
+	if _, err := os.Stat(filepath.Join(dir, "control")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "log"), 0755); err != nil {
+		return err
+	}
+	cmd := exec.Command(mpsControl, "-d")
+	cmd.Env = mpsDaemonEnv(uuid)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	klog.Infof("Started the MPS control daemon of device %s", uuid)
+	return nil
+}
+
+// stopMPSDaemon asks the daemon of the device to quit.
+func stopMPSDaemon(uuid string) {
+	cmd := exec.Command(mpsControl)
+	cmd.Env = mpsDaemonEnv(uuid)
+	cmd.Stdin = strings.NewReader("quit\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		klog.Warningf("Failed to stop the MPS control daemon of device %s: %v %s", uuid, err, out)
+		return
+	}
+	klog.Infof("Stopped the MPS control daemon of device %s", uuid)
+}
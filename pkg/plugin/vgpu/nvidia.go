@@ -43,6 +43,8 @@ type Device struct {
 	Paths  []string
 	Index  string
 	Memory uint64
+	// Tiers is where the memory of a GPU comes from, unset for MIG devices.
+	Tiers config.MemoryTiers
 }
 
 // ResourceManager provides an interface for listing a set of Devices and checking health on them
@@ -85,6 +87,7 @@ func NewMigDeviceManager(strategy MigStrategy, resource string) *MigDeviceManage
 
 // Devices returns a list of devices from the GpuDeviceManager
 func (g *GpuDeviceManager) Devices() []*Device {
+	cfg := CurrentRuntimeConfig()
 	n, ret := config.Nvml().DeviceGetCount()
 	check(ret)
 	if n > util.DeviceLimit {
@@ -110,7 +113,7 @@ func (g *GpuDeviceManager) Devices() []*Device {
 		}
 
 		// Auto ebale MIG mode when the plugin is running in MIG mode
-		if config.Mode == "mig" && migMode != nvml.DEVICE_MIG_ENABLE {
+		if cfg.Mode == "mig" && migMode != nvml.DEVICE_MIG_ENABLE {
 			if ret == nvml.ERROR_NOT_SUPPORTED {
 				klog.V(4).Infof("Node is configed as MIG mode, but GPU %v does not support MIG mode", i)
 				continue
@@ -126,6 +129,10 @@ func (g *GpuDeviceManager) Devices() []*Device {
 		if err != nil {
 			log.Panicln("Fatal:", err)
 		}
+		if cfg.FilterDevice.Filtered(uint(i), dev.ID) {
+			klog.Infof("Device %v %s filtered out by the node config", i, dev.ID)
+			continue
+		}
 
 		devs = append(devs, dev)
 	}
@@ -135,6 +142,7 @@ func (g *GpuDeviceManager) Devices() []*Device {
 
 // Devices returns a list of devices from the MigDeviceManager
 func (m *MigDeviceManager) Devices() []*Device {
+	filter := CurrentRuntimeConfig().FilterDevice
 	n, ret := config.Nvml().DeviceGetCount()
 	check(ret)
 	if n > util.DeviceLimit {
@@ -160,6 +168,9 @@ func (m *MigDeviceManager) Devices() []*Device {
 		}
 
 		err := config.Device().VisitMigDevices(func(i int, d device.Device, j int, mig device.MigDevice) error {
+			if uuid, _ := d.GetUUID(); filter.Filtered(uint(i), uuid) {
+				return nil
+			}
 			dev, err := buildMigDevice(fmt.Sprintf("%v:%v", i, j), mig)
 			if err != nil {
 				log.Panicln("Fatal:", err)
@@ -197,9 +208,9 @@ func buildDevice(index string, d nvml.Device) (*Device, error) {
 	}
 	paths := []string{fmt.Sprintf("/dev/nvidia%d", minor)}
 
-	memory, ret := config.Nvml().DeviceGetMemoryInfo(d)
-	if ret != nvml.SUCCESS {
-		return nil, fmt.Errorf("error getting memory info of device: %v", ret)
+	tiers, err := config.DeviceMemory(d)
+	if err != nil {
+		return nil, err
 	}
 
 	hasNuma, numa, err := getNumaNode(d)
@@ -212,7 +223,8 @@ func buildDevice(index string, d nvml.Device) (*Device, error) {
 	dev.Health = pluginapi.Healthy
 	dev.Paths = paths
 	dev.Index = index
-	dev.Memory = memory.Total / (1024 * 1024)
+	dev.Memory = tiers.Total() / (1024 * 1024)
+	dev.Tiers = tiers
 	if hasNuma {
 		dev.Topology = &pluginapi.TopologyInfo{
 			Nodes: []*pluginapi.NUMANode{
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/rego"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// OPADenyQuery is the rule the admission policies define, a set of messages
+// explaining why an allocation is refused.
+const OPADenyQuery = "data.vgpu.admission.deny"
+
+// opaAdmission is the prepared query of the Rego admission policies, nil
+// when none is loaded.
+var opaAdmission *rego.PreparedEvalQuery
+
+// LoadOPAPolicies compiles the Rego policies and data files found in paths,
+// every container allocation is then vetoed by a non empty deny set.
+func LoadOPAPolicies(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	q, err := rego.New(
+		rego.Query(OPADenyQuery),
+		rego.Load(paths, nil),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load OPA policies from %v: %v", paths, err)
+	}
+	opaAdmission = &q
+	klog.Infof("Loaded OPA admission policies from %v", paths)
+	return nil
+}
+
+// opaDevice is a device of the node as seen by the admission policies.
+type opaDevice struct {
+	UUID       string           `json:"uuid"`
+	Index      int              `json:"index"`
+	Type       string           `json:"type"`
+	Numa       int              `json:"numa"`
+	Count      int32            `json:"count"`
+	Used       int32            `json:"used"`
+	Totalmem   int32            `json:"totalmem"`
+	Usedmem    int32            `json:"usedmem"`
+	Totalcore  int32            `json:"totalcore"`
+	Usedcores  int32            `json:"usedcores"`
+	Namespaces map[string]int32 `json:"namespaces"`
+}
+
+// opaInput is the document the admission policies are evaluated against.
+type opaInput struct {
+	Pod       *corev1.Pod `json:"pod"`
+	Container string      `json:"container"`
+	Node      struct {
+		Name        string            `json:"name"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"node"`
+	// Devices are the devices assigned to the container.
+	Devices []util.ContainerDevice `json:"devices"`
+	// NodeDevices are the devices of the node with what the other pods and
+	// the containers of the pod placed before use.
+	NodeDevices []opaDevice `json:"nodeDevices"`
+}
+
+// admitPlacement evaluates the admission policies for the devices assigned
+// to the container, it returns an error listing the deny messages when the
+// allocation is refused.
+func (m *NvidiaDevicePlugin) admitPlacement(node *corev1.Node, ledger []*policy.Device, current *corev1.Pod, ctr string, devreq util.ContainerDevices) error {
+	input := opaInput{Pod: current, Container: ctr, Devices: devreq}
+	input.Node.Name = node.Name
+	input.Node.Labels, input.Node.Annotations = node.Labels, node.Annotations
+	for _, d := range ledger {
+		input.NodeDevices = append(input.NodeDevices, toOPADevice(d))
+	}
+	rs, err := opaAdmission.Eval(context.Background(), rego.EvalInput(input))
+	if err != nil {
+		return fmt.Errorf("OPA evaluation failed: %v", err)
+	}
+	var denies []string
+	for _, r := range rs {
+		for _, e := range r.Expressions {
+			set, ok := e.Value.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, v := range set {
+				denies = append(denies, fmt.Sprint(v))
+			}
+		}
+	}
+	if len(denies) > 0 {
+		sort.Strings(denies)
+		return fmt.Errorf("denied by OPA policy: %s", strings.Join(denies, "; "))
+	}
+	return nil
+}
+
+func toOPADevice(d *policy.Device) opaDevice {
+	return opaDevice{
+		UUID:       d.ID,
+		Index:      d.Index,
+		Type:       d.Type,
+		Numa:       d.Numa,
+		Count:      d.Count,
+		Used:       d.Used,
+		Totalmem:   d.Totalmem,
+		Usedmem:    d.Usedmem,
+		Totalcore:  d.Totalcore,
+		Usedcores:  d.Usedcores,
+		Namespaces: d.Namespaces,
+	}
+}
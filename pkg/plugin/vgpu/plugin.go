@@ -26,13 +26,16 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/klog/v2"
 	"volcano.sh/k8s-device-plugin/pkg/lock"
 	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
 	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
 
 	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
@@ -69,6 +72,18 @@ type NvidiaDevicePlugin struct {
 	socket           string
 	schedulerConfig  *config.NvidiaConfig
 	operatingMode    string
+	// allocationPolicy checks the devices chosen by the scheduler, nil to
+	// trust them.
+	allocationPolicy policy.AllocationPolicy
+	// selectionPolicy re-places the containers on the devices it prefers,
+	// nil to keep those of the scheduler.
+	selectionPolicy policy.AllocationPolicy
+	// shadow evaluates the shadow policy on every allocation, nil when none
+	// is configured.
+	shadow *shadowEvaluator
+	// allocation is the pod whose containers are being allocated.
+	allocationMutex sync.Mutex
+	allocation      *podAllocation
 
 	virtualDevices []*pluginapi.Device
 	migCurrent     config.MigPartedSpec
@@ -89,7 +104,7 @@ func NewNvidiaDevicePlugin(resourceName string, deviceCache *DeviceCache, alloca
 		allocatePolicy:  allocatePolicy,
 		socket:          socket,
 		migStrategy:     "none",
-		operatingMode:   config.Mode,
+		operatingMode:   CurrentRuntimeConfig().Mode,
 		schedulerConfig: cfg,
 		// These will be reinitialized every
 		// time the plugin server is restarted.
@@ -97,6 +112,27 @@ func NewNvidiaDevicePlugin(resourceName string, deviceCache *DeviceCache, alloca
 		health: nil,
 		stop:   nil,
 	}
+	if config.AllocationPolicy != "" {
+		p, err := policy.Get(config.AllocationPolicy)
+		if err != nil {
+			klog.Fatalf("Failed to get allocation policy: %v", err)
+		}
+		dp.allocationPolicy = p
+	}
+	if selection := CurrentRuntimeConfig().DeviceSelectionPolicy; selection != "" {
+		p, err := policy.Get(selection)
+		if err != nil {
+			klog.Fatalf("Failed to get device selection policy: %v", err)
+		}
+		dp.selectionPolicy = p
+	}
+	if config.ShadowAllocationPolicy != "" {
+		p, err := policy.Get(config.ShadowAllocationPolicy)
+		if err != nil {
+			klog.Fatalf("Failed to get shadow allocation policy: %v", err)
+		}
+		dp.shadow = getShadowEvaluator(p)
+	}
 	return dp
 }
 
@@ -158,30 +194,13 @@ func (m *NvidiaDevicePlugin) Start() error {
 	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
 
 	if m.operatingMode == "mig" {
-		cmd := exec.Command("nvidia-mig-parted", "export")
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			klog.Fatalf("nvidia-mig-parted failed with %s\n", err)
-		}
-		outStr := stdout.Bytes()
-		yaml.Unmarshal(outStr, &m.migCurrent)
-		os.WriteFile("/tmp/migconfig.yaml", outStr, os.ModePerm)
-		if len(m.migCurrent.MigConfigs["current"]) == 1 && len(m.migCurrent.MigConfigs["current"][0].Devices) == 0 {
-			idx := 0
-			m.migCurrent.MigConfigs["current"][0].Devices = make([]int32, 0)
-			for idx < util.GetDeviceNums() {
-				m.migCurrent.MigConfigs["current"][0].Devices = append(m.migCurrent.MigConfigs["current"][0].Devices, int32(idx))
-				idx++
-			}
+		if err := m.exportMigConfig(); err != nil {
+			klog.Fatal(err)
 		}
-		klog.Infoln("Mig export", m.migCurrent)
 	}
 
 	if strings.Compare(m.migStrategy, "none") == 0 {
-		m.deviceCache.AddNotifyChannel("plugin", m.health)
+		m.deviceCache.AddNotifyChannel(m.resourceName, m.health)
 	} else if strings.Compare(m.migStrategy, "mixed") == 0 {
 		go m.CheckHealth(m.stop, m.cachedDevices, m.health)
 	} else {
@@ -196,7 +215,7 @@ func (m *NvidiaDevicePlugin) Stop() error {
 		return nil
 	}
 	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
-	m.deviceCache.RemoveNotifyChannel("plugin")
+	m.deviceCache.RemoveNotifyChannel(m.resourceName)
 	m.server.Stop()
 	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
 		return err
@@ -313,10 +332,20 @@ func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Device
 
 	} else {
 		_ = s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
+		// The devices of the whole GPU pool turn available once their
+		// vGPUs are released.
+		var relist <-chan time.Time
+		if strings.Compare(m.resourceName, util.ResourceWholeGPU) == 0 {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+			relist = ticker.C
+		}
 		for {
 			select {
 			case <-m.stop:
 				return nil
+			case <-relist:
+				_ = s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
 			case d := <-m.health:
 				// FIXME: there is no way to recover from the Unhealthy state.
 				//d.Health = pluginapi.Unhealthy
@@ -352,15 +381,16 @@ func (m *NvidiaDevicePlugin) MIGAllocate(ctx context.Context, reqs *pluginapi.Al
 
 // Allocate which return list of devices.
 func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	if len(reqs.ContainerRequests) > 1 {
-		return &pluginapi.AllocateResponse{}, errors.New("multiple Container Requests not supported")
-	}
 	if strings.Compare(m.migStrategy, "mixed") == 0 {
 		return m.MIGAllocate(ctx, reqs)
 	}
+	if strings.Compare(m.resourceName, util.ResourceWholeGPU) == 0 {
+		return m.allocateWhole(ctx, reqs)
+	}
 	responses := pluginapi.AllocateResponse{}
 
-	if strings.Compare(m.resourceName, util.ResourceMem) == 0 || strings.Compare(m.resourceName, util.ResourceCores) == 0 {
+	if strings.Compare(m.resourceName, util.ResourceMem) == 0 || strings.Compare(m.resourceName, util.ResourceCores) == 0 ||
+		strings.Compare(m.resourceName, util.ResourceMemPercentage) == 0 {
 		for range reqs.ContainerRequests {
 			responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{})
 		}
@@ -368,56 +398,78 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 	}
 	nodename := os.Getenv("NODE_NAME")
 
-	current, err := util.GetPendingPod(nodename)
+	m.allocationMutex.Lock()
+	defer m.allocationMutex.Unlock()
+	var deviceIDs []string
+	if len(reqs.ContainerRequests) > 0 {
+		deviceIDs = reqs.ContainerRequests[0].DevicesIDs
+	}
+	alloc, current, err := m.beginPodAllocation(nodename, deviceIDs)
 	if err != nil {
-		lock.ReleaseNodeLock(nodename, util.VGPUDeviceName)
+		klog.Errorln("device allocation rejected", err.Error())
+		if current != nil {
+			util.PodAllocationFailed(nodename, current)
+		} else {
+			lock.ReleaseNodeLock(nodename, util.VGPUDeviceName)
+		}
 		return &pluginapi.AllocateResponse{}, err
 	}
-	if current == nil {
-		klog.Errorf("no pending pod found on node %s", nodename)
-		lock.ReleaseNodeLock(nodename, util.VGPUDeviceName)
-		return &pluginapi.AllocateResponse{}, errors.New("no pending pod found on node")
+	// abort fails the whole pod, none of its containers will start.
+	abort := func(err error) (*pluginapi.AllocateResponse, error) {
+		m.allocation = nil
+		util.PodAllocationFailed(nodename, current)
+		return &pluginapi.AllocateResponse{}, err
 	}
 
 	for idx := range reqs.ContainerRequests {
-		currentCtr, devreq, err := util.GetNextDeviceRequest(util.NvidiaGPUDevice, *current)
-		klog.Infoln("deviceAllocateFromAnnotation=", devreq)
-		if err != nil {
-			klog.Errorln("get device from annotation failed", err.Error())
-			util.PodAllocationFailed(nodename, current)
-			return &pluginapi.AllocateResponse{}, err
+		if len(alloc.pending) == 0 {
+			klog.Errorln("get device from annotation failed, no container left to allocate")
+			return abort(errors.New("device request not found"))
 		}
+		next := alloc.next(util.NvidiaGPUDevice)
+		currentCtr, devreq := next.container, next.devices
+		klog.Infoln("deviceAllocateFromAnnotation=", devreq)
 		if len(devreq) != len(reqs.ContainerRequests[idx].DevicesIDs) {
 			klog.Errorln("device number not matched", devreq, reqs.ContainerRequests[idx].DevicesIDs)
-			util.PodAllocationFailed(nodename, current)
-			return &pluginapi.AllocateResponse{}, errors.New("device number not matched")
+			return abort(errors.New("device number not matched"))
 		}
 
 		response := pluginapi.ContainerAllocateResponse{}
 		response.Envs = make(map[string]string)
-		response.Envs["NVIDIA_VISIBLE_DEVICES"] = strings.Join(m.GetContainerDeviceStrArray(devreq), ",")
-
-		err = util.EraseNextDeviceTypeFromAnnotation(util.NvidiaGPUDevice, *current)
+		visible, err := m.GetContainerDeviceStrArray(current, devreq)
 		if err != nil {
-			klog.Errorln("Erase annotation failed", err.Error())
-			util.PodAllocationFailed(nodename, current)
-			return &pluginapi.AllocateResponse{}, err
+			klog.Errorf("Failed to get the devices of container %s: %v", currentCtr.Name, err)
+			return abort(err)
 		}
+		response.Envs["NVIDIA_VISIBLE_DEVICES"] = strings.Join(visible, ",")
 
 		if m.operatingMode != "mig" {
 
-			for i, dev := range devreq {
-				limitKey := fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)
-				response.Envs[limitKey] = fmt.Sprintf("%vm", dev.Usedmem*int32(config.GPUMemoryFactor))
+			for k, v := range limitEnvs(devreq) {
+				response.Envs[k] = v
+			}
+			response.Envs[util.CorrelationIDEnv] = alloc.correlationID
+			if priority, ok, _ := podTaskPriority(current); ok {
+				response.Envs[util.TaskPriorityEnv] = fmt.Sprint(priority)
+			}
+			if fallback, _ := podMemoryFallback(current); fallback {
+				response.Envs[util.OversubscribeEnv] = "true"
+			}
+			if mpsIsolated(current) {
+				pipeDirectory, err := mpsHostPipeDirectory(devreq)
+				if err != nil {
+					return abort(err)
+				}
+				mpsEnvs(response.Envs, devreq)
+				response.Mounts = append(response.Mounts, &pluginapi.Mount{ContainerPath: mpsPipeDirectory,
+					HostPath: pipeDirectory,
+					ReadOnly: false},
+				)
 			}
-			response.Envs["CUDA_DEVICE_SM_LIMIT"] = fmt.Sprint(devreq[0].Usedcores)
 			response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = fmt.Sprintf("/tmp/vgpu/%v.cache", uuid.NewUUID())
 
-			cacheFileHostDirectory := "/tmp/vgpu/containers/" + string(current.UID) + "_" + currentCtr.Name
-			os.MkdirAll(cacheFileHostDirectory, 0777)
-			os.Chmod(cacheFileHostDirectory, 0777)
-			os.MkdirAll("/tmp/vgpulock", 0777)
-			os.Chmod("/tmp/vgpulock", 0777)
+			cacheFileHostDirectory := containerStateDir(string(current.UID), currentCtr.Name)
+			makeStateDirs(cacheFileHostDirectory)
 			hostHookPath := os.Getenv("HOOK_PATH")
 
 			response.Mounts = append(response.Mounts,
@@ -433,16 +485,9 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 			)
 
 			overrideEnvPath := cacheFileHostDirectory + "/vgpu_envs"
-			file, err := os.OpenFile(overrideEnvPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-			if err != nil {
+			if err := writeEnvFile(overrideEnvPath, response.Envs, len(devreq)); err != nil {
 				klog.Errorln("Failed to create file `/etc/vgpu_envs`")
 			} else {
-				defer file.Close()
-				fmt.Fprintf(file, "CUDA_DEVICE_SM_LIMIT=%s\n", response.Envs["CUDA_DEVICE_SM_LIMIT"])
-				for i := range devreq {
-					limitKey := fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)
-					fmt.Fprintf(file, "%s=%s\n", limitKey, response.Envs[limitKey])
-				}
 				response.Mounts = append(response.Mounts,
 					&pluginapi.Mount{ContainerPath: "/etc/vgpu_envs",
 						HostPath: overrideEnvPath,
@@ -464,10 +509,48 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 				)
 			}
 		}
+		if config.CDISpecDirectory != "" {
+			if err := m.cdiResponse(string(current.UID), currentCtr.Name, devreq, &response); err != nil {
+				klog.Errorf("Failed to write the CDI spec of container %s: %v", currentCtr.Name, err)
+				return abort(err)
+			}
+		}
+		alloc.records = append(alloc.records, AllocationRecord{
+			PodUID:    string(current.UID),
+			Namespace: current.Namespace,
+			Pod:       current.Name,
+			Container: currentCtr.Name,
+			Devices:   devreq,
+			Time:      time.Now(),
+		})
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
 	klog.Infoln("Allocate Response", responses.ContainerResponses)
-	util.PodAllocationTrySuccess(nodename, current)
+
+	// What is left to allocate is written once per call, a restarted plugin
+	// resumes from it.
+	annotations := alloc.handshakeAnnotations(time.Now())
+	annotations[util.AssignedIDsToAllocateAnnotations] = util.EncodePodDevices(alloc.toAllocate)
+	err = util.PatchPodAnnotations(current, annotations)
+	if err != nil {
+		klog.Errorln("Erase annotation failed", err.Error())
+		return abort(err)
+	}
+	if len(alloc.pending) > 0 {
+		// Containers are left to allocate, keep the node reserved.
+		if err := lock.RenewNodeLock(nodename, util.VGPUDeviceName); err != nil {
+			klog.Errorf("renew lock failed:%v", err.Error())
+		}
+		return &responses, nil
+	}
+	m.allocation = nil
+	if ck := allocationCheckpoint(); ck != nil {
+		if err := ck.AddAll(alloc.records); err != nil {
+			klog.Errorf("Failed to checkpoint allocation: %v", err)
+		}
+	}
+	klog.Infoln("AllDevicesAllocateSuccess releasing lock")
+	util.PodAllocationSuccess(nodename, current)
 	return &responses, nil
 }
 
@@ -525,6 +608,13 @@ func (m *NvidiaDevicePlugin) apiDevices() []*pluginapi.Device {
 		return pdevs
 	}
 	devices := m.Devices()
+	if nodeDraining() {
+		devices = drainedDevices(devices)
+	}
+	if strings.Compare(m.resourceName, util.ResourceWholeGPU) == 0 {
+		return m.wholeAPIDevices(devices)
+	}
+	devices = vgpuPool(devices)
 	var res []*pluginapi.Device
 
 	if strings.Compare(m.resourceName, util.ResourceMem) == 0 {
@@ -535,7 +625,7 @@ func (m *NvidiaDevicePlugin) apiDevices() []*pluginapi.Device {
 				res = append(res, &pluginapi.Device{
 					ID:       fmt.Sprintf("%v-memory-%v", dev.ID, i),
 					Health:   dev.Health,
-					Topology: nil,
+					Topology: dev.Topology,
 				})
 				i++
 			}
@@ -550,21 +640,35 @@ func (m *NvidiaDevicePlugin) apiDevices() []*pluginapi.Device {
 				res = append(res, &pluginapi.Device{
 					ID:       fmt.Sprintf("%v-core-%v", dev.ID, i),
 					Health:   dev.Health,
-					Topology: nil,
+					Topology: dev.Topology,
 				})
 				i++
 			}
 		}
 		return res
 	}
+	// A percentage of the memory of every device, the scheduler grants it
+	// in MiB of the device it picks.
+	if strings.Compare(m.resourceName, util.ResourceMemPercentage) == 0 {
+		for _, dev := range devices {
+			for i := 0; i < 100; i++ {
+				res = append(res, &pluginapi.Device{
+					ID:       fmt.Sprintf("%v-memory-percentage-%v", dev.ID, i),
+					Health:   dev.Health,
+					Topology: dev.Topology,
+				})
+			}
+		}
+		return res
+	}
 
 	for _, dev := range devices {
-		for i := uint(0); i < config.DeviceSplitCount; i++ {
+		for i := uint(0); i < CurrentRuntimeConfig().DeviceSplitCount; i++ {
 			id := fmt.Sprintf("%v-%v", dev.ID, i)
 			res = append(res, &pluginapi.Device{
 				ID:       id,
 				Health:   dev.Health,
-				Topology: nil,
+				Topology: dev.Topology,
 			})
 		}
 	}
@@ -577,7 +681,34 @@ func (m *NvidiaDevicePlugin) apiEnvs(envvar string, deviceIDs []string) map[stri
 	}
 }
 
-func (m *NvidiaDevicePlugin) ApplyMigTemplate() {
+// exportMigConfig reads the MIG configuration of the GPUs of the node.
+func (m *NvidiaDevicePlugin) exportMigConfig() error {
+	cmd := exec.Command("nvidia-mig-parted", "export")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nvidia-mig-parted export failed with %v: %s", err, stderr.String())
+	}
+	outStr := stdout.Bytes()
+	m.migCurrent = config.MigPartedSpec{}
+	yaml.Unmarshal(outStr, &m.migCurrent)
+	os.WriteFile("/tmp/migconfig.yaml", outStr, os.ModePerm)
+	if len(m.migCurrent.MigConfigs["current"]) == 1 && len(m.migCurrent.MigConfigs["current"][0].Devices) == 0 {
+		idx := 0
+		m.migCurrent.MigConfigs["current"][0].Devices = make([]int32, 0)
+		for idx < util.GetDeviceNums() {
+			m.migCurrent.MigConfigs["current"][0].Devices = append(m.migCurrent.MigConfigs["current"][0].Devices, int32(idx))
+			idx++
+		}
+	}
+	klog.Infoln("Mig export", m.migCurrent)
+	return nil
+}
+
+// ApplyMigTemplate applies the MIG configuration of the plugin to the GPUs,
+// the configuration is read again from the GPUs when it fails.
+func (m *NvidiaDevicePlugin) ApplyMigTemplate() error {
 	data, err := yaml.Marshal(m.migCurrent)
 	if err != nil {
 		klog.Error("marshal failed", err.Error())
@@ -590,13 +721,21 @@ func (m *NvidiaDevicePlugin) ApplyMigTemplate() {
 	cmd.Stderr = &stderr
 	err = cmd.Run()
 	if err != nil {
-		klog.Fatalf("nvidia-mig-parted failed with %s\n", err)
+		err = fmt.Errorf("nvidia-mig-parted apply failed with %v: %s", err, stderr.String())
+		if exportErr := m.exportMigConfig(); exportErr != nil {
+			klog.Errorf("Failed to read the MIG configuration back: %v", exportErr)
+		}
+		return err
 	}
 	outStr := stdout.String()
 	klog.Infoln("Mig apply", outStr)
+	return nil
 }
 
-func (m *NvidiaDevicePlugin) GetContainerDeviceStrArray(c util.ContainerDevices) []string {
+// GetContainerDeviceStrArray returns the devices of the container to make
+// visible, the MIG devices of the geometries assigned by the scheduler,
+// which are created first when the GPU doesn't have them.
+func (m *NvidiaDevicePlugin) GetContainerDeviceStrArray(current *corev1.Pod, c util.ContainerDevices) ([]string, error) {
 	tmp := []string{}
 	needsreset := false
 	position := 0
@@ -606,14 +745,50 @@ func (m *NvidiaDevicePlugin) GetContainerDeviceStrArray(c util.ContainerDevices)
 		} else {
 			devtype, devindex := util.GetIndexAndTypeFromUUID(val.UUID)
 			position, needsreset = m.GenerateMigTemplate(devtype, devindex, val)
+			if position < 0 {
+				return nil, fmt.Errorf("no known MIG geometry for device %s", val.UUID)
+			}
 			if needsreset {
-				m.ApplyMigTemplate()
+				if err := migGPUInUse(current, val.UUID); err != nil {
+					// The geometry of the GPU is left as it is.
+					if exportErr := m.exportMigConfig(); exportErr != nil {
+						klog.Errorf("Failed to read the MIG configuration back: %v", exportErr)
+					}
+					return nil, err
+				}
+				if err := m.ApplyMigTemplate(); err != nil {
+					return nil, err
+				}
 			}
 			tmp = append(tmp, util.GetMigUUIDFromIndex(val.UUID, position))
 		}
 	}
 	klog.V(3).Infoln("mig current=", m.migCurrent, ":", needsreset, "position=", position, "uuid lists", tmp)
-	return tmp
+	return tmp, nil
+}
+
+// migGPUInUse returns an error when a pod of the node other than current is
+// assigned a MIG device of the GPU of uuid, whose geometry can't change
+// without destroying it.
+func migGPUInUse(current *corev1.Pod, uuid string) error {
+	gpu := strings.Split(uuid, "[")[0]
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.UID == current.UID {
+			continue
+		}
+		for _, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			for _, dev := range ctr {
+				if strings.Contains(dev.UUID, "[") && strings.Split(dev.UUID, "[")[0] == gpu {
+					return fmt.Errorf("MIG geometry of GPU %s can't change, pod %s/%s uses its MIG device %s", gpu, pod.Namespace, pod.Name, dev.UUID)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 func (m *NvidiaDevicePlugin) GenerateMigTemplate(devtype string, devindex int, val util.ContainerDevice) (int, bool) {
@@ -662,13 +837,28 @@ func (m *NvidiaDevicePlugin) GenerateMigTemplate(devtype string, devindex int, v
 					}
 
 					if needsreset {
-						for k := range m.migCurrent.MigConfigs["current"][migidx].MigDevices {
-							delete(m.migCurrent.MigConfigs["current"][migidx].MigDevices, k)
-						}
-
+						// Only the GPU changes geometry, the others of
+						// its entry keep theirs.
+						migDevices := make(map[string]int32, len(v))
 						for _, migTemplateEntry := range v {
-							m.migCurrent.MigConfigs["current"][migidx].MigDevices[migTemplateEntry.Name] = migTemplateEntry.Count
+							migDevices[migTemplateEntry.Name] = migTemplateEntry.Count
+						}
+						if len(migpartedDev.Devices) == 1 {
+							m.migCurrent.MigConfigs["current"][migidx].MigDevices = migDevices
 							m.migCurrent.MigConfigs["current"][migidx].MigEnabled = true
+						} else {
+							var others []int32
+							for _, d := range migpartedDev.Devices {
+								if int(d) != devindex {
+									others = append(others, d)
+								}
+							}
+							m.migCurrent.MigConfigs["current"][migidx].Devices = others
+							m.migCurrent.MigConfigs["current"] = append(m.migCurrent.MigConfigs["current"], config.MigConfigSpec{
+								Devices:    []int32{int32(devindex)},
+								MigEnabled: true,
+								MigDevices: migDevices,
+							})
 						}
 					}
 					break
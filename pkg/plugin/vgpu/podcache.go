@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// podCacheSyncTimeout is how long a list of the pods of the node waits for
+// the cache to sync.
+const podCacheSyncTimeout = 30 * time.Second
+
+// podCache watches the pods bound to the node and the pods not bound yet,
+// which the scheduler may have assigned to the node in an annotation, so
+// that the allocations, the registrations and the metrics read the pods of
+// the node without listing every pod of the cluster.
+type podCache struct {
+	client  kubernetes.Interface
+	node    string
+	bound   listerscorev1.PodLister
+	unbound listerscorev1.PodLister
+	synced  []cache.InformerSynced
+	stopCh  chan struct{}
+}
+
+var (
+	podCacheMutex sync.Mutex
+	nodePodCache  *podCache
+)
+
+// nodePods returns the cache of the pods of node, started on the first call
+// and again when the client changes.
+func nodePods(node string) *podCache {
+	podCacheMutex.Lock()
+	defer podCacheMutex.Unlock()
+	client := lock.GetClient()
+	if c := nodePodCache; c != nil && c.client == client && c.node == node {
+		return c
+	}
+	if nodePodCache != nil {
+		close(nodePodCache.stopCh)
+	}
+	nodePodCache = newPodCache(client, node)
+	return nodePodCache
+}
+
+func newPodCache(client kubernetes.Interface, node string) *podCache {
+	c := &podCache{client: client, node: node, stopCh: make(chan struct{})}
+	for _, selector := range []string{"spec.nodeName=" + node, "spec.nodeName="} {
+		selector := selector
+		factory := informers.NewSharedInformerFactoryWithOptions(client, time.Hour,
+			informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.FieldSelector = selector }))
+		informer := factory.Core().V1().Pods()
+		if c.bound == nil {
+			c.bound = informer.Lister()
+		} else {
+			c.unbound = informer.Lister()
+		}
+		c.synced = append(c.synced, informer.Informer().HasSynced)
+		factory.Start(c.stopCh)
+	}
+	return c
+}
+
+// List returns the pods bound to the node and those assigned to it not bound
+// yet, terminated or not. They are shared with the cache, not to be
+// modified.
+func (c *podCache) List() ([]*corev1.Pod, error) {
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(podCacheSyncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(timeout, c.synced...) {
+		return nil, fmt.Errorf("pods of node %s not synced after %v", c.node, podCacheSyncTimeout)
+	}
+	bound, err := c.bound.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	unbound, err := c.unbound.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var res []*corev1.Pod
+	for _, pod := range bound {
+		if pod.Spec.NodeName == c.node {
+			res = append(res, pod)
+		}
+	}
+	for _, pod := range unbound {
+		if pod.Spec.NodeName == "" && pod.Annotations[util.AssignedNodeAnnotations] == c.node {
+			res = append(res, pod)
+		}
+	}
+	return res, nil
+}
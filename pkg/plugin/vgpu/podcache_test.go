@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+func testPod(name, nodeName, assigned string, phase corev1.PodPhase) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, UID: types.UID("uid-" + name)},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+	if assigned != "" {
+		pod.Annotations = map[string]string{util.AssignedNodeAnnotations: assigned}
+	}
+	return pod
+}
+
+// useTestClient makes the plugin use a fake client of objects.
+func useTestClient(t *testing.T, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	require.NoError(t, lock.UseClient(client))
+	return client
+}
+
+func TestListNodePods(t *testing.T) {
+	useTestClient(t,
+		testPod("bound", "node1", "", corev1.PodRunning),
+		testPod("assigned", "", "node1", corev1.PodPending),
+		testPod("bound-elsewhere", "node2", "node1", corev1.PodRunning),
+		testPod("assigned-elsewhere", "", "node2", corev1.PodPending),
+		testPod("unassigned", "", "", corev1.PodPending),
+		testPod("succeeded", "node1", "", corev1.PodSucceeded),
+		testPod("other", "node2", "", corev1.PodRunning),
+	)
+
+	pods, err := listNodePods("node1")
+	require.NoError(t, err)
+	var names []string
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"assigned", "bound"}, names)
+}
+
+func TestAllocationCollectorReadsCache(t *testing.T) {
+	nodeName := config.NodeName
+	defer func() { config.NodeName = nodeName }()
+	config.NodeName = "node1"
+	client := useTestClient(t, testPod("bound", "node1", "", corev1.PodRunning))
+
+	c := NewAllocationCollector(&DeviceCache{})
+	for i := 0; i < 3; i++ {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+	}
+	lists := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "pods" {
+			lists++
+		}
+	}
+	// The pods bound to the node and those not bound yet are listed once
+	// by their informers.
+	require.Equal(t, 2, lists)
+}
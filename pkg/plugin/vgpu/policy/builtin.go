@@ -0,0 +1,113 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// Names of the built-in policies.
+const (
+	Binpack  = "binpack"
+	Spread   = "spread"
+	Topology = "topology"
+)
+
+func init() {
+	Register(binpack{})
+	Register(spread{})
+	Register(topology{})
+}
+
+// usage returns how much of dev is granted, between 0 and 1, as the average
+// of its vGPU, memory and core usage.
+func usage(dev *Device) float64 {
+	var u float64
+	if dev.Count > 0 {
+		u += float64(dev.Used) / float64(dev.Count)
+	}
+	if dev.Totalmem > 0 {
+		u += float64(dev.Usedmem) / float64(dev.Totalmem)
+	}
+	if dev.Totalcore > 0 {
+		u += float64(dev.Usedcores) / float64(dev.Totalcore)
+	}
+	return u / 3
+}
+
+// binpack fills the most used devices first, keeping whole devices free for
+// large requests.
+type binpack struct{}
+
+func (binpack) Name() string { return Binpack }
+
+func (binpack) Filter(req *util.ContainerDeviceRequest, dev *Device) bool { return Fits(req, dev) }
+
+func (binpack) Score(req *util.ContainerDeviceRequest, dev *Device, candidates []*Device) float64 {
+	return usage(dev)
+}
+
+// spread places requests on the least used devices first, limiting the
+// interference between the containers sharing a device.
+type spread struct{}
+
+func (spread) Name() string { return Spread }
+
+func (spread) Filter(req *util.ContainerDeviceRequest, dev *Device) bool { return Fits(req, dev) }
+
+func (spread) Score(req *util.ContainerDeviceRequest, dev *Device, candidates []*Device) float64 {
+	return 1 - usage(dev)
+}
+
+// topology keeps the devices of a request on one NUMA node: it prefers the
+// NUMA node with the most candidates, then the PCIe switch with the most
+// candidates inside it, then binpacks.
+type topology struct{}
+
+func (topology) Name() string { return Topology }
+
+func (topology) Filter(req *util.ContainerDeviceRequest, dev *Device) bool { return Fits(req, dev) }
+
+func (topology) Score(req *util.ContainerDeviceRequest, dev *Device, candidates []*Device) float64 {
+	numa := localityScore(req, candidates, dev.Numa, func(c *Device) int { return c.Numa })
+	pcie := localityScore(req, candidates, dev.Switch, func(c *Device) int { return c.Switch })
+	// Each locality score is below 2*(len(candidates)+1), the NUMA node
+	// always wins over the switch, which always wins over the usage.
+	scale := float64(2*len(candidates) + 2)
+	return (numa*scale+pcie)*scale + usage(dev)
+}
+
+// localityScore ranks the group of the device among the candidates by the
+// number of candidates of the group, a group with enough candidates for the
+// whole request always winning over one without. Devices of no known group
+// score 0.
+func localityScore(req *util.ContainerDeviceRequest, candidates []*Device, group int, groupOf func(*Device) int) float64 {
+	if group < 0 {
+		return 0
+	}
+	peers := 0
+	for _, c := range candidates {
+		if groupOf(c) == group {
+			peers++
+		}
+	}
+	score := float64(peers)
+	if int32(peers) >= req.Nums {
+		score += float64(len(candidates))
+	}
+	return score
+}
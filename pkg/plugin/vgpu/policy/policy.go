@@ -0,0 +1,147 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy decides on which physical GPUs of a node a vGPU request is
+// placed. A policy filters the devices a request can not use and scores the
+// remaining ones, the request gets the best scored devices.
+package policy
+
+import (
+	"fmt"
+	"sort"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// Device is a physical GPU of the node with what the pods bound to the node
+// already use of it.
+type Device struct {
+	ID     string
+	Index  int
+	Type   string
+	Health bool
+	// Numa is the NUMA node of the device, -1 when unknown.
+	Numa int
+	// Switch identifies the devices of the node under the same PCIe
+	// switch, -1 when unknown.
+	Switch int
+	// Count is the number of vGPUs the device is split in.
+	Count int32
+	// Totalmem is the device memory, in MiB or in blocks of the memory
+	// factor when one is set.
+	Totalmem int32
+	// Totalcore is the SM percentage available, 100 for a whole device.
+	Totalcore int32
+	Used      int32
+	Usedmem   int32
+	Usedcores int32
+	// Namespaces counts the vGPUs of the device granted to each namespace.
+	Namespaces map[string]int32
+}
+
+// Freemem returns the memory of the device not yet granted.
+func (d *Device) Freemem() int32 {
+	return d.Totalmem - d.Usedmem
+}
+
+// Freecores returns the SM percentage of the device not yet granted.
+func (d *Device) Freecores() int32 {
+	return d.Totalcore - d.Usedcores
+}
+
+// AllocationPolicy places vGPU requests on the devices of a node.
+type AllocationPolicy interface {
+	// Name is the name the policy is selected with.
+	Name() string
+	// Filter reports whether the request can be placed on dev.
+	Filter(req *util.ContainerDeviceRequest, dev *Device) bool
+	// Score ranks dev for the request among the devices which passed the
+	// filter, the higher the better.
+	Score(req *util.ContainerDeviceRequest, dev *Device, candidates []*Device) float64
+}
+
+// RequestMemory returns the memory the request needs on dev in MiB.
+func RequestMemory(req *util.ContainerDeviceRequest, dev *Device) int32 {
+	if req.Memreq > 0 {
+		return req.Memreq
+	}
+	if req.MemPercentagereq > 0 && req.MemPercentagereq <= 100 {
+		return dev.Totalmem * req.MemPercentagereq / 100
+	}
+	return dev.Totalmem
+}
+
+// Fits reports whether dev is healthy and has a free vGPU, enough memory and
+// enough cores left for the request. It is the filter of the built-in
+// policies, custom policies usually call it before their own rules.
+func Fits(req *util.ContainerDeviceRequest, dev *Device) bool {
+	if !dev.Health || dev.Used >= dev.Count {
+		return false
+	}
+	if dev.Freemem() < RequestMemory(req, dev) {
+		return false
+	}
+	if dev.Freecores() < req.Coresreq {
+		return false
+	}
+	// A request for the whole device can't share it.
+	if req.Coresreq == util.DeviceLimit && dev.Used > 0 {
+		return false
+	}
+	return true
+}
+
+// Allocate returns the req.Nums devices the policy places the request on,
+// in decreasing score order.
+func Allocate(p AllocationPolicy, req *util.ContainerDeviceRequest, devices []*Device) ([]*Device, error) {
+	var candidates []*Device
+	for _, d := range devices {
+		if p.Filter(req, d) {
+			candidates = append(candidates, d)
+		}
+	}
+	if int32(len(candidates)) < req.Nums {
+		return nil, fmt.Errorf("policy %s: %d of %d devices fit the request, %d needed", p.Name(), len(candidates), len(devices), req.Nums)
+	}
+	scores := make(map[*Device]float64, len(candidates))
+	for _, d := range candidates {
+		scores[d] = p.Score(req, d, candidates)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i]] > scores[candidates[j]]
+	})
+	return candidates[:req.Nums], nil
+}
+
+// Fragmentation returns the share of the free memory of the healthy devices
+// stranded on devices already in use, between 0 when the free memory is on
+// whole free devices and 1 when no device is left whole.
+func Fragmentation(devices []*Device) float64 {
+	var free, stranded int32
+	for _, d := range devices {
+		if !d.Health {
+			continue
+		}
+		free += d.Freemem()
+		if d.Used > 0 {
+			stranded += d.Freemem()
+		}
+	}
+	if free <= 0 {
+		return 0
+	}
+	return float64(stranded) / float64(free)
+}
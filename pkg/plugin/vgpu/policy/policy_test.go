@@ -0,0 +1,201 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+func device(id string, used, usedmem, usedcores int32) *Device {
+	return &Device{
+		ID:        id,
+		Health:    true,
+		Numa:      -1,
+		Switch:    -1,
+		Count:     4,
+		Totalmem:  1000,
+		Totalcore: 100,
+		Used:      used,
+		Usedmem:   usedmem,
+		Usedcores: usedcores,
+	}
+}
+
+func TestFits(t *testing.T) {
+	unhealthy := device("gpu", 0, 0, 0)
+	unhealthy.Health = false
+	testCases := []struct {
+		req    util.ContainerDeviceRequest
+		dev    *Device
+		output bool
+	}{
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 500, Coresreq: 50},
+			dev:    device("gpu", 1, 500, 50),
+			output: true,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 500},
+			dev:    unhealthy,
+			output: false,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 100},
+			dev:    device("gpu", 4, 0, 0),
+			output: false,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 501},
+			dev:    device("gpu", 1, 500, 0),
+			output: false,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, MemPercentagereq: 50},
+			dev:    device("gpu", 1, 500, 0),
+			output: true,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, MemPercentagereq: 60},
+			dev:    device("gpu", 1, 500, 0),
+			output: false,
+		},
+		{
+			// No memory requested takes the whole device memory.
+			req:    util.ContainerDeviceRequest{Nums: 1},
+			dev:    device("gpu", 1, 1, 0),
+			output: false,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 100, Coresreq: 60},
+			dev:    device("gpu", 1, 0, 50),
+			output: false,
+		},
+		{
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 100, Coresreq: util.DeviceLimit},
+			dev:    device("gpu", 1, 0, 0),
+			output: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, Fits(&tc.req, tc.dev))
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	newDevices := func() []*Device {
+		devices := []*Device{
+			device("gpu0", 0, 0, 0),
+			device("gpu1", 2, 600, 40),
+			device("gpu2", 1, 200, 10),
+			device("gpu3", 3, 950, 0),
+		}
+		devices[0].Numa, devices[1].Numa, devices[2].Numa, devices[3].Numa = 0, 1, 1, 0
+		devices[0].Switch, devices[1].Switch, devices[2].Switch, devices[3].Switch = 0, 1, 2, 0
+		return devices
+	}
+	testCases := []struct {
+		policy string
+		req    util.ContainerDeviceRequest
+		output []string
+		err    bool
+	}{
+		{
+			policy: Binpack,
+			req:    util.ContainerDeviceRequest{Nums: 1, Memreq: 100},
+			output: []string{"gpu1"},
+		},
+		{
+			policy: Spread,
+			req:    util.ContainerDeviceRequest{Nums: 2, Memreq: 100},
+			output: []string{"gpu0", "gpu2"},
+		},
+		{
+			// gpu3 is too full, the NUMA node 1 is the only one with two
+			// candidates.
+			policy: Topology,
+			req:    util.ContainerDeviceRequest{Nums: 2, Memreq: 100},
+			output: []string{"gpu1", "gpu2"},
+		},
+		{
+			policy: Binpack,
+			req:    util.ContainerDeviceRequest{Nums: 4, Memreq: 100},
+			err:    true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			p, err := Get(tc.policy)
+			require.NoError(t, err)
+			res, err := Allocate(p, &tc.req, newDevices())
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var ids []string
+			for _, d := range res {
+				ids = append(ids, d.ID)
+			}
+			require.Equal(t, tc.output, ids)
+		})
+	}
+}
+
+func TestBuiltinScore(t *testing.T) {
+	req := &util.ContainerDeviceRequest{Nums: 1, Memreq: 100}
+	idle, busy := device("idle", 0, 0, 0), device("busy", 2, 500, 50)
+	candidates := []*Device{idle, busy}
+	testCases := []struct {
+		policy string
+		// better is the device the policy scores higher.
+		better, worse *Device
+	}{
+		{policy: Binpack, better: busy, worse: idle},
+		{policy: Spread, better: idle, worse: busy},
+		{policy: Topology, better: busy, worse: idle},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			p, err := Get(tc.policy)
+			require.NoError(t, err)
+			require.Greater(t, p.Score(req, tc.better, candidates), p.Score(req, tc.worse, candidates))
+		})
+	}
+
+	// The NUMA node wins over the usage for the topology policy.
+	local := device("local", 0, 0, 0)
+	local.Numa = 0
+	peer := device("peer", 0, 0, 0)
+	peer.Numa = 0
+	remote := device("remote", 3, 900, 90)
+	remote.Numa = 1
+	p, err := Get(Topology)
+	require.NoError(t, err)
+	candidates = []*Device{local, peer, remote}
+	req.Nums = 2
+	require.Greater(t, p.Score(req, local, candidates), p.Score(req, remote, candidates))
+}
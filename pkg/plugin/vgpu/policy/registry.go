@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"plugin"
+	"sort"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+var (
+	mutex    sync.RWMutex
+	policies = make(map[string]AllocationPolicy)
+)
+
+// Register makes p available under its name, replacing any policy of the
+// same name.
+func Register(p AllocationPolicy) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	policies[p.Name()] = p
+}
+
+// Get returns the policy registered under name.
+func Get(name string) (AllocationPolicy, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	p, ok := policies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown allocation policy %q, known policies are %v", name, names())
+	}
+	return p, nil
+}
+
+func names() []string {
+	var res []string
+	for name := range policies {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// LoadPlugin registers the policy of a Go plugin built with
+// `go build -buildmode=plugin` against the same version of this module. The
+// plugin exports either a `Policy` variable implementing AllocationPolicy or
+// a `NewPolicy func() AllocationPolicy` function.
+func LoadPlugin(path string) (AllocationPolicy, error) {
+	plug, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open policy plugin %s: %v", path, err)
+	}
+	var p AllocationPolicy
+	if sym, err := plug.Lookup("Policy"); err == nil {
+		switch v := sym.(type) {
+		case *AllocationPolicy:
+			p = *v
+		case AllocationPolicy:
+			p = v
+		default:
+			return nil, fmt.Errorf("policy plugin %s: Policy is a %T, not an AllocationPolicy", path, sym)
+		}
+	} else if sym, err := plug.Lookup("NewPolicy"); err == nil {
+		newPolicy, ok := sym.(func() AllocationPolicy)
+		if !ok {
+			return nil, fmt.Errorf("policy plugin %s: NewPolicy is a %T, not a func() AllocationPolicy", path, sym)
+		}
+		p = newPolicy()
+	} else {
+		return nil, fmt.Errorf("policy plugin %s exports neither Policy nor NewPolicy", path)
+	}
+	if p == nil {
+		return nil, fmt.Errorf("policy plugin %s returned no policy", path)
+	}
+	Register(p)
+	klog.Infof("Loaded allocation policy %s from %s", p.Name(), path)
+	return p, nil
+}
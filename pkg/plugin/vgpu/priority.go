@@ -0,0 +1,48 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// podTaskPriority returns the priority of the vGPUs of the pod for libvgpu,
+// false when the pod leaves it to the default of libvgpu.
+func podTaskPriority(pod *corev1.Pod) (int, bool, error) {
+	class, ok := pod.Annotations[util.TaskPriorityAnnotation]
+	if !ok {
+		return 0, false, nil
+	}
+	priority, ok := util.TaskPriority(class)
+	if !ok {
+		return 0, false, fmt.Errorf("unknown vGPU priority %q of annotation %s, expected one of %s",
+			class, util.TaskPriorityAnnotation, strings.Join(util.TaskPriorityClasses, ", "))
+	}
+	return priority, true, nil
+}
+
+// checkTaskPriority returns an error if the priority annotation of the pod
+// isn't a known class.
+func checkTaskPriority(a *podAllocation) error {
+	_, _, err := podTaskPriority(a.pod)
+	return err
+}
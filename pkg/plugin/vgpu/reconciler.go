@@ -0,0 +1,202 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// Results of the reconciliations of the annotations of the node.
+const (
+	ReconcileInSync   = "in-sync"
+	ReconcileRepaired = "repaired"
+	ReconcileError    = "error"
+)
+
+var (
+	annotationReconcilesDesc = prometheus.NewDesc(
+		"vgpu_node_annotation_reconciles_total",
+		"Checks of the annotations the plugin registers on its node, by result: in-sync, repaired or error",
+		[]string{"result"}, nil,
+	)
+	annotationDriftDesc = prometheus.NewDesc(
+		"vgpu_node_annotation_drift_total",
+		"Annotations of the node found edited or removed by another writer and written back, by annotation",
+		[]string{"annotation"}, nil,
+	)
+	nodeUpdateConflictsDesc = prometheus.NewDesc(
+		"vgpu_node_update_conflicts_total",
+		"Writes to the node which conflicted with a concurrent update and were retried",
+		nil, nil,
+	)
+)
+
+// AnnotationReconciler owns the annotations the plugin registers on its
+// node for the scheduler, the devices and the cores granted on them. It
+// writes them when they are registered and checks them in between, those
+// another writer edited or removed are written back.
+//
+// NodeHandshake is written with the others but not checked, the scheduler
+// answers on it.
+type AnnotationReconciler struct {
+	node     string
+	interval time.Duration
+	stopCh   chan struct{}
+
+	mutex sync.Mutex
+	// desired are the values of the annotations owned, once registered.
+	desired map[string]string
+	results map[string]float64
+	drift   map[string]float64
+}
+
+// NewAnnotationReconciler returns a reconciler of the annotations of node
+// checking them every interval once started, never when 0.
+func NewAnnotationReconciler(node string, interval time.Duration) *AnnotationReconciler {
+	return &AnnotationReconciler{
+		node:     node,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+		desired:  make(map[string]string),
+		results:  make(map[string]float64),
+		drift:    make(map[string]float64),
+	}
+}
+
+func (r *AnnotationReconciler) Start() {
+	if r.interval > 0 {
+		go r.Run()
+	}
+}
+
+func (r *AnnotationReconciler) Stop() {
+	close(r.stopCh)
+}
+
+func (r *AnnotationReconciler) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(); err != nil {
+				klog.Errorf("Failed to reconcile the annotations of node %s: %v", r.node, err)
+			}
+		}
+	}
+}
+
+// Publish writes the annotations on the node and owns them from then on,
+// with the values given.
+func (r *AnnotationReconciler) Publish(annotations map[string]string) error {
+	r.mutex.Lock()
+	for k, v := range annotations {
+		if k != util.NodeHandshake {
+			r.desired[k] = v
+		}
+	}
+	r.mutex.Unlock()
+	return lock.NodeUpdates().Patch(r.node, annotations, nil)
+}
+
+// Reconcile writes back the annotations owned the node doesn't have the
+// values of.
+func (r *AnnotationReconciler) Reconcile() error {
+	node, err := util.GetNode(r.node)
+	if err != nil {
+		r.record(ReconcileError, nil)
+		return err
+	}
+	drifted := r.drifted(node)
+	if len(drifted) == 0 {
+		r.record(ReconcileInSync, nil)
+		return nil
+	}
+	klog.Warningf("Annotations %v of node %s were changed by another writer, writing them back", drifted, r.node)
+	// The values are read again on the latest version of the node, for a
+	// registration meanwhile to win.
+	err = lock.NodeUpdates().Mutate(r.node, func(node *corev1.Node) error {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		for k, v := range r.desired {
+			node.Annotations[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		r.record(ReconcileError, nil)
+		return err
+	}
+	r.record(ReconcileRepaired, drifted)
+	return nil
+}
+
+// drifted returns the annotations owned the node doesn't have the values of.
+func (r *AnnotationReconciler) drifted(node *corev1.Node) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var res []string
+	for k, v := range r.desired {
+		if actual, ok := node.Annotations[k]; !ok || actual != v {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (r *AnnotationReconciler) record(result string, drifted []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results[result]++
+	for _, k := range drifted {
+		r.drift[k]++
+	}
+}
+
+func (r *AnnotationReconciler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- annotationReconcilesDesc
+	ch <- annotationDriftDesc
+	ch <- nodeUpdateConflictsDesc
+}
+
+func (r *AnnotationReconciler) Collect(ch chan<- prometheus.Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, result := range []string{ReconcileInSync, ReconcileRepaired, ReconcileError} {
+		ch <- prometheus.MustNewConstMetric(annotationReconcilesDesc, prometheus.CounterValue, r.results[result], result)
+	}
+	keys := make([]string, 0, len(r.drift))
+	for k := range r.drift {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ch <- prometheus.MustNewConstMetric(annotationDriftDesc, prometheus.CounterValue, r.drift[k], k)
+	}
+	ch <- prometheus.MustNewConstMetric(nodeUpdateConflictsDesc, prometheus.CounterValue, float64(lock.NodeUpdates().Conflicts()))
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// KubeletCheckpoint is the checkpoint of the device manager of the kubelet.
+const KubeletCheckpoint = pluginapi.DevicePluginPath + "kubelet_internal_checkpoint"
+
+const (
+	containerStateRoot = "/tmp/vgpu/containers"
+	vgpuLockDir        = "/tmp/vgpulock"
+)
+
+// containerStateDir is the host directory of the shared region and limits
+// of a container.
+func containerStateDir(podUID, ctrName string) string {
+	return containerStateRoot + "/" + podUID + "_" + ctrName
+}
+
+func makeStateDirs(dir string) {
+	os.MkdirAll(dir, 0777)
+	os.Chmod(dir, 0777)
+	os.MkdirAll(vgpuLockDir, 0777)
+	os.Chmod(vgpuLockDir, 0777)
+}
+
+// limitEnvs returns the limits libvgpu enforces for the devices.
+func limitEnvs(devices util.ContainerDevices) map[string]string {
+	cfg := CurrentRuntimeConfig()
+	envs := make(map[string]string)
+	for i, dev := range devices {
+		envs[fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)] = fmt.Sprintf("%vm", dev.Usedmem*int32(config.GPUMemoryFactor))
+		if cfg.MemoryScaling.Of(dev.Type) > 1 {
+			envs[util.OversubscribeEnv] = "true"
+		}
+	}
+	if len(devices) > 0 {
+		envs["CUDA_DEVICE_SM_LIMIT"] = fmt.Sprint(devices[0].Usedcores)
+	}
+	if cfg.DisableCoreLimit {
+		envs[util.CoreUtilizationPolicyEnv] = "disable"
+	}
+	return envs
+}
+
+// writeEnvFile writes the limits of envs for n devices in the file mounted
+// on /etc/vgpu_envs.
+func writeEnvFile(path string, envs map[string]string, n int) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "CUDA_DEVICE_SM_LIMIT=%s\n", envs["CUDA_DEVICE_SM_LIMIT"])
+	if policy, ok := envs[util.CoreUtilizationPolicyEnv]; ok {
+		fmt.Fprintf(file, "%s=%s\n", util.CoreUtilizationPolicyEnv, policy)
+	}
+	if priority, ok := envs[util.TaskPriorityEnv]; ok {
+		fmt.Fprintf(file, "%s=%s\n", util.TaskPriorityEnv, priority)
+	}
+	if oversubscribe, ok := envs[util.OversubscribeEnv]; ok {
+		fmt.Fprintf(file, "%s=%s\n", util.OversubscribeEnv, oversubscribe)
+	}
+	for i := 0; i < n; i++ {
+		limitKey := fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)
+		fmt.Fprintf(file, "%s=%s\n", limitKey, envs[limitKey])
+	}
+	return nil
+}
+
+// kubeletEntry is a container allocation of the kubelet checkpoint, the
+// device IDs are listed by NUMA node since Kubernetes 1.20.
+type kubeletEntry struct {
+	PodUID        string
+	ContainerName string
+	ResourceName  string
+	DeviceIDs     json.RawMessage
+}
+
+func (e kubeletEntry) ids() []string {
+	var ids []string
+	if err := json.Unmarshal(e.DeviceIDs, &ids); err == nil {
+		return ids
+	}
+	var byNuma map[string][]string
+	if err := json.Unmarshal(e.DeviceIDs, &byNuma); err != nil {
+		return nil
+	}
+	for _, numa := range byNuma {
+		ids = append(ids, numa...)
+	}
+	return ids
+}
+
+// readKubeletCheckpoint returns the device IDs of resourceName the kubelet
+// allocated to the containers, keyed by pod UID/container.
+func readKubeletCheckpoint(path, resourceName string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ck struct {
+		Data struct {
+			PodDeviceEntries []kubeletEntry
+		}
+	}
+	if err := json.Unmarshal(data, &ck); err != nil {
+		return nil, fmt.Errorf("unmarshal kubelet checkpoint: %v", err)
+	}
+	res := make(map[string][]string)
+	for _, e := range ck.Data.PodDeviceEntries {
+		if e.ResourceName == resourceName {
+			key := e.PodUID + "/" + e.ContainerName
+			res[key] = append(res[key], e.ids()...)
+		}
+	}
+	return res, nil
+}
+
+func sameDevices(a, b util.ContainerDevices) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Recover reconciles, before the plugin advertises the devices, the
+// allocations of the pods of the node with the checkpoint of the plugin and
+// the one of the kubelet, and restores the limits of the containers lost
+// with /tmp on reboot. The devices assigned to the pods win over the
+// checkpoints, the scheduler accounts the capacity of the node from them.
+func Recover(nodeName string, devices []*Device) error {
+	pods, err := listNodePods(nodeName)
+	if err != nil {
+		return err
+	}
+	kubelet, err := readKubeletCheckpoint(KubeletCheckpoint, util.ResourceName)
+	if err != nil {
+		klog.Warningf("Recovering without the kubelet checkpoint: %v", err)
+	}
+	recorded := make(map[string]AllocationRecord)
+	ck := allocationCheckpoint()
+	if ck != nil {
+		for _, r := range ck.List() {
+			recorded[r.key()] = r
+		}
+	}
+
+	var records []AllocationRecord
+	restored := 0
+	owned := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != nodeName || pod.Annotations[util.DeviceBindPhase] != util.DeviceBindSuccess {
+			continue
+		}
+		var allocations []containerAllocation
+		for i, ctr := range util.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations]) {
+			if len(ctr) == 0 || i >= len(pod.Spec.Containers) {
+				continue
+			}
+			allocations = append(allocations, containerAllocation{container: pod.Spec.Containers[i], devices: ctr})
+		}
+		inits, err := initContainerAllocations(util.NvidiaGPUDevice, &pod, devices)
+		if err != nil {
+			klog.Warningf("Not recovering the init containers of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		for _, a := range append(inits, allocations...) {
+			ctr := a.devices
+			r := AllocationRecord{
+				PodUID:    string(pod.UID),
+				Namespace: pod.Namespace,
+				Pod:       pod.Name,
+				Container: a.container.Name,
+				Devices:   ctr,
+				Time:      time.Now(),
+			}
+			owned[r.key()] = true
+			if old, ok := recorded[r.key()]; ok {
+				if !sameDevices(old.Devices, ctr) {
+					klog.Warningf("Container %s of pod %s/%s was checkpointed with devices %v, assigned %v", r.Container, pod.Namespace, pod.Name, old.Devices, ctr)
+				}
+				r.Time = old.Time
+			} else if ck != nil {
+				klog.Infof("Recovered allocation of container %s of pod %s/%s missing from the checkpoint", r.Container, pod.Namespace, pod.Name)
+			}
+			if _, ok := kubelet[r.key()]; kubelet != nil && !ok {
+				klog.Warningf("Container %s of pod %s/%s is assigned devices the kubelet didn't allocate", r.Container, pod.Namespace, pod.Name)
+			}
+			records = append(records, r)
+
+			if CurrentRuntimeConfig().Mode == "mig" {
+				continue
+			}
+			dir := containerStateDir(r.PodUID, r.Container)
+			if _, err := os.Stat(filepath.Join(dir, "vgpu_envs")); !os.IsNotExist(err) {
+				continue
+			}
+			makeStateDirs(dir)
+			envs := limitEnvs(ctr)
+			if mpsIsolated(&pod) {
+				mpsEnvs(envs, ctr)
+			}
+			if priority, ok, _ := podTaskPriority(&pod); ok {
+				envs[util.TaskPriorityEnv] = fmt.Sprint(priority)
+			}
+			if fallback, _ := podMemoryFallback(&pod); fallback {
+				envs[util.OversubscribeEnv] = "true"
+			}
+			if err := writeEnvFile(filepath.Join(dir, "vgpu_envs"), envs, len(ctr)); err != nil {
+				klog.Errorf("Failed to restore limits of container %s of pod %s/%s: %v", r.Container, pod.Namespace, pod.Name, err)
+				continue
+			}
+			restored++
+		}
+	}
+	for key, r := range recorded {
+		if !owned[key] {
+			klog.Infof("Dropping checkpointed allocation of container %s of gone pod %s/%s", r.Container, r.Namespace, r.Pod)
+		}
+	}
+	for key := range kubelet {
+		if !owned[key] {
+			klog.Warningf("Kubelet allocated %s to container %s which no pod of the node was assigned", util.ResourceName, key)
+		}
+	}
+	if ck != nil {
+		if err := ck.Replace(records); err != nil {
+			klog.Errorf("Failed to save checkpoint: %v", err)
+		}
+	}
+	// No container is allocated before the plugins register, the specs of
+	// the pods gone are removed whatever their age.
+	if _, err := removeCDISpecs(nodeName, 0, time.Now()); err != nil {
+		klog.Errorf("Failed to remove the CDI specs of the pods gone: %v", err)
+	}
+
+	// The pods being allocated count too, a device granted beyond its
+	// capacity was double-booked before the restart.
+	for _, d := range nodeLedger(devices, pods, "") {
+		if d.Used > d.Count || d.Usedmem > d.Totalmem || d.Usedcores > d.Totalcore {
+			klog.Errorf("Device %s is overbooked: %d/%d vGPUs, %d/%d memory, %d/%d cores granted",
+				d.ID, d.Used, d.Count, d.Usedmem, d.Totalmem, d.Usedcores, d.Totalcore)
+		}
+	}
+	klog.Infof("Recovered %d container allocations, restored the limits of %d", len(records), restored)
+	return nil
+}
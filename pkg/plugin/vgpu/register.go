@@ -19,11 +19,13 @@ package vgpu
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"k8s.io/klog/v2"
 	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
 	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
 )
 
@@ -33,6 +35,16 @@ type DeviceRegister struct {
 	deviceCache *DeviceCache
 	unhealthy   chan *Device
 	stopCh      chan struct{}
+	// refresh registers the devices again before the next interval.
+	refresh chan struct{}
+	// registered is the last registration of every device.
+	registered map[string]util.DeviceInfo
+	// reserved are the devices last registered without vGPUs.
+	reserved   []string
+	mutex      sync.Mutex
+	reconciler *AnnotationReconciler
+	// publisher publishes the devices as VGPUDevices too when not nil.
+	publisher *DevicePublisher
 }
 
 func NewDeviceRegister(deviceCache *DeviceCache) *DeviceRegister {
@@ -40,90 +52,189 @@ func NewDeviceRegister(deviceCache *DeviceCache) *DeviceRegister {
 		deviceCache: deviceCache,
 		unhealthy:   make(chan *Device),
 		stopCh:      make(chan struct{}),
+		refresh:     make(chan struct{}, 1),
+		registered:  make(map[string]util.DeviceInfo),
+		reconciler:  NewAnnotationReconciler(config.NodeName, config.AnnotationReconcileInterval),
 	}
 }
 
 func (r *DeviceRegister) Start() {
 	r.deviceCache.AddNotifyChannel("register", r.unhealthy)
+	r.reconciler.Start()
 	go r.WatchAndRegister()
 }
 
 func (r *DeviceRegister) Stop() {
+	r.reconciler.Stop()
 	close(r.stopCh)
 }
 
-func (r *DeviceRegister) apiDevices() *[]*util.DeviceInfo {
+// PublishDevices publishes the devices registered as VGPUDevices with p
+// besides the node annotations, kept for the schedulers reading them.
+func (r *DeviceRegister) PublishDevices(p *DevicePublisher) {
+	r.publisher = p
+}
+
+// Refresh registers the devices again without waiting for the next
+// interval, e.g. once their configuration changed.
+func (r *DeviceRegister) Refresh() {
+	select {
+	case r.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Reconciler returns the reconciler of the annotations registered.
+func (r *DeviceRegister) Reconciler() *AnnotationReconciler {
+	return r.reconciler
+}
+
+// apiDevices returns the registrations of the devices, the reserved ones and
+// all of them while the node drains without vGPUs for the scheduler not to
+// place any on them.
+func (r *DeviceRegister) apiDevices(reserved *config.FilterDevice) *[]*util.DeviceInfo {
 	devs := r.deviceCache.GetCache()
 	res := make([]*util.DeviceInfo, 0, len(devs))
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var reservedIDs []string
 	for _, dev := range devs {
-		ndev, ret := config.Nvml().DeviceGetHandleByUUID(dev.ID)
-		if ret != nvml.SUCCESS {
-			fmt.Println("nvml new device by uuid error id=", dev.ID)
-			panic(ret)
+		info, err := deviceInfo(dev)
+		if err != nil {
+			// A GPU gone from the bus can't be queried anymore, it is
+			// reported unhealthy as last registered for the scheduler to
+			// stop placing pods on it.
+			last, ok := r.registered[dev.ID]
+			if !ok {
+				klog.Errorf("Failed to get device %s, not registering it: %v", dev.ID, err)
+				continue
+			}
+			klog.Warningf("Failed to get device %s, registering it unhealthy: %v", dev.ID, err)
+			last.Health = false
+			info = &last
 		}
-
-		memory, ret := config.Nvml().DeviceGetMemoryInfo(ndev)
-		if ret != nvml.SUCCESS {
-			fmt.Println("failed to get memory info for device id=", dev.ID)
-			panic(ret)
+		isReserved := deviceReserved(reserved, dev)
+		if isReserved {
+			reservedIDs = append(reservedIDs, dev.ID)
 		}
-
-		model, ret := config.Nvml().DeviceGetName(ndev)
-		if ret != nvml.SUCCESS {
-			fmt.Println("failed to get model name for device id=", dev.ID)
-			panic(ret)
+		if isReserved || nodeDraining() {
+			info.Count = 0
+		} else if info.Count == 0 {
+			info.Count = int32(CurrentRuntimeConfig().DeviceSplitCount)
 		}
-
-		klog.V(3).Infoln("nvml registered device id=", dev.ID, "memory=", memory.Total, "type=", model)
-
-		registeredmem := int32(memory.Total/(1024*1024)) / int32(config.GPUMemoryFactor)
-		klog.V(3).Infoln("GPUMemoryFactor=", config.GPUMemoryFactor, "registeredmem=", registeredmem)
-		res = append(res, &util.DeviceInfo{
-			Id:     dev.ID,
-			Count:  int32(config.DeviceSplitCount),
-			Devmem: registeredmem,
-			Mode:   config.Mode,
-			Type:   fmt.Sprintf("%v-%v", "NVIDIA", model),
-			Health: strings.EqualFold(dev.Health, "healthy"),
-		})
+		r.registered[dev.ID] = *info
+		res = append(res, info)
+	}
+	if strings.Join(reservedIDs, ",") != strings.Join(r.reserved, ",") {
+		klog.Infof("Reserved devices out of the vGPU pool: %v", reservedIDs)
+		r.reserved = reservedIDs
 	}
 	return &res
 }
 
+// deviceInfo returns the registration of the device.
+func deviceInfo(dev *Device) (*util.DeviceInfo, error) {
+	ndev, ret := config.Nvml().DeviceGetHandleByUUID(dev.ID)
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("nvml new device by uuid error id=%s: %v", dev.ID, ret)
+	}
+
+	memory, err := config.DeviceMemory(ndev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory info for device id=%s: %v", dev.ID, err)
+	}
+
+	model, ret := config.Nvml().DeviceGetName(ndev)
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to get model name for device id=%s: %v", dev.ID, ret)
+	}
+
+	klog.V(3).Infoln("nvml registered device id=", dev.ID, "memory=", memory.Total(), "tier=", memory.Tier, "type=", model)
+
+	// The memory is overcommitted by scaling what the device registers, the
+	// scheduler only applying the scaling of the cluster.
+	devtype := fmt.Sprintf("%v-%v", "NVIDIA", model)
+	cfg := CurrentRuntimeConfig()
+	registeredmem := cfg.MemoryScaling.Registered(devtype, int32(memory.Total()/(1024*1024))/int32(config.GPUMemoryFactor))
+	klog.V(3).Infoln("GPUMemoryFactor=", config.GPUMemoryFactor, "scaling=", cfg.MemoryScaling.Of(devtype), "registeredmem=", registeredmem)
+	return &util.DeviceInfo{
+		Id:     dev.ID,
+		Count:  int32(cfg.DeviceSplitCount),
+		Devmem: registeredmem,
+		Mode:   cfg.Mode,
+		Type:   devtype,
+		Health: strings.EqualFold(dev.Health, "healthy"),
+	}, nil
+}
+
 func (r *DeviceRegister) RegisterInAnnotation() error {
-	devices := r.apiDevices()
-	annos := make(map[string]string)
 	node, err := util.GetNode(config.NodeName)
 	if err != nil {
-		klog.Errorln("get node error", err.Error())
-		return err
+		klog.Errorln("get node error, registering the reserved devices of the node config only", err.Error())
+		node = nil
 	}
+	pods, podsErr := listNodePods(config.NodeName)
+	devices := r.apiDevices(reservedDevices(node, pods))
+	annos := make(map[string]string)
 	encodeddevices := util.EncodeNodeDevices(*devices)
 	annos[util.NodeHandshake] = "Reported " + time.Now().String()
 	annos[util.NodeNvidiaDeviceRegistered] = encodeddevices
+	annos[util.NodeGPUTypesAnnotation] = encodeNodeGPUTypes(*devices)
+	annos[util.NodeConfigHashAnnotation] = CurrentRuntimeConfig().Hash()
+	if podsErr != nil {
+		klog.Errorln("list node pods error", podsErr.Error())
+	} else {
+		annos[util.NodeCoresAnnotation] = encodeNodeCores(nodeLedger(r.deviceCache.GetCache(), pods, ""))
+	}
 	klog.Infoln("Reporting devices", encodeddevices, "in", time.Now().String())
-	err = util.PatchNodeAnnotations(node, annos)
+	err = r.reconciler.Publish(annos)
 
 	if err != nil {
 		klog.Errorln("patch node error", err.Error())
 	}
+	if r.publisher != nil && podsErr == nil {
+		if perr := r.publisher.Publish(*devices, r.deviceCache.GetCache(), pods); perr != nil {
+			klog.Errorln("publish devices error", perr.Error())
+			if err == nil {
+				err = perr
+			}
+		}
+	}
 	return err
 }
 
+// encodeNodeCores encodes the cores of the devices of the ledger and the
+// cores granted on each for NodeCoresAnnotation.
+func encodeNodeCores(ledger []*policy.Device) string {
+	var b strings.Builder
+	for _, d := range ledger {
+		fmt.Fprintf(&b, "%s,%d,%d:", d.ID, d.Totalcore, d.Usedcores)
+	}
+	return b.String()
+}
+
 func (r *DeviceRegister) WatchAndRegister() {
 	klog.Infof("into WatchAndRegister")
 	for {
-		if len(config.Mode) == 0 {
+		if len(CurrentRuntimeConfig().Mode) == 0 {
 			klog.V(5).Info("register skipped, waiting for device config to be loaded")
 			time.Sleep(time.Second * 2)
 			continue
 		}
+		wait := time.Second * 30
 		err := r.RegisterInAnnotation()
 		if err != nil {
 			klog.Errorf("register error, %v", err)
-			time.Sleep(time.Second * 5)
-		} else {
-			time.Sleep(time.Second * 30)
+			wait = time.Second * 5
+		}
+		// A device turning unhealthy is registered right away.
+		select {
+		case <-r.stopCh:
+			return
+		case dev := <-r.unhealthy:
+			klog.Infof("Registering unhealthy device %s", dev.ID)
+		case <-r.refresh:
+		case <-time.After(wait):
 		}
 	}
 }
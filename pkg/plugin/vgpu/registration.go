@@ -0,0 +1,88 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons the plugins register with the kubelet for.
+const (
+	RegistrationStart          = "start"
+	RegistrationKubeletRestart = "kubelet-restart"
+	RegistrationSignal         = "sighup"
+	RegistrationRetry          = "retry"
+	RegistrationConfigChange   = "config-change"
+	RegistrationDrain          = "drain"
+)
+
+var kubeletRegistrationsDesc = prometheus.NewDesc(
+	"vgpu_kubelet_registrations_total",
+	"Registrations of the device plugins with the kubelet, by reason: start, kubelet-restart, sighup, retry, config-change or drain, and result: success or error",
+	[]string{"reason", "result"}, nil,
+)
+
+type registrationKey struct {
+	reason, result string
+}
+
+// RegistrationCounter counts the registrations of the plugins with the
+// kubelet, every restart of all the plugins being one.
+type RegistrationCounter struct {
+	mutex  sync.Mutex
+	counts map[registrationKey]float64
+}
+
+// KubeletRegistrations counts the registrations of the plugins of the
+// process.
+var KubeletRegistrations = &RegistrationCounter{counts: make(map[registrationKey]float64)}
+
+// Record counts a registration for reason, failed when err isn't nil.
+func (c *RegistrationCounter) Record(reason string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[registrationKey{reason: reason, result: result}]++
+}
+
+func (c *RegistrationCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- kubeletRegistrationsDesc
+}
+
+func (c *RegistrationCounter) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keys := make([]registrationKey, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].reason != keys[j].reason {
+			return keys[i].reason < keys[j].reason
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(kubeletRegistrationsDesc, prometheus.CounterValue, c.counts[key], key.reason, key.result)
+	}
+}
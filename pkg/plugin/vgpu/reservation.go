@@ -0,0 +1,112 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// reservedDevices returns the devices of the node kept out of the vGPU pool:
+// those reserved by the node config and by its NodeReservedDevicesAnnotation,
+// those of the whole GPU pool and those still granted whole to one of the
+// pods. The node and the pods may be nil.
+func reservedDevices(node *corev1.Node, pods []corev1.Pod) *config.FilterDevice {
+	cfg := CurrentRuntimeConfig()
+	res := &config.FilterDevice{}
+	for _, r := range []*config.FilterDevice{cfg.ReservedDevices, cfg.WholeDevices} {
+		if r != nil {
+			res.Index = append(res.Index, r.Index...)
+			res.UUID = append(res.UUID, r.UUID...)
+		}
+	}
+	if pods != nil {
+		granted, err := wholeGrantedDevices(pods)
+		if err != nil {
+			klog.Errorf("Failed to read the devices granted whole by the kubelet: %v", err)
+		}
+		res.UUID = append(res.UUID, granted...)
+	}
+	if node == nil {
+		return res
+	}
+	for _, s := range strings.Split(node.Annotations[util.NodeReservedDevicesAnnotation], ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if i, err := strconv.ParseUint(s, 10, 32); err == nil {
+			res.Index = append(res.Index, uint(i))
+		} else {
+			res.UUID = append(res.UUID, s)
+		}
+	}
+	return res
+}
+
+// deviceReserved reports whether the device is reserved, a MIG device being
+// reserved with its GPU by index.
+func deviceReserved(reserved *config.FilterDevice, dev *Device) bool {
+	if reserved == nil {
+		return false
+	}
+	for _, uuid := range reserved.UUID {
+		if uuid == dev.ID {
+			return true
+		}
+	}
+	i, err := strconv.ParseUint(strings.SplitN(dev.Index, ":", 2)[0], 10, 32)
+	return err == nil && reserved.Filtered(uint(i), "")
+}
+
+// checkReservedDevices verifies that none of the containers of the pod is
+// placed on a reserved device of the node.
+func (m *NvidiaDevicePlugin) checkReservedDevices(nodename string, a *podAllocation) error {
+	node, err := util.GetNode(nodename)
+	if err != nil {
+		return err
+	}
+	pods, err := listNodePods(nodename)
+	if err != nil {
+		return err
+	}
+	reserved := reservedDevices(node, pods)
+	if len(reserved.Index) == 0 && len(reserved.UUID) == 0 {
+		return nil
+	}
+	byUUID := make(map[string]*Device)
+	for _, d := range m.Devices() {
+		byUUID[d.ID] = d
+	}
+	for _, c := range a.pending {
+		if c.init {
+			continue
+		}
+		for _, dev := range c.devices {
+			if d, ok := byUUID[dev.UUID]; ok && deviceReserved(reserved, d) {
+				return fmt.Errorf("device %s of container %s is reserved on node %s", dev.UUID, c.container.Name, nodename)
+			}
+		}
+	}
+	return nil
+}
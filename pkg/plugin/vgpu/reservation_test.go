@@ -0,0 +1,86 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// useRuntimeConfig applies c for the test.
+func useRuntimeConfig(t *testing.T, c RuntimeConfig) {
+	prev := CurrentRuntimeConfig()
+	t.Cleanup(prev.Apply)
+	c.Apply()
+}
+
+func TestReservedDevices(t *testing.T) {
+	testCases := []struct {
+		config     RuntimeConfig
+		annotation string
+		output     *config.FilterDevice
+	}{
+		{output: &config.FilterDevice{}},
+		{
+			config: RuntimeConfig{
+				ReservedDevices: &config.FilterDevice{Index: []uint{0}, UUID: []string{"GPU-a"}},
+				WholeDevices:    &config.FilterDevice{Index: []uint{3}},
+			},
+			annotation: "1, GPU-b,,",
+			output:     &config.FilterDevice{Index: []uint{0, 3, 1}, UUID: []string{"GPU-a", "GPU-b"}},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			useRuntimeConfig(t, tc.config)
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{util.NodeReservedDevicesAnnotation: tc.annotation}}}
+			require.Equal(t, tc.output, reservedDevices(node, nil))
+		})
+	}
+}
+
+func TestDeviceReserved(t *testing.T) {
+	reserved := &config.FilterDevice{Index: []uint{1}, UUID: []string{"GPU-a"}}
+	testCases := []struct {
+		reserved *config.FilterDevice
+		device   *Device
+		output   bool
+	}{
+		{reserved: nil, device: &Device{Device: pluginapi.Device{ID: "GPU-a"}, Index: "0"}, output: false},
+		{reserved: reserved, device: &Device{Device: pluginapi.Device{ID: "GPU-a"}, Index: "0"}, output: true},
+		{reserved: reserved, device: &Device{Device: pluginapi.Device{ID: "GPU-b"}, Index: "1"}, output: true},
+		{reserved: reserved, device: &Device{Device: pluginapi.Device{ID: "GPU-b"}, Index: "2"}, output: false},
+		// A MIG device is reserved with its GPU.
+		{reserved: reserved, device: &Device{Device: pluginapi.Device{ID: "MIG-c"}, Index: "1:0"}, output: true},
+		{reserved: reserved, device: &Device{Device: pluginapi.Device{ID: "MIG-d"}, Index: "2:1"}, output: false},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, deviceReserved(tc.reserved, tc.device))
+		})
+	}
+}
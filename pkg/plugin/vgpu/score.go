@@ -0,0 +1,181 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+)
+
+// ScoresPath is where the plugin serves the allocatable scores of the
+// devices of the node.
+const ScoresPath = "/api/v1/scores"
+
+// The temperatures a device scores 1 below and 0 above.
+const (
+	coolTemperature = 50
+	hotTemperature  = 90
+)
+
+// DeviceScore is how well a device can take one more vGPU, every score
+// between 0, the worst, and 1, the best.
+type DeviceScore struct {
+	UUID    string `json:"uuid"`
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	Healthy bool   `json:"healthy"`
+	// FreeSlots, FreeMemory and FreeCores are what is not granted yet, the
+	// memory in MiB.
+	FreeSlots  int32 `json:"freeSlots"`
+	FreeMemory int32 `json:"freeMemory"`
+	FreeCores  int32 `json:"freeCores"`
+	// Temperature is in degrees C, -1 when unknown.
+	Temperature int `json:"temperature"`
+
+	MemoryScore      float64 `json:"memoryScore"`
+	CoresScore       float64 `json:"coresScore"`
+	TemperatureScore float64 `json:"temperatureScore"`
+	// FragmentationScore is 1 on a device already shared and lower on an
+	// empty one the more of the free memory of the node it holds, a vGPU
+	// placed there stranding the rest of it.
+	FragmentationScore float64 `json:"fragmentationScore"`
+	// Score is the mean of the other scores, 0 for a device which can't
+	// take a vGPU.
+	Score float64 `json:"score"`
+}
+
+// NodeScores are the scores of the devices of a node.
+type NodeScores struct {
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	// Fragmentation is the share of the free memory of the node on devices
+	// already in use.
+	Fragmentation float64       `json:"fragmentation"`
+	Devices       []DeviceScore `json:"devices"`
+}
+
+func ratio(free, total int32) float64 {
+	if total <= 0 || free <= 0 {
+		return 0
+	}
+	return float64(free) / float64(total)
+}
+
+func temperatureScore(t int) float64 {
+	switch {
+	case t <= coolTemperature:
+		return 1
+	case t >= hotTemperature:
+		return 0
+	}
+	return float64(hotTemperature-t) / float64(hotTemperature-coolTemperature)
+}
+
+// scoreDevices scores the devices of the ledger, temperatures by uuid.
+func scoreDevices(ledger []*policy.Device, temperatures map[string]int) []DeviceScore {
+	var free int32
+	for _, d := range ledger {
+		if d.Health && d.Freemem() > 0 {
+			free += d.Freemem()
+		}
+	}
+	res := make([]DeviceScore, 0, len(ledger))
+	for _, d := range ledger {
+		s := DeviceScore{
+			UUID:        d.ID,
+			Index:       d.Index,
+			Type:        d.Type,
+			Healthy:     d.Health,
+			FreeSlots:   d.Count - d.Used,
+			FreeMemory:  d.Freemem(),
+			FreeCores:   d.Freecores(),
+			Temperature: -1,
+		}
+		if t, ok := temperatures[d.ID]; ok {
+			s.Temperature = t
+		}
+		s.MemoryScore = ratio(s.FreeMemory, d.Totalmem)
+		s.CoresScore = ratio(s.FreeCores, d.Totalcore)
+		s.TemperatureScore = temperatureScore(s.Temperature)
+		s.FragmentationScore = 1
+		if d.Used == 0 && free > 0 {
+			s.FragmentationScore = 1 - ratio(d.Freemem(), free)
+		}
+		if d.Health && s.FreeSlots > 0 && s.FreeMemory > 0 {
+			s.Score = (s.MemoryScore + s.CoresScore + s.TemperatureScore + s.FragmentationScore) / 4
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// ScoreHandler serves the scores of the devices of the node, for schedulers
+// which don't speak the annotations of Volcano.
+type ScoreHandler struct {
+	deviceCache *DeviceCache
+}
+
+func NewScoreHandler(deviceCache *DeviceCache) *ScoreHandler {
+	return &ScoreHandler{deviceCache: deviceCache}
+}
+
+// Scores returns the scores of the devices from the grants of the pods of
+// the node.
+func (h *ScoreHandler) Scores() (NodeScores, error) {
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		return NodeScores{}, err
+	}
+	devices := h.deviceCache.GetCache()
+	temperatures := make(map[string]int)
+	for _, d := range devices {
+		ndev, ret := config.Nvml().DeviceGetHandleByUUID(d.ID)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if t, ret := config.Nvml().DeviceGetTemperature(ndev, nvml.TEMPERATURE_GPU); ret == nvml.SUCCESS {
+			temperatures[d.ID] = int(t)
+		}
+	}
+	ledger := nodeLedger(devices, pods, "")
+	return NodeScores{
+		Node:          config.NodeName,
+		Time:          time.Now(),
+		Fragmentation: policy.Fragmentation(ledger),
+		Devices:       scoreDevices(ledger, temperatures),
+	}, nil
+}
+
+func (h *ScoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scores, err := h.Scores()
+	if err != nil {
+		klog.Errorf("Failed to score devices: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(scores); err != nil {
+		klog.Errorf("Failed to encode response: %v", err)
+	}
+}
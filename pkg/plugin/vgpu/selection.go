@@ -0,0 +1,207 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+const (
+	// SelectionPolicyAnnotation names the policy choosing the devices of
+	// the pod, overriding the selection policy of the node.
+	SelectionPolicyAnnotation = "volcano.sh/vgpu-selection-policy"
+	// PinnedDevicesAnnotation lists the UUIDs of the devices the vGPUs of
+	// the pod must be placed on, separated by commas.
+	PinnedDevicesAnnotation = "volcano.sh/gpu-uuid"
+)
+
+// podSelectionPolicy returns the policy choosing the devices of the pod, nil
+// to keep the devices of the scheduler. Pods pinned to devices are binpacked
+// on them when no policy is set.
+func (m *NvidiaDevicePlugin) podSelectionPolicy(pod *corev1.Pod) (policy.AllocationPolicy, error) {
+	if name := pod.Annotations[SelectionPolicyAnnotation]; name != "" {
+		return policy.Get(name)
+	}
+	if m.selectionPolicy == nil && len(pinnedDevices(pod)) > 0 {
+		return policy.Get(policy.Binpack)
+	}
+	return m.selectionPolicy, nil
+}
+
+// pinnedDevices returns the UUIDs of the devices the pod is pinned to.
+func pinnedDevices(pod *corev1.Pod) []string {
+	var res []string
+	for _, uuid := range strings.Split(pod.Annotations[PinnedDevicesAnnotation], ",") {
+		if uuid = strings.TrimSpace(uuid); uuid != "" {
+			res = append(res, uuid)
+		}
+	}
+	return res
+}
+
+// checkPinnedDevices verifies that the containers of the pod are placed on
+// the devices it is pinned to.
+func checkPinnedDevices(a *podAllocation) error {
+	uuids := pinnedDevices(a.pod)
+	if len(uuids) == 0 {
+		return nil
+	}
+	pinned := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		pinned[uuid] = true
+	}
+	for _, c := range a.pending {
+		if c.init {
+			continue
+		}
+		for _, dev := range c.devices {
+			if !pinned[dev.UUID] {
+				return fmt.Errorf("device %s of container %s is not one the pod is pinned to: %v", dev.UUID, c.container.Name, uuids)
+			}
+		}
+	}
+	return nil
+}
+
+// selectDevices re-places the vGPUs of the containers of the pod on the
+// devices the policy prefers, among the devices the pod is pinned to or,
+// when it is not, those of the type the scheduler assigned, each container
+// seeing the devices of the previous ones granted. The grants of the
+// scheduler are kept, and the devices chosen are written in the assigned
+// devices of the pod for the scheduler to account for them.
+func (m *NvidiaDevicePlugin) selectDevices(nodename string, a *podAllocation, p policy.AllocationPolicy) error {
+	pods, err := listNodePods(nodename)
+	if err != nil {
+		return err
+	}
+	ledger := nodeLedger(m.Devices(), pods, a.pod.UID)
+	byUUID := make(map[string]*policy.Device, len(ledger))
+	for _, d := range ledger {
+		byUUID[d.ID] = d
+	}
+	pinned := make(map[string]bool)
+	for _, uuid := range pinnedDevices(a.pod) {
+		if _, ok := byUUID[uuid]; !ok {
+			return fmt.Errorf("pod pinned to device %s, which is not a device of node %s", uuid, nodename)
+		}
+		pinned[uuid] = true
+	}
+	assigned := util.DecodePodDevices(a.pod.Annotations[util.AssignedIDsAnnotations])
+	changed := false
+	for i, c := range a.pending {
+		if c.init {
+			continue
+		}
+		first, ok := byUUID[c.devices[0].UUID]
+		if !ok {
+			return fmt.Errorf("pod assigned unknown device %s", c.devices[0].UUID)
+		}
+		req := &util.ContainerDeviceRequest{
+			Nums: int32(len(c.devices)),
+			Type: c.devices[0].Type,
+		}
+		for _, dev := range c.devices {
+			if dev.Usedmem > req.Memreq {
+				req.Memreq = dev.Usedmem
+			}
+			if dev.Usedcores > req.Coresreq {
+				req.Coresreq = dev.Usedcores
+			}
+		}
+		if exclusiveMode(a.pod) {
+			// The devices are granted whole afterwards.
+			req.Memreq, req.Coresreq = 0, util.DeviceLimit
+		}
+		var candidates []*policy.Device
+		for _, d := range ledger {
+			if (len(pinned) == 0 && d.Type == first.Type) || pinned[d.ID] {
+				candidates = append(candidates, d)
+			}
+		}
+		// The devices on the NUMA nodes of the CPUs of the pod are
+		// preferred when they fit.
+		var local []*policy.Device
+		for _, d := range candidates {
+			if a.numa[d.Numa] {
+				local = append(local, d)
+			}
+		}
+		chosen, err := policy.Allocate(p, req, local)
+		if err != nil {
+			chosen, err = policy.Allocate(p, req, candidates)
+		}
+		if err != nil {
+			return fmt.Errorf("select the devices of container %s: %v", c.container.Name, err)
+		}
+		devices := make(util.ContainerDevices, 0, len(c.devices))
+		for j, dev := range c.devices {
+			if dev.UUID != chosen[j].ID {
+				changed = true
+			}
+			dev.UUID = chosen[j].ID
+			devices = append(devices, dev)
+		}
+		a.pending[i].devices = devices
+		grantDevices(ledger, a.pod.Namespace, devices)
+		for idx, ctr := range a.pod.Spec.Containers {
+			if ctr.Name != c.container.Name {
+				continue
+			}
+			if idx < len(assigned) {
+				assigned[idx] = replaceDevices(assigned[idx], devices)
+			}
+			if idx < len(a.toAllocate) {
+				a.toAllocate[idx] = replaceDevices(a.toAllocate[idx], devices)
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	encoded := util.EncodePodDevices(assigned)
+	if err := util.PatchPodAnnotations(a.pod, map[string]string{
+		util.AssignedIDsAnnotations:           encoded,
+		util.AssignedIDsToAllocateAnnotations: util.EncodePodDevices(a.toAllocate),
+	}); err != nil {
+		return err
+	}
+	klog.Infof("Policy %s selected the devices of pod %s/%s: %s", p.Name(), a.pod.Namespace, a.pod.Name, encoded)
+	a.pod.Annotations[util.AssignedIDsAnnotations] = encoded
+	return nil
+}
+
+// replaceDevices returns the devices of a container with those of the type
+// of devices replaced by them, in order.
+func replaceDevices(ctr util.ContainerDevices, devices util.ContainerDevices) util.ContainerDevices {
+	res := make(util.ContainerDevices, 0, len(ctr))
+	j := 0
+	for _, dev := range ctr {
+		if j < len(devices) && dev.Type == devices[j].Type {
+			dev = devices[j]
+			j++
+		}
+		res = append(res, dev)
+	}
+	return res
+}
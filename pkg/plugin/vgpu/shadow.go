@@ -0,0 +1,164 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/policy"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// Results of a shadow evaluation.
+const (
+	shadowMatch       = "match"
+	shadowDiffer      = "differ"
+	shadowUnplaceable = "unplaceable"
+)
+
+var (
+	shadowEvaluationsDesc = prometheus.NewDesc(
+		"vgpu_shadow_policy_evaluations_total",
+		"Number of allocations the shadow policy was evaluated on, by whether it would have chosen the same devices",
+		[]string{"policy", "result"}, nil,
+	)
+	shadowFragmentationDeltaDesc = prometheus.NewDesc(
+		"vgpu_shadow_policy_fragmentation_delta_sum",
+		"Sum over the allocations of the node fragmentation with the devices of the shadow policy minus with the devices granted",
+		[]string{"policy"}, nil,
+	)
+	shadowFragmentationDesc = prometheus.NewDesc(
+		"vgpu_shadow_policy_fragmentation",
+		"Node fragmentation after the last allocation, with the devices granted and with the devices of the shadow policy",
+		[]string{"policy", "placement"}, nil,
+	)
+)
+
+// shadowEvaluator compares the devices granted to every container with the
+// ones a policy which is not enforced would have chosen.
+type shadowEvaluator struct {
+	policy policy.AllocationPolicy
+
+	mutex         sync.Mutex
+	results       map[string]float64
+	deltaSum      float64
+	fragmentation float64
+	shadowFrag    float64
+}
+
+var (
+	shadowOnce sync.Once
+	shadow     *shadowEvaluator
+)
+
+// getShadowEvaluator returns the evaluator of p, shared by the plugins of
+// every resource and their restarts so that it is registered once.
+func getShadowEvaluator(p policy.AllocationPolicy) *shadowEvaluator {
+	shadowOnce.Do(func() {
+		shadow = &shadowEvaluator{policy: p, results: make(map[string]float64)}
+		prometheus.MustRegister(shadow)
+	})
+	return shadow
+}
+
+// grant returns a copy of the ledger with the devices ids granted the
+// memory and cores of req.
+func grant(ledger []*policy.Device, ids []string, req *util.ContainerDeviceRequest) []*policy.Device {
+	res := make([]*policy.Device, 0, len(ledger))
+	for _, d := range ledger {
+		c := *d
+		for _, id := range ids {
+			if id == d.ID {
+				c.Used++
+				c.Usedmem += policy.RequestMemory(req, d)
+				c.Usedcores += req.Coresreq
+			}
+		}
+		res = append(res, &c)
+	}
+	return res
+}
+
+// Evaluate runs the shadow policy on the request of devreq against the
+// ledger of the node before the allocation.
+func (e *shadowEvaluator) Evaluate(ledger []*policy.Device, pod *corev1.Pod, ctrName string, devreq util.ContainerDevices) {
+	if len(devreq) == 0 {
+		return
+	}
+	req := &util.ContainerDeviceRequest{
+		Nums:     int32(len(devreq)),
+		Type:     devreq[0].Type,
+		Memreq:   devreq[0].Usedmem,
+		Coresreq: devreq[0].Usedcores,
+	}
+	var granted []string
+	for _, cd := range devreq {
+		granted = append(granted, cd.UUID)
+	}
+	sort.Strings(granted)
+	fragmentation := policy.Fragmentation(grant(ledger, granted, req))
+
+	result := shadowUnplaceable
+	shadowFrag := fragmentation
+	var chosen []string
+	if devices, err := policy.Allocate(e.policy, req, ledger); err != nil {
+		klog.Infof("Shadow policy %s can't place container %s of pod %s/%s granted %v: %v",
+			e.policy.Name(), ctrName, pod.Namespace, pod.Name, granted, err)
+	} else {
+		for _, d := range devices {
+			chosen = append(chosen, d.ID)
+		}
+		sort.Strings(chosen)
+		shadowFrag = policy.Fragmentation(grant(ledger, chosen, req))
+		result = shadowMatch
+		if strings.Join(chosen, ",") != strings.Join(granted, ",") {
+			result = shadowDiffer
+			klog.Infof("Shadow policy %s would place container %s of pod %s/%s on %v instead of %v, fragmentation %.3f instead of %.3f",
+				e.policy.Name(), ctrName, pod.Namespace, pod.Name, chosen, granted, shadowFrag, fragmentation)
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.results[result]++
+	e.deltaSum += shadowFrag - fragmentation
+	e.fragmentation, e.shadowFrag = fragmentation, shadowFrag
+}
+
+func (e *shadowEvaluator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shadowEvaluationsDesc
+	ch <- shadowFragmentationDeltaDesc
+	ch <- shadowFragmentationDesc
+}
+
+func (e *shadowEvaluator) Collect(ch chan<- prometheus.Metric) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	name := e.policy.Name()
+	for result, v := range e.results {
+		ch <- prometheus.MustNewConstMetric(shadowEvaluationsDesc, prometheus.CounterValue, v, name, result)
+	}
+	ch <- prometheus.MustNewConstMetric(shadowFragmentationDeltaDesc, prometheus.GaugeValue, e.deltaSum, name)
+	ch <- prometheus.MustNewConstMetric(shadowFragmentationDesc, prometheus.GaugeValue, e.fragmentation, name, "granted")
+	ch <- prometheus.MustNewConstMetric(shadowFragmentationDesc, prometheus.GaugeValue, e.shadowFrag, name, "shadow")
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/slo"
+)
+
+// Reasons the devices assigned to a pod are released for.
+const (
+	StaleFailed         = "failed"
+	StaleDeleted        = "deleted"
+	StaleUnbound        = "unbound"
+	StaleBoundElsewhere = "bound-elsewhere"
+)
+
+// assignmentAnnotations are the annotations the scheduler assigns the
+// devices of a node to a pod with, the pod holds them until it terminates.
+var assignmentAnnotations = []string{
+	util.AssignedNodeAnnotations,
+	util.AssignedIDsAnnotations,
+	util.AssignedIDsToAllocateAnnotations,
+	util.AssignedTimeAnnotations,
+	util.BindTimeAnnotations,
+	util.DeviceBindPhase,
+}
+
+var (
+	staleAllocationsDesc = prometheus.NewDesc(
+		"vgpu_stale_allocations_released_total",
+		"Pods whose vGPU assignment was removed since they were never bound to its node, by reason: failed, deleted, unbound or bound-elsewhere",
+		[]string{"reason"}, nil,
+	)
+	checkpointPrunedDesc = prometheus.NewDesc(
+		"vgpu_checkpoint_records_pruned_total",
+		"Allocation records of the checkpoint dropped since their pod is gone or terminated",
+		nil, nil,
+	)
+)
+
+// AllocationSweeper releases the devices the scheduler assigned to pods of
+// the node which were never bound to it, the pod failed or was deleted
+// before its binding or it was bound elsewhere, since the scheduler counts
+// them against the capacity of the node as long as the pod keeps its
+// assignment. The pods assigned to another node but bound to this one are
+// released by this node, which watches only its own pods. It also drops the
+// checkpoint records and the CDI specs of the pods gone.
+type AllocationSweeper struct {
+	node     string
+	interval time.Duration
+	// grace is how long after its assignment a pod is left to be bound.
+	grace  time.Duration
+	stopCh chan struct{}
+
+	mutex    sync.Mutex
+	released map[string]float64
+	pruned   float64
+}
+
+// NewAllocationSweeper returns a sweeper of the assignments to node older
+// than grace, every interval once started.
+func NewAllocationSweeper(node string, interval, grace time.Duration) *AllocationSweeper {
+	return &AllocationSweeper{
+		node:     node,
+		interval: interval,
+		grace:    grace,
+		stopCh:   make(chan struct{}),
+		released: make(map[string]float64),
+	}
+}
+
+func (s *AllocationSweeper) Start() {
+	go s.Run()
+}
+
+func (s *AllocationSweeper) Stop() {
+	close(s.stopCh)
+}
+
+func (s *AllocationSweeper) Run() {
+	klog.Infof("Releasing the vGPU assignments to node %s not bound after %v every %v", s.node, s.grace, s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			if err := s.Sweep(time.Now()); err != nil {
+				klog.Errorf("Failed to sweep the vGPU assignments of node %s: %v", s.node, err)
+			}
+		}
+	}
+}
+
+// Sweep releases the stale assignments to the node and prunes the
+// checkpoint and the CDI specs.
+func (s *AllocationSweeper) Sweep(now time.Time) error {
+	pods, err := nodePods(s.node).List()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.Spec.NodeName == s.node && !terminated(pod) {
+			live[string(pod.UID)] = true
+		}
+		// The pods assigned to another node but bound to this one are
+		// released here, their node doesn't see them.
+		assigned := pod.Annotations[util.AssignedNodeAnnotations]
+		if assigned == "" {
+			continue
+		}
+		reason := staleAssignment(pod, assigned, s.grace, now)
+		if reason == "" {
+			continue
+		}
+		// The pod changing meanwhile, e.g. assigned again by the scheduler,
+		// fails the removal, it is checked again on the next sweep.
+		if err := util.RemovePodAnnotations(pod, assignmentAnnotations...); err != nil {
+			if !apierrors.IsConflict(err) && !apierrors.IsNotFound(err) {
+				klog.Errorf("Failed to release the %s vGPU assignment of pod %s/%s: %v", reason, pod.Namespace, pod.Name, err)
+			}
+			continue
+		}
+		klog.Infof("Released the %s vGPU assignment of pod %s/%s to node %s", reason, pod.Namespace, pod.Name, assigned)
+		s.mutex.Lock()
+		s.released[reason]++
+		s.mutex.Unlock()
+	}
+	// A spec is written before its container starts, the pod of a spec
+	// younger than grace may not be in the cache yet.
+	if _, err := removeCDISpecs(s.node, s.grace, now); err != nil {
+		klog.Errorf("Failed to remove the CDI specs of the pods gone from node %s: %v", s.node, err)
+	}
+	ck := allocationCheckpoint()
+	if ck == nil {
+		return nil
+	}
+	pruned, err := ck.Prune(func(r AllocationRecord) bool {
+		return live[r.PodUID] || now.Sub(r.Time) < s.grace
+	})
+	if pruned > 0 {
+		klog.Infof("Dropped %d allocation records of the pods gone from node %s", pruned, s.node)
+		s.mutex.Lock()
+		s.pruned += float64(pruned)
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+func terminated(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// staleAssignment returns why the assignment of the pod to node must be
+// released, empty while the pod is bound to it or may still be.
+func staleAssignment(pod *corev1.Pod, node string, grace time.Duration, now time.Time) string {
+	if pod.Spec.NodeName == node {
+		return ""
+	}
+	// getOldestPod overwrites the assignment time when the plugin picks the
+	// pod, the handshake start keeps it.
+	assigned, ok := slo.ParseTime(pod.Annotations[util.HandshakeStartAnnotation])
+	if !ok {
+		assigned, ok = slo.ParseTime(pod.Annotations[util.AssignedTimeAnnotations])
+	}
+	if !ok || assigned.After(now) {
+		assigned = pod.CreationTimestamp.Time
+	}
+	if now.Sub(assigned) < grace {
+		return ""
+	}
+	switch {
+	case pod.Spec.NodeName != "":
+		return StaleBoundElsewhere
+	case pod.DeletionTimestamp != nil:
+		return StaleDeleted
+	case pod.Status.Phase == corev1.PodFailed:
+		return StaleFailed
+	}
+	return StaleUnbound
+}
+
+func (s *AllocationSweeper) Describe(ch chan<- *prometheus.Desc) {
+	ch <- staleAllocationsDesc
+	ch <- checkpointPrunedDesc
+}
+
+func (s *AllocationSweeper) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, reason := range []string{StaleFailed, StaleDeleted, StaleUnbound, StaleBoundElsewhere} {
+		ch <- prometheus.MustNewConstMetric(staleAllocationsDesc, prometheus.CounterValue, s.released[reason], reason)
+	}
+	ch <- prometheus.MustNewConstMetric(checkpointPrunedDesc, prometheus.CounterValue, s.pruned)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/slo"
+)
+
+func TestStaleAssignment(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	grace := 5 * time.Minute
+	old, recent := now.Add(-10*time.Minute), now.Add(-time.Minute)
+	deleted := metav1.NewTime(now)
+	testCases := []struct {
+		nodeName    string
+		created     time.Time
+		annotations map[string]string
+		deleted     bool
+		phase       corev1.PodPhase
+		output      string
+	}{
+		{nodeName: "node1", created: old, output: ""},
+		{created: recent, output: ""},
+		{created: old, output: StaleUnbound},
+		{nodeName: "node2", created: old, output: StaleBoundElsewhere},
+		{created: old, deleted: true, output: StaleDeleted},
+		{created: old, phase: corev1.PodFailed, output: StaleFailed},
+		// The assignment time is the handshake start, then the assigned
+		// time, then the creation.
+		{created: old, annotations: map[string]string{util.AssignedTimeAnnotations: slo.FormatTime(recent)}, output: ""},
+		{
+			created: old,
+			annotations: map[string]string{
+				util.HandshakeStartAnnotation: slo.FormatTime(old),
+				util.AssignedTimeAnnotations:  slo.FormatTime(recent),
+			},
+			output: StaleUnbound,
+		},
+		{created: old, annotations: map[string]string{util.AssignedTimeAnnotations: "invalid"}, output: StaleUnbound},
+		// An assignment in the future falls back to the creation.
+		{created: old, annotations: map[string]string{util.AssignedTimeAnnotations: slo.FormatTime(now.Add(time.Hour))}, output: StaleUnbound},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:         "ns",
+					Name:              "pod",
+					CreationTimestamp: metav1.NewTime(tc.created),
+					Annotations:       tc.annotations,
+				},
+				Spec:   corev1.PodSpec{NodeName: tc.nodeName},
+				Status: corev1.PodStatus{Phase: tc.phase},
+			}
+			if tc.deleted {
+				pod.DeletionTimestamp = &deleted
+			}
+			require.Equal(t, tc.output, staleAssignment(pod, "node1", grace, now))
+		})
+	}
+}
+
+func TestAllocationSweeperSweep(t *testing.T) {
+	now := time.Now()
+	assigned := func(name, nodeName, node string) *corev1.Pod {
+		pod := testPod(name, nodeName, node, corev1.PodPending)
+		pod.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+		pod.Annotations[util.AssignedIDsAnnotations] = "GPU-0,NVIDIA,1024,10:;"
+		return pod
+	}
+	client := useTestClient(t,
+		assigned("unbound", "", "node1"),
+		assigned("bound", "node1", "node1"),
+		assigned("bound-elsewhere", "node1", "node2"),
+		assigned("other", "", "node2"),
+	)
+
+	s := NewAllocationSweeper("node1", time.Minute, 5*time.Minute)
+	require.NoError(t, s.Sweep(now))
+
+	// The unbound pod assigned to another node is released by its node.
+	for name, kept := range map[string]bool{"unbound": false, "bound": true, "bound-elsewhere": false, "other": true} {
+		pod, err := client.CoreV1().Pods("ns").Get(context.Background(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		if kept {
+			require.Contains(t, pod.Annotations, util.AssignedNodeAnnotations, name)
+		} else {
+			require.NotContains(t, pod.Annotations, util.AssignedNodeAnnotations, name)
+			require.NotContains(t, pod.Annotations, util.AssignedIDsAnnotations, name)
+		}
+	}
+	require.Equal(t, map[string]float64{StaleUnbound: 1, StaleBoundElsewhere: 1}, s.released)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+)
+
+var (
+	switchMutex sync.Mutex
+	// switchGroups caches the PCIe switch of every device by the devices
+	// of the node, which don't move.
+	switchKey    string
+	switchGroups map[string]int
+)
+
+// pcieSwitches returns the PCIe switch of every device, the devices whose
+// common ancestor is a PCIe switch being under the same one. The devices
+// whose topology the driver doesn't report are left out.
+func pcieSwitches(devices []*Device) map[string]int {
+	ids := make([]string, 0, len(devices))
+	for _, d := range devices {
+		ids = append(ids, d.ID)
+	}
+	key := strings.Join(ids, ",")
+	switchMutex.Lock()
+	defer switchMutex.Unlock()
+	if switchGroups != nil && switchKey == key {
+		return switchGroups
+	}
+
+	handles := make(map[string]nvml.Device, len(devices))
+	for _, d := range devices {
+		if h, ret := config.Nvml().DeviceGetHandleByUUID(d.ID); ret == nvml.SUCCESS {
+			handles[d.ID] = h
+		}
+	}
+	res := make(map[string]int)
+	next := 0
+	for i, a := range ids {
+		ha, ok := handles[a]
+		if !ok {
+			continue
+		}
+		if _, ok := res[a]; !ok {
+			res[a] = next
+			next++
+		}
+		for _, b := range ids[i+1:] {
+			hb, ok := handles[b]
+			if _, grouped := res[b]; !ok || grouped {
+				continue
+			}
+			level, ret := config.Nvml().DeviceGetTopologyCommonAncestor(ha, hb)
+			if ret != nvml.SUCCESS {
+				klog.V(4).Infof("nvml get common ancestor of devices %s and %s error ret=%v", a, b, ret)
+				continue
+			}
+			if level <= nvml.TOPOLOGY_MULTIPLE {
+				res[b] = res[a]
+			}
+		}
+	}
+	switchKey, switchGroups = key, res
+	return res
+}
+
+// kubeletNumaNodes returns the NUMA nodes of the devices of the vGPU IDs the
+// kubelet allocates, which its topology manager aligns with the CPUs of the
+// container, empty when they are unknown.
+func (m *NvidiaDevicePlugin) kubeletNumaNodes(deviceIDs []string) map[int]bool {
+	numa := make(map[string]int)
+	for _, d := range m.Devices() {
+		if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+			numa[d.ID] = int(d.Topology.Nodes[0].ID)
+		}
+	}
+	res := make(map[int]bool)
+	for _, id := range deviceIDs {
+		// The vGPU IDs are the UUID of the device and the index of the
+		// vGPU.
+		if i := strings.LastIndex(id, "-"); i > 0 {
+			if n, ok := numa[id[:i]]; ok {
+				res[n] = true
+			}
+		}
+	}
+	return res
+}
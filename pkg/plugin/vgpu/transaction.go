@@ -0,0 +1,250 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// containerAllocation is a container of a pod with the devices the
+// scheduler assigned to it, or for an init container those it reuses.
+type containerAllocation struct {
+	container corev1.Container
+	devices   util.ContainerDevices
+	init      bool
+}
+
+// podAllocation is the allocation of the containers of a pod, whose devices
+// are read and checked once, when the first one is allocated. The kubelet
+// allocates the containers one after the other while the node is locked for
+// the pod.
+type podAllocation struct {
+	pod *corev1.Pod
+	// toAllocate is what is left of the devices-to-allocate annotation.
+	toAllocate util.PodDevices
+	// pending are the containers left to allocate, in order.
+	pending []containerAllocation
+	records []AllocationRecord
+	started time.Time
+	// correlationID identifies the handshake of the pod, assigned is when
+	// the scheduler assigned it, zero when unknown.
+	correlationID string
+	assigned      time.Time
+	// numa are the NUMA nodes the kubelet aligned the vGPUs of the first
+	// container with, empty when unknown.
+	numa map[int]bool
+}
+
+// stillPending reports whether the pod is still waiting for its devices,
+// it may have been deleted and the node locked for another one.
+func (a *podAllocation) stillPending() bool {
+	pod, err := lock.GetClient().CoreV1().Pods(a.pod.Namespace).Get(context.Background(), a.pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	return pod.UID == a.pod.UID && pod.DeletionTimestamp == nil && pod.Annotations[util.DeviceBindPhase] == util.DeviceBindAllocating
+}
+
+// pendingContainers returns the containers of the pod with devices of
+// dtype left to allocate.
+func pendingContainers(dtype string, pod *corev1.Pod, toAllocate util.PodDevices) []containerAllocation {
+	var res []containerAllocation
+	for idx, val := range toAllocate {
+		if idx >= len(pod.Spec.Containers) {
+			break
+		}
+		var devices util.ContainerDevices
+		for _, dev := range val {
+			if dev.Type == dtype {
+				devices = append(devices, dev)
+			}
+		}
+		if len(devices) > 0 {
+			res = append(res, containerAllocation{container: pod.Spec.Containers[idx], devices: devices})
+		}
+	}
+	return res
+}
+
+// beginPodAllocation returns the allocation in progress or starts the one of
+// the pod pending on the node, checking the devices of all its containers
+// at once so that none is allocated when one is refused. deviceIDs are the
+// vGPUs the kubelet allocates to the first container. The pod is returned
+// with the error when known. The allocation mutex must be held.
+func (m *NvidiaDevicePlugin) beginPodAllocation(nodename string, deviceIDs []string) (*podAllocation, *corev1.Pod, error) {
+	if a := m.allocation; a != nil {
+		if len(a.pending) > 0 && time.Since(a.started) < lock.LockTTL && a.stillPending() {
+			return a, a.pod, nil
+		}
+		klog.Warningf("Dropping allocation of pod %s/%s left with %d containers", a.pod.Namespace, a.pod.Name, len(a.pending))
+		m.allocation = nil
+	}
+	current, err := util.GetPendingPod(nodename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if current == nil {
+		klog.Errorf("no pending pod found on node %s", nodename)
+		return nil, nil, errors.New("no pending pod found on node")
+	}
+	a := &podAllocation{
+		pod:        current,
+		toAllocate: util.DecodePodDevices(current.Annotations[util.AssignedIDsToAllocateAnnotations]),
+		started:    time.Now(),
+		numa:       m.kubeletNumaNodes(deviceIDs),
+	}
+	a.pending = pendingContainers(util.NvidiaGPUDevice, current, a.toAllocate)
+	if len(a.pending) == 0 {
+		return nil, current, errors.New("device request not found")
+	}
+	a.beginHandshake()
+	// Nothing of the pod is allocated yet while none of the devices of its
+	// containers is erased.
+	assigned := util.DecodePodDevices(current.Annotations[util.AssignedIDsAnnotations])
+	fresh := len(a.pending) == len(pendingContainers(util.NvidiaGPUDevice, current, assigned))
+	if m.operatingMode != "mig" && fresh {
+		p, err := m.podSelectionPolicy(current)
+		if err != nil {
+			return nil, current, err
+		}
+		if p != nil {
+			if err := m.selectDevices(nodename, a, p); err != nil {
+				return nil, current, err
+			}
+		}
+	}
+	if m.operatingMode != "mig" {
+		if err := m.splitMemory(a); err != nil {
+			return nil, current, err
+		}
+	}
+	if m.operatingMode != "mig" && exclusiveMode(current) {
+		if err := m.grantExclusive(nodename, a); err != nil {
+			return nil, current, err
+		}
+	}
+	// The kubelet allocates the init containers first, they are done once
+	// the devices of a container are erased.
+	if fresh {
+		inits, err := initContainerAllocations(util.NvidiaGPUDevice, current, m.Devices())
+		if err != nil {
+			return nil, current, err
+		}
+		a.pending = append(inits, a.pending...)
+	}
+	if err := m.checkPodAllocation(nodename, a); err != nil {
+		return nil, current, err
+	}
+	m.allocation = a
+	return a, current, nil
+}
+
+// checkPodAllocation runs the checks of the plugin on the devices of every
+// container of the pod, each container seeing the devices of the previous
+// ones granted. The init containers are granted nothing of their own.
+func (m *NvidiaDevicePlugin) checkPodAllocation(nodename string, a *podAllocation) error {
+	if m.operatingMode != "mig" && mpsIsolated(a.pod) {
+		for _, c := range a.pending {
+			if err := checkMPS(c.devices); err != nil {
+				return err
+			}
+		}
+	}
+	if m.operatingMode != "mig" {
+		if err := checkPinnedDevices(a); err != nil {
+			return err
+		}
+		if err := checkTaskPriority(a); err != nil {
+			return err
+		}
+		if err := checkMemoryFallback(a); err != nil {
+			return err
+		}
+	}
+	if err := checkGPUTypes(a); err != nil {
+		return err
+	}
+	if err := m.checkReservedDevices(nodename, a); err != nil {
+		return err
+	}
+	if m.allocationPolicy == nil && opaAdmission == nil && m.shadow == nil {
+		return nil
+	}
+	pods, err := listNodePods(nodename)
+	if err != nil {
+		return err
+	}
+	var node *corev1.Node
+	if opaAdmission != nil {
+		if node, err = util.GetNode(nodename); err != nil {
+			return err
+		}
+	}
+	ledger := nodeLedger(m.Devices(), pods, a.pod.UID)
+	for _, c := range a.pending {
+		if c.init {
+			continue
+		}
+		if m.allocationPolicy != nil {
+			if err := m.checkPlacement(ledger, a.pod, c.devices); err != nil {
+				return err
+			}
+		}
+		if opaAdmission != nil {
+			if err := m.admitPlacement(node, ledger, a.pod, c.container.Name, c.devices); err != nil {
+				return err
+			}
+		}
+		if m.shadow != nil {
+			m.shadow.Evaluate(ledger, a.pod, c.container.Name, c.devices)
+		}
+		grantDevices(ledger, a.pod.Namespace, c.devices)
+	}
+	return nil
+}
+
+// next returns the next container to allocate and erases its devices from
+// what is left to allocate.
+func (a *podAllocation) next(dtype string) containerAllocation {
+	c := a.pending[0]
+	a.pending = a.pending[1:]
+	if c.init {
+		return c
+	}
+	for idx, ctr := range a.pod.Spec.Containers {
+		if ctr.Name != c.container.Name || idx >= len(a.toAllocate) {
+			continue
+		}
+		var rest util.ContainerDevices
+		for _, dev := range a.toAllocate[idx] {
+			if dev.Type != dtype {
+				rest = append(rest, dev)
+			}
+		}
+		a.toAllocate[idx] = rest
+	}
+	return c
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+// Log formats of --log-format.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogFormat is the format of the logs, text as klog writes them or json.
+var LogFormat = LogFormatText
+
+// SetupLogging switches klog to LogFormat, it must be called before the
+// goroutines logging are started.
+func SetupLogging() error {
+	switch LogFormat {
+	case LogFormatText, "":
+		return nil
+	case LogFormatJSON:
+		klog.SetLogger(logr.New(&jsonSink{out: os.Stderr, mutex: &sync.Mutex{}}))
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q, text or json", LogFormat)
+}
+
+// jsonSink writes a JSON object per line, as the json format of the
+// Kubernetes components: ts in milliseconds, caller, msg, err and the keys
+// and values of the structured calls.
+type jsonSink struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	name   string
+	values []interface{}
+	depth  int
+}
+
+func (s *jsonSink) Init(logr.RuntimeInfo) {}
+
+// Enabled is always true, klog checks the verbosity before calling the sink.
+func (s *jsonSink) Enabled(int) bool {
+	return true
+}
+
+func (s *jsonSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.write(level, nil, msg, keysAndValues)
+}
+
+func (s *jsonSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.write(0, err, msg, keysAndValues)
+}
+
+func (s *jsonSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	c := *s
+	c.values = append(s.values[:len(s.values):len(s.values)], keysAndValues...)
+	return &c
+}
+
+func (s *jsonSink) WithName(name string) logr.LogSink {
+	c := *s
+	if c.name != "" {
+		name = c.name + "." + name
+	}
+	c.name = name
+	return &c
+}
+
+func (s *jsonSink) WithCallDepth(depth int) logr.LogSink {
+	c := *s
+	c.depth += depth
+	return &c
+}
+
+func (s *jsonSink) write(level int, err error, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(`{"ts":`)
+	b.WriteString(strconv.FormatFloat(float64(time.Now().UnixNano())/1e6, 'f', 3, 64))
+	// write is called by Info or Error, called by the logr.Logger.
+	if _, file, line, ok := runtime.Caller(3 + s.depth); ok {
+		writeJSONField(&b, "caller", filepath.Base(file)+":"+strconv.Itoa(line))
+	}
+	if s.name != "" {
+		writeJSONField(&b, "logger", s.name)
+	}
+	// klog ends the messages of the unstructured calls with a newline.
+	writeJSONField(&b, "msg", strings.TrimSuffix(msg, "\n"))
+	if level > 0 {
+		writeJSONField(&b, "v", level)
+	}
+	if err != nil {
+		writeJSONField(&b, "err", err.Error())
+	}
+	for _, kv := range [][]interface{}{s.values, keysAndValues} {
+		for i := 0; i < len(kv); i += 2 {
+			var value interface{} = "(MISSING)"
+			if i+1 < len(kv) {
+				value = kv[i+1]
+			}
+			writeJSONField(&b, fmt.Sprint(kv[i]), value)
+		}
+	}
+	b.WriteString("}\n")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, _ = io.WriteString(s.out, b.String())
+}
+
+func writeJSONField(b *strings.Builder, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	k, _ := json.Marshal(key)
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	b.WriteByte(',')
+	b.Write(k)
+	b.WriteByte(':')
+	b.Write(data)
+}
+
+// RateLimitedLog logs a message at most once per interval, with the number
+// of times it was suppressed since it was last logged, for the messages of
+// the code running on every scrape.
+type RateLimitedLog struct {
+	interval time.Duration
+
+	mutex      sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+func NewRateLimitedLog(interval time.Duration) *RateLimitedLog {
+	return &RateLimitedLog{interval: interval, last: make(map[string]time.Time), suppressed: make(map[string]int)}
+}
+
+// allow reports whether msg is to be logged now, with the number of times it
+// was suppressed.
+func (l *RateLimitedLog) allow(msg string) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if last, ok := l.last[msg]; ok && now.Sub(last) < l.interval {
+		l.suppressed[msg]++
+		return false, 0
+	}
+	l.last[msg] = now
+	n := l.suppressed[msg]
+	delete(l.suppressed, msg)
+	return true, n
+}
+
+// ErrorS logs an error as klog.ErrorS does, at most once per interval.
+func (l *RateLimitedLog) ErrorS(err error, msg string, keysAndValues ...interface{}) {
+	if ok, n := l.allow(msg); ok {
+		klog.ErrorSDepth(1, err, msg, append(keysAndValues, "suppressed", n)...)
+	}
+}
+
+// InfoS logs a message as klog.InfoS does, at most once per interval.
+func (l *RateLimitedLog) InfoS(msg string, keysAndValues ...interface{}) {
+	if ok, n := l.allow(msg); ok {
+		klog.InfoSDepth(1, msg, append(keysAndValues, "suppressed", n)...)
+	}
+}
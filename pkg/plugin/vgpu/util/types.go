@@ -26,11 +26,29 @@ const (
 	BindTimeAnnotations              = "volcano.sh/bind-time"
 	DeviceBindPhase                  = "volcano.sh/bind-phase"
 
+	// CorrelationIDAnnotation identifies the vGPU handshake of a pod in the
+	// logs and the latencies of the scheduler, the plugin and the monitor.
+	CorrelationIDAnnotation = "volcano.sh/vgpu-correlation-id"
+	// HandshakeStartAnnotation keeps the assignment time of the pod, the
+	// plugin overwrites AssignedTimeAnnotations when it picks the pod.
+	HandshakeStartAnnotation = "volcano.sh/vgpu-handshake-start"
+	// AllocatedTimeAnnotation is when the last container of the pod was
+	// allocated its devices.
+	AllocatedTimeAnnotation = "volcano.sh/vgpu-allocated-time"
+	// CorrelationIDEnv passes the correlation ID to libvgpu.
+	CorrelationIDEnv = "VGPU_CORRELATION_ID"
+
 	// PodAnnotationMaxLength pod annotation max data length 1MB
 	PodAnnotationMaxLength = 1024 * 1024
 
 	GPUInUse = "nvidia.com/use-gputype"
 	GPUNoUse = "nvidia.com/nouse-gputype"
+	// GPUTypeIncludeAnnotation and GPUTypeExcludeAnnotation restrict the
+	// vGPUs of a pod to the models whose NVML name contains one of the
+	// comma separated values, case insensitive, and to those containing
+	// none of the excluded ones, together with GPUInUse and GPUNoUse.
+	GPUTypeIncludeAnnotation = "volcano.sh/gpu-type-include"
+	GPUTypeExcludeAnnotation = "volcano.sh/gpu-type-exclude"
 
 	DeviceBindAllocating = "allocating"
 	DeviceBindFailed     = "failed"
@@ -50,6 +68,46 @@ const (
 
 	NodeHandshake              = "volcano.sh/node-vgpu-handshake"
 	NodeNvidiaDeviceRegistered = "volcano.sh/node-vgpu-register"
+	// NodeCoresAnnotation reports the SM percentage of every device of the
+	// node and the part granted to its pods, uuid,cores,used separated by
+	// colons, the cores being 100 times the core scaling.
+	NodeCoresAnnotation = "volcano.sh/node-vgpu-cores"
+	// NodeGPUTypesAnnotation reports the NVML names of the models of the
+	// devices of the node, separated by commas, for the scheduler to match
+	// the GPU type annotations of the pods.
+	NodeGPUTypesAnnotation = "volcano.sh/node-vgpu-types"
+	// NodeConfigHashAnnotation is the hash of the runtime configuration the
+	// device plugin of the node runs with.
+	NodeConfigHashAnnotation = "volcano.sh/node-vgpu-config-hash"
+	// NodeReservedDevicesAnnotation lists the indexes or the UUIDs of the
+	// devices of the node kept out of the vGPU pool, separated by commas.
+	// It is set by the administrators, not by the plugin.
+	NodeReservedDevicesAnnotation = "volcano.sh/node-vgpu-reserved"
+	// NodeDrainAnnotation is set while the device plugin of the node drains,
+	// to NodeDraining until its vGPU pods finished, then to NodeDrained.
+	// The plugin serves no new vGPU until it is removed.
+	NodeDrainAnnotation = "volcano.sh/node-vgpu-drain"
+	NodeDraining        = "draining"
+	NodeDrained         = "drained"
+	// CoreUtilizationPolicyEnv turns the core limits of libvgpu off when
+	// set to disable.
+	CoreUtilizationPolicyEnv = "GPU_CORE_UTILIZATION_POLICY"
+	// TaskPriorityAnnotation sets the priority class of the vGPUs of a pod
+	// when its GPU is contended, one of TaskPriorityClasses.
+	TaskPriorityAnnotation = "volcano.sh/vgpu-priority"
+	// TaskPriorityEnv passes the priority to libvgpu, which records it in
+	// the shared region of the container.
+	TaskPriorityEnv = "CUDA_TASK_PRIORITY"
+	// OversubscribeEnv lets libvgpu back the memory of an overcommitted
+	// device with host memory when its physical memory runs out.
+	OversubscribeEnv = "CUDA_OVERSUBSCRIBE"
+	// MemoryFallbackAnnotation lets the vGPUs of a pod spill the memory
+	// their GPU runs out of to host memory when set to MemoryFallbackHost.
+	MemoryFallbackAnnotation = "volcano.sh/vgpu-memory-fallback"
+	// The modes of MemoryFallbackAnnotation, without it the allocations
+	// over the memory of the GPU fail.
+	MemoryFallbackHost = "host"
+	MemoryFallbackNone = "none"
 
 	// DeviceName used to indicate this device
 	VGPUDeviceName = "hamivgpu"
@@ -63,6 +121,7 @@ var (
 	ResourceMem           string
 	ResourceCores         string
 	ResourceMemPercentage string
+	ResourceWholeGPU      string
 	ResourcePriority      string
 	DebugMode             bool
 
@@ -72,6 +131,11 @@ var (
 	KnownDevice = map[string]string{
 		NodeHandshake: NodeNvidiaDeviceRegistered,
 	}
+
+	// TaskPriorityClasses are the priority classes of TaskPriorityAnnotation
+	// by the priority libvgpu knows them by, 0 being the highest. The pods
+	// without the annotation are medium for libvgpu.
+	TaskPriorityClasses = []string{"high", "medium", "low"}
 )
 
 type ContainerDevice struct {
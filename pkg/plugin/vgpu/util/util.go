@@ -54,7 +54,10 @@ func GlobalFlagSet() *flag.FlagSet {
 	fs.StringVar(&ResourceName, "resource-name", "volcano.sh/vgpu-number", "resource name")
 	fs.StringVar(&ResourceMem, "resource-memory-name", "volcano.sh/vgpu-memory", "resource name for resource memory resources")
 	fs.StringVar(&ResourceCores, "resource-core-name", "volcano.sh/vgpu-cores", "resource name for resource core resources")
+	fs.StringVar(&ResourceMemPercentage, "resource-memory-percentage-name", "volcano.sh/vgpu-memory-percentage", "resource name for the memory of a vGPU as a percentage of the device memory")
+	fs.StringVar(&ResourceWholeGPU, "resource-whole-gpu-name", "nvidia.com/gpu", "resource name for the GPUs of the whole GPU pool of the node")
 	fs.BoolVar(&DebugMode, "debug", false, "debug mode")
+	fs.StringVar(&LogFormat, "log-format", LogFormatText, "the format of the logs: text or json")
 	klog.InitFlags(fs)
 	return fs
 }
@@ -158,7 +161,7 @@ func EncodeContainerDevices(cd ContainerDevices) string {
 	for _, val := range cd {
 		tmp += val.UUID + "," + val.Type + "," + strconv.Itoa(int(val.Usedmem)) + "," + strconv.Itoa(int(val.Usedcores)) + ":"
 	}
-	fmt.Println("Encoded container Devices=", tmp)
+	klog.V(3).Infoln("Encoded container Devices", tmp)
 	return tmp
 	//return strings.Join(cd, ",")
 }
@@ -208,6 +211,53 @@ func DecodePodDevices(str string) PodDevices {
 	return pd
 }
 
+// GPUTypeFilters returns the GPU models the pod with annotations is
+// restricted to and those it excludes.
+func GPUTypeFilters(annotations map[string]string) (include, exclude []string) {
+	for _, key := range []string{GPUTypeIncludeAnnotation, GPUInUse} {
+		if s := annotations[key]; s != "" {
+			include = append(include, strings.Split(s, ",")...)
+		}
+	}
+	for _, key := range []string{GPUTypeExcludeAnnotation, GPUNoUse} {
+		if s := annotations[key]; s != "" {
+			exclude = append(exclude, strings.Split(s, ",")...)
+		}
+	}
+	return include, exclude
+}
+
+// ContainsGPUType reports whether the model name contains one of types,
+// case insensitive.
+func ContainsGPUType(name string, types []string) bool {
+	for _, t := range types {
+		if t = strings.TrimSpace(t); t != "" && strings.Contains(strings.ToUpper(name), strings.ToUpper(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchGPUType reports whether the model name passes the include and exclude
+// filters of GPUTypeFilters.
+func MatchGPUType(name string, include, exclude []string) bool {
+	if ContainsGPUType(name, exclude) {
+		return false
+	}
+	return len(include) == 0 || ContainsGPUType(name, include)
+}
+
+// TaskPriority returns the priority libvgpu knows the priority class by,
+// false for an unknown class.
+func TaskPriority(class string) (int, bool) {
+	for i, c := range TaskPriorityClasses {
+		if c == class {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 func GetNextDeviceRequest(dtype string, p v1.Pod) (v1.Container, ContainerDevices, error) {
 	pdevices := DecodePodDevices(p.Annotations[AssignedIDsToAllocateAnnotations])
 	klog.Infoln("pdevices=", pdevices)
@@ -263,6 +313,10 @@ func PodAllocationTrySuccess(nodeName string, pod *v1.Pod) {
 	klog.Infoln("TrySuccess:", annos)
 	for _, val := range DevicesToHandle {
 		if strings.Contains(annos, val) {
+			// Containers are left to allocate, keep the node reserved.
+			if err := lock.RenewNodeLock(nodeName, VGPUDeviceName); err != nil {
+				klog.Errorf("renew lock failed:%v", err.Error())
+			}
 			return
 		}
 	}
@@ -296,7 +350,17 @@ func PodAllocationFailed(nodeName string, pod *v1.Pod) {
 	}
 }
 
+// PatchNodeAnnotations sets annotations of the node through the node update
+// queue, the other annotations are left untouched.
 func PatchNodeAnnotations(node *v1.Node, annotations map[string]string) error {
+	err := lock.NodeUpdates().Patch(node.Name, annotations, nil)
+	if err != nil {
+		klog.Infof("patch node %v failed, %v", node.Name, err)
+	}
+	return err
+}
+
+func PatchPodAnnotations(pod *v1.Pod, annotations map[string]string) error {
 	type patchMetadata struct {
 		Annotations map[string]string `json:"annotations,omitempty"`
 	}
@@ -312,26 +376,29 @@ func PatchNodeAnnotations(node *v1.Node, annotations map[string]string) error {
 	if err != nil {
 		return err
 	}
-	_, err = lock.GetClient().CoreV1().Nodes().
-		Patch(context.Background(), node.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+	_, err = lock.GetClient().CoreV1().Pods(pod.Namespace).
+		Patch(context.Background(), pod.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
 	if err != nil {
-		klog.Infof("patch pod %v failed, %v", node.Name, err)
+		klog.Infof("patch pod %v failed, %v", pod.Name, err)
 	}
 	return err
 }
 
-func PatchPodAnnotations(pod *v1.Pod, annotations map[string]string) error {
+// RemovePodAnnotations deletes annotations of the pod, it fails with a
+// conflict if the pod changed since it was read.
+func RemovePodAnnotations(pod *v1.Pod, keys ...string) error {
 	type patchMetadata struct {
-		Annotations map[string]string `json:"annotations,omitempty"`
+		ResourceVersion string             `json:"resourceVersion"`
+		Annotations     map[string]*string `json:"annotations"`
 	}
 	type patchPod struct {
 		Metadata patchMetadata `json:"metadata"`
-		//Spec     patchSpec     `json:"spec,omitempty"`
 	}
 
-	p := patchPod{}
-	p.Metadata.Annotations = annotations
-
+	p := patchPod{Metadata: patchMetadata{ResourceVersion: pod.ResourceVersion, Annotations: make(map[string]*string, len(keys))}}
+	for _, k := range keys {
+		p.Metadata.Annotations[k] = nil
+	}
 	bytes, err := json.Marshal(p)
 	if err != nil {
 		return err
@@ -339,7 +406,7 @@ func PatchPodAnnotations(pod *v1.Pod, annotations map[string]string) error {
 	_, err = lock.GetClient().CoreV1().Pods(pod.Namespace).
 		Patch(context.Background(), pod.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
 	if err != nil {
-		klog.Infof("patch pod %v failed, %v", pod.Name, err)
+		klog.Infof("remove annotations of pod %v failed, %v", pod.Name, err)
 	}
 	return err
 }
@@ -402,11 +469,11 @@ func GetDevices(gpuMemoryFactor uint) ([]*pluginapi.Device, map[uint]string) {
 		}
 		id := i
 		deviceByIndex[id] = uuid
-		memory, ret := d.GetMemoryInfo()
-		if ret != nvml.SUCCESS {
-			klog.Fatalf("call GetMemoryInfo with error: %v", ret)
+		memory, err := config.DeviceMemory(d)
+		if err != nil {
+			klog.Fatalf("call GetMemoryInfo with error: %v", err)
 		}
-		deviceGPUMemory := uint(memory.Total / (1024 * 1024))
+		deviceGPUMemory := uint(memory.Total() / (1024 * 1024))
 		for j := uint(0); j < deviceGPUMemory/gpuMemoryFactor; j++ {
 			klog.V(4).Infof("adding virtual device: %d", j)
 			fakeID := GenerateVirtualDeviceID(id, j)
@@ -561,38 +628,50 @@ func LoadNvidiaConfig() *config.NvidiaConfig {
 	return &nvidiaConfig
 }
 
+// NodeConfigFile is the node config file, the volcano-vgpu-node-config
+// ConfigMap mounted in the plugin.
+const NodeConfigFile = "/config/config.json"
+
+// readFromConfigFile applies the scaling and split count of the node config
+// of the node to sConfig, the other settings of the node config are the
+// runtime configuration of the plugin.
 func readFromConfigFile(sConfig *config.NvidiaConfig) error {
-	config.Mode = "hami-core"
-	jsonbyte, err := os.ReadFile("/config/config.json")
-	if err != nil {
+	val, err := LoadNodeConfig(NodeConfigFile, os.Getenv("NODE_NAME"))
+	if err != nil || val == nil {
 		return err
 	}
+	klog.Infof("Reading config from file %s", val.Name)
+	if val.Devicememoryscaling > 0 {
+		sConfig.NodeMemoryScaling = val.Devicememoryscaling
+	}
+	if val.Devicecorescaling > 0 {
+		sConfig.DeviceCoreScaling = val.Devicecorescaling
+	}
+	if val.Devicesplitcount > 0 {
+		sConfig.DeviceSplitCount = val.Devicesplitcount
+	}
+	klog.Infof("FilterDevice: %v", val.FilterDevice)
+	return nil
+}
+
+// LoadNodeConfig returns the config of the node in the node config file at
+// path, nil when it has none.
+func LoadNodeConfig(path string, nodeName string) (*config.NodeConfig, error) {
+	jsonbyte, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 	var deviceConfigs config.DevicePluginConfigs
 	err = json.Unmarshal(jsonbyte, &deviceConfigs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	klog.Infof("Device Plugin Configs: %v", fmt.Sprintf("%v", deviceConfigs))
-	for _, val := range deviceConfigs.Nodeconfig {
-		if os.Getenv("NODE_NAME") == val.Name {
-			klog.Infof("Reading config from file %s", val.Name)
-			if val.Devicememoryscaling > 0 {
-				sConfig.DeviceMemoryScaling = val.Devicememoryscaling
-			}
-			if val.Devicecorescaling > 0 {
-				sConfig.DeviceCoreScaling = val.Devicecorescaling
-			}
-			if val.Devicesplitcount > 0 {
-				sConfig.DeviceSplitCount = val.Devicesplitcount
-			}
-			if val.FilterDevice != nil && (len(val.FilterDevice.UUID) > 0 || len(val.FilterDevice.Index) > 0) {
-				config.DevicePluginFilterDevice = val.FilterDevice
-			}
-			if len(val.OperatingMode) > 0 {
-				config.Mode = val.OperatingMode
-			}
-			klog.Infof("FilterDevice: %v", val.FilterDevice)
+	klog.V(4).Infof("Device Plugin Configs: %v", fmt.Sprintf("%v", deviceConfigs))
+	var res *config.NodeConfig
+	for i, val := range deviceConfigs.Nodeconfig {
+		if nodeName == val.Name {
+			res = &deviceConfigs.Nodeconfig[i]
 		}
 	}
-	return nil
+	return res, nil
 }
@@ -0,0 +1,208 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// devicePublishRefresh is how long the status of an unchanged VGPUDevice
+// is kept before it is written again, for its readers to tell a live
+// device plugin.
+const devicePublishRefresh = 5 * time.Minute
+
+// DevicePublisher publishes the devices the node registers as VGPUDevices,
+// with the vGPUs granted on them, besides the node annotations.
+type DevicePublisher struct {
+	node   string
+	client dynamic.Interface
+}
+
+func NewDevicePublisher(node string) (*DevicePublisher, error) {
+	cfg, err := lock.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &DevicePublisher{node: node, client: client}, nil
+}
+
+// deviceName returns the name of the VGPUDevice of a GPU.
+func deviceName(uuid string) string {
+	return strings.ToLower(uuid)
+}
+
+// vgpuDevices returns the VGPUDevices of the registered devices with the
+// vGPUs granted to the pods, by name.
+func vgpuDevices(node string, registered []*util.DeviceInfo, devices []*Device, pods []corev1.Pod) map[string]*v1alpha1.VGPUDevice {
+	factor := int32(config.GPUMemoryFactor)
+	if factor == 0 {
+		factor = 1
+	}
+	allocations := make(map[string]v1alpha1.DeviceStatus)
+	for _, d := range allocationStatus(devices, pods).Devices {
+		allocations[d.UUID] = d
+	}
+	res := make(map[string]*v1alpha1.VGPUDevice, len(registered))
+	for _, info := range registered {
+		a := allocations[info.Id]
+		// The allocation table is in MiB, the registration in blocks.
+		pods := a.Pods
+		for i := range pods {
+			pods[i].Memory /= factor
+		}
+		res[deviceName(info.Id)] = &v1alpha1.VGPUDevice{
+			Spec: v1alpha1.VGPUDeviceSpec{
+				NodeName: node,
+				UUID:     info.Id,
+				Index:    a.Index,
+				Type:     info.Type,
+				Count:    info.Count,
+				Memory:   info.Devmem,
+				Cores:    a.Cores,
+				Mode:     info.Mode,
+			},
+			Status: v1alpha1.VGPUDeviceStatus{
+				Healthy:    info.Health,
+				Used:       a.Used,
+				UsedMemory: a.UsedMemory / factor,
+				UsedCores:  a.UsedCores,
+				Pods:       pods,
+			},
+		}
+	}
+	return res
+}
+
+// Publish writes the VGPUDevices of the registered devices which changed
+// and deletes those of the devices the node doesn't register anymore.
+func (p *DevicePublisher) Publish(registered []*util.DeviceInfo, devices []*Device, pods []corev1.Pod) error {
+	ctx := context.Background()
+	resource := p.client.Resource(v1alpha1.VGPUDeviceResource)
+	list, err := resource.List(ctx, metav1.ListOptions{LabelSelector: v1alpha1.NodeLabel + "=" + p.node})
+	if err != nil {
+		return err
+	}
+	desired := vgpuDevices(p.node, registered, devices, pods)
+	var errs []string
+	for i := range list.Items {
+		obj := &list.Items[i]
+		want, ok := desired[obj.GetName()]
+		if !ok {
+			klog.Infof("Deleting VGPUDevice %s gone from node %s", obj.GetName(), p.node)
+			if err := resource.Delete(ctx, obj.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		delete(desired, obj.GetName())
+		if err := p.update(ctx, obj, want); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for name, want := range desired {
+		obj, err := p.create(ctx, name, want)
+		if err == nil {
+			err = p.update(ctx, obj, want)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to publish the VGPUDevices of node %s: %s", p.node, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *DevicePublisher) create(ctx context.Context, name string, want *v1alpha1.VGPUDevice) (*unstructured.Unstructured, error) {
+	node, err := util.GetNode(p.node)
+	if err != nil {
+		return nil, err
+	}
+	dev := &v1alpha1.VGPUDevice{
+		TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "VGPUDevice"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{v1alpha1.NodeLabel: p.node},
+			// The devices go away with the node.
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "Node", Name: node.Name, UID: node.UID}},
+		},
+		Spec: want.Spec,
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(dev)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Creating VGPUDevice %s of node %s", name, p.node)
+	return p.client.Resource(v1alpha1.VGPUDeviceResource).Create(ctx, &unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+}
+
+// update writes the spec and the status of the VGPUDevice of obj which
+// differ from want.
+func (p *DevicePublisher) update(ctx context.Context, obj *unstructured.Unstructured, want *v1alpha1.VGPUDevice) error {
+	resource := p.client.Resource(v1alpha1.VGPUDeviceResource)
+	var current v1alpha1.VGPUDevice
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &current); err != nil {
+		return fmt.Errorf("decode %s: %v", obj.GetName(), err)
+	}
+	if !reflect.DeepEqual(current.Spec, want.Spec) {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&want.Spec)
+		if err != nil {
+			return err
+		}
+		obj.Object["spec"] = content
+		updated, err := resource.Update(ctx, obj, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		obj = updated
+	}
+	status := current.Status
+	status.UpdateTime = metav1.Time{}
+	if reflect.DeepEqual(status, want.Status) && time.Since(current.Status.UpdateTime.Time) < devicePublishRefresh {
+		return nil
+	}
+	want.Status.UpdateTime = metav1.Now()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&want.Status)
+	if err != nil {
+		return err
+	}
+	obj.Object["status"] = content
+	_, err = resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
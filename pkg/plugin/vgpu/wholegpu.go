@@ -0,0 +1,148 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// wholeDevice reports whether the device is in the whole GPU pool of the
+// node.
+func wholeDevice(dev *Device) bool {
+	return deviceReserved(CurrentRuntimeConfig().WholeDevices, dev)
+}
+
+// vgpuPool returns the devices shared as vGPUs, those not in the whole GPU
+// pool.
+func vgpuPool(devices []*Device) []*Device {
+	res := make([]*Device, 0, len(devices))
+	for _, dev := range devices {
+		if !wholeDevice(dev) {
+			res = append(res, dev)
+		}
+	}
+	return res
+}
+
+// wholeAPIDevices returns the devices of the whole GPU pool for the kubelet,
+// those vGPUs are still granted on unhealthy for it not to grant them until
+// the vGPUs are released.
+func (m *NvidiaDevicePlugin) wholeAPIDevices(devices []*Device) []*pluginapi.Device {
+	used := make(map[string]int32)
+	if pods, err := listNodePods(config.NodeName); err != nil {
+		klog.Errorf("Failed to list the pods of the node, advertising the whole GPU pool as is: %v", err)
+	} else {
+		for _, d := range nodeLedger(devices, pods, "") {
+			used[d.ID] = d.Used
+		}
+	}
+	var res []*pluginapi.Device
+	for _, dev := range devices {
+		if !wholeDevice(dev) {
+			continue
+		}
+		health := dev.Health
+		if used[dev.ID] > 0 {
+			klog.Infof("Device %s of the whole GPU pool still has %d vGPUs granted", dev.ID, used[dev.ID])
+			health = pluginapi.Unhealthy
+		}
+		res = append(res, &pluginapi.Device{
+			ID:       dev.ID,
+			Health:   health,
+			Topology: dev.Topology,
+		})
+	}
+	return res
+}
+
+// allocateWhole grants the containers the devices of the whole GPU pool the
+// kubelet chose, failing on those vGPUs are still granted on.
+func (m *NvidiaDevicePlugin) allocateWhole(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	pods, err := listNodePods(config.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Device)
+	for _, dev := range m.Devices() {
+		byID[dev.ID] = dev
+	}
+	used := make(map[string]int32)
+	for _, d := range nodeLedger(m.Devices(), pods, "") {
+		used[d.ID] = d.Used
+	}
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			if dev, ok := byID[id]; !ok || !wholeDevice(dev) {
+				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
+			}
+			if used[id] > 0 {
+				return nil, fmt.Errorf("device %s of the whole GPU pool still has %d vGPUs granted", id, used[id])
+			}
+		}
+		klog.Infof("Granting the whole devices %v", req.DevicesIDs)
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs: m.apiEnvs("NVIDIA_VISIBLE_DEVICES", req.DevicesIDs),
+		})
+	}
+	return &responses, nil
+}
+
+// wholeGrantedDevices returns the UUIDs of the devices the kubelet granted
+// whole to the pods, which are kept out of the vGPU pool until they exit
+// even once they left the whole GPU pool.
+func wholeGrantedDevices(pods []corev1.Pod) ([]string, error) {
+	grants, err := wholeGrants(pods)
+	var res []string
+	for _, ids := range grants {
+		res = append(res, ids...)
+	}
+	return res, err
+}
+
+// wholeGrants returns the devices the kubelet granted whole to the pods, by
+// pod UID.
+func wholeGrants(pods []corev1.Pod) (map[string][]string, error) {
+	grants, err := readKubeletCheckpoint(KubeletCheckpoint, util.ResourceWholeGPU)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		running[string(pod.UID)] = true
+	}
+	res := make(map[string][]string)
+	for key, ids := range grants {
+		if uid, _, _ := strings.Cut(key, "/"); running[uid] {
+			res[uid] = append(res[uid], ids...)
+		}
+	}
+	return res, nil
+}
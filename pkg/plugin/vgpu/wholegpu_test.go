@@ -0,0 +1,157 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vgpu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+// simulatedDevices returns count devices of simulated GPUs of node.
+func simulatedDevices(t *testing.T, node string, count int) []*Device {
+	require.NoError(t, config.Simulate(node, count))
+	var res []*Device
+	for i := 0; i < count; i++ {
+		d, ret := config.Nvml().DeviceGetHandleByIndex(i)
+		require.Equal(t, nvml.SUCCESS, ret)
+		uuid, ret := d.GetUUID()
+		require.Equal(t, nvml.SUCCESS, ret)
+		res = append(res, &Device{
+			Device: pluginapi.Device{ID: uuid, Health: pluginapi.Healthy},
+			Index:  fmt.Sprint(i),
+			Memory: 40960,
+		})
+	}
+	return res
+}
+
+func TestVGPUPool(t *testing.T) {
+	useRuntimeConfig(t, RuntimeConfig{WholeDevices: &config.FilterDevice{Index: []uint{1}, UUID: []string{"GPU-c"}}})
+	devices := []*Device{
+		{Device: pluginapi.Device{ID: "GPU-a"}, Index: "0"},
+		{Device: pluginapi.Device{ID: "GPU-b"}, Index: "1"},
+		{Device: pluginapi.Device{ID: "GPU-c"}, Index: "2"},
+		{Device: pluginapi.Device{ID: "MIG-d"}, Index: "1:0"},
+		{Device: pluginapi.Device{ID: "MIG-e"}, Index: "3:0"},
+	}
+	var ids []string
+	for _, d := range vgpuPool(devices) {
+		ids = append(ids, d.ID)
+	}
+	require.Equal(t, []string{"GPU-a", "MIG-e"}, ids)
+}
+
+func TestAllocateWhole(t *testing.T) {
+	nodeName := config.NodeName
+	defer func() { config.NodeName = nodeName }()
+	config.NodeName = "node1"
+	devices := simulatedDevices(t, "node1", 3)
+	useRuntimeConfig(t, RuntimeConfig{DeviceSplitCount: 10, Mode: "hami-core", WholeDevices: &config.FilterDevice{Index: []uint{1, 2}}})
+	vgpuPod := testPod("vgpu", "node1", "node1", corev1.PodRunning)
+	vgpuPod.Annotations[util.AssignedIDsAnnotations] = util.EncodePodDevices(util.PodDevices{{{UUID: devices[2].ID, Type: "NVIDIA", Usedmem: 1024, Usedcores: 10}}})
+	testCases := []struct {
+		pods []runtime.Object
+		ids  []string
+		envs map[string]string
+		err  bool
+	}{
+		{ids: []string{devices[1].ID}, envs: map[string]string{"NVIDIA_VISIBLE_DEVICES": devices[1].ID}},
+		{ids: []string{devices[1].ID, devices[2].ID}, envs: map[string]string{"NVIDIA_VISIBLE_DEVICES": devices[1].ID + "," + devices[2].ID}},
+		// Shared as vGPUs.
+		{ids: []string{devices[0].ID}, err: true},
+		{ids: []string{"GPU-unknown"}, err: true},
+		// A vGPU is still granted on the device moved to the whole pool.
+		{pods: []runtime.Object{vgpuPod}, ids: []string{devices[2].ID}, err: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			useTestClient(t, tc.pods...)
+			m := &NvidiaDevicePlugin{migStrategy: "none", resourceName: util.ResourceWholeGPU, deviceCache: &DeviceCache{cache: devices}}
+			reqs := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: tc.ids}}}
+			res, err := m.allocateWhole(context.Background(), reqs)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, &pluginapi.AllocateResponse{ContainerResponses: []*pluginapi.ContainerAllocateResponse{{Envs: tc.envs}}}, res)
+		})
+	}
+}
+
+func TestWholeAPIDevices(t *testing.T) {
+	nodeName := config.NodeName
+	defer func() { config.NodeName = nodeName }()
+	config.NodeName = "node1"
+	devices := simulatedDevices(t, "node1", 3)
+	useRuntimeConfig(t, RuntimeConfig{DeviceSplitCount: 10, Mode: "hami-core", WholeDevices: &config.FilterDevice{Index: []uint{1, 2}}})
+	vgpuPod := testPod("vgpu", "node1", "node1", corev1.PodRunning)
+	vgpuPod.Annotations[util.AssignedIDsAnnotations] = util.EncodePodDevices(util.PodDevices{{{UUID: devices[2].ID, Type: "NVIDIA", Usedmem: 1024, Usedcores: 10}}})
+	useTestClient(t, vgpuPod)
+
+	m := &NvidiaDevicePlugin{migStrategy: "none", resourceName: util.ResourceWholeGPU, deviceCache: &DeviceCache{cache: devices}}
+	require.Equal(t, []*pluginapi.Device{
+		{ID: devices[1].ID, Health: pluginapi.Healthy},
+		{ID: devices[2].ID, Health: pluginapi.Unhealthy},
+	}, m.wholeAPIDevices(devices))
+}
+
+func TestReadKubeletCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubelet_internal_checkpoint")
+	// The device IDs are a list before Kubernetes 1.20 and by NUMA node
+	// since.
+	require.NoError(t, os.WriteFile(path, []byte(`{"Data": {"PodDeviceEntries": [
+		{"PodUID": "uid1", "ContainerName": "main", "ResourceName": "volcano.sh/vgpu-number", "DeviceIDs": ["GPU-a-0", "GPU-a-1"]},
+		{"PodUID": "uid1", "ContainerName": "main", "ResourceName": "nvidia.com/gpu", "DeviceIDs": {"0": ["GPU-b"], "1": ["GPU-c"]}},
+		{"PodUID": "uid2", "ContainerName": "main", "ResourceName": "nvidia.com/gpu", "DeviceIDs": {"-1": ["GPU-d"]}}
+	]}}`), 0644))
+	testCases := []struct {
+		resourceName string
+		output       map[string][]string
+	}{
+		{resourceName: "volcano.sh/vgpu-number", output: map[string][]string{"uid1/main": {"GPU-a-0", "GPU-a-1"}}},
+		{resourceName: "nvidia.com/gpu", output: map[string][]string{"uid1/main": {"GPU-b", "GPU-c"}, "uid2/main": {"GPU-d"}}},
+		{resourceName: "other", output: map[string][]string{}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			output, err := readKubeletCheckpoint(path, tc.resourceName)
+			require.NoError(t, err)
+			for _, ids := range output {
+				sort.Strings(ids)
+			}
+			require.Equal(t, tc.output, output)
+		})
+	}
+	_, err := readKubeletCheckpoint(filepath.Join(t.TempDir(), "missing"), "nvidia.com/gpu")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package quota enforces the VGPUQuotas, the totals of vGPUs, memory and
+// cores the pods of a namespace are granted, which the extended resources
+// of a ResourceQuota can't express for shares of GPUs.
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/aggregator"
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+func terminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// PodUsage returns the vGPUs of the pod: those the scheduler assigned to
+// it or, before, those its containers request. A memory percentage is
+// counted of deviceMemory, usually the largest memory of a GPU.
+func PodUsage(pod *corev1.Pod, deviceMemory int32) v1alpha1.VGPUQuotaUsage {
+	var u v1alpha1.VGPUQuotaUsage
+	if assigned := pod.Annotations[util.AssignedIDsAnnotations]; assigned != "" {
+		for _, ctr := range util.DecodePodDevices(assigned) {
+			for _, d := range ctr {
+				u.VGPUs++
+				u.Memory += int64(d.Usedmem)
+				u.Cores += int64(d.Usedcores)
+			}
+		}
+		return u
+	}
+	for _, s := range aggregator.RequestShapes(pod) {
+		memory := int64(s.Memory)
+		if memory == 0 {
+			memory = int64(s.MemoryPercentage) * int64(deviceMemory) / 100
+		}
+		u.VGPUs += int64(s.Count)
+		u.Memory += int64(s.Count) * memory
+		u.Cores += int64(s.Count) * int64(s.Cores)
+	}
+	return u
+}
+
+// NamespaceUsage returns the vGPUs of the pods of namespace which didn't
+// terminate.
+func NamespaceUsage(pods []*corev1.Pod, namespace string, deviceMemory int32) v1alpha1.VGPUQuotaUsage {
+	var u v1alpha1.VGPUQuotaUsage
+	for _, pod := range pods {
+		if pod.Namespace != namespace || terminated(pod) {
+			continue
+		}
+		u = u.Add(PodUsage(pod, deviceMemory))
+	}
+	return u
+}
+
+// MaxDeviceMemory returns the largest memory of the GPUs the nodes
+// registered.
+func MaxDeviceMemory(nodes []*corev1.Node) int32 {
+	var res int32
+	for _, node := range nodes {
+		for _, d := range util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered]) {
+			if d.Devmem > res {
+				res = d.Devmem
+			}
+		}
+	}
+	return res
+}
+
+// Check returns why the request of a pod doesn't fit in the quota with the
+// usage of the namespace, nil when it does.
+func Check(q *v1alpha1.VGPUQuota, used, request v1alpha1.VGPUQuotaUsage) error {
+	total := used.Add(request)
+	var exceeded []string
+	for _, r := range []struct {
+		name         string
+		hard         *int64
+		total, asked int64
+	}{
+		{"vgpus", q.Spec.Hard.VGPUs, total.VGPUs, request.VGPUs},
+		{"memory", q.Spec.Hard.Memory, total.Memory, request.Memory},
+		{"cores", q.Spec.Hard.Cores, total.Cores, request.Cores},
+	} {
+		if r.hard != nil && r.asked > 0 && r.total > *r.hard {
+			exceeded = append(exceeded, fmt.Sprintf("%s: requested %d, used %d, limited to %d", r.name, r.asked, r.total-r.asked, *r.hard))
+		}
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+	return fmt.Errorf("exceeded VGPUQuota %s, %s", q.Name, strings.Join(exceeded, ", "))
+}
+
+// Decode returns the quota of an unstructured object.
+func Decode(obj *unstructured.Unstructured) (*v1alpha1.VGPUQuota, error) {
+	var q v1alpha1.VGPUQuota
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &q); err != nil {
+		return nil, fmt.Errorf("decode VGPUQuota %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return &q, nil
+}
+
+// DecodeAll returns the quotas of the objects, sorted by namespace and
+// name, skipping those which can't be decoded.
+func DecodeAll(objs []runtime.Object) []*v1alpha1.VGPUQuota {
+	res := make([]*v1alpha1.VGPUQuota, 0, len(objs))
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		q, err := Decode(u)
+		if err != nil {
+			klog.Warning(err)
+			continue
+		}
+		res = append(res, q)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+func init() {
+	util.ResourceName = "volcano.sh/vgpu-number"
+	util.ResourceMem = "volcano.sh/vgpu-memory"
+	util.ResourceCores = "volcano.sh/vgpu-cores"
+	util.ResourceMemPercentage = "volcano.sh/vgpu-memory-percentage"
+}
+
+func vgpuPod(annotations map[string]string, limits ...map[string]int64) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", Annotations: annotations}}
+	for _, l := range limits {
+		ctr := corev1.Container{Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{}}}
+		for name, v := range l {
+			ctr.Resources.Limits[corev1.ResourceName(name)] = *resource.NewQuantity(v, resource.DecimalSI)
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, ctr)
+	}
+	return pod
+}
+
+func TestPodUsage(t *testing.T) {
+	testCases := []struct {
+		pod    *corev1.Pod
+		output v1alpha1.VGPUQuotaUsage
+	}{
+		{
+			pod:    vgpuPod(nil),
+			output: v1alpha1.VGPUQuotaUsage{},
+		},
+		{
+			pod: vgpuPod(nil,
+				map[string]int64{util.ResourceName: 2, util.ResourceMem: 1000, util.ResourceCores: 30},
+				map[string]int64{util.ResourceName: 1, util.ResourceMemPercentage: 50}),
+			output: v1alpha1.VGPUQuotaUsage{VGPUs: 3, Memory: 2*1000 + 8000, Cores: 60},
+		},
+		{
+			// The assigned devices win over the requests.
+			pod: vgpuPod(map[string]string{util.AssignedIDsAnnotations: util.EncodePodDevices(util.PodDevices{
+				{{UUID: "gpu0", Type: "NVIDIA", Usedmem: 500, Usedcores: 20}, {UUID: "gpu1", Type: "NVIDIA", Usedmem: 700, Usedcores: 0}},
+			})}, map[string]int64{util.ResourceName: 4, util.ResourceMem: 1}),
+			output: v1alpha1.VGPUQuotaUsage{VGPUs: 2, Memory: 1200, Cores: 20},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, PodUsage(tc.pod, 16000))
+		})
+	}
+}
+
+func TestNamespaceUsage(t *testing.T) {
+	running := vgpuPod(nil, map[string]int64{util.ResourceName: 1, util.ResourceMem: 100})
+	done := vgpuPod(nil, map[string]int64{util.ResourceName: 1, util.ResourceMem: 100})
+	done.Status.Phase = corev1.PodSucceeded
+	other := vgpuPod(nil, map[string]int64{util.ResourceName: 1, util.ResourceMem: 100})
+	other.Namespace = "other"
+	require.Equal(t, v1alpha1.VGPUQuotaUsage{VGPUs: 1, Memory: 100}, NamespaceUsage([]*corev1.Pod{running, done, other}, "ns", 0))
+}
+
+func TestCheck(t *testing.T) {
+	limit := func(v int64) *int64 { return &v }
+	q := &v1alpha1.VGPUQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "quota"},
+		Spec:       v1alpha1.VGPUQuotaSpec{Hard: v1alpha1.VGPUQuotaLimits{VGPUs: limit(4), Memory: limit(1000)}},
+	}
+	testCases := []struct {
+		used, request v1alpha1.VGPUQuotaUsage
+		err           string
+	}{
+		{
+			used:    v1alpha1.VGPUQuotaUsage{VGPUs: 2, Memory: 500, Cores: 500},
+			request: v1alpha1.VGPUQuotaUsage{VGPUs: 2, Memory: 500, Cores: 500},
+		},
+		{
+			used:    v1alpha1.VGPUQuotaUsage{VGPUs: 3, Memory: 500},
+			request: v1alpha1.VGPUQuotaUsage{VGPUs: 2, Memory: 600},
+			err:     "exceeded VGPUQuota quota, vgpus: requested 2, used 3, limited to 4, memory: requested 600, used 500, limited to 1000",
+		},
+		{
+			// A namespace over its quota still runs the pods asking for
+			// none of the exceeded resources.
+			used:    v1alpha1.VGPUQuotaUsage{VGPUs: 5, Memory: 500},
+			request: v1alpha1.VGPUQuotaUsage{Memory: 100},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			err := Check(q, tc.used, tc.request)
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
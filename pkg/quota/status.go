@@ -0,0 +1,131 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+)
+
+var (
+	quotaHardDesc = prometheus.NewDesc(
+		"vgpu_namespace_quota_hard",
+		"Limit of a VGPUQuota, by resource: vgpus, memory in MiB or cores",
+		[]string{"namespace", "quota", "resource"}, nil,
+	)
+	quotaUsedDesc = prometheus.NewDesc(
+		"vgpu_namespace_quota_used",
+		"vGPUs the pods of the namespace of a VGPUQuota are granted or request, by resource: vgpus, memory in MiB or cores",
+		[]string{"namespace", "quota", "resource"}, nil,
+	)
+)
+
+// StatusWriter writes the usage of the VGPUQuotas in their status.
+type StatusWriter struct {
+	Client dynamic.Interface
+
+	mutex  sync.Mutex
+	quotas []*v1alpha1.VGPUQuota
+}
+
+// Run writes the usage of the quotas from the state returned by list every
+// interval. It never returns.
+func (w *StatusWriter) Run(interval time.Duration, list func() ([]*corev1.Node, []*corev1.Pod)) {
+	klog.Infof("Writing the usage of the VGPUQuotas every %v", interval)
+	for {
+		nodes, pods := list()
+		if err := w.Step(nodes, pods, time.Now()); err != nil {
+			klog.Errorf("Failed to write the usage of the VGPUQuotas: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Step writes the usage of the quotas whose status is out of date.
+func (w *StatusWriter) Step(nodes []*corev1.Node, pods []*corev1.Pod, now time.Time) error {
+	ctx := context.Background()
+	resource := w.Client.Resource(v1alpha1.VGPUQuotaResource)
+	list, err := resource.Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	deviceMemory := MaxDeviceMemory(nodes)
+	objs := make([]runtime.Object, 0, len(list.Items))
+	for i := range list.Items {
+		obj := &list.Items[i]
+		objs = append(objs, obj)
+		q, err := Decode(obj)
+		if err != nil {
+			klog.Warning(err)
+			continue
+		}
+		used := NamespaceUsage(pods, q.Namespace, deviceMemory)
+		if q.Status.Used == used && !q.Status.UpdateTime.IsZero() {
+			continue
+		}
+		status := v1alpha1.VGPUQuotaStatus{UpdateTime: metav1.NewTime(now), Used: used}
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return err
+		}
+		obj.Object["status"] = content
+		if _, err := resource.Namespace(q.Namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			klog.Errorf("Failed to write the usage of VGPUQuota %s/%s: %v", q.Namespace, q.Name, err)
+		}
+	}
+	quotas := DecodeAll(objs)
+	w.mutex.Lock()
+	w.quotas = quotas
+	w.mutex.Unlock()
+	return nil
+}
+
+func (w *StatusWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quotaHardDesc
+	ch <- quotaUsedDesc
+}
+
+func (w *StatusWriter) Collect(ch chan<- prometheus.Metric) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, q := range w.quotas {
+		for _, r := range []struct {
+			name string
+			hard *int64
+			used int64
+		}{
+			{"vgpus", q.Spec.Hard.VGPUs, q.Status.Used.VGPUs},
+			{"memory", q.Spec.Hard.Memory, q.Status.Used.Memory},
+			{"cores", q.Spec.Hard.Cores, q.Status.Used.Cores},
+		} {
+			if r.hard != nil {
+				ch <- prometheus.MustNewConstMetric(quotaHardDesc, prometheus.GaugeValue, float64(*r.hard), q.Namespace, q.Name, r.name)
+			}
+			ch <- prometheus.MustNewConstMetric(quotaUsedDesc, prometheus.GaugeValue, float64(r.used), q.Namespace, q.Name, r.name)
+		}
+	}
+}
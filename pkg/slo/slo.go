@@ -0,0 +1,133 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package slo measures the phases of the vGPU handshake of a pod, from its
+// assignment by the scheduler to the first shared region of its containers.
+package slo
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// The phases of the handshake of a pod.
+const (
+	// PhaseBind is from the assignment of the pod by the scheduler to the
+	// first Allocate of its devices.
+	PhaseBind = "bind"
+	// PhaseAllocate is from the first Allocate of the pod to the last one.
+	PhaseAllocate = "allocate"
+	// PhaseRegion is from the end of the allocation of the pod to the
+	// shared region of a container created by libvgpu.
+	PhaseRegion = "region"
+	// PhaseTotal is from the assignment of the pod to the shared region of
+	// a container, the time from the pod bind to the GPU usable.
+	PhaseTotal = "total"
+)
+
+// Buckets are the upper bounds of the phase durations, in seconds.
+var Buckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var phaseDurationDesc = prometheus.NewDesc(
+	"vgpu_allocation_phase_duration_seconds",
+	"Duration of the phases of the vGPU handshake of the pods, from the assignment by the scheduler to the GPU usable",
+	[]string{"phase"}, nil,
+)
+
+type histogram struct {
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+// Recorder exports the durations of the phases observed by a component as
+// histograms.
+type Recorder struct {
+	mutex  sync.Mutex
+	phases map[string]*histogram
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{phases: make(map[string]*histogram)}
+}
+
+// Observe records the duration of a phase of the handshake identified by
+// correlationID, durations below zero are from skewed clocks and dropped.
+func (r *Recorder) Observe(phase, correlationID string, d time.Duration) {
+	if d < 0 {
+		klog.V(4).Infof("Dropping negative %s duration %v of handshake %s", phase, d, correlationID)
+		return
+	}
+	klog.Infof("Handshake %s: phase %s took %v", correlationID, phase, d)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	h, ok := r.phases[phase]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(Buckets))}
+		r.phases[phase] = h
+	}
+	s := d.Seconds()
+	h.count++
+	h.sum += s
+	for i, b := range Buckets {
+		if s <= b {
+			h.buckets[i]++
+		}
+	}
+}
+
+func (r *Recorder) Describe(ch chan<- *prometheus.Desc) {
+	ch <- phaseDurationDesc
+}
+
+func (r *Recorder) Collect(ch chan<- prometheus.Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	phases := make([]string, 0, len(r.phases))
+	for phase := range r.phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		h := r.phases[phase]
+		buckets := make(map[float64]uint64, len(Buckets))
+		for i, b := range Buckets {
+			buckets[b] = h.buckets[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(phaseDurationDesc, h.count, h.sum, buckets, phase)
+	}
+}
+
+// ParseTime parses a time annotation in nanoseconds since the epoch, false
+// when it is missing or not a time, as the placeholder the plugin leaves on
+// the pods it picked.
+func ParseTime(value string) (time.Time, bool) {
+	ns, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ns <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// FormatTime formats a time annotation.
+func FormatTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+)
+
+// Exemplar label names, the pod UID and the container ID without the
+// scheme of its runtime, which fit the 128 characters OpenMetrics allows
+// the labels of an exemplar.
+const (
+	ExemplarPodUID      = "pod_uid"
+	ExemplarContainerID = "container_id"
+)
+
+// PodExemplars attaches the pod UID and the container ID of a container to
+// its metrics as exemplars, to link a series to the workload.
+type PodExemplars struct {
+	lister listerscorev1.PodLister
+}
+
+// NewPodExemplars returns nil when disabled, a nil PodExemplars attaches
+// nothing.
+func NewPodExemplars(lister listerscorev1.PodLister, enabled bool) *PodExemplars {
+	if !enabled {
+		return nil
+	}
+	return &PodExemplars{lister: lister}
+}
+
+// Gatherer attaches the exemplars to the counters of g which have the labels
+// named namespaceLabel and podLabel, the container ID is left out when they
+// have no containerLabel. OpenMetrics only allows exemplars on the counters
+// and the histogram buckets, the gauges get none.
+func (p *PodExemplars) Gatherer(g prometheus.Gatherer, namespaceLabel, podLabel, containerLabel string) prometheus.Gatherer {
+	if p == nil {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, mf := range families {
+			if mf.GetType() != dto.MetricType_COUNTER {
+				continue
+			}
+			for _, m := range mf.Metric {
+				p.attach(m, namespaceLabel, podLabel, containerLabel)
+			}
+		}
+		return families, err
+	})
+}
+
+func (p *PodExemplars) attach(m *dto.Metric, namespaceLabel, podLabel, containerLabel string) {
+	var namespace, name, container string
+	for _, l := range m.Label {
+		switch l.GetName() {
+		case namespaceLabel:
+			namespace = l.GetValue()
+		case podLabel:
+			name = l.GetValue()
+		case containerLabel:
+			container = l.GetValue()
+		}
+	}
+	if namespace == "" || name == "" || m.Counter == nil {
+		return
+	}
+	pod, err := p.lister.Pods(namespace).Get(name)
+	if err != nil {
+		return
+	}
+	labels := []*dto.LabelPair{exemplarLabel(ExemplarPodUID, string(pod.UID))}
+	if container != "" {
+		for _, s := range pod.Status.ContainerStatuses {
+			if s.Name == container && s.ContainerID != "" {
+				id := s.ContainerID
+				if i := strings.Index(id, "://"); i >= 0 {
+					id = id[i+len("://"):]
+				}
+				labels = append(labels, exemplarLabel(ExemplarContainerID, id))
+				break
+			}
+		}
+	}
+	value := m.Counter.GetValue()
+	m.Counter.Exemplar = &dto.Exemplar{Label: labels, Value: &value}
+}
+
+func exemplarLabel(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
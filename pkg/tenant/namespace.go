@@ -0,0 +1,170 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceMatcher matches the namespaces by name or by label selector.
+type namespaceMatcher struct {
+	names     map[string]bool
+	selectors []labels.Selector
+}
+
+// newNamespaceMatcher parses the entries of an allow or deny list. An entry
+// with an operator, e.g. team=ml or env in (prod,staging), is a label
+// selector, the others comma-separated namespace names.
+func newNamespaceMatcher(entries []string) (*namespaceMatcher, error) {
+	m := &namespaceMatcher{names: make(map[string]bool)}
+	for _, entry := range entries {
+		if strings.ContainsAny(entry, "=!(") {
+			selector, err := labels.Parse(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespace selector %q: %v", entry, err)
+			}
+			m.selectors = append(m.selectors, selector)
+			continue
+		}
+		for _, name := range strings.Split(entry, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				m.names[name] = true
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *namespaceMatcher) empty() bool {
+	return len(m.names) == 0 && len(m.selectors) == 0
+}
+
+func (m *namespaceMatcher) match(name string, nsLabels labels.Set) bool {
+	if m.names[name] {
+		return true
+	}
+	for _, s := range m.selectors {
+		if nsLabels != nil && s.Matches(nsLabels) {
+			return true
+		}
+	}
+	return false
+}
+
+// NamespaceFilter selects the namespaces whose container metrics are
+// exported, those of the allow list if there is one, but for those of the
+// deny list.
+type NamespaceFilter struct {
+	allow, deny *namespaceMatcher
+	// lister is nil unless a selector needs the labels of the namespaces.
+	lister listerscorev1.NamespaceLister
+}
+
+// NewNamespaceFilter parses the allow and deny lists and, when one has
+// label selectors, starts a namespace informer and returns once it synced.
+// It returns nil when both lists are empty, a nil NamespaceFilter allows
+// every namespace.
+func NewNamespaceFilter(client kubernetes.Interface, allow, deny []string, stopCh <-chan struct{}) (*NamespaceFilter, error) {
+	f := &NamespaceFilter{}
+	var err error
+	if f.allow, err = newNamespaceMatcher(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = newNamespaceMatcher(deny); err != nil {
+		return nil, err
+	}
+	if f.allow.empty() && f.deny.empty() {
+		return nil, nil
+	}
+	if len(f.allow.selectors) > 0 || len(f.deny.selectors) > 0 {
+		factory := informers.NewSharedInformerFactory(client, time.Hour)
+		informer := factory.Core().V1().Namespaces()
+		f.lister = informer.Lister()
+		factory.Start(stopCh)
+		cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced)
+	}
+	return f, nil
+}
+
+// Allowed reports whether the metrics of the namespace are exported.
+func (f *NamespaceFilter) Allowed(namespace string) bool {
+	if f == nil {
+		return true
+	}
+	var nsLabels labels.Set
+	if f.lister != nil {
+		if ns, err := f.lister.Get(namespace); err == nil {
+			nsLabels = ns.Labels
+		}
+	}
+	if !f.allow.empty() && !f.allow.match(namespace, nsLabels) {
+		return false
+	}
+	return !f.deny.match(namespace, nsLabels)
+}
+
+// Gatherer drops the metrics of g whose label named namespaceLabel is a
+// namespace not allowed, those without it or with it empty are kept. The
+// families left without metrics are dropped too.
+func (f *NamespaceFilter) Gatherer(g prometheus.Gatherer, namespaceLabel string) prometheus.Gatherer {
+	if f == nil {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		allowed := make(map[string]bool)
+		res := families[:0]
+		for _, mf := range families {
+			metrics := mf.Metric[:0]
+			for _, m := range mf.Metric {
+				namespace := ""
+				for _, l := range m.Label {
+					if l.GetName() == namespaceLabel {
+						namespace = l.GetValue()
+						break
+					}
+				}
+				if namespace != "" {
+					ok, known := allowed[namespace]
+					if !known {
+						ok = f.Allowed(namespace)
+						allowed[namespace] = ok
+					}
+					if !ok {
+						continue
+					}
+				}
+				metrics = append(metrics, m)
+			}
+			mf.Metric = metrics
+			if len(metrics) > 0 {
+				res = append(res, mf)
+			}
+		}
+		return res, err
+	})
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tenant
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+)
+
+// PodLabels maps a pod to the values of an allowlist of its labels, e.g.
+// the team or the Volcano job, for the chargeback of its containers.
+type PodLabels struct {
+	lister listerscorev1.PodLister
+	keys   []string
+	names  []string
+}
+
+// NewPodLabels returns nil when no label is allowed, a nil PodLabels
+// resolves nothing.
+func NewPodLabels(lister listerscorev1.PodLister, keys []string) *PodLabels {
+	if len(keys) == 0 {
+		return nil
+	}
+	p := &PodLabels{lister: lister, keys: keys}
+	for _, key := range keys {
+		p.names = append(p.names, PodLabelName(key))
+	}
+	return p
+}
+
+// PodLabelName is the metric label a pod label is exported as, label_
+// followed by its full name, e.g. label_volcano_sh_job_name for
+// volcano.sh/job-name, as kube-state-metrics does.
+func PodLabelName(key string) string {
+	return "label_" + sanitize(key)
+}
+
+// Names returns the metric label names, in the order of Values.
+func (p *PodLabels) Names() []string {
+	if p == nil {
+		return nil
+	}
+	return p.names
+}
+
+// Values returns the values of the allowed labels of the pod, empty for the
+// ones it doesn't have.
+func (p *PodLabels) Values(namespace, name string) []string {
+	if p == nil {
+		return nil
+	}
+	values := make([]string, len(p.keys))
+	pod, err := p.lister.Pods(namespace).Get(name)
+	if err != nil {
+		return values
+	}
+	for i, key := range p.keys {
+		values[i] = pod.Labels[key]
+	}
+	return values
+}
+
+// Gatherer adds the allowed labels of the pod to the metrics of g which have
+// the labels named namespaceLabel and podLabel.
+func (p *PodLabels) Gatherer(g prometheus.Gatherer, namespaceLabel, podLabel string) prometheus.Gatherer {
+	if p == nil {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, mf := range families {
+			for _, m := range mf.Metric {
+				p.label(m, namespaceLabel, podLabel)
+			}
+		}
+		return families, err
+	})
+}
+
+func (p *PodLabels) label(m *dto.Metric, namespaceLabel, podLabel string) {
+	var namespace, pod string
+	for _, l := range m.Label {
+		switch l.GetName() {
+		case namespaceLabel:
+			namespace = l.GetValue()
+		case podLabel:
+			pod = l.GetValue()
+		}
+	}
+	if namespace == "" || pod == "" {
+		return
+	}
+	for i, v := range p.Values(namespace, pod) {
+		name, value := p.names[i], v
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+}
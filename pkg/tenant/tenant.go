@@ -0,0 +1,156 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tenant resolves the team, cost center or any other tenant
+// metadata of a namespace, from its labels and annotations, so that it can
+// be attached to the metrics of the containers of the namespace.
+package tenant
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Resolver maps a namespace to the values of the configured labels and
+// annotations, following a namespace informer.
+type Resolver struct {
+	lister      listerscorev1.NamespaceLister
+	labels      []string
+	annotations []string
+	names       []string
+}
+
+// NewResolver starts a namespace informer and returns once it synced. It
+// returns nil when no label nor annotation is configured, a nil Resolver
+// resolves nothing.
+func NewResolver(client kubernetes.Interface, labels, annotations []string, stopCh <-chan struct{}) *Resolver {
+	if len(labels) == 0 && len(annotations) == 0 {
+		return nil
+	}
+	factory := informers.NewSharedInformerFactory(client, time.Hour)
+	informer := factory.Core().V1().Namespaces()
+	r := &Resolver{lister: informer.Lister(), labels: labels, annotations: annotations}
+	for _, key := range append(append([]string{}, labels...), annotations...) {
+		r.names = append(r.names, LabelName(key))
+	}
+	factory.Start(stopCh)
+	cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced)
+	return r
+}
+
+// LabelName is the metric label a namespace label or annotation is exported
+// as, namespace_ followed by its name, e.g. namespace_cost_center for
+// example.com/cost-center.
+func LabelName(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		key = key[i+1:]
+	}
+	return "namespace_" + sanitize(key)
+}
+
+// sanitize replaces the characters not allowed in a metric label name by
+// underscores.
+func sanitize(key string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// Names returns the metric label names, in the order of Values.
+func (r *Resolver) Names() []string {
+	if r == nil {
+		return nil
+	}
+	return r.names
+}
+
+// Values returns the values of the labels then of the annotations of the
+// namespace, empty for the ones it doesn't have.
+func (r *Resolver) Values(namespace string) []string {
+	if r == nil {
+		return nil
+	}
+	values := make([]string, len(r.names))
+	ns, err := r.lister.Get(namespace)
+	if err != nil {
+		return values
+	}
+	for i, key := range r.labels {
+		values[i] = ns.Labels[key]
+	}
+	for i, key := range r.annotations {
+		values[len(r.labels)+i] = ns.Annotations[key]
+	}
+	return values
+}
+
+// Map returns the values of Values keyed by their label name.
+func (r *Resolver) Map(namespace string) map[string]string {
+	if r == nil {
+		return nil
+	}
+	res := make(map[string]string, len(r.names))
+	for i, v := range r.Values(namespace) {
+		res[r.names[i]] = v
+	}
+	return res
+}
+
+// Gatherer adds the tenant labels of the namespace to the metrics of g
+// which have a label named namespaceLabel.
+func (r *Resolver) Gatherer(g prometheus.Gatherer, namespaceLabel string) prometheus.Gatherer {
+	if r == nil {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, mf := range families {
+			for _, m := range mf.Metric {
+				r.label(m, namespaceLabel)
+			}
+		}
+		return families, err
+	})
+}
+
+func (r *Resolver) label(m *dto.Metric, namespaceLabel string) {
+	namespace, found := "", false
+	for _, l := range m.Label {
+		if l.GetName() == namespaceLabel {
+			namespace, found = l.GetValue(), true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	for i, v := range r.Values(namespace) {
+		name, value := r.names[i], v
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+}
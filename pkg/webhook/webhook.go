@@ -0,0 +1,372 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook admits the pods requesting vGPUs: it defaults their
+// memory, points them to the vGPU scheduler and rejects the requests no node
+// can satisfy, instead of the pods staying pending or failing their
+// allocation on the node.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"volcano.sh/k8s-device-plugin/pkg/aggregator"
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+	"volcano.sh/k8s-device-plugin/pkg/quota"
+)
+
+// Paths the webhook serves the admission reviews on.
+const (
+	MutatePath   = "/mutate"
+	ValidatePath = "/validate"
+)
+
+var admissionsDesc = prometheus.NewDesc(
+	"vgpu_webhook_admissions_total",
+	"Admission reviews of the pods requesting vGPUs, by webhook: mutate or validate, and result: allowed, mutated or denied",
+	[]string{"webhook", "result"}, nil,
+)
+
+// Webhook admits the pods requesting vGPUs.
+type Webhook struct {
+	// Nodes lists the nodes the requests are checked against.
+	Nodes func() []*corev1.Node
+	// DefaultMemory is the memory, in MiB, of the vGPUs requested without
+	// memory, the whole memory of the device when 0.
+	DefaultMemory int64
+	// DefaultCores are the cores of the vGPUs requested without cores, left
+	// unset when 0.
+	DefaultCores int64
+	// SchedulerName is the scheduler the pods of the default scheduler are
+	// given, left unchanged when empty.
+	SchedulerName string
+	// Quotas lists the VGPUQuotas of a namespace and Pods its pods, the
+	// quotas are not enforced when nil.
+	Quotas func(namespace string) []*v1alpha1.VGPUQuota
+	Pods   func(namespace string) []*corev1.Pod
+
+	mutex  sync.Mutex
+	counts map[admissionKey]float64
+}
+
+type admissionKey struct {
+	webhook, result string
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// requestsVGPU reports whether the container requests vGPUs.
+func requestsVGPU(ctr *corev1.Container) bool {
+	count, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceName)]
+	return ok && count.Value() > 0
+}
+
+// escape escapes a key for a JSON patch path.
+func escape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// Mutate returns the patch defaulting the pod, nil when the pod requests no
+// vGPU. The vGPU containers without memory get DefaultMemory, or the whole
+// memory of the device, and DefaultCores; the other containers of the pod
+// get NVIDIA_VISIBLE_DEVICES=none so that the NVIDIA runtime doesn't give
+// them every GPU of the node.
+func (w *Webhook) Mutate(pod *corev1.Pod) []patchOperation {
+	var patch []patchOperation
+	vgpu := false
+	for i := range pod.Spec.Containers {
+		ctr := &pod.Spec.Containers[i]
+		if !requestsVGPU(ctr) {
+			continue
+		}
+		vgpu = true
+		var defaults []corev1.ResourceList
+		_, hasMem := ctr.Resources.Limits[corev1.ResourceName(util.ResourceMem)]
+		_, hasPct := ctr.Resources.Limits[corev1.ResourceName(util.ResourceMemPercentage)]
+		if !hasMem && !hasPct {
+			if w.DefaultMemory > 0 {
+				defaults = append(defaults, quantity(util.ResourceMem, w.DefaultMemory))
+			} else {
+				defaults = append(defaults, quantity(util.ResourceMemPercentage, 100))
+			}
+		}
+		if _, ok := ctr.Resources.Limits[corev1.ResourceName(util.ResourceCores)]; !ok && w.DefaultCores > 0 {
+			defaults = append(defaults, quantity(util.ResourceCores, w.DefaultCores))
+		}
+		for _, d := range defaults {
+			for name, q := range d {
+				patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/resources/limits/%s", i, escape(string(name))), Value: q.String()})
+				// The extended resources requested must equal their limits.
+				if _, ok := ctr.Resources.Requests[corev1.ResourceName(util.ResourceName)]; ok {
+					patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/resources/requests/%s", i, escape(string(name))), Value: q.String()})
+				}
+			}
+		}
+	}
+	if !vgpu {
+		return nil
+	}
+	for i := range pod.Spec.Containers {
+		ctr := &pod.Spec.Containers[i]
+		if requestsVGPU(ctr) || hasEnv(ctr, "NVIDIA_VISIBLE_DEVICES") {
+			continue
+		}
+		env := corev1.EnvVar{Name: "NVIDIA_VISIBLE_DEVICES", Value: "none"}
+		if len(ctr.Env) == 0 {
+			patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/env", i), Value: []corev1.EnvVar{env}})
+		} else {
+			patch = append(patch, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/env/-", i), Value: env})
+		}
+	}
+	if w.SchedulerName != "" && (pod.Spec.SchedulerName == "" || pod.Spec.SchedulerName == corev1.DefaultSchedulerName) {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/schedulerName", Value: w.SchedulerName})
+	}
+	return patch
+}
+
+func quantity(name string, value int64) corev1.ResourceList {
+	return corev1.ResourceList{corev1.ResourceName(name): *resource.NewQuantity(value, resource.DecimalSI)}
+}
+
+func hasEnv(ctr *corev1.Container, name string) bool {
+	for _, env := range ctr.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns why no node can host the vGPUs of a container of the
+// pod, nil when they all fit on a node or no node registered devices yet,
+// or why they exceed a VGPUQuota of its namespace.
+func (w *Webhook) Validate(pod *corev1.Pod) error {
+	shapes := aggregator.RequestShapes(pod)
+	if len(shapes) == 0 {
+		return nil
+	}
+	nodes := w.Nodes()
+	var registered [][]*util.DeviceInfo
+	for _, node := range nodes {
+		if devices := util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered]); len(devices) > 0 {
+			registered = append(registered, devices)
+		}
+	}
+	for _, s := range shapes {
+		switch {
+		case s.Memory < 0 || s.Cores < 0:
+			return fmt.Errorf("the vGPU memory and cores can't be negative")
+		case s.MemoryPercentage > 100:
+			return fmt.Errorf("%s is %d, more than 100%% of the device memory", util.ResourceMemPercentage, s.MemoryPercentage)
+		case s.Cores > util.DeviceLimit:
+			return fmt.Errorf("%s is %d, more than the %d%% of a device", util.ResourceCores, s.Cores, util.DeviceLimit)
+		}
+		if len(registered) == 0 {
+			// Nodes may come with the cluster autoscaler, the scheduler
+			// decides then.
+			continue
+		}
+		if !fitsAnyNode(s, registered) {
+			return fmt.Errorf("no node has %d healthy GPUs%s%s", s.Count, memoryFilter(s), typeFilter(s))
+		}
+	}
+	return w.checkQuotas(pod, nodes)
+}
+
+// checkQuotas returns why the pod exceeds a VGPUQuota of its namespace with
+// the pods already there.
+func (w *Webhook) checkQuotas(pod *corev1.Pod, nodes []*corev1.Node) error {
+	if w.Quotas == nil {
+		return nil
+	}
+	quotas := w.Quotas(pod.Namespace)
+	if len(quotas) == 0 {
+		return nil
+	}
+	deviceMemory := quota.MaxDeviceMemory(nodes)
+	var others []*corev1.Pod
+	for _, p := range w.Pods(pod.Namespace) {
+		if pod.UID == "" || p.UID != pod.UID {
+			others = append(others, p)
+		}
+	}
+	used := quota.NamespaceUsage(others, pod.Namespace, deviceMemory)
+	request := quota.PodUsage(pod, deviceMemory)
+	for _, q := range quotas {
+		if err := quota.Check(q, used, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fitsAnyNode reports whether the devices of a node can host the shape,
+// empty ones.
+func fitsAnyNode(s aggregator.RequestShape, registered [][]*util.DeviceInfo) bool {
+	for _, devices := range registered {
+		fit := int32(0)
+		for _, d := range devices {
+			if d.Health && d.Devmem >= s.Memory && util.MatchGPUType(d.Type, s.UseTypes, s.NoUseTypes) {
+				fit++
+			}
+		}
+		if fit >= s.Count {
+			return true
+		}
+	}
+	return false
+}
+
+func memoryFilter(s aggregator.RequestShape) string {
+	if s.Memory == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" with %d MiB of memory each", s.Memory)
+}
+
+func typeFilter(s aggregator.RequestShape) string {
+	var res string
+	if len(s.UseTypes) > 0 {
+		res += fmt.Sprintf(" of types %v", s.UseTypes)
+	}
+	if len(s.NoUseTypes) > 0 {
+		res += fmt.Sprintf(" not of types %v", s.NoUseTypes)
+	}
+	return res
+}
+
+// ServeMutate serves the reviews of the mutating webhook.
+func (w *Webhook) ServeMutate(rw http.ResponseWriter, r *http.Request) {
+	w.serve(rw, r, "mutate", func(pod *corev1.Pod, resp *admissionv1.AdmissionResponse) string {
+		patch := w.Mutate(pod)
+		if len(patch) == 0 {
+			return "allowed"
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			resp.Allowed = false
+			resp.Result = &metav1.Status{Message: err.Error()}
+			return "denied"
+		}
+		pt := admissionv1.PatchTypeJSONPatch
+		resp.Patch, resp.PatchType = data, &pt
+		return "mutated"
+	})
+}
+
+// ServeValidate serves the reviews of the validating webhook.
+func (w *Webhook) ServeValidate(rw http.ResponseWriter, r *http.Request) {
+	w.serve(rw, r, "validate", func(pod *corev1.Pod, resp *admissionv1.AdmissionResponse) string {
+		if err := w.Validate(pod); err != nil {
+			klog.Infof("Denying pod %s/%s: %v", pod.Namespace, podName(pod), err)
+			resp.Allowed = false
+			resp.Result = &metav1.Status{Message: "vGPU request: " + err.Error(), Reason: metav1.StatusReasonInvalid, Code: http.StatusUnprocessableEntity}
+			return "denied"
+		}
+		return "allowed"
+	})
+}
+
+// podName returns the name of the pod, its generated name prefix when it is
+// created with one.
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+func (w *Webhook) serve(rw http.ResponseWriter, r *http.Request, webhook string, admit func(*corev1.Pod, *admissionv1.AdmissionResponse) string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(rw, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	resp := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(review.Request.Object.Raw, pod); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("invalid pod: %v", err)}
+		w.count(webhook, "denied")
+	} else {
+		if pod.Namespace == "" {
+			pod.Namespace = review.Request.Namespace
+		}
+		w.count(webhook, admit(pod, resp))
+	}
+	// The API server only reads v1 responses.
+	review.TypeMeta = metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"}
+	review.Response = resp
+	review.Request = nil
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(review); err != nil {
+		klog.Errorf("Failed to encode the admission review: %v", err)
+	}
+}
+
+func (w *Webhook) count(webhook, result string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.counts == nil {
+		w.counts = make(map[admissionKey]float64)
+	}
+	w.counts[admissionKey{webhook: webhook, result: result}]++
+}
+
+func (w *Webhook) Describe(ch chan<- *prometheus.Desc) {
+	ch <- admissionsDesc
+}
+
+func (w *Webhook) Collect(ch chan<- prometheus.Metric) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	keys := make([]admissionKey, 0, len(w.counts))
+	for key := range w.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].webhook != keys[j].webhook {
+			return keys[i].webhook < keys[j].webhook
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(admissionsDesc, prometheus.CounterValue, w.counts[key], key.webhook, key.result)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"volcano.sh/k8s-device-plugin/pkg/apis/vgpu/v1alpha1"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+func init() {
+	util.ResourceName = "volcano.sh/vgpu-number"
+	util.ResourceMem = "volcano.sh/vgpu-memory"
+	util.ResourceCores = "volcano.sh/vgpu-cores"
+	util.ResourceMemPercentage = "volcano.sh/vgpu-memory-percentage"
+}
+
+func container(limits map[string]int64, env ...corev1.EnvVar) corev1.Container {
+	ctr := corev1.Container{Env: env, Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{}}}
+	for name, v := range limits {
+		ctr.Resources.Limits[corev1.ResourceName(name)] = *resource.NewQuantity(v, resource.DecimalSI)
+	}
+	return ctr
+}
+
+func pod(containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", UID: "uid"},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+func node(devices ...*util.DeviceInfo) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node",
+		Annotations: map[string]string{util.NodeNvidiaDeviceRegistered: util.EncodeNodeDevices(devices)},
+	}}
+}
+
+func TestMutate(t *testing.T) {
+	testCases := []struct {
+		webhook *Webhook
+		pod     *corev1.Pod
+		output  []patchOperation
+	}{
+		{
+			webhook: &Webhook{},
+			pod:     pod(container(nil)),
+		},
+		{
+			webhook: &Webhook{DefaultCores: 30, SchedulerName: "volcano"},
+			pod: pod(
+				container(map[string]int64{util.ResourceName: 1}),
+				container(nil),
+				container(nil, corev1.EnvVar{Name: "A", Value: "1"}),
+				container(nil, corev1.EnvVar{Name: "NVIDIA_VISIBLE_DEVICES", Value: "all"}),
+			),
+			output: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/resources/limits/volcano.sh~1vgpu-memory-percentage", Value: "100"},
+				{Op: "add", Path: "/spec/containers/0/resources/limits/volcano.sh~1vgpu-cores", Value: "30"},
+				{Op: "add", Path: "/spec/containers/1/env", Value: []corev1.EnvVar{{Name: "NVIDIA_VISIBLE_DEVICES", Value: "none"}}},
+				{Op: "add", Path: "/spec/containers/2/env/-", Value: corev1.EnvVar{Name: "NVIDIA_VISIBLE_DEVICES", Value: "none"}},
+				{Op: "add", Path: "/spec/schedulerName", Value: "volcano"},
+			},
+		},
+		{
+			webhook: &Webhook{DefaultMemory: 2000},
+			pod: pod(
+				container(map[string]int64{util.ResourceName: 1}),
+				container(map[string]int64{util.ResourceName: 1, util.ResourceMem: 1000, util.ResourceCores: 50}),
+			),
+			output: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/resources/limits/volcano.sh~1vgpu-memory", Value: "2k"},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			require.Equal(t, tc.output, tc.webhook.Mutate(tc.pod))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	nodes := []*corev1.Node{node(
+		&util.DeviceInfo{Id: "gpu0", Count: 4, Devmem: 16000, Type: "NVIDIA-Tesla T4", Health: true},
+		&util.DeviceInfo{Id: "gpu1", Count: 4, Devmem: 16000, Type: "NVIDIA-Tesla T4", Health: true},
+		&util.DeviceInfo{Id: "gpu2", Count: 4, Devmem: 16000, Type: "NVIDIA-Tesla T4", Health: false},
+	)}
+	limit := int64(2)
+	quotas := []*v1alpha1.VGPUQuota{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "quota"},
+		Spec:       v1alpha1.VGPUQuotaSpec{Hard: v1alpha1.VGPUQuotaLimits{VGPUs: &limit}},
+	}}
+	running := pod(container(map[string]int64{util.ResourceName: 1, util.ResourceMem: 1000}))
+	running.UID = "running"
+	testCases := []struct {
+		nodes []*corev1.Node
+		pod   *corev1.Pod
+		err   string
+	}{
+		{
+			nodes: nodes,
+			pod:   pod(container(nil)),
+		},
+		{
+			nodes: nodes,
+			pod:   pod(container(map[string]int64{util.ResourceName: 1, util.ResourceMem: 8000, util.ResourceCores: 50})),
+		},
+		{
+			nodes: nodes,
+			pod:   pod(container(map[string]int64{util.ResourceName: 1, util.ResourceMemPercentage: 150})),
+			err:   "volcano.sh/vgpu-memory-percentage is 150, more than 100% of the device memory",
+		},
+		{
+			nodes: nodes,
+			pod:   pod(container(map[string]int64{util.ResourceName: 1, util.ResourceCores: 120})),
+			err:   "volcano.sh/vgpu-cores is 120, more than the 100% of a device",
+		},
+		{
+			nodes: nodes,
+			pod:   pod(container(map[string]int64{util.ResourceName: 3, util.ResourceMem: 1000})),
+			err:   "no node has 3 healthy GPUs with 1000 MiB of memory each",
+		},
+		{
+			// Without registered nodes the scheduler decides.
+			pod: pod(container(map[string]int64{util.ResourceName: 1, util.ResourceMem: 32000})),
+		},
+		{
+			nodes: nodes,
+			pod:   pod(container(map[string]int64{util.ResourceName: 2, util.ResourceMem: 1000})),
+			err:   "exceeded VGPUQuota quota, vgpus: requested 2, used 1, limited to 2",
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("test case %d", i), func(t *testing.T) {
+			w := Webhook{
+				Nodes:  func() []*corev1.Node { return tc.nodes },
+				Quotas: func(string) []*v1alpha1.VGPUQuota { return quotas },
+				Pods:   func(string) []*corev1.Pod { return []*corev1.Pod{running, tc.pod} },
+			}
+			err := w.Validate(tc.pod)
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+//go:build kwok
+
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kwok
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+func TestRegisterInAnnotation(t *testing.T) {
+	if err := h.register.RegisterInAnnotation(); err != nil {
+		t.Fatalf("failed to register devices: %v", err)
+	}
+	registered := h.registeredDevices(t)
+	if len(registered) != simulatedGPUs {
+		t.Fatalf("registered %d devices, expected %d", len(registered), simulatedGPUs)
+	}
+	for i, d := range registered {
+		if d.Id != h.cache.GetCache()[i].ID {
+			t.Errorf("device %d registered as %s, expected %s", i, d.Id, h.cache.GetCache()[i].ID)
+		}
+		if d.Count != splitCount || !d.Health || !strings.Contains(d.Type, "A100") {
+			t.Errorf("device %d registered as %+v", i, d)
+		}
+	}
+
+	// A restarted plugin registers the same devices.
+	if err := h.register.RegisterInAnnotation(); err != nil {
+		t.Fatalf("failed to register devices again: %v", err)
+	}
+	if again := h.registeredDevices(t); util.EncodeNodeDevices(again) != util.EncodeNodeDevices(registered) {
+		t.Errorf("devices changed on register: %v, expected %v", again, registered)
+	}
+}
+
+func TestAllocateLifecycle(t *testing.T) {
+	registered := h.registeredDevices(t)
+	if len(registered) == 0 {
+		t.Skip("no registered devices")
+	}
+	pod := h.schedule(t, "lifecycle", time.Now(), util.PodDevices{
+		{device(registered, 0, 1024, 30), device(registered, 1, 2048, 30)},
+		{device(registered, 2, 4096, 0)},
+	})
+
+	// The kubelet allocates the containers one after the other.
+	resp, err := h.allocate(2)
+	if err != nil {
+		t.Fatalf("failed to allocate first container: %v", err)
+	}
+	envs := resp.ContainerResponses[0].Envs
+	if envs["NVIDIA_VISIBLE_DEVICES"] != registered[0].Id+","+registered[1].Id {
+		t.Errorf("NVIDIA_VISIBLE_DEVICES=%s", envs["NVIDIA_VISIBLE_DEVICES"])
+	}
+	if envs["CUDA_DEVICE_MEMORY_LIMIT_0"] != "1024m" || envs["CUDA_DEVICE_MEMORY_LIMIT_1"] != "2048m" || envs["CUDA_DEVICE_SM_LIMIT"] != "30" {
+		t.Errorf("unexpected limits %v", envs)
+	}
+	if phase := h.pod(t, pod.Name).Annotations[util.DeviceBindPhase]; phase != util.DeviceBindAllocating {
+		t.Errorf("bind phase %s after the first container, expected %s", phase, util.DeviceBindAllocating)
+	}
+	if !h.nodeLocked(t) {
+		t.Errorf("node unlocked before every container was allocated")
+	}
+
+	resp, err = h.allocate(1)
+	if err != nil {
+		t.Fatalf("failed to allocate second container: %v", err)
+	}
+	envs = resp.ContainerResponses[0].Envs
+	if envs["NVIDIA_VISIBLE_DEVICES"] != registered[2].Id || envs["CUDA_DEVICE_MEMORY_LIMIT_0"] != "4096m" {
+		t.Errorf("unexpected envs of second container %v", envs)
+	}
+	allocated := h.pod(t, pod.Name)
+	if phase := allocated.Annotations[util.DeviceBindPhase]; phase != util.DeviceBindSuccess {
+		t.Errorf("bind phase %s, expected %s", phase, util.DeviceBindSuccess)
+	}
+	for _, ctr := range util.DecodePodDevices(allocated.Annotations[util.AssignedIDsToAllocateAnnotations]) {
+		if len(ctr) != 0 {
+			t.Errorf("devices left to allocate: %s", allocated.Annotations[util.AssignedIDsToAllocateAnnotations])
+		}
+	}
+	if h.nodeLocked(t) {
+		t.Errorf("node still locked after allocation")
+	}
+}
+
+func TestAllocateDeviceNumberMismatch(t *testing.T) {
+	registered := h.registeredDevices(t)
+	if len(registered) == 0 {
+		t.Skip("no registered devices")
+	}
+	pod := h.schedule(t, "mismatch", time.Now(), util.PodDevices{
+		{device(registered, 0, 1024, 0)},
+	})
+
+	if _, err := h.allocate(2); err == nil {
+		t.Fatalf("allocated 2 devices for a container granted 1")
+	}
+	if phase := h.pod(t, pod.Name).Annotations[util.DeviceBindPhase]; phase != util.DeviceBindFailed {
+		t.Errorf("bind phase %s, expected %s", phase, util.DeviceBindFailed)
+	}
+	if h.nodeLocked(t) {
+		t.Errorf("node still locked after a failed allocation")
+	}
+}
+
+func TestAllocateOldestPodFirst(t *testing.T) {
+	registered := h.registeredDevices(t)
+	if len(registered) < 2 {
+		t.Skip("not enough registered devices")
+	}
+	now := time.Now()
+	newer := h.schedule(t, "newer", now, util.PodDevices{{device(registered, 1, 2048, 0)}})
+	// The scheduler would wait for the node lock of the first pod to be
+	// released, both are bound here to check the plugin picks the oldest.
+	older := h.schedule(t, "older", now.Add(-time.Minute), util.PodDevices{{device(registered, 0, 1024, 0)}})
+
+	resp, err := h.allocate(1)
+	if err != nil {
+		t.Fatalf("failed to allocate: %v", err)
+	}
+	if got := resp.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"]; got != registered[0].Id {
+		t.Errorf("allocated %s, expected the device of the oldest pod %s", got, registered[0].Id)
+	}
+	if phase := h.pod(t, older.Name).Annotations[util.DeviceBindPhase]; phase != util.DeviceBindSuccess {
+		t.Errorf("bind phase of older pod %s, expected %s", phase, util.DeviceBindSuccess)
+	}
+	if phase := h.pod(t, newer.Name).Annotations[util.DeviceBindPhase]; phase != util.DeviceBindAllocating {
+		t.Errorf("bind phase of newer pod %s, expected %s", phase, util.DeviceBindAllocating)
+	}
+}
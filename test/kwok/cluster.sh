@@ -0,0 +1,47 @@
+#!/usr/bin/env bash
+# Copyright 2023 The Volcano Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Creates or deletes the kwok cluster the integration tests run against.
+#
+#   test/kwok/cluster.sh up      create the cluster and print its kubeconfig
+#   test/kwok/cluster.sh down    delete the cluster
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+CLUSTER_NAME=${CLUSTER_NAME:-vgpu-kwok}
+KUBECONFIG_PATH=${KUBECONFIG_PATH:-${TMPDIR:-/tmp}/${CLUSTER_NAME}.kubeconfig}
+
+if ! command -v kwokctl >/dev/null; then
+  echo "kwokctl not found, see https://kwok.sigs.k8s.io/docs/user/installation/" >&2
+  exit 1
+fi
+
+case "${1:-}" in
+up)
+  kwokctl get clusters | grep -qx "${CLUSTER_NAME}" || kwokctl create cluster --name "${CLUSTER_NAME}" --wait 2m
+  kwokctl get kubeconfig --name "${CLUSTER_NAME}" >"${KUBECONFIG_PATH}"
+  echo "${KUBECONFIG_PATH}"
+  ;;
+down)
+  kwokctl delete cluster --name "${CLUSTER_NAME}"
+  rm -f "${KUBECONFIG_PATH}"
+  ;;
+*)
+  echo "usage: $0 up|down" >&2
+  exit 1
+  ;;
+esac
@@ -0,0 +1,238 @@
+//go:build kwok
+
+/*
+Copyright 2023 The Volcano Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kwok runs the device plugin with simulated GPUs against the API
+// server of a kwok cluster, playing the part of the scheduler and of the
+// kubelet, to test the annotation handshake without GPUs.
+package kwok
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"volcano.sh/k8s-device-plugin/pkg/lock"
+	nvidiadevice "volcano.sh/k8s-device-plugin/pkg/plugin/vgpu"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/config"
+	"volcano.sh/k8s-device-plugin/pkg/plugin/vgpu/util"
+)
+
+const (
+	// simulatedGPUs is the number of GPUs of the fake node.
+	simulatedGPUs = 4
+	// splitCount is the number of vGPUs every GPU is split in.
+	splitCount = 4
+	namespace  = "default"
+)
+
+// harness is a simulated GPU node served by the device plugin.
+type harness struct {
+	client   kubernetes.Interface
+	node     string
+	cache    *nvidiadevice.DeviceCache
+	register *nvidiadevice.DeviceRegister
+	plugin   *nvidiadevice.NvidiaDevicePlugin
+}
+
+var h *harness
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KUBECONFIG") == "" {
+		fmt.Println("KUBECONFIG is not set, run test/kwok/cluster.sh up first")
+		os.Exit(1)
+	}
+	var err error
+	h, err = newHarness(fmt.Sprintf("kwok-vgpu-%d", time.Now().Unix()))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	h.close()
+	os.Exit(code)
+}
+
+func newHarness(node string) (*harness, error) {
+	client, err := lock.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build client: %v", err)
+	}
+	if _, err := client.CoreV1().Nodes().Create(context.Background(), fakeNode(node), metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create node %s: %v", node, err)
+	}
+
+	os.Setenv("NODE_NAME", node)
+	config.NodeName = node
+	config.Mode = "hami-core"
+	config.DeviceSplitCount = splitCount
+	config.GPUMemoryFactor = 1
+	config.DeviceCoresScaling = 1
+	if err := config.Simulate(node, simulatedGPUs); err != nil {
+		return nil, err
+	}
+	if ret := config.Nvml().Init(); ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to initialize NVML: %v", ret)
+	}
+
+	cache := nvidiadevice.NewDeviceCache()
+	cache.Start()
+	cfg := &config.NvidiaConfig{
+		DeviceSplitCount:  splitCount,
+		DeviceCoreScaling: 1,
+		GPUMemoryFactor:   1,
+	}
+	return &harness{
+		client:   client,
+		node:     node,
+		cache:    cache,
+		register: nvidiadevice.NewDeviceRegister(cache),
+		plugin:   nvidiadevice.NewNvidiaDevicePlugin(util.ResourceName, cache, gpuallocator.NewBestEffortPolicy(), "", cfg),
+	}, nil
+}
+
+func (h *harness) close() {
+	h.cache.Stop()
+	config.Nvml().Shutdown()
+	h.client.CoreV1().Nodes().Delete(context.Background(), h.node, metav1.DeleteOptions{})
+}
+
+// fakeNode is a node kwok takes over and keeps ready.
+func fakeNode(name string) *corev1.Node {
+	capacity := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("32"),
+		corev1.ResourceMemory: resource.MustParse("256Gi"),
+		corev1.ResourcePods:   resource.MustParse("110"),
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{"kwok.x-k8s.io/node": "fake"},
+			Labels:      map[string]string{"type": "kwok", "kubernetes.io/hostname": name},
+		},
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{{Key: "kwok.x-k8s.io/node", Value: "fake", Effect: corev1.TaintEffectNoSchedule}},
+		},
+		Status: corev1.NodeStatus{Capacity: capacity, Allocatable: capacity},
+	}
+}
+
+// registeredDevices returns the devices the plugin registered on the node.
+func (h *harness) registeredDevices(t *testing.T) []*util.DeviceInfo {
+	node, err := h.client.CoreV1().Nodes().Get(context.Background(), h.node, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	return util.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered])
+}
+
+// schedule creates a pod bound to the node with the annotations the
+// scheduler writes once it picked the devices of every container, and locks
+// the node as the scheduler does until the plugin allocated them, unless it
+// is already.
+func (h *harness) schedule(t *testing.T, name string, predicated time.Time, devices util.PodDevices) *corev1.Pod {
+	t.Helper()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				util.AssignedNodeAnnotations:          h.node,
+				util.AssignedTimeAnnotations:          strconv.FormatInt(predicated.UnixNano(), 10),
+				util.AssignedIDsAnnotations:           util.EncodePodDevices(devices),
+				util.AssignedIDsToAllocateAnnotations: util.EncodePodDevices(devices),
+				util.DeviceBindPhase:                  util.DeviceBindAllocating,
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:    h.node,
+			Tolerations: []corev1.Toleration{{Key: "kwok.x-k8s.io/node", Operator: corev1.TolerationOpExists}},
+		},
+	}
+	for i := range devices {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  fmt.Sprintf("ctr-%d", i),
+			Image: "fake",
+		})
+	}
+	pod, err := h.client.CoreV1().Pods(namespace).Create(context.Background(), pod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create pod %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		h.client.CoreV1().Pods(namespace).Delete(context.Background(), name, *metav1.NewDeleteOptions(0))
+	})
+	if h.nodeLocked(t) {
+		return pod
+	}
+	if err := lock.LockNode(h.node, util.VGPUDeviceName); err != nil {
+		t.Fatalf("failed to lock node: %v", err)
+	}
+	return pod
+}
+
+// allocate calls Allocate as the kubelet does for a container granted n
+// vGPUs.
+func (h *harness) allocate(n int) (*pluginapi.AllocateResponse, error) {
+	req := &pluginapi.ContainerAllocateRequest{}
+	for i := 0; i < n; i++ {
+		req.DevicesIDs = append(req.DevicesIDs, util.GenerateVirtualDeviceID(0, uint(i)))
+	}
+	return h.plugin.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{req},
+	})
+}
+
+func (h *harness) pod(t *testing.T, name string) *corev1.Pod {
+	t.Helper()
+	pod, err := h.client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get pod %s: %v", name, err)
+	}
+	return pod
+}
+
+func (h *harness) nodeLocked(t *testing.T) bool {
+	t.Helper()
+	node, err := h.client.CoreV1().Nodes().Get(context.Background(), h.node, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	_, ok := node.Annotations[util.VGPUDeviceName]
+	return ok
+}
+
+// device returns a vGPU of the i-th registered device.
+func device(registered []*util.DeviceInfo, i int, mem, cores int32) util.ContainerDevice {
+	return util.ContainerDevice{
+		UUID:      registered[i].Id,
+		Type:      util.NvidiaGPUDevice,
+		Usedmem:   mem,
+		Usedcores: cores,
+	}
+}